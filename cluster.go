@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/config"
+	"github.com/forbearing/k8s-loadbalancer/pkg/controller"
+	"github.com/forbearing/k8s-loadbalancer/pkg/firewall"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/forbearing/k8s/node"
+	"github.com/forbearing/k8s/service"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// clusterController is the controller of a cluster in --kubeconfig and the
+// handlers it list-and-watch with.
+type clusterController struct {
+	cluster config.Cluster
+	ctrl    *controller.Controller
+	// handler is the service handler of all namespaces, its clientset is used
+	// by the leader election and the sharding.
+	handler         *service.Handler
+	serviceHandlers []*service.Handler
+	nodeHandler     *node.Handler
+}
+
+// newClusterController creates the k8s handlers and the controller of the cluster,
+// it panics if the kubeconfig is invalid. The k8s api server is not connected
+// until the informers started, an unreachable cluster only stays unsynced.
+func newClusterController(cluster config.Cluster, fw firewall.Backend) *clusterController {
+	kubeconfig, cleanup, err := cluster.KubeconfigFile()
+	if err != nil {
+		logrus.Fatalf("Error loading kubeconfig of cluster %s: %s", cluster, err.Error())
+	}
+	defer cleanup()
+
+	cc := &clusterController{cluster: cluster}
+	// service.NewOrDie will creates a handler which with various methods to
+	// make it  easily to operators k8s service resource in golang coding.
+	// panic if create service handler failed.
+	cc.handler = service.NewOrDie(context.Background(), kubeconfig, metav1.NamespaceAll)
+
+	// SetInformerFactoryResyncPeriod  set the period of the infomer relist
+	// k8s service resource object, default to 0(no resync).
+	cc.handler.SetInformerFactoryResyncPeriod(0)
+
+	// if --upstream-from-nodes is set, the upstream hosts are discovered from
+	// the k8s nodes, the node informer only list-and-watch the selected nodes.
+	if args.GetUpstreamFromNodes() {
+		cc.nodeHandler = node.NewOrDie(context.Background(), kubeconfig)
+		cc.nodeHandler.SetInformerFactoryTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = args.GetUpstreamNodeSelector()
+		})
+	}
+	// the k8s services out of --namespaces, --exclude-namespaces and --service-selector
+	// are never list-and-watched.
+	cc.serviceHandlers = controller.ServiceHandlers(cc.handler)
+	cc.ctrl = controller.NewController(cluster, cc.serviceHandlers, cc.nodeHandler, nginx.DefaultRuntime(), fw)
+	return cc
+}
+
+// start starts the shared informers of the cluster.
+func (cc *clusterController) start(stopCh <-chan struct{}) {
+	for _, h := range cc.serviceHandlers {
+		h.InformerFactory().Start(stopCh)
+	}
+	if cc.nodeHandler != nil {
+		cc.nodeHandler.InformerFactory().Start(stopCh)
+	}
+}
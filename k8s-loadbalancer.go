@@ -3,73 +3,487 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/forbearing/k8s-loadbalancer/pkg/announce"
 	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/config"
 	"github.com/forbearing/k8s-loadbalancer/pkg/controller"
+	"github.com/forbearing/k8s-loadbalancer/pkg/firewall"
+	"github.com/forbearing/k8s-loadbalancer/pkg/healthcheck"
+	"github.com/forbearing/k8s-loadbalancer/pkg/ipam"
+	"github.com/forbearing/k8s-loadbalancer/pkg/keepalived"
 	"github.com/forbearing/k8s-loadbalancer/pkg/logger"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/forbearing/k8s-loadbalancer/pkg/server"
+	"github.com/forbearing/k8s-loadbalancer/pkg/shard"
+	"github.com/forbearing/k8s-loadbalancer/pkg/vip"
+	"github.com/forbearing/k8s/configmap"
 	"github.com/forbearing/k8s/service"
+	"github.com/forbearing/k8s/util/leaderelection"
 	"github.com/forbearing/k8s/util/signals"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 var (
-	argPort       = pflag.Int("port", 8080, "port to listen to for incoming HTTP requests")
-	argBindAddr   = pflag.IP("bind-address", net.IPv4(0, 0, 0, 0), "IP address on which to serve the --port, set to 0.0.0.0 for all interfaces by default")
-	argKubeconfig = pflag.String("kubeconfig", "", "path to kubeconfig file with authorization and master location information")
-	argLogLevel   = pflag.String("log-level", "INFO", "level of API request logging, should be one of   'ERROR', 'WARNING|WARN', 'INFO', 'DEBUG' or 'TRACE'")
-	argLogFormat  = pflag.String("log-format", "TEXT", "specify log format, should be on of 'TEXT' or 'JSON'")
-	argLogFile    = pflag.String("log-output", "/dev/stdout", "specify log file, default output log to /dev/stdout")
-	argUpstream   = pflag.StringSlice("upstream", []string{}, "multiple upstream hosts or IP to which the loadbalancer will proxy traffic, separated by common, eg: --upstream host1,host2,host3 or --upstream 1.1.1.1,2.2.2.2,3.3.3.3 ")
-	argNumWorker  = pflag.Int("worker", runtime.NumCPU(), "the number of worker goroutines to handle k8s service resources and nginx daemon, default to the number of cpu")
-	//argEnableFirewall = pflag.Bool("enable-firewall", false, "whether enable ufw for debian/ubuntu and firewalld for rocky/centos, default to false")
-	//argConfPath = pflag.String("conf", "", "the configuration file path")
+	argPort                = pflag.Int("port", 8080, "port to listen to for incoming HTTP requests")
+	argBindAddr            = pflag.IP("bind-address", net.IPv4(0, 0, 0, 0), "IP address on which to serve the --port, set to 0.0.0.0 for all interfaces by default")
+	argDebugAddr           = pflag.String("debug-address", "127.0.0.1:8081", "the host:port serving /debug/config and /debug/dry-run, they expose the configuration and the generated files, so they're served on localhost by default, set to empty to disable them")
+	argKubeconfig          = pflag.String("kubeconfig", "", "path to kubeconfig file with authorization and master location information, multiple clusters are specified as name=kubeconfig[#context] separated by comma, eg: a=/root/.kube/a.conf,b=/root/.kube/config#b")
+	argClusterID           = pflag.StringSlice("cluster-id", []string{}, "the identity of the cluster recorded in every generated nginx config file, only the files of the same cluster id are overwritten or removed. default to the uid of the kube-system namespace. multiple clusters are specified as name=id separated by comma")
+	argCoordinationCluster = pflag.String("coordination-cluster", "", "the cluster in --kubeconfig hosting the Leases of the leader election and the sharding and the ConfigMap of --nginx-conf-configmap, default to the first cluster")
+	argLogLevel            = pflag.String("log-level", "INFO", "level of API request logging, should be one of   'ERROR', 'WARNING|WARN', 'INFO', 'DEBUG' or 'TRACE'")
+	argLogFormat           = pflag.String("log-format", "TEXT", "specify log format, should be on of 'TEXT' or 'JSON'")
+	argLogFile             = pflag.String("log-output", "/dev/stdout", "specify log file, default output log to /dev/stdout")
+	argUpstream            = pflag.StringSlice("upstream", []string{}, "multiple upstream hosts or IP to which the loadbalancer will proxy traffic, separated by common, eg: --upstream host1,host2,host3 or --upstream 1.1.1.1,2.2.2.2,3.3.3.3 ")
+	argDryRun              = pflag.Bool("dry-run", false, "watch the k8s services and compute the nginx config files and commands without touching the host, the diffs against the files on disk are logged and served on /debug/dry-run")
+	argNumWorker           = pflag.Int("worker", runtime.NumCPU(), "the number of worker goroutines to handle k8s service resources and nginx daemon, default to the number of cpu")
+
+	argUpstreamMaxFails     = pflag.Int("upstream-max-fails", -1, "the global max_fails of every upstream server, -1 means using the nginx default")
+	argUpstreamFailTimeout  = pflag.String("upstream-fail-timeout", "", "the global fail_timeout of every upstream server, eg: 10s, empty means using the nginx default")
+	argUpstreamMaxConns     = pflag.Int("upstream-max-conns", 0, "the global max_conns of every upstream server, 0 means no limit")
+	argUpstreamFromNodes    = pflag.Bool("upstream-from-nodes", false, "discover the upstream hosts from the ready k8s nodes instead of --upstream")
+	argUpstreamNodeSelector = pflag.String("upstream-node-selector", "", "label selector to filter the k8s nodes used as upstream hosts, only used with --upstream-from-nodes")
+
+	argHealthCheckMode     = pflag.String("health-check", string(healthcheck.ModeNone), "active health checking of the upstream hosts, should be one of 'none', 'tcp'(connect to the NodePort) or 'http'(GET the kube-proxy healthz endpoint)")
+	argHealthCheckInterval = pflag.Duration("health-check-interval", 5*time.Second, "the interval between two health checking probes")
+	argHealthCheckTimeout  = pflag.Duration("health-check-timeout", 2*time.Second, "the timeout of every health checking probe")
+	argHealthCheckRise     = pflag.Int("health-check-rise", 2, "the number of consecutive successful probes to consider a down upstream up again")
+	argHealthCheckFall     = pflag.Int("health-check-fall", 3, "the number of consecutive failed probes to consider a upstream down")
+	argHealthCheckPort     = pflag.Int("health-check-port", 10256, "the kube-proxy healthz port probed in 'http' health checking mode")
+	argHealthCheckPath     = pflag.String("health-check-path", "/healthz", "the kube-proxy healthz path probed in 'http' health checking mode")
+
+	argNginxProcessManager = pflag.String("nginx-process-manager", string(nginx.ProcessManagerSystemd), "how the nginx daemon is managed, should be one of 'systemd' or 'supervisor'. in 'supervisor' mode nginx runs in the foreground as a child process of the controller, it's useful in container or on hosts without systemd")
+	argManageNginxInstall  = pflag.Bool("manage-nginx-install", true, "whether the controller installs the nginx package if it's not installed, set to false to never touch the packages")
+	argNginxConfMode       = pflag.String("nginx-conf-mode", string(nginx.NginxConfModeManaged), "whether the controller owns /etc/nginx/nginx.conf, should be one of 'managed' or 'unmanaged'. in 'unmanaged' mode nginx.conf is never written, only verified to include the controller's stream/http directories")
+	argNginxConfParamsFile = pflag.String("nginx-conf-params", "", "yaml file containing the parameters (user, workerConnections, workerRlimitNofile, log formats, gzip) to render nginx.conf in 'managed' mode")
+	argTemplateDir         = pflag.String("template-dir", "", "directory containing the user supplied templates to override the builtin ones, the template file name should be one of 'nginx.conf.tmpl', 'tcp.tmpl', 'udp.tmpl', 'http.tmpl' or 'https.tmpl'")
+	argNginxConfConfigMap  = pflag.String("nginx-conf-configmap", "", "namespace/name of the ConfigMap whose key \""+nginx.NginxConfParamsKey+"\" containing the parameters to render nginx.conf in 'managed' mode, takes precedence over --nginx-conf-params")
+
+	argEnableFirewall  = pflag.Bool("enable-firewall", false, "whether open the nginx listen ports of the k8s services in the host firewall, restricted to the loadBalancerSourceRanges if specified")
+	argFirewallBackend = pflag.String("firewall-backend", string(firewall.BackendAuto), "the host firewall used by --enable-firewall, should be one of 'auto', 'nftables', 'firewalld' or 'ufw'. 'auto' picks firewalld or ufw if it's active, otherwise nftables")
+
+	argVIPInterface = pflag.String("vip-interface", "", "the network interface the controller adds the nginx listen ip addresses (annotation \"loadbalancer/ip\" or spec.loadBalancerIP) to if they don't exist on the host, empty means never manage the ip addresses")
+	argIPPoolConfig = pflag.String("ip-pool-config", "", "yaml file defining the ip address pools the k8s services allocated addresses from, the allocated address is persisted in the annotation \"loadbalancer/allocated-ip\" and the service status")
+
+	argKeepalived          = pflag.Bool("keepalived", false, "whether generate keepalived.conf and reload keepalived, the nginx listen ip addresses of the k8s services are the VIPs floating between the LB hosts")
+	argKeepalivedConf      = pflag.String("keepalived-conf", "/etc/keepalived/keepalived.conf", "the keepalived configuration file generated by --keepalived")
+	argKeepalivedInterface = pflag.String("keepalived-interface", "", "the network interface the keepalived VRRP instance runs on and the VIPs added to")
+	argKeepalivedRouterID  = pflag.Int("keepalived-router-id", 51, "the keepalived virtual_router_id, must be the same on all the LB hosts")
+	argKeepalivedPriority  = pflag.Int("keepalived-priority", 100, "the keepalived priority of this LB host, the host with the highest priority holds the VIPs")
+	argKeepalivedAuthPass  = pflag.String("keepalived-auth-pass", "", "the keepalived VRRP authentication password, empty means no authentication")
+
+	argLeaderElect          = pflag.Bool("leader-elect", false, "whether run the leader election among the controllers on the LB hosts, only the leader holds the VIPs managed by --vip-interface")
+	argLeaderElectNamespace = pflag.String("leader-elect-namespace", metav1.NamespaceSystem, "the namespace of the Lease used by the leader election")
+	argLeaderElectName      = pflag.String("leader-elect-name", "k8s-loadbalancer", "the name of the Lease used by the leader election")
+	argAnnounceInterval     = pflag.Duration("announce-interval", 10*time.Second, "the interval of the gratuitous ARP (IPv4) and unsolicited neighbor advertisement (IPv6) for the VIPs managed by --vip-interface, 0 disables the announcements")
+
+	argNamespaces        = pflag.StringSlice("namespaces", []string{}, "only watch the k8s services in these namespaces, separated by comma, empty means all the namespaces. one informer is created for every namespace, so the controller only needs the namespaced Role")
+	argExcludeNamespaces = pflag.StringSlice("exclude-namespaces", []string{}, "never watch the k8s services in these namespaces, separated by comma")
+	argServiceSelector   = pflag.String("service-selector", "", "label selector to filter the k8s services watched by the controller, applied at the informer level, eg: tenant=a")
+
+	argShard              = pflag.Bool("shard", false, "whether split the k8s services across the k8s-loadbalancer instances, every instance registers itself with a Lease and only serves the k8s services assigned to it")
+	argShardGroup         = pflag.String("shard-group", "k8s-loadbalancer", "the name of the instances splitting the k8s services, it's the prefix of the member Lease names")
+	argShardNamespace     = pflag.String("shard-namespace", metav1.NamespaceSystem, "the namespace of the member Leases")
+	argShardMember        = pflag.String("shard-member", hostname(), "the name of this instance, default to the hostname")
+	argShardPool          = pflag.String("shard-pool", "", "the pool this instance serves, only the k8s services with the annotation \"loadbalancer/pool\" of the pool are assigned to it. empty means the k8s services without the annotation")
+	argShardLeaseDuration = pflag.Duration("shard-lease-duration", 15*time.Second, "the duration the k8s services of a dead instance are reassigned after, the Lease is renewed every third of it")
+
+	argConfPath = pflag.String(config.FileFlag, "", "the declarative configuration file in yaml format, the flags not set on the command line are set from the env variables \""+config.EnvPrefix+"<FLAG>\" and then this file")
+	argNginxDir = pflag.String("nginx-dir", "/etc/nginx", "the nginx config directory the controller generates the config files into, the stream and http config files are in its sub-directories 'sites-stream' and 'sites-enabled'")
 )
 
-func init() {
+// subcommands is the subcommands of k8s-loadbalancer, eg: "k8s-loadbalancer migrate
+// k8s-loadbalancer.conf". The controller flags are not parsed for the subcommands.
+var subcommands = map[string]func(arguments []string) error{
+	"migrate": runMigrate,
+	"render":  runRender,
+}
+
+// subcommand returns the subcommand specified by the first argument.
+func subcommand() (func(arguments []string) error, bool) {
+	if len(os.Args) < 2 {
+		return nil, false
+	}
+	cmd, ok := subcommands[os.Args[1]]
+	return cmd, ok
+}
+
+// parseArgs parses the controller flags and publishes the args, the subcommands
+// parse their own flags.
+func parseArgs() {
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 
-	builder := args.NewBuilder()
+	// the flags not set on the command line are set from the env variables
+	// and the config file, the precedence is: flags > env > file > default.
+	var cfg *config.Config
+	confFile := config.File(pflag.CommandLine)
+	if len(confFile) != 0 {
+		var err error
+		if cfg, err = config.Load(confFile); err != nil {
+			logrus.Fatalf("Error loading config file: %s", err.Error())
+		}
+	}
+	if err := config.Apply(pflag.CommandLine, cfg, confFile); err != nil {
+		logrus.Fatalf("Error applying config: %s", err.Error())
+	}
+	// the args are validated in main, the controller exits if they're invalid.
+	args.Publish(buildArgs(confFile))
+	if cfg != nil {
+		config.SetServices(cfg.Services)
+	}
+}
+
+// buildArgs builds the args from the flags, it's called again when the
+// configuration reloaded. The args take effect only after published.
+func buildArgs(confFile string) *args.Args {
+	builder := args.NewStagedBuilder()
+	builder.SetConfigFile(confFile)
 	builder.SetPort(*argPort)
 	builder.SetBindAddress(*argBindAddr)
+	builder.SetDebugAddress(*argDebugAddr)
 	builder.SetKubeconfig(*argKubeconfig)
 	builder.SetLogLevel(*argLogLevel)
 	builder.SetLogFormat(*argLogFormat)
 	builder.SetLogFile(*argLogFile)
 	builder.SetUpstream(*argUpstream)
 	builder.SetNumWorker(*argNumWorker)
+	builder.SetNginxDir(*argNginxDir)
+	builder.SetNginxConfMode(*argNginxConfMode)
+	builder.SetNginxProcessManager(*argNginxProcessManager)
+	builder.SetManageNginxInstall(*argManageNginxInstall)
+	builder.SetNginxConfParamsFile(*argNginxConfParamsFile)
+	builder.SetNginxConfConfigMap(*argNginxConfConfigMap)
+	builder.SetTemplateDir(*argTemplateDir)
+	builder.SetUpstreamMaxFails(*argUpstreamMaxFails)
+	builder.SetUpstreamFailTimeout(*argUpstreamFailTimeout)
+	builder.SetUpstreamMaxConns(*argUpstreamMaxConns)
+	builder.SetUpstreamFromNodes(*argUpstreamFromNodes)
+	builder.SetUpstreamNodeSelector(*argUpstreamNodeSelector)
+	builder.SetHealthCheckMode(*argHealthCheckMode)
+	builder.SetHealthCheckInterval(*argHealthCheckInterval)
+	builder.SetHealthCheckTimeout(*argHealthCheckTimeout)
+	builder.SetHealthCheckRise(*argHealthCheckRise)
+	builder.SetHealthCheckFall(*argHealthCheckFall)
+	builder.SetHealthCheckPort(*argHealthCheckPort)
+	builder.SetHealthCheckPath(*argHealthCheckPath)
+	builder.SetEnableFirewall(*argEnableFirewall)
+	builder.SetFirewallBackend(*argFirewallBackend)
+	builder.SetVIPInterface(*argVIPInterface)
+	builder.SetIPPoolConfig(*argIPPoolConfig)
+	builder.SetKeepalived(*argKeepalived)
+	builder.SetKeepalivedConf(*argKeepalivedConf)
+	builder.SetKeepalivedInterface(*argKeepalivedInterface)
+	builder.SetKeepalivedRouterID(*argKeepalivedRouterID)
+	builder.SetKeepalivedPriority(*argKeepalivedPriority)
+	builder.SetKeepalivedAuthPass(*argKeepalivedAuthPass)
+	builder.SetLeaderElect(*argLeaderElect)
+	builder.SetLeaderElectNamespace(*argLeaderElectNamespace)
+	builder.SetLeaderElectName(*argLeaderElectName)
+	builder.SetAnnounceInterval(*argAnnounceInterval)
+	builder.SetNamespaces(*argNamespaces)
+	builder.SetExcludeNamespaces(*argExcludeNamespaces)
+	builder.SetServiceSelector(*argServiceSelector)
+	builder.SetShard(*argShard)
+	builder.SetShardGroup(*argShardGroup)
+	builder.SetShardNamespace(*argShardNamespace)
+	builder.SetShardMember(*argShardMember)
+	builder.SetShardPool(*argShardPool)
+	builder.SetShardLeaseDuration(*argShardLeaseDuration)
+	builder.SetClusterID(*argClusterID)
+	builder.SetCoordinationCluster(*argCoordinationCluster)
+	builder.SetDryRun(*argDryRun)
+	return builder.Build()
+}
+
+// hostname returns the lower cased hostname, it's the default shard member name.
+func hostname() string {
+	name, _ := os.Hostname()
+	return strings.ToLower(name)
 }
 
 func main() {
+	if cmd, ok := subcommand(); ok {
+		if err := cmd(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	parseArgs()
+
 	// init the log-level, log-format, log-output according to the arguments.
 	// you can also call logger.New() to get a new *logrus.Logger that is not
 	// affected by logger.Init().
 	logger.Init()
 
-	// service.NewOrDie will creates a handler which with various methods to
-	// make it  easily to operators k8s service resource in golang coding.
-	// panic if create service handler failed.
-	handler := service.NewOrDie(context.Background(), args.GetKubeconfig(), metav1.NamespaceAll)
+	// validate the whole configuration, all the invalid settings are reported together.
+	if err := config.Validate(args.Current()); err != nil {
+		logrus.Fatalf("Invalid configuration: %s", err.Error())
+	}
+	if len(args.GetConfigFile()) != 0 {
+		logrus.Infof("Using config file %s", args.GetConfigFile())
+	}
+	nginx.SetNginxDir(args.GetNginxDir())
 
-	// SetInformerFactoryResyncPeriod  set the period of the infomer relist
-	// k8s service resource object, default to 0(no resync).
-	handler.SetInformerFactoryResyncPeriod(0)
+	// load and validate the templates used to render nginx config files.
+	if err := nginx.LoadTemplates(args.GetTemplateDir()); err != nil {
+		logrus.Fatalf("Error loading templates: %s", err.Error())
+	}
+	// load the parameters used to render /etc/nginx/nginx.conf. The ConfigMap in
+	// the coordination cluster unreachable doesn't stop the controller, the
+	// existing nginx.conf is kept until the ConfigMap loaded.
+	var loadingNginxConfParams bool
+	if err := loadNginxConfParams(); err != nil {
+		if len(args.GetNginxConfConfigMap()) == 0 {
+			logrus.Fatalf("Error loading nginx.conf parameters: %s", err.Error())
+		}
+		logrus.Errorf("Error loading nginx.conf parameters, keep the existing nginx.conf until loaded: %s", err.Error())
+		nginx.SetNginxConfParams(nil)
+		loadingNginxConfParams = true
+	}
+	// in dry-run mode, the nginx config files and commands are only logged, the
+	// sysctls, VIPs and firewall rules are never changed.
+	if nginx.DryRun() {
+		logrus.Info("Running in dry-run mode, the host is never touched")
+	} else if len(args.GetVIPInterface()) != 0 || keepalived.Enabled() {
+		// nginx listens to the VIPs not held by this host.
+		if err := vip.EnableNonlocalBind(); err != nil {
+			logrus.Fatalf("Error enabling nonlocal bind: %s", err.Error())
+		}
+	}
+	// the k8s services are allocated ip addresses from the pools.
+	if len(args.GetIPPoolConfig()) != 0 {
+		cfg, err := ipam.LoadConfig(args.GetIPPoolConfig())
+		if err != nil {
+			logrus.Fatalf("Error loading ip pool config: %s", err.Error())
+		}
+		ipam.SetConfig(cfg)
+	}
+	// the firewall backend opens the nginx listen ports, nil if the firewall is disabled.
+	var fw firewall.Backend
+	if args.GetEnableFirewall() && !nginx.DryRun() {
+		var err error
+		if fw, err = firewall.NewBackend(firewall.BackendType(args.GetFirewallBackend())); err != nil {
+			logrus.Fatalf("Error creating firewall backend: %s", err.Error())
+		}
+		logrus.Infof("Using %s firewall backend", fw.Name())
+	}
+
+	// bootstrap the host once at startup: create directories, install, enable and start nginx.
+	// if it failed, it will be retried when processing the k8s service.
+	if err := nginx.Bootstrap(nginx.DefaultRuntime()); err != nil {
+		logrus.Errorf("Error bootstrapping nginx: %s", err.Error())
+	}
 
 	// SetupSignalChannel will creates a chan struct{} and it will receive a element
 	// when this controller captured Ctrl-C or SIGTERM signal.
 	// If stopCh receive a element, the service informer and the workers created by
 	// this controller will stop work.
 	stopCh := signals.SetupSignalChannel()
-	ctrl := controller.NewController(handler)
+	if loadingNginxConfParams {
+		go retryNginxConfParams(stopCh)
+	}
+
+	// one controller for every cluster in --kubeconfig, the leader election,
+	// the sharding and the nginx.conf ConfigMap use the coordination cluster.
+	clusters, _ := config.Clusters()
+	coordination, _ := config.CoordinationCluster()
+	var ccs []*clusterController
+	var handler *service.Handler
+	for _, cluster := range clusters {
+		cc := newClusterController(cluster, fw)
+		if cluster.Name == coordination.Name {
+			handler = cc.handler
+		}
+		ccs = append(ccs, cc)
+	}
+	if len(clusters) > 1 {
+		logrus.Infof("Using cluster %s as the coordination cluster", coordination)
+	}
+
+	// the k8s services are assigned to the shard members, this instance only
+	// serves the k8s services assigned to it. It keeps joining if the
+	// coordination cluster is unreachable.
+	if shard.Enabled() {
+		shard.Start(stopCh, handler.Clientset(), controller.OnMembersChanged)
+		logrus.Infof("Joining shard group %q as member %q", args.GetShardGroup(), shard.Self())
+	}
+
+	// serve /healthz and /metrics, and /debug/config and /debug/dry-run on --debug-address.
+	go func() {
+		if err := server.Run(stopCh); err != nil {
+			logrus.Fatalf("Error running HTTP server: %s", err.Error())
+		}
+	}()
+
+	// the configuration is reloaded on SIGHUP or when the config file changed.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-hup:
+				logrus.Info("SIGHUP received, reloading configuration")
+				reloadConfig()
+			}
+		}
+	}()
+	if len(args.GetConfigFile()) != 0 {
+		go config.Watch(stopCh, args.GetConfigFile(), 5*time.Second, func() {
+			reloadConfig()
+		})
+	}
+
+	// only the leader holds the VIPs, the VIPs are announced after acquired.
+	if args.GetLeaderElect() && !nginx.DryRun() {
+		go runLeaderElection(handler, stopCh)
+	}
+	if len(args.GetVIPInterface()) != 0 && !nginx.DryRun() {
+		go announce.Run(stopCh, args.GetAnnounceInterval())
+	}
+
+	// start the shared informers, block here until this controller capture SIGINT
+	// or SIGTERM signal. The clusters are list-and-watched independently, an
+	// unreachable cluster doesn't block the others.
+	errCh := make(chan error, len(ccs))
+	for _, cc := range ccs {
+		cc.start(stopCh)
+		go func(cc *clusterController) {
+			if err := cc.ctrl.Run(args.GetNumWorker(), stopCh); err != nil {
+				errCh <- fmt.Errorf("cluster %s: %s", cc.cluster, err.Error())
+				return
+			}
+			errCh <- nil
+		}(cc)
+	}
+	var err error
+	for range ccs {
+		if e := <-errCh; e != nil && err == nil {
+			err = e
+		}
+	}
+	// the k8s services of this member are reassigned immediately.
+	if shard.Enabled() {
+		if err := shard.Leave(handler.Clientset()); err != nil {
+			logrus.Errorf("Error leaving shard members: %s", err.Error())
+		}
+	}
+	// stop the supervised nginx before exit.
+	if err := nginx.Shutdown(); err != nil {
+		logrus.Errorf("Error stopping nginx: %s", err.Error())
+	}
+	if err != nil {
+		logrus.Fatalf("Error running controller: %s", err.Error())
+	}
+}
+
+// retryNginxConfParams loads the nginx.conf parameters every 5 seconds until
+// loaded or stopCh closed, then regenerates nginx.conf.
+func retryNginxConfParams(stopCh <-chan struct{}) {
+	wait.PollUntil(5*time.Second, func() (bool, error) {
+		if err := loadNginxConfParams(); err != nil {
+			logrus.Errorf("Error loading nginx.conf parameters: %s", err.Error())
+			return false, nil
+		}
+		logrus.Info("nginx.conf parameters loaded")
+		if err := controller.RerenderAll(); err != nil {
+			logrus.Errorf("Error regenerating nginx config: %s", err.Error())
+		}
+		return true, nil
+	}, stopCh)
+}
+
+// loadNginxConfParams loads the nginx.conf parameters from the ConfigMap
+// or the file specified by arguments.
+func loadNginxConfParams() error {
+	switch nginx.NginxConfMode(args.GetNginxConfMode()) {
+	case nginx.NginxConfModeManaged:
+	case nginx.NginxConfModeUnmanaged:
+		return nil
+	default:
+		return fmt.Errorf("unknown nginx.conf mode: %q", args.GetNginxConfMode())
+	}
+
+	var params *nginx.NginxConfParams
+	var err error
+	switch {
+	case len(args.GetNginxConfConfigMap()) != 0:
+		items := strings.SplitN(args.GetNginxConfConfigMap(), "/", 2)
+		if len(items) != 2 {
+			return fmt.Errorf("--nginx-conf-configmap should be in format namespace/name, got %q", args.GetNginxConfConfigMap())
+		}
+		// the ConfigMap is in the coordination cluster.
+		cluster, err := config.CoordinationCluster()
+		if err != nil {
+			return err
+		}
+		kubeconfig, cleanup, err := cluster.KubeconfigFile()
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		handler, err := configmap.New(context.Background(), kubeconfig, items[0])
+		if err != nil {
+			return err
+		}
+		cm, err := handler.Get(items[1])
+		if err != nil {
+			return err
+		}
+		if params, err = nginx.ParseNginxConfParamsConfigMap(cm); err != nil {
+			return err
+		}
+	case len(args.GetNginxConfParamsFile()) != 0:
+		if params, err = nginx.LoadNginxConfParams(args.GetNginxConfParamsFile()); err != nil {
+			return err
+		}
+	default:
+		params = nginx.DefaultNginxConfParams()
+	}
+	nginx.SetNginxConfParams(params)
+	return nil
+}
 
-	// start the shared informer.
-	handler.InformerFactory().Start(stopCh)
-	// block here until this controller capture SIGINT or SIGTERM signal.
-	if err := ctrl.Run(args.GetNumWorker(), stopCh); err != nil {
-		logrus.Fatal("Error running controller: %s", err.Error())
+// runLeaderElection runs the leader election until stopCh closed, the controller
+// becomes a candidate again after it lost the leadership.
+func runLeaderElection(handler *service.Handler, stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	for {
+		leaderelection.RunOrDie(ctx, handler.RESTConfig(), leaderelection.Options{
+			LeaderElectionNamespace: args.GetLeaderElectNamespace(),
+			LeaderElectionName:      args.GetLeaderElectName(),
+			LeaseDuration:           15 * time.Second,
+			RenewDeadline:           10 * time.Second,
+			RetryPeriod:             2 * time.Second,
+			OnStartedLeading:        controller.OnStartedLeading,
+			OnStoppedLeading:        controller.OnStoppedLeading,
+			OnNewLeader: func(identity string) {
+				logrus.Infof("New leader elected: %s", identity)
+			},
+		})
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
 	}
 }
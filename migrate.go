@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/config"
+	"github.com/forbearing/k8s-loadbalancer/pkg/controller"
+	"github.com/forbearing/k8s/service"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+// migratedService is a k8s service the legacy config lines mapped to.
+type migratedService struct {
+	svc     *corev1.Service
+	entries []config.LegacyEntry
+}
+
+// runMigrate is the "migrate" subcommand, it converts the k8s-loadbalancer.conf of
+// the archived shell version into the declarative config, or writes the equivalent
+// annotations onto the k8s services. The lines can't be resolved are reported.
+func runMigrate(arguments []string) error {
+	fs := pflag.NewFlagSet("migrate", pflag.ExitOnError)
+	kubeconfig := fs.String("kubeconfig", "", "path to kubeconfig file with authorization and master location information")
+	output := fs.StringP("output", "o", "", "the file the declarative config is written to, default to stdout")
+	annotate := fs.Bool("annotate", false, "write the annotations \""+controller.AnnotationLoadBalancer+"\" and \""+controller.AnnotationNginxListenPort+"\" onto the k8s services instead of producing the declarative config")
+	dryRun := fs.Bool("dry-run", false, "only show the annotations would be written, used with --annotate")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s migrate [flags] /etc/k8s-loadbalancer/k8s-loadbalancer.conf\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(arguments)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("the legacy config file is required")
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	entries, parseErrs := config.ParseLegacy(file)
+	file.Close()
+	unresolved := len(parseErrs)
+	for _, err := range parseErrs {
+		fmt.Fprintf(os.Stderr, "UNRESOLVED %s\n", err.Error())
+	}
+
+	handler, err := service.New(context.Background(), *kubeconfig, metav1.NamespaceAll)
+	if err != nil {
+		return err
+	}
+	client := handler.Clientset().CoreV1()
+
+	// resolve every line to the k8s service port, the k8s services are in the
+	// order of their first line.
+	var services []*migratedService
+	index := make(map[string]*migratedService)
+	for _, entry := range entries {
+		svc, err := client.Services(entry.Namespace).Get(context.TODO(), entry.Name, metav1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				err = fmt.Errorf("service %s/%s not found", entry.Namespace, entry.Name)
+			}
+			fmt.Fprintf(os.Stderr, "UNRESOLVED line %d %q: %s\n", entry.Line, entry.Text, err.Error())
+			unresolved++
+			continue
+		}
+		if reason := resolveLegacyEntry(svc, entry); len(reason) != 0 {
+			fmt.Fprintf(os.Stderr, "UNRESOLVED line %d %q: %s\n", entry.Line, entry.Text, reason)
+			unresolved++
+			continue
+		}
+		msg := fmt.Sprintf("line %d %q -> service %s/%s port %d/%s, nginx listen port %d",
+			entry.Line, entry.Text, svc.Namespace, svc.Name, entry.Port, entry.K8sProtocol(), entry.ListenPort)
+		if entry.Protocol == "http" || entry.Protocol == "https" {
+			msg += fmt.Sprintf(" (%s is proxied as TCP)", entry.Protocol)
+		}
+		fmt.Fprintln(os.Stderr, msg)
+
+		key := svc.Namespace + "/" + svc.Name
+		if _, ok := index[key]; !ok {
+			index[key] = &migratedService{svc: svc}
+			services = append(services, index[key])
+		}
+		index[key].entries = append(index[key].entries, entry)
+	}
+
+	if *annotate {
+		unresolved += annotateMigratedServices(handler, services, *dryRun)
+	} else if err := writeMigratedConfig(services, *output); err != nil {
+		return err
+	}
+	if unresolved != 0 {
+		return fmt.Errorf("%d lines unresolved", unresolved)
+	}
+	return nil
+}
+
+// resolveLegacyEntry returns the reason why the line can't be mapped to the k8s
+// service, empty means it's resolved.
+func resolveLegacyEntry(svc *corev1.Service, entry config.LegacyEntry) string {
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return fmt.Sprintf("service %s/%s type is %s, should be LoadBalancer", svc.Namespace, svc.Name, svc.Spec.Type)
+	}
+	for _, port := range svc.Spec.Ports {
+		if port.Port == entry.Port && string(port.Protocol) == entry.K8sProtocol() {
+			return ""
+		}
+	}
+	return fmt.Sprintf("service %s/%s has no port %d/%s", svc.Namespace, svc.Name, entry.Port, entry.K8sProtocol())
+}
+
+// writeMigratedConfig writes the declarative config selecting the k8s services
+// to the file, or stdout if file is empty.
+func writeMigratedConfig(services []*migratedService, file string) error {
+	cfg := struct {
+		APIVersion string                 `json:"apiVersion"`
+		Kind       string                 `json:"kind"`
+		Services   []config.ServiceConfig `json:"services"`
+	}{APIVersion: config.APIVersion, Kind: config.Kind, Services: []config.ServiceConfig{}}
+	for _, s := range services {
+		svcConfig := config.ServiceConfig{Namespace: s.svc.Namespace, Name: s.svc.Name}
+		for _, entry := range s.entries {
+			port := config.ServicePortConfig{Port: entry.Port, Protocol: entry.K8sProtocol()}
+			if entry.ListenPort != entry.Port {
+				port.ListenPort = entry.ListenPort
+			}
+			svcConfig.Ports = append(svcConfig.Ports, port)
+		}
+		cfg.Services = append(cfg.Services, svcConfig)
+	}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if len(file) == 0 {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "declarative config written to %s\n", file)
+	return nil
+}
+
+// annotateMigratedServices writes the annotations onto the k8s services, it
+// returns the number of the k8s services can't be expressed by the annotations.
+// The annotation "nginx-listen-port" applies to all the ports of the k8s service,
+// so a different listen port is only supported by the k8s service with one port.
+func annotateMigratedServices(handler *service.Handler, services []*migratedService, dryRun bool) int {
+	var failed int
+	lbKey := strings.SplitN(controller.AnnotationLoadBalancer, "=", 2)
+	for _, s := range services {
+		key := s.svc.Namespace + "/" + s.svc.Name
+		annotations := map[string]string{lbKey[0]: lbKey[1]}
+		var listenPortDiffers bool
+		for _, entry := range s.entries {
+			if entry.ListenPort != entry.Port {
+				listenPortDiffers = true
+			}
+		}
+		if listenPortDiffers {
+			if len(s.entries) != 1 || len(s.svc.Spec.Ports) != 1 {
+				fmt.Fprintf(os.Stderr, "UNRESOLVED service %s: the listen ports differ from the service ports, annotation %q can't express it for the service with multiple ports, use the declarative config instead\n",
+					key, controller.AnnotationNginxListenPort)
+				failed++
+				continue
+			}
+			annotations[controller.AnnotationNginxListenPort] = strconv.Itoa(int(s.entries[0].ListenPort))
+		}
+		if len(s.entries) < len(s.svc.Spec.Ports) {
+			fmt.Fprintf(os.Stderr, "WARNING service %s: the ports not listed in the legacy config are also load balanced by the annotations\n", key)
+		}
+
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"annotations": annotations},
+		})
+		if dryRun {
+			fmt.Fprintf(os.Stderr, "would annotate service %s: %s\n", key, patch)
+			continue
+		}
+		if _, err := handler.Clientset().CoreV1().Services(s.svc.Namespace).Patch(
+			context.TODO(), s.svc.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			fmt.Fprintf(os.Stderr, "UNRESOLVED service %s: annotate failed: %s\n", key, err.Error())
+			failed++
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "annotated service %s: %s\n", key, patch)
+	}
+	return failed
+}
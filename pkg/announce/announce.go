@@ -0,0 +1,125 @@
+package announce
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// burst is the number of announcements sent one second apart for the newly
+// acquired VIP, in case some of them are lost.
+const burst = 3
+
+var (
+	locker sync.Mutex
+	// iface is the network interface the announcements are sent on.
+	iface string
+	// vips is the VIPs to announce, value is the remaining burst announcements.
+	vips = make(map[string]int)
+)
+
+// Set sets the VIPs to announce on the network interface. The newly acquired
+// VIPs are announced immediately, the VIPs not in ips anymore are not announced.
+func Set(ifaceName string, ips []string) {
+	locker.Lock()
+	defer locker.Unlock()
+	if ifaceName != iface {
+		iface = ifaceName
+		vips = make(map[string]int)
+	}
+	desired := make(map[string]bool)
+	for _, ip := range ips {
+		desired[ip] = true
+		if _, ok := vips[ip]; !ok {
+			vips[ip] = burst
+		}
+	}
+	for ip := range vips {
+		if !desired[ip] {
+			delete(vips, ip)
+		}
+	}
+}
+
+// Reset announces all the VIPs every second for the first few times again, it's
+// called when the controller becomes the leader, the VIPs may be held by the
+// previous leader recently, or the VIPs are set before the caches synced.
+func Reset() {
+	locker.Lock()
+	defer locker.Unlock()
+	for ip := range vips {
+		vips[ip] = burst
+	}
+}
+
+// Run announces every VIP every interval until stopCh closed, the newly acquired
+// VIPs are announced every second for the first few times. Gratuitous ARP is sent
+// for IPv4 VIP and unsolicited neighbor advertisement is sent for IPv6 VIP, so the
+// switches and the hosts in the same L2 network learn the VIPs location after failover.
+func Run(stopCh <-chan struct{}, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	logrus.Infof("Starting VIP announcements every %s", interval)
+	burstTicker := time.NewTicker(time.Second)
+	defer burstTicker.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-burstTicker.C:
+			announceAll(true)
+		case <-ticker.C:
+			announceAll(false)
+		}
+	}
+}
+
+// announceAll announces the VIPs, only the VIPs having remaining burst
+// announcements are announced if onlyBurst is true.
+func announceAll(onlyBurst bool) {
+	locker.Lock()
+	name := iface
+	var ips []string
+	for ip, remaining := range vips {
+		if onlyBurst && remaining == 0 {
+			continue
+		}
+		if remaining > 0 {
+			vips[ip] = remaining - 1
+		}
+		ips = append(ips, ip)
+	}
+	locker.Unlock()
+	if len(ips) == 0 {
+		return
+	}
+	sort.Strings(ips)
+
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		logrus.Errorf("announce VIPs failed: %s", err.Error())
+		return
+	}
+	for _, ip := range ips {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			continue
+		}
+		if v4 := addr.To4(); v4 != nil {
+			err = sendGratuitousARP(ifi, v4)
+		} else {
+			err = sendUnsolicitedNA(ifi, addr)
+		}
+		if err != nil {
+			logrus.WithField("vip", ip).Warnf("announce VIP on %s failed: %s", name, err.Error())
+			continue
+		}
+		logrus.WithField("vip", ip).Debugf("announced VIP on %s", name)
+	}
+}
@@ -0,0 +1,87 @@
+package announce
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// sendGratuitousARP broadcasts an ARP request whose sender and target
+// protocol address are both the VIP.
+func sendGratuitousARP(ifi *net.Interface, ip net.IP) error {
+	if len(ifi.HardwareAddr) != 6 {
+		return errors.New("interface has no ethernet address")
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 0, 42)
+	// ethernet header.
+	frame = append(frame, broadcast...)
+	frame = append(frame, ifi.HardwareAddr...)
+	frame = appendUint16(frame, unix.ETH_P_ARP)
+	// arp request: ethernet, IPv4, hardware size 6, protocol size 4.
+	frame = appendUint16(frame, 1)
+	frame = appendUint16(frame, unix.ETH_P_IP)
+	frame = append(frame, 6, 4)
+	frame = appendUint16(frame, 1)
+	frame = append(frame, ifi.HardwareAddr...)
+	frame = append(frame, ip.To4()...)
+	frame = append(frame, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, ip.To4()...)
+
+	sa := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  ifi.Index,
+		Halen:    6,
+	}
+	copy(sa.Addr[:], broadcast)
+	return unix.Sendto(fd, frame, 0, sa)
+}
+
+// sendUnsolicitedNA sends a neighbor advertisement with the override flag
+// for the VIP to the all-nodes multicast address.
+func sendUnsolicitedNA(ifi *net.Interface, ip net.IP) error {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	// the neighbor discovery messages must be sent with hop limit 255.
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, ifi.Index); err != nil {
+		return err
+	}
+
+	// type 136 (neighbor advertisement), code 0, the checksum is filled by the kernel.
+	msg := []byte{136, 0, 0, 0}
+	// flags: override.
+	msg = append(msg, 0x20, 0, 0, 0)
+	msg = append(msg, ip.To16()...)
+	// option: target link-layer address.
+	if len(ifi.HardwareAddr) == 6 {
+		msg = append(msg, 2, 1)
+		msg = append(msg, ifi.HardwareAddr...)
+	}
+
+	sa := &unix.SockaddrInet6{ZoneId: uint32(ifi.Index)}
+	copy(sa.Addr[:], net.IPv6linklocalallnodes)
+	return unix.Sendto(fd, msg, 0, sa)
+}
+
+// appendUint16 appends the short in network byte order.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// htons converts the short from host to network byte order.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
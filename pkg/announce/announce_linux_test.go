@@ -0,0 +1,160 @@
+package announce
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// setupVeth creates a veth pair in a new network namespace, the test goroutine
+// is locked in the namespace until the test finished. It returns the interface
+// to send the announcements on and the peer to capture them.
+func setupVeth(t *testing.T) (*net.Interface, *net.Interface) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating the network namespace requires root")
+	}
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("create network namespace failed: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		netns.Set(origin)
+		origin.Close()
+		ns.Close()
+		runtime.UnlockOSThread()
+	})
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("create veth failed: %s", err.Error())
+	}
+	for _, name := range []string{"veth0", "veth1"} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the unsolicited NA is sent from the link-local address, the duplicate
+	// address detection is skipped so it can be used immediately.
+	link, _ := netlink.LinkByName("veth0")
+	addr, _ := netlink.ParseAddr("fe80::1/64")
+	addr.Flags = unix.IFA_F_NODAD
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		t.Fatal(err)
+	}
+	sender, err := net.InterfaceByName("veth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := net.InterfaceByName("veth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, peer
+}
+
+// capture opens a packet socket on the interface receiving the frames of the ethernet type.
+func capture(t *testing.T, ifi *net.Interface, ethType uint16) int {
+	t.Helper()
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(ethType)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(ethType), Ifindex: ifi.Index}); err != nil {
+		t.Fatal(err)
+	}
+	tv := unix.NsecToTimeval(int64(2 * time.Second))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+// receive returns the first frame matched, the test fails if timeout.
+func receive(t *testing.T, fd int, match func([]byte) bool) []byte {
+	t.Helper()
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			t.Fatalf("receive the announcement failed: %s", err.Error())
+		}
+		if match(buf[:n]) {
+			return buf[:n]
+		}
+	}
+}
+
+func TestSendGratuitousARP(t *testing.T) {
+	sender, peer := setupVeth(t)
+	fd := capture(t, peer, unix.ETH_P_ARP)
+	vip := net.ParseIP("192.0.2.10").To4()
+	if err := sendGratuitousARP(sender, vip); err != nil {
+		t.Fatal(err)
+	}
+	frame := receive(t, fd, func(frame []byte) bool {
+		return len(frame) >= 42 && bytes.Equal(frame[38:42], vip)
+	})
+	if !bytes.Equal(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("destination = %s, want broadcast", net.HardwareAddr(frame[0:6]))
+	}
+	if op := binary.BigEndian.Uint16(frame[20:22]); op != 1 {
+		t.Errorf("arp operation = %d, want 1", op)
+	}
+	if !bytes.Equal(frame[22:28], sender.HardwareAddr) {
+		t.Errorf("sender hardware address = %s, want %s", net.HardwareAddr(frame[22:28]), sender.HardwareAddr)
+	}
+	if !bytes.Equal(frame[28:32], vip) {
+		t.Errorf("sender protocol address = %s, want %s", net.IP(frame[28:32]), vip)
+	}
+}
+
+func TestSendUnsolicitedNA(t *testing.T) {
+	sender, peer := setupVeth(t)
+	fd := capture(t, peer, unix.ETH_P_IPV6)
+	vip := net.ParseIP("2001:db8::10")
+	if err := sendUnsolicitedNA(sender, vip); err != nil {
+		t.Fatal(err)
+	}
+	// ethernet header 14 bytes, IPv6 header 40 bytes, then the ICMPv6 message.
+	frame := receive(t, fd, func(frame []byte) bool {
+		return len(frame) >= 14+40+24 && frame[14+6] == unix.IPPROTO_ICMPV6 && frame[14+40] == 136
+	})
+	ipv6, icmp := frame[14:14+40], frame[14+40:]
+	if hopLimit := ipv6[7]; hopLimit != 255 {
+		t.Errorf("hop limit = %d, want 255", hopLimit)
+	}
+	if dst := net.IP(ipv6[24:40]); !dst.Equal(net.IPv6linklocalallnodes) {
+		t.Errorf("destination = %s, want %s", dst, net.IPv6linklocalallnodes)
+	}
+	if icmp[4]&0x20 == 0 {
+		t.Errorf("override flag is not set: %#x", icmp[4])
+	}
+	if target := net.IP(icmp[8:24]); !target.Equal(vip) {
+		t.Errorf("target = %s, want %s", target, vip)
+	}
+	if len(icmp) < 32 || icmp[24] != 2 || !bytes.Equal(icmp[26:32], sender.HardwareAddr) {
+		t.Errorf("target link-layer address option is missing: %x", icmp[24:])
+	}
+}
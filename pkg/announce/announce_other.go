@@ -0,0 +1,14 @@
+//go:build !linux
+
+package announce
+
+import (
+	"errors"
+	"net"
+)
+
+var errNotSupported = errors.New("VIP announcement is only supported on linux")
+
+func sendGratuitousARP(ifi *net.Interface, ip net.IP) error { return errNotSupported }
+
+func sendUnsolicitedNA(ifi *net.Interface, ip net.IP) error { return errNotSupported }
@@ -0,0 +1,27 @@
+package announce
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetAndReset(t *testing.T) {
+	t.Cleanup(func() { Set("", nil) })
+
+	Set("eth0", []string{"10.0.0.1", "10.0.0.2"})
+	if want := map[string]int{"10.0.0.1": burst, "10.0.0.2": burst}; !reflect.DeepEqual(vips, want) {
+		t.Errorf("vips = %v, want %v", vips, want)
+	}
+	vips["10.0.0.1"], vips["10.0.0.2"] = 0, 0
+
+	// the VIP acquired before is not announced in burst again.
+	Set("eth0", []string{"10.0.0.1", "10.0.0.3"})
+	if want := map[string]int{"10.0.0.1": 0, "10.0.0.3": burst}; !reflect.DeepEqual(vips, want) {
+		t.Errorf("vips = %v, want %v", vips, want)
+	}
+
+	Reset()
+	if want := map[string]int{"10.0.0.1": burst, "10.0.0.3": burst}; !reflect.DeepEqual(vips, want) {
+		t.Errorf("vips = %v, want %v", vips, want)
+	}
+}
@@ -0,0 +1,74 @@
+package args
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestStagedBuilder(t *testing.T) {
+	NewBuilder().SetPort(8080).SetUpstream([]string{"10.0.0.1"})
+
+	staged := NewStagedBuilder()
+	staged.SetPort(9090).SetUpstream([]string{"10.0.0.2", "10.0.0.3"})
+	if GetPort() != 8080 || !reflect.DeepEqual(GetUpstream(), []string{"10.0.0.1"}) {
+		t.Fatalf("staged args took effect before published: %d %v", GetPort(), GetUpstream())
+	}
+	a := staged.Build()
+	if a.GetPort() != 9090 {
+		t.Fatalf("built port = %d, want 9090", a.GetPort())
+	}
+	// the args built are not affected by the later changes of the builder.
+	staged.SetPort(9091)
+	if a.GetPort() != 9090 {
+		t.Fatalf("built args changed by the builder: %d", a.GetPort())
+	}
+
+	Publish(a)
+	if GetPort() != 9090 || !reflect.DeepEqual(GetUpstream(), []string{"10.0.0.2", "10.0.0.3"}) {
+		t.Fatalf("published args = %d %v", GetPort(), GetUpstream())
+	}
+	// the published args are never modified.
+	NewBuilder().SetPort(7070)
+	if a.GetPort() != 9090 || GetPort() != 7070 {
+		t.Fatalf("published args modified: %d %d", a.GetPort(), GetPort())
+	}
+}
+
+func TestConcurrentPublish(t *testing.T) {
+	upstreams := [][]string{{"10.0.0.1"}, {"10.0.0.2", "10.0.0.3"}}
+	staged := make([]*Args, len(upstreams))
+	for i, upstream := range upstreams {
+		staged[i] = NewStagedBuilder().SetPort(9000 + i).SetUpstream(upstream).Build()
+	}
+	Publish(staged[0])
+
+	var wg sync.WaitGroup
+	stopCh := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				// the args read from one snapshot are always consistent.
+				a := Current()
+				if upstream := upstreams[a.GetPort()-9000]; !reflect.DeepEqual(a.GetUpstream(), upstream) {
+					t.Errorf("port %d with upstream %v", a.GetPort(), a.GetUpstream())
+					return
+				}
+				GetUpstream()
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		Publish(staged[i%2])
+		NewBuilder().SetLogLevel("DEBUG")
+	}
+	close(stopCh)
+	wg.Wait()
+}
@@ -3,71 +3,451 @@ package args
 import (
 	"net"
 	"sync"
+	"time"
 )
 
-var lbBuilder = &builder{holder: lbHolder}
+var lbBuilder = &builder{}
 
+// builder sets the args. The builder returned by NewBuilder publishes every
+// change immediately, the one returned by NewStagedBuilder keeps the changes
+// until they're validated and published by Publish.
 type builder struct {
-	l sync.RWMutex
-	*holder
+	l sync.Mutex
+	*Args
+	staged bool
 }
 
-func (b *builder) SetPort(port int) *builder {
+// lock locks the builder, the builder publishing immediately starts from a
+// copy of the args in effect, the published args are never modified.
+func (b *builder) lock() {
 	b.l.Lock()
-	defer b.l.Unlock()
+	if !b.staged {
+		b.Args = Current().clone()
+	}
+}
+
+// unlock publishes the changes of the builder publishing immediately and
+// unlocks the builder.
+func (b *builder) unlock() {
+	if !b.staged {
+		lbHolder.Store(b.Args)
+	}
+	b.l.Unlock()
+}
+
+func (b *builder) SetPort(port int) *builder {
+	b.lock()
+	defer b.unlock()
 	b.port = port
 	return b
 }
 
 func (b *builder) SetBindAddress(bindAddress net.IP) *builder {
-	b.l.Lock()
-	defer b.l.Unlock()
-	b.bindAddress = bindAddress
+	b.lock()
+	defer b.unlock()
+	b.bindAddress = append(net.IP(nil), bindAddress...)
+	return b
+}
+
+func (b *builder) SetDebugAddress(addr string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.debugAddr = addr
 	return b
 }
 
 func (b *builder) SetKubeconfig(kubeconfig string) *builder {
-	b.l.Lock()
-	defer b.l.Unlock()
+	b.lock()
+	defer b.unlock()
 	b.kubeconfig = kubeconfig
 	return b
 }
 
 func (b *builder) SetLogLevel(logLevel string) *builder {
-	b.l.Lock()
-	defer b.l.Unlock()
+	b.lock()
+	defer b.unlock()
 	b.logLevel = logLevel
 	return b
 }
 
 func (b *builder) SetLogFormat(logFormat string) *builder {
-	b.l.Lock()
-	defer b.l.Unlock()
+	b.lock()
+	defer b.unlock()
 	b.logFormat = logFormat
 	return b
 }
 
 func (b *builder) SetLogFile(logFile string) *builder {
-	b.l.Lock()
-	defer b.l.Unlock()
+	b.lock()
+	defer b.unlock()
 	b.logFile = logFile
 	return b
 }
 
 func (b *builder) SetUpstream(upstream []string) *builder {
-	b.l.Lock()
-	defer b.l.Unlock()
-	for _, host := range upstream {
-		b.upstream = append(b.upstream, host)
-	}
+	b.lock()
+	defer b.unlock()
+	// the upstream hosts are replaced, the builder is called again when the
+	// configuration reloaded.
+	b.upstream = append([]string{}, upstream...)
 	return b
 }
 
 func (b *builder) SetNumWorker(numWorker int) *builder {
-	b.l.Lock()
-	defer b.l.Unlock()
+	b.lock()
+	defer b.unlock()
 	b.numWorker = numWorker
 	return b
 }
 
+func (b *builder) SetConfigFile(configFile string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.configFile = configFile
+	return b
+}
+
+func (b *builder) SetNginxDir(dir string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.nginxDir = dir
+	return b
+}
+
+func (b *builder) SetNginxConfMode(mode string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.nginxConfMode = mode
+	return b
+}
+
+func (b *builder) SetNginxConfParamsFile(filename string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.nginxConfParamsFile = filename
+	return b
+}
+
+func (b *builder) SetNginxConfConfigMap(configmap string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.nginxConfConfigMap = configmap
+	return b
+}
+
+func (b *builder) SetTemplateDir(dir string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.templateDir = dir
+	return b
+}
+
+func (b *builder) SetUpstreamMaxFails(maxFails int) *builder {
+	b.lock()
+	defer b.unlock()
+	b.upstreamMaxFails = maxFails
+	return b
+}
+
+func (b *builder) SetUpstreamFailTimeout(failTimeout string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.upstreamFailTimeout = failTimeout
+	return b
+}
+
+func (b *builder) SetUpstreamMaxConns(maxConns int) *builder {
+	b.lock()
+	defer b.unlock()
+	b.upstreamMaxConns = maxConns
+	return b
+}
+
+func (b *builder) SetUpstreamFromNodes(fromNodes bool) *builder {
+	b.lock()
+	defer b.unlock()
+	b.upstreamFromNodes = fromNodes
+	return b
+}
+
+func (b *builder) SetUpstreamNodeSelector(selector string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.upstreamNodeSelector = selector
+	return b
+}
+
+func (b *builder) SetHealthCheckMode(mode string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.healthCheckMode = mode
+	return b
+}
+
+func (b *builder) SetHealthCheckInterval(interval time.Duration) *builder {
+	b.lock()
+	defer b.unlock()
+	b.healthCheckInterval = interval
+	return b
+}
+
+func (b *builder) SetHealthCheckTimeout(timeout time.Duration) *builder {
+	b.lock()
+	defer b.unlock()
+	b.healthCheckTimeout = timeout
+	return b
+}
+
+func (b *builder) SetHealthCheckRise(rise int) *builder {
+	b.lock()
+	defer b.unlock()
+	b.healthCheckRise = rise
+	return b
+}
+
+func (b *builder) SetHealthCheckFall(fall int) *builder {
+	b.lock()
+	defer b.unlock()
+	b.healthCheckFall = fall
+	return b
+}
+
+func (b *builder) SetHealthCheckPort(port int) *builder {
+	b.lock()
+	defer b.unlock()
+	b.healthCheckPort = port
+	return b
+}
+
+func (b *builder) SetHealthCheckPath(path string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.healthCheckPath = path
+	return b
+}
+
+func (b *builder) SetNginxProcessManager(manager string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.nginxProcessManager = manager
+	return b
+}
+
+func (b *builder) SetManageNginxInstall(manage bool) *builder {
+	b.lock()
+	defer b.unlock()
+	b.manageNginxInstall = manage
+	return b
+}
+
+func (b *builder) SetEnableFirewall(enable bool) *builder {
+	b.lock()
+	defer b.unlock()
+	b.enableFirewall = enable
+	return b
+}
+
+func (b *builder) SetFirewallBackend(backend string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.firewallBackend = backend
+	return b
+}
+
+func (b *builder) SetVIPInterface(iface string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.vipInterface = iface
+	return b
+}
+
+func (b *builder) SetIPPoolConfig(file string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.ipPoolConfig = file
+	return b
+}
+
+func (b *builder) SetKeepalived(enable bool) *builder {
+	b.lock()
+	defer b.unlock()
+	b.keepalived = enable
+	return b
+}
+
+func (b *builder) SetKeepalivedConf(file string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.keepalivedConf = file
+	return b
+}
+
+func (b *builder) SetKeepalivedInterface(iface string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.keepalivedInterface = iface
+	return b
+}
+
+func (b *builder) SetKeepalivedRouterID(id int) *builder {
+	b.lock()
+	defer b.unlock()
+	b.keepalivedRouterID = id
+	return b
+}
+
+func (b *builder) SetKeepalivedPriority(priority int) *builder {
+	b.lock()
+	defer b.unlock()
+	b.keepalivedPriority = priority
+	return b
+}
+
+func (b *builder) SetKeepalivedAuthPass(pass string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.keepalivedAuthPass = pass
+	return b
+}
+
+func (b *builder) SetLeaderElect(enable bool) *builder {
+	b.lock()
+	defer b.unlock()
+	b.leaderElect = enable
+	return b
+}
+
+func (b *builder) SetLeaderElectNamespace(namespace string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.leaderElectNamespace = namespace
+	return b
+}
+
+func (b *builder) SetLeaderElectName(name string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.leaderElectName = name
+	return b
+}
+
+func (b *builder) SetAnnounceInterval(interval time.Duration) *builder {
+	b.lock()
+	defer b.unlock()
+	b.announceInterval = interval
+	return b
+}
+
+func (b *builder) SetNamespaces(namespaces []string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.namespaces = append([]string{}, namespaces...)
+	return b
+}
+
+func (b *builder) SetExcludeNamespaces(namespaces []string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.excludeNamespaces = append([]string{}, namespaces...)
+	return b
+}
+
+func (b *builder) SetServiceSelector(selector string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.serviceSelector = selector
+	return b
+}
+
+func (b *builder) SetShard(shard bool) *builder {
+	b.lock()
+	defer b.unlock()
+	b.shard = shard
+	return b
+}
+
+func (b *builder) SetShardGroup(group string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.shardGroup = group
+	return b
+}
+
+func (b *builder) SetShardNamespace(namespace string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.shardNamespace = namespace
+	return b
+}
+
+func (b *builder) SetShardMember(member string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.shardMember = member
+	return b
+}
+
+func (b *builder) SetShardPool(pool string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.shardPool = pool
+	return b
+}
+
+func (b *builder) SetShardLeaseDuration(duration time.Duration) *builder {
+	b.lock()
+	defer b.unlock()
+	b.shardLeaseDuration = duration
+	return b
+}
+
+func (b *builder) SetClusterID(ids []string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.clusterID = append([]string{}, ids...)
+	return b
+}
+
+func (b *builder) SetCoordinationCluster(cluster string) *builder {
+	b.lock()
+	defer b.unlock()
+	b.coordinationCluster = cluster
+	return b
+}
+
+func (b *builder) SetDryRun(dryRun bool) *builder {
+	b.lock()
+	defer b.unlock()
+	b.dryRun = dryRun
+	return b
+}
+
+// Build returns the args set by the builder.
+func (b *builder) Build() *Args {
+	b.lock()
+	defer b.unlock()
+	return b.Args.clone()
+}
+
+// NewBuilder returns the builder publishing every change immediately.
 func NewBuilder() *builder { return lbBuilder }
+
+// NewStagedBuilder returns a builder starting from the args in effect, its
+// changes take effect only after the built args published by Publish.
+func NewStagedBuilder() *builder {
+	return &builder{Args: Current().clone(), staged: true}
+}
+
+// Publish makes the args take effect all together.
+func Publish(a *Args) {
+	lbBuilder.l.Lock()
+	defer lbBuilder.l.Unlock()
+	lbHolder.Store(a.clone())
+}
+
+// clone returns a copy of the args, the slices are never modified in place
+// by the builder, so they're shared.
+func (a *Args) clone() *Args {
+	c := *a
+	return &c
+}
@@ -1,31 +1,201 @@
 package args
 
-import "net"
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
 
-var lbHolder = &holder{}
+// lbHolder holds the *Args in effect. An Args is never modified once it's
+// published, the getters read a consistent snapshot without any lock, and
+// the reloaded args take effect all together by replacing the snapshot.
+var lbHolder atomic.Value
 
-type holder struct {
+func init() { lbHolder.Store(&Args{}) }
+
+// Args is a snapshot of the controller arguments, it's built by the builder
+// and published by Publish.
+type Args struct {
 	port        int
 	bindAddress net.IP
+	debugAddr   string
 	kubeconfig  string
 	logLevel    string
 	logFormat   string
 	logFile     string
 	upstream    []string
 	numWorker   int
-}
 
-func GetPort() int           { return lbHolder.port }
-func GetBindAddress() net.IP { return lbHolder.bindAddress }
-func GetKubeconfig() string  { return lbHolder.kubeconfig }
-func GetLogLevel() string    { return lbHolder.logLevel }
-func GetLogFormat() string   { return lbHolder.logFormat }
-func GetLogFile() string     { return lbHolder.logFile }
-func GetUpstream() []string {
-	var upstream []string
-	for _, host := range lbHolder.upstream {
-		upstream = append(upstream, host)
-	}
-	return upstream
+	configFile string
+	nginxDir   string
+
+	nginxConfMode       string
+	nginxConfParamsFile string
+	nginxConfConfigMap  string
+	templateDir         string
+
+	upstreamMaxFails     int
+	upstreamFailTimeout  string
+	upstreamMaxConns     int
+	upstreamFromNodes    bool
+	upstreamNodeSelector string
+
+	healthCheckMode     string
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+	healthCheckRise     int
+	healthCheckFall     int
+	healthCheckPort     int
+	healthCheckPath     string
+
+	nginxProcessManager string
+	manageNginxInstall  bool
+
+	enableFirewall  bool
+	firewallBackend string
+
+	vipInterface string
+	ipPoolConfig string
+
+	keepalived          bool
+	keepalivedConf      string
+	keepalivedInterface string
+	keepalivedRouterID  int
+	keepalivedPriority  int
+	keepalivedAuthPass  string
+
+	leaderElect          bool
+	leaderElectNamespace string
+	leaderElectName      string
+	announceInterval     time.Duration
+
+	namespaces        []string
+	excludeNamespaces []string
+	serviceSelector   string
+
+	shard              bool
+	shardGroup         string
+	shardNamespace     string
+	shardMember        string
+	shardPool          string
+	shardLeaseDuration time.Duration
+
+	clusterID           []string
+	coordinationCluster string
+	dryRun              bool
 }
-func GetNumWorker() int { return lbHolder.numWorker }
+
+// Current returns the args in effect.
+func Current() *Args { return lbHolder.Load().(*Args) }
+
+func (a *Args) GetPort() int                          { return a.port }
+func (a *Args) GetBindAddress() net.IP                { return a.bindAddress }
+func (a *Args) GetDebugAddress() string               { return a.debugAddr }
+func (a *Args) GetKubeconfig() string                 { return a.kubeconfig }
+func (a *Args) GetLogLevel() string                   { return a.logLevel }
+func (a *Args) GetLogFormat() string                  { return a.logFormat }
+func (a *Args) GetLogFile() string                    { return a.logFile }
+func (a *Args) GetUpstream() []string                 { return append([]string(nil), a.upstream...) }
+func (a *Args) GetNumWorker() int                     { return a.numWorker }
+func (a *Args) GetConfigFile() string                 { return a.configFile }
+func (a *Args) GetNginxDir() string                   { return a.nginxDir }
+func (a *Args) GetNginxConfMode() string              { return a.nginxConfMode }
+func (a *Args) GetNginxConfParamsFile() string        { return a.nginxConfParamsFile }
+func (a *Args) GetNginxConfConfigMap() string         { return a.nginxConfConfigMap }
+func (a *Args) GetTemplateDir() string                { return a.templateDir }
+func (a *Args) GetUpstreamMaxFails() int              { return a.upstreamMaxFails }
+func (a *Args) GetUpstreamFailTimeout() string        { return a.upstreamFailTimeout }
+func (a *Args) GetUpstreamMaxConns() int              { return a.upstreamMaxConns }
+func (a *Args) GetUpstreamFromNodes() bool            { return a.upstreamFromNodes }
+func (a *Args) GetUpstreamNodeSelector() string       { return a.upstreamNodeSelector }
+func (a *Args) GetHealthCheckMode() string            { return a.healthCheckMode }
+func (a *Args) GetHealthCheckInterval() time.Duration { return a.healthCheckInterval }
+func (a *Args) GetHealthCheckTimeout() time.Duration  { return a.healthCheckTimeout }
+func (a *Args) GetHealthCheckRise() int               { return a.healthCheckRise }
+func (a *Args) GetHealthCheckFall() int               { return a.healthCheckFall }
+func (a *Args) GetHealthCheckPort() int               { return a.healthCheckPort }
+func (a *Args) GetHealthCheckPath() string            { return a.healthCheckPath }
+func (a *Args) GetNginxProcessManager() string        { return a.nginxProcessManager }
+func (a *Args) GetManageNginxInstall() bool           { return a.manageNginxInstall }
+func (a *Args) GetEnableFirewall() bool               { return a.enableFirewall }
+func (a *Args) GetFirewallBackend() string            { return a.firewallBackend }
+func (a *Args) GetVIPInterface() string               { return a.vipInterface }
+func (a *Args) GetIPPoolConfig() string               { return a.ipPoolConfig }
+func (a *Args) GetKeepalived() bool                   { return a.keepalived }
+func (a *Args) GetKeepalivedConf() string             { return a.keepalivedConf }
+func (a *Args) GetKeepalivedInterface() string        { return a.keepalivedInterface }
+func (a *Args) GetKeepalivedRouterID() int            { return a.keepalivedRouterID }
+func (a *Args) GetKeepalivedPriority() int            { return a.keepalivedPriority }
+func (a *Args) GetKeepalivedAuthPass() string         { return a.keepalivedAuthPass }
+func (a *Args) GetLeaderElect() bool                  { return a.leaderElect }
+func (a *Args) GetLeaderElectNamespace() string       { return a.leaderElectNamespace }
+func (a *Args) GetLeaderElectName() string            { return a.leaderElectName }
+func (a *Args) GetAnnounceInterval() time.Duration    { return a.announceInterval }
+func (a *Args) GetNamespaces() []string               { return append([]string(nil), a.namespaces...) }
+func (a *Args) GetExcludeNamespaces() []string        { return append([]string(nil), a.excludeNamespaces...) }
+func (a *Args) GetServiceSelector() string            { return a.serviceSelector }
+func (a *Args) GetShard() bool                        { return a.shard }
+func (a *Args) GetShardGroup() string                 { return a.shardGroup }
+func (a *Args) GetShardNamespace() string             { return a.shardNamespace }
+func (a *Args) GetShardMember() string                { return a.shardMember }
+func (a *Args) GetShardPool() string                  { return a.shardPool }
+func (a *Args) GetShardLeaseDuration() time.Duration  { return a.shardLeaseDuration }
+func (a *Args) GetClusterID() []string                { return append([]string(nil), a.clusterID...) }
+func (a *Args) GetCoordinationCluster() string        { return a.coordinationCluster }
+func (a *Args) GetDryRun() bool                       { return a.dryRun }
+
+func GetPort() int                          { return Current().GetPort() }
+func GetBindAddress() net.IP                { return Current().GetBindAddress() }
+func GetDebugAddress() string               { return Current().GetDebugAddress() }
+func GetKubeconfig() string                 { return Current().GetKubeconfig() }
+func GetLogLevel() string                   { return Current().GetLogLevel() }
+func GetLogFormat() string                  { return Current().GetLogFormat() }
+func GetLogFile() string                    { return Current().GetLogFile() }
+func GetUpstream() []string                 { return Current().GetUpstream() }
+func GetNumWorker() int                     { return Current().GetNumWorker() }
+func GetConfigFile() string                 { return Current().GetConfigFile() }
+func GetNginxDir() string                   { return Current().GetNginxDir() }
+func GetNginxConfMode() string              { return Current().GetNginxConfMode() }
+func GetNginxConfParamsFile() string        { return Current().GetNginxConfParamsFile() }
+func GetNginxConfConfigMap() string         { return Current().GetNginxConfConfigMap() }
+func GetTemplateDir() string                { return Current().GetTemplateDir() }
+func GetUpstreamMaxFails() int              { return Current().GetUpstreamMaxFails() }
+func GetUpstreamFailTimeout() string        { return Current().GetUpstreamFailTimeout() }
+func GetUpstreamMaxConns() int              { return Current().GetUpstreamMaxConns() }
+func GetUpstreamFromNodes() bool            { return Current().GetUpstreamFromNodes() }
+func GetUpstreamNodeSelector() string       { return Current().GetUpstreamNodeSelector() }
+func GetHealthCheckMode() string            { return Current().GetHealthCheckMode() }
+func GetHealthCheckInterval() time.Duration { return Current().GetHealthCheckInterval() }
+func GetHealthCheckTimeout() time.Duration  { return Current().GetHealthCheckTimeout() }
+func GetHealthCheckRise() int               { return Current().GetHealthCheckRise() }
+func GetHealthCheckFall() int               { return Current().GetHealthCheckFall() }
+func GetHealthCheckPort() int               { return Current().GetHealthCheckPort() }
+func GetHealthCheckPath() string            { return Current().GetHealthCheckPath() }
+func GetNginxProcessManager() string        { return Current().GetNginxProcessManager() }
+func GetManageNginxInstall() bool           { return Current().GetManageNginxInstall() }
+func GetEnableFirewall() bool               { return Current().GetEnableFirewall() }
+func GetFirewallBackend() string            { return Current().GetFirewallBackend() }
+func GetVIPInterface() string               { return Current().GetVIPInterface() }
+func GetIPPoolConfig() string               { return Current().GetIPPoolConfig() }
+func GetKeepalived() bool                   { return Current().GetKeepalived() }
+func GetKeepalivedConf() string             { return Current().GetKeepalivedConf() }
+func GetKeepalivedInterface() string        { return Current().GetKeepalivedInterface() }
+func GetKeepalivedRouterID() int            { return Current().GetKeepalivedRouterID() }
+func GetKeepalivedPriority() int            { return Current().GetKeepalivedPriority() }
+func GetKeepalivedAuthPass() string         { return Current().GetKeepalivedAuthPass() }
+func GetLeaderElect() bool                  { return Current().GetLeaderElect() }
+func GetLeaderElectNamespace() string       { return Current().GetLeaderElectNamespace() }
+func GetLeaderElectName() string            { return Current().GetLeaderElectName() }
+func GetAnnounceInterval() time.Duration    { return Current().GetAnnounceInterval() }
+func GetNamespaces() []string               { return Current().GetNamespaces() }
+func GetExcludeNamespaces() []string        { return Current().GetExcludeNamespaces() }
+func GetServiceSelector() string            { return Current().GetServiceSelector() }
+func GetShard() bool                        { return Current().GetShard() }
+func GetShardGroup() string                 { return Current().GetShardGroup() }
+func GetShardNamespace() string             { return Current().GetShardNamespace() }
+func GetShardMember() string                { return Current().GetShardMember() }
+func GetShardPool() string                  { return Current().GetShardPool() }
+func GetShardLeaseDuration() time.Duration  { return Current().GetShardLeaseDuration() }
+func GetClusterID() []string                { return Current().GetClusterID() }
+func GetCoordinationCluster() string        { return Current().GetCoordinationCluster() }
+func GetDryRun() bool                       { return Current().GetDryRun() }
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// Source is where the value of a flag comes from.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFlag    Source = "flag"
+	SourceEnv     Source = "env"
+	SourceFile    Source = "file"
+)
+
+const (
+	// FileFlag is the command line flag specifying the config file.
+	FileFlag = "conf"
+	// EnvPrefix is the prefix of the env variables, the env variable of
+	// --health-check-interval is K8S_LOADBALANCER_HEALTH_CHECK_INTERVAL.
+	EnvPrefix = "K8S_LOADBALANCER_"
+)
+
+var (
+	locker sync.Mutex
+	// sources is where the value of every flag comes from, key is the flag name.
+	sources = make(map[string]Source)
+	// paths is the config file field path of every flag, key is the flag name.
+	paths = make(map[string]string)
+	// filename is the config file applied last time.
+	filename string
+)
+
+func init() {
+	for _, f := range (&Config{}).fields() {
+		paths[f.flag] = f.path
+	}
+}
+
+// EnvName returns the env variable name of the flag.
+func EnvName(flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// File returns the config file specified by --conf or the env variable
+// K8S_LOADBALANCER_CONF, empty means no config file.
+func File(fs *pflag.FlagSet) string {
+	f := fs.Lookup(FileFlag)
+	if f == nil {
+		return ""
+	}
+	if f.Changed {
+		return f.Value.String()
+	}
+	if val, ok := os.LookupEnv(EnvName(FileFlag)); ok {
+		return val
+	}
+	return f.Value.String()
+}
+
+// Apply sets the flags not specified on the command line from the env variables
+// and the config file, the precedence is: flags > env > file > default. cfg is
+// nil if there is no config file. It can be called again to reload the config
+// file, the flags set by the last config file but not by cfg are reset to default.
+func Apply(fs *pflag.FlagSet, cfg *Config, file string) error {
+	locker.Lock()
+	defer locker.Unlock()
+
+	fields := make(map[string]field)
+	if cfg != nil {
+		for _, f := range cfg.fields() {
+			fields[f.flag] = f
+		}
+	}
+	var errs []string
+	fs.VisitAll(func(flag *pflag.Flag) {
+		// the flags set on the command line always take precedence, the flags
+		// changed by the last Apply are set from env or file again.
+		if src, ok := sources[flag.Name]; src == SourceFlag || (!ok && flag.Changed) {
+			sources[flag.Name] = SourceFlag
+			return
+		}
+		if val, ok := os.LookupEnv(EnvName(flag.Name)); ok {
+			if err := setFlag(flag, val, split(val)); err != nil {
+				errs = append(errs, fmt.Sprintf("env %s: %s", EnvName(flag.Name), err.Error()))
+			}
+			sources[flag.Name] = SourceEnv
+			return
+		}
+		if f, ok := fields[flag.Name]; ok && f.isSet() {
+			if err := setFlag(flag, f.String(), f.value.Interface()); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s: %s", file, f.path, err.Error()))
+			}
+			sources[flag.Name] = SourceFile
+			return
+		}
+		if sources[flag.Name] != SourceDefault {
+			def := strings.Trim(flag.DefValue, "[]")
+			if err := setFlag(flag, flag.DefValue, split(def)); err != nil {
+				errs = append(errs, fmt.Sprintf("reset --%s to default: %s", flag.Name, err.Error()))
+			}
+		}
+		sources[flag.Name] = SourceDefault
+	})
+	filename = file
+	if len(errs) != 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	for _, name := range sortedFlags() {
+		if src := sources[name]; src == SourceEnv || src == SourceFile {
+			logrus.Debugf("--%s is set from %s", name, src)
+		}
+	}
+	return nil
+}
+
+// Describe returns the flag name with where its value comes from, it's used in
+// the error messages, eg: "--health-check-interval (healthCheck.interval in /etc/k8s-loadbalancer.yaml)".
+func Describe(flag string) string {
+	locker.Lock()
+	defer locker.Unlock()
+	switch sources[flag] {
+	case SourceEnv:
+		return fmt.Sprintf("--%s (env %s)", flag, EnvName(flag))
+	case SourceFile:
+		return fmt.Sprintf("--%s (%s in %s)", flag, paths[flag], filename)
+	}
+	return "--" + flag
+}
+
+// Values returns the current value of every flag, key is the flag name.
+func Values(fs *pflag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	fs.VisitAll(func(flag *pflag.Flag) {
+		values[flag.Name] = flag.Value.String()
+	})
+	return values
+}
+
+// Restore sets the flag back to the value returned by Values, it's used to keep
+// the settings requiring a restart unchanged when the configuration reloaded.
+func Restore(fs *pflag.FlagSet, name, val string) error {
+	flag := fs.Lookup(name)
+	if flag == nil {
+		return fmt.Errorf("unknown flag --%s", name)
+	}
+	return setFlag(flag, val, split(strings.Trim(val, "[]")))
+}
+
+// setFlag sets the flag value, the slice flag is replaced by slice instead
+// of appended to.
+func setFlag(flag *pflag.Flag, val string, slice interface{}) error {
+	if sv, ok := flag.Value.(pflag.SliceValue); ok {
+		items, _ := slice.([]string)
+		return sv.Replace(items)
+	}
+	return flag.Value.Set(val)
+}
+
+// split splits the comma separated values, the empty values are dropped.
+func split(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// sortedFlags returns the names of the flags having source, sorted.
+func sortedFlags() []string {
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// newTestFlagSet returns the flag set with the flags parsed from the command line,
+// the sources recorded by the last Apply are cleared.
+func newTestFlagSet(t *testing.T, arguments ...string) *pflag.FlagSet {
+	t.Helper()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.Int("port", 8080, "")
+	fs.String("log-level", "INFO", "")
+	fs.String("log-format", "TEXT", "")
+	fs.StringSlice("upstream", []string{}, "")
+	fs.String("debug-address", "127.0.0.1:8081", "")
+	if err := fs.Parse(arguments); err != nil {
+		t.Fatal(err)
+	}
+	locker.Lock()
+	sources = make(map[string]Source)
+	locker.Unlock()
+	return fs
+}
+
+// parseTestConfig returns the config parsed from the yaml.
+func parseTestConfig(t *testing.T, data string) *Config {
+	t.Helper()
+	cfg, err := Parse([]byte("apiVersion: " + APIVersion + "\nkind: " + Kind + "\n" + data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestApplyPrecedence(t *testing.T) {
+	fs := newTestFlagSet(t, "--port=9000")
+	t.Setenv(EnvName("port"), "9001")
+	t.Setenv(EnvName("log-level"), "DEBUG")
+	cfg := parseTestConfig(t, `
+server:
+  port: 9002
+  debugAddress: ""
+log:
+  level: WARN
+  format: JSON
+upstream:
+  hosts: [10.0.0.1, 10.0.0.2]
+`)
+	if err := Apply(fs, cfg, "lb.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		flag   string
+		value  string
+		source Source
+	}{
+		{"port", "9000", SourceFlag},
+		{"log-level", "DEBUG", SourceEnv},
+		{"log-format", "JSON", SourceFile},
+		{"upstream", "[10.0.0.1,10.0.0.2]", SourceFile},
+		{"debug-address", "", SourceFile},
+	}
+	values := Values(fs)
+	for _, tt := range tests {
+		if values[tt.flag] != tt.value {
+			t.Errorf("--%s = %q, want %q", tt.flag, values[tt.flag], tt.value)
+		}
+		if sources[tt.flag] != tt.source {
+			t.Errorf("--%s source = %s, want %s", tt.flag, sources[tt.flag], tt.source)
+		}
+	}
+	if got, want := Describe("log-format"), "--log-format (log.format in lb.yaml)"; got != want {
+		t.Errorf("Describe() = %q, want %q", got, want)
+	}
+	if got, want := Describe("log-level"), "--log-level (env K8S_LOADBALANCER_LOG_LEVEL)"; got != want {
+		t.Errorf("Describe() = %q, want %q", got, want)
+	}
+}
+
+func TestApplyReload(t *testing.T) {
+	fs := newTestFlagSet(t, "--port=9000")
+	cfg := parseTestConfig(t, `
+server:
+  port: 9002
+log:
+  format: JSON
+upstream:
+  hosts: [10.0.0.1]
+`)
+	if err := Apply(fs, cfg, "lb.yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the flags set by the last config file but not by the new one are reset to
+	// default, the command line flags are never overridden.
+	t.Setenv(EnvName("upstream"), "10.0.0.3,10.0.0.4")
+	cfg = parseTestConfig(t, `
+server:
+  port: 9003
+log:
+  level: ERROR
+`)
+	if err := Apply(fs, cfg, "lb.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"port":       "9000",
+		"log-level":  "ERROR",
+		"log-format": "TEXT",
+		"upstream":   "[10.0.0.3,10.0.0.4]",
+	}
+	values := Values(fs)
+	for flag, val := range want {
+		if values[flag] != val {
+			t.Errorf("--%s = %q, want %q", flag, values[flag], val)
+		}
+	}
+	if sources["log-format"] != SourceDefault {
+		t.Errorf("--log-format source = %s, want %s", sources["log-format"], SourceDefault)
+	}
+}
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Cluster is a k8s cluster the controller list-and-watch, parsed from --kubeconfig.
+type Cluster struct {
+	// Name is prefixed to the generated nginx config file names and upstream
+	// names, it's empty if only one cluster is specified without name.
+	Name string
+	// Kubeconfig is the kubeconfig file, empty means the default one.
+	Kubeconfig string
+	// Context is the kubeconfig context, empty means the current context.
+	Context string
+	// ID is the identity of the cluster specified by --cluster-id, empty means
+	// the uid of the kube-system namespace.
+	ID string
+}
+
+func (c Cluster) String() string {
+	if len(c.Name) == 0 {
+		return "default"
+	}
+	return c.Name
+}
+
+// Clusters parses --kubeconfig, it's a comma separated list of "name=kubeconfig"
+// or "name=kubeconfig#context", eg: "a=/root/.kube/a.conf,b=/root/.kube/config#b".
+// A single kubeconfig file without name is the only cluster and its nginx config
+// files are not prefixed, it's the same as before multiple clusters supported.
+func Clusters() ([]Cluster, error) {
+	clusters, err := parseKubeconfig(args.GetKubeconfig())
+	if err != nil {
+		return nil, err
+	}
+	if err := setClusterIDs(clusters, args.GetClusterID()); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// parseKubeconfig parses the clusters of --kubeconfig.
+func parseKubeconfig(value string) ([]Cluster, error) {
+	if !strings.Contains(value, "=") && !strings.Contains(value, ",") && !strings.Contains(value, "#") {
+		return []Cluster{{Kubeconfig: value}}, nil
+	}
+	var clusters []Cluster
+	seen := make(map[string]bool)
+	for _, entry := range split(value) {
+		items := strings.SplitN(entry, "=", 2)
+		if len(items) != 2 {
+			return nil, fmt.Errorf("%q should be in format name=kubeconfig or name=kubeconfig#context", entry)
+		}
+		cluster := Cluster{Name: items[0], Kubeconfig: items[1]}
+		if i := strings.Index(cluster.Kubeconfig, "#"); i >= 0 {
+			cluster.Kubeconfig, cluster.Context = cluster.Kubeconfig[:i], cluster.Kubeconfig[i+1:]
+		}
+		if msgs := validation.IsDNS1123Label(cluster.Name); len(msgs) != 0 {
+			return nil, fmt.Errorf("invalid cluster name %q: %s", cluster.Name, strings.Join(msgs, ", "))
+		}
+		if seen[cluster.Name] {
+			return nil, fmt.Errorf("duplicate cluster name %q", cluster.Name)
+		}
+		seen[cluster.Name] = true
+		clusters = append(clusters, cluster)
+	}
+	if len(clusters) == 0 {
+		return nil, fmt.Errorf("no cluster specified")
+	}
+	return clusters, nil
+}
+
+// setClusterIDs sets the cluster ids of --cluster-id, it's "id" if only one cluster
+// or a comma separated list of "name=id". The cluster id is embedded in the nginx
+// config file names, so it must be a DNS-1123 label, eg: the uid of a namespace.
+func setClusterIDs(clusters []Cluster, ids []string) error {
+	seen := make(map[string]bool)
+	for _, entry := range ids {
+		name, id := "", entry
+		if items := strings.SplitN(entry, "=", 2); len(items) == 2 {
+			name, id = items[0], items[1]
+		} else if len(clusters) != 1 {
+			return fmt.Errorf("%q should be in format name=id if multiple clusters specified", entry)
+		}
+		if msgs := validation.IsDNS1123Label(id); len(msgs) != 0 {
+			return fmt.Errorf("invalid cluster id %q: %s", id, strings.Join(msgs, ", "))
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate cluster id of cluster %q", name)
+		}
+		seen[name] = true
+		found := false
+		for i := range clusters {
+			// the only cluster takes the id without name.
+			if clusters[i].Name == name || len(name) == 0 {
+				clusters[i].ID, found = id, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%q: cluster %q is not in --kubeconfig", entry, name)
+		}
+	}
+	return nil
+}
+
+// KubeconfigFile returns the kubeconfig file used to create the k8s clients of the
+// cluster. If the cluster has a context, a temporary kubeconfig file using the
+// context is written, cleanup removes it after the clients created.
+func (c Cluster) KubeconfigFile() (file string, cleanup func(), err error) {
+	if len(c.Context) == 0 {
+		return c.Kubeconfig, func() {}, nil
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if len(c.Kubeconfig) != 0 {
+		rules.ExplicitPath = c.Kubeconfig
+	}
+	raw, err := rules.Load()
+	if err != nil {
+		return "", nil, err
+	}
+	if _, ok := raw.Contexts[c.Context]; !ok {
+		return "", nil, fmt.Errorf("cluster %s: context %q not found in kubeconfig", c.Name, c.Context)
+	}
+	raw.CurrentContext = c.Context
+	// the relative certificate paths are resolved before written to another directory.
+	if err := clientcmd.ResolveLocalPaths(raw); err != nil {
+		return "", nil, err
+	}
+	f, err := ioutil.TempFile("", "k8s-loadbalancer-kubeconfig-")
+	if err != nil {
+		return "", nil, err
+	}
+	f.Close()
+	cleanup = func() { os.Remove(f.Name()) }
+	if err := clientcmd.WriteToFile(*raw, f.Name()); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return f.Name(), cleanup, nil
+}
+
+// hasCluster returns true if the cluster is specified by --kubeconfig.
+func hasCluster(name string) bool {
+	clusters, _ := Clusters()
+	_, ok := findCluster(clusters, name)
+	return ok
+}
+
+// findCluster returns the cluster of the name.
+func findCluster(clusters []Cluster, name string) (Cluster, bool) {
+	for _, c := range clusters {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Cluster{}, false
+}
+
+// CoordinationCluster returns the cluster hosting the Leases of the leader
+// election and the sharding and the ConfigMap of --nginx-conf-configmap, it's
+// --coordination-cluster or the first cluster of --kubeconfig.
+func CoordinationCluster() (Cluster, error) {
+	clusters, err := Clusters()
+	if err != nil {
+		return Cluster{}, err
+	}
+	return coordinationCluster(clusters, args.GetCoordinationCluster())
+}
+
+// coordinationCluster returns the cluster of the name, the first cluster if
+// the name is empty.
+func coordinationCluster(clusters []Cluster, name string) (Cluster, error) {
+	if len(name) == 0 {
+		return clusters[0], nil
+	}
+	if c, ok := findCluster(clusters, name); ok {
+		return c, nil
+	}
+	return Cluster{}, fmt.Errorf("cluster %q is not in --kubeconfig", name)
+}
@@ -0,0 +1,22 @@
+package config
+
+import "testing"
+
+func TestCoordinationCluster(t *testing.T) {
+	clusters, err := parseKubeconfig("a=/root/.kube/a.conf,b=/root/.kube/config#b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"": "a", "a": "a", "b": "b"} {
+		c, err := coordinationCluster(clusters, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Name != want {
+			t.Errorf("coordination cluster of %q = %s, want %s", name, c.Name, want)
+		}
+	}
+	if _, err := coordinationCluster(clusters, "c"); err == nil {
+		t.Error("the cluster not in --kubeconfig is accepted")
+	}
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// APIVersion and Kind identify the controller config file.
+	APIVersion = "k8s-loadbalancer.forbearing.io/v1alpha1"
+	Kind       = "LoadBalancerConfig"
+)
+
+// Config is the declarative configuration of the controller. Every field is
+// the same as the command line flag in the "flag" tag, a nil field means the
+// flag is not set by the config file. The precedence is: flags > env > file.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	Kubeconfig          *string  `json:"kubeconfig,omitempty" flag:"kubeconfig"`
+	ClusterID           []string `json:"clusterID,omitempty" flag:"cluster-id"`
+	CoordinationCluster *string  `json:"coordinationCluster,omitempty" flag:"coordination-cluster"`
+	Workers             *int     `json:"workers,omitempty" flag:"worker"`
+	DryRun              *bool    `json:"dryRun,omitempty" flag:"dry-run"`
+
+	Server         ServerConfig         `json:"server"`
+	Log            LogConfig            `json:"log"`
+	Upstream       UpstreamConfig       `json:"upstream"`
+	HealthCheck    HealthCheckConfig    `json:"healthCheck"`
+	Nginx          NginxConfig          `json:"nginx"`
+	Firewall       FirewallConfig       `json:"firewall"`
+	VIP            VIPConfig            `json:"vip"`
+	Keepalived     KeepalivedConfig     `json:"keepalived"`
+	LeaderElection LeaderElectionConfig `json:"leaderElection"`
+	Scope          ScopeConfig          `json:"scope"`
+	Shard          ShardConfig          `json:"shard"`
+
+	// Services is the k8s services selected explicitly, they don't need the
+	// annotation "loadbalancer=enabled". It's reloaded when the file changed.
+	Services []ServiceConfig `json:"services,omitempty"`
+}
+
+// ServerConfig is the HTTP server serving /healthz and /metrics, and the debug
+// HTTP server serving /debug/config and /debug/dry-run.
+type ServerConfig struct {
+	Port         *int    `json:"port,omitempty" flag:"port"`
+	BindAddress  *string `json:"bindAddress,omitempty" flag:"bind-address"`
+	DebugAddress *string `json:"debugAddress,omitempty" flag:"debug-address"`
+}
+
+type LogConfig struct {
+	Level  *string `json:"level,omitempty" flag:"log-level"`
+	Format *string `json:"format,omitempty" flag:"log-format"`
+	Output *string `json:"output,omitempty" flag:"log-output"`
+}
+
+// UpstreamConfig is the upstream hosts and the global upstream server parameters.
+type UpstreamConfig struct {
+	Hosts        []string `json:"hosts,omitempty" flag:"upstream"`
+	FromNodes    *bool    `json:"fromNodes,omitempty" flag:"upstream-from-nodes"`
+	NodeSelector *string  `json:"nodeSelector,omitempty" flag:"upstream-node-selector"`
+	MaxFails     *int     `json:"maxFails,omitempty" flag:"upstream-max-fails"`
+	FailTimeout  *string  `json:"failTimeout,omitempty" flag:"upstream-fail-timeout"`
+	MaxConns     *int     `json:"maxConns,omitempty" flag:"upstream-max-conns"`
+}
+
+// HealthCheckConfig is the active health checking of the upstream hosts,
+// the interval and timeout are durations, eg: 5s, 1m.
+type HealthCheckConfig struct {
+	Mode     *string `json:"mode,omitempty" flag:"health-check"`
+	Interval *string `json:"interval,omitempty" flag:"health-check-interval"`
+	Timeout  *string `json:"timeout,omitempty" flag:"health-check-timeout"`
+	Rise     *int    `json:"rise,omitempty" flag:"health-check-rise"`
+	Fall     *int    `json:"fall,omitempty" flag:"health-check-fall"`
+	Port     *int    `json:"port,omitempty" flag:"health-check-port"`
+	Path     *string `json:"path,omitempty" flag:"health-check-path"`
+}
+
+type NginxConfig struct {
+	Dir            *string `json:"dir,omitempty" flag:"nginx-dir"`
+	ProcessManager *string `json:"processManager,omitempty" flag:"nginx-process-manager"`
+	ManageInstall  *bool   `json:"manageInstall,omitempty" flag:"manage-nginx-install"`
+	ConfMode       *string `json:"confMode,omitempty" flag:"nginx-conf-mode"`
+	ConfParams     *string `json:"confParams,omitempty" flag:"nginx-conf-params"`
+	ConfConfigMap  *string `json:"confConfigMap,omitempty" flag:"nginx-conf-configmap"`
+	TemplateDir    *string `json:"templateDir,omitempty" flag:"template-dir"`
+}
+
+type FirewallConfig struct {
+	Enabled *bool   `json:"enabled,omitempty" flag:"enable-firewall"`
+	Backend *string `json:"backend,omitempty" flag:"firewall-backend"`
+}
+
+type VIPConfig struct {
+	Interface        *string `json:"interface,omitempty" flag:"vip-interface"`
+	IPPoolConfig     *string `json:"ipPoolConfig,omitempty" flag:"ip-pool-config"`
+	AnnounceInterval *string `json:"announceInterval,omitempty" flag:"announce-interval"`
+}
+
+type KeepalivedConfig struct {
+	Enabled   *bool   `json:"enabled,omitempty" flag:"keepalived"`
+	Conf      *string `json:"conf,omitempty" flag:"keepalived-conf"`
+	Interface *string `json:"interface,omitempty" flag:"keepalived-interface"`
+	RouterID  *int    `json:"routerID,omitempty" flag:"keepalived-router-id"`
+	Priority  *int    `json:"priority,omitempty" flag:"keepalived-priority"`
+	AuthPass  *string `json:"authPass,omitempty" flag:"keepalived-auth-pass" secret:"true"`
+}
+
+type LeaderElectionConfig struct {
+	Enabled   *bool   `json:"enabled,omitempty" flag:"leader-elect"`
+	Namespace *string `json:"namespace,omitempty" flag:"leader-elect-namespace"`
+	Name      *string `json:"name,omitempty" flag:"leader-elect-name"`
+}
+
+// ScopeConfig limits the k8s services watched by the controller, it's applied
+// at the informer level, so the k8s services out of the scope are never listed.
+type ScopeConfig struct {
+	Namespaces        []string `json:"namespaces,omitempty" flag:"namespaces"`
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty" flag:"exclude-namespaces"`
+	ServiceSelector   *string  `json:"serviceSelector,omitempty" flag:"service-selector"`
+}
+
+// ShardConfig splits the k8s services across the k8s-loadbalancer instances,
+// the lease duration is a duration, eg: 15s.
+type ShardConfig struct {
+	Enabled       *bool   `json:"enabled,omitempty" flag:"shard"`
+	Group         *string `json:"group,omitempty" flag:"shard-group"`
+	Namespace     *string `json:"namespace,omitempty" flag:"shard-namespace"`
+	Member        *string `json:"member,omitempty" flag:"shard-member"`
+	Pool          *string `json:"pool,omitempty" flag:"shard-pool"`
+	LeaseDuration *string `json:"leaseDuration,omitempty" flag:"shard-lease-duration"`
+}
+
+// field is a config field bound to a command line flag.
+type field struct {
+	// path is the field path in the config file, eg: healthCheck.interval.
+	path   string
+	flag   string
+	secret bool
+	value  reflect.Value
+}
+
+// Parse parses the yaml data into Config, the unknown fields are rejected.
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config failed: %s", err.Error())
+	}
+	if cfg.APIVersion != APIVersion {
+		return nil, fmt.Errorf("unsupported apiVersion %q, should be %q", cfg.APIVersion, APIVersion)
+	}
+	if cfg.Kind != Kind {
+		return nil, fmt.Errorf("unsupported kind %q, should be %q", cfg.Kind, Kind)
+	}
+	if err := validateServices(cfg.Services); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Load reads the config file.
+func Load(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return cfg, nil
+}
+
+// fields returns all the config fields bound to the command line flags.
+func (c *Config) fields() []field {
+	var fields []field
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			path := prefix + strings.Split(sf.Tag.Get("json"), ",")[0]
+			if flag := sf.Tag.Get("flag"); len(flag) != 0 {
+				fields = append(fields, field{path: path, flag: flag, secret: sf.Tag.Get("secret") == "true", value: v.Field(i)})
+				continue
+			}
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), path+".")
+			}
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return fields
+}
+
+// isSet returns true if the field is specified in the config file.
+func (f field) isSet() bool {
+	return !f.value.IsNil()
+}
+
+// String returns the field value in the command line flag format,
+// the slice is joined by comma.
+func (f field) String() string {
+	if f.value.Kind() == reflect.Slice {
+		return strings.Join(f.value.Interface().([]string), ",")
+	}
+	return fmt.Sprint(f.value.Elem().Interface())
+}
+
+// set sets the field from the command line flag value.
+func (f field) set(val string, slice []string) error {
+	switch f.value.Type().Elem().Kind() {
+	case reflect.String:
+		if f.value.Kind() == reflect.Slice {
+			f.value.Set(reflect.ValueOf(append([]string{}, slice...)))
+			return nil
+		}
+		f.value.Set(reflect.ValueOf(&val))
+	case reflect.Int:
+		i, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		f.value.Set(reflect.ValueOf(&i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		f.value.Set(reflect.ValueOf(&b))
+	default:
+		return fmt.Errorf("unsupported config field type %s", f.value.Type())
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// secretMask replaces the secret values in the dumped config.
+const secretMask = "******"
+
+// Effective returns the effective configuration of the controller, it's built
+// from the current flag values, so the values from flags, env and config file
+// are all included. The secret values are masked.
+func Effective(fs *pflag.FlagSet) *Config {
+	cfg := &Config{APIVersion: APIVersion, Kind: Kind}
+	for _, f := range cfg.fields() {
+		flag := fs.Lookup(f.flag)
+		if flag == nil {
+			continue
+		}
+		val := flag.Value.String()
+		var slice []string
+		if sv, ok := flag.Value.(pflag.SliceValue); ok {
+			slice = sv.GetSlice()
+		}
+		if f.secret && len(val) != 0 {
+			val = secretMask
+		}
+		if err := f.set(val, slice); err != nil {
+			logrus.Warnf("dump config field %s failed: %s", f.path, err.Error())
+		}
+	}
+	return cfg
+}
+
+// Dump writes the effective configuration in yaml format, the fields not
+// using the default value are listed with their sources in the header comment.
+func Dump(w io.Writer, fs *pflag.FlagSet) error {
+	data, err := yaml.Marshal(Effective(fs))
+	if err != nil {
+		return err
+	}
+	locker.Lock()
+	fmt.Fprintln(w, "# effective configuration, the non-default values come from:")
+	for _, name := range sortedFlags() {
+		src := sources[name]
+		path, ok := paths[name]
+		if !ok || src == SourceDefault {
+			continue
+		}
+		switch src {
+		case SourceEnv:
+			fmt.Fprintf(w, "#   %s: env %s\n", path, EnvName(name))
+		case SourceFile:
+			fmt.Fprintf(w, "#   %s: file %s\n", path, filename)
+		default:
+			fmt.Fprintf(w, "#   %s: flag --%s\n", path, name)
+		}
+	}
+	locker.Unlock()
+	_, err = w.Write(data)
+	return err
+}
+
+// Handler serves the effective configuration of the command line flags.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	if err := Dump(w, pflag.CommandLine); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
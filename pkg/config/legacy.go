@@ -0,0 +1,166 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// LegacyEntry is a line of the k8s-loadbalancer.conf used by the archived shell
+// version, format is "listenPort: name.namespace:port:protocol". The fields can
+// be separated by any of ".", "|", ":" and "/", the protocol is optional, default to tcp.
+type LegacyEntry struct {
+	// Line is the line number in the file, starts from 1.
+	Line int
+	// Text is the original line.
+	Text string
+
+	ListenPort int32
+	Name       string
+	Namespace  string
+	Port       int32
+	// Protocol is one of tcp, udp, http and https.
+	Protocol string
+}
+
+// K8sProtocol returns the k8s service port protocol of the entry, http and
+// https are proxied as TCP.
+func (e LegacyEntry) K8sProtocol() string {
+	if e.Protocol == "udp" {
+		return string(corev1.ProtocolUDP)
+	}
+	return string(corev1.ProtocolTCP)
+}
+
+func (e LegacyEntry) String() string {
+	return fmt.Sprintf("%d: %s.%s:%d:%s", e.ListenPort, e.Name, e.Namespace, e.Port, e.Protocol)
+}
+
+// LegacyError is a line of the legacy config failed to parse.
+type LegacyError struct {
+	Line int
+	Text string
+	Err  string
+}
+
+func (e LegacyError) Error() string {
+	if e.Line == 0 {
+		return e.Err
+	}
+	return fmt.Sprintf("line %d %q: %s", e.Line, e.Text, e.Err)
+}
+
+// ParseLegacy parses the k8s-loadbalancer.conf of the archived shell version the
+// same way as it does: the comments, quotes and spaces are removed, the fields are
+// split by awk -F '[.|:|/]', and the names are lower cased. It returns the entries
+// parsed and the lines failed to parse. The k8s service port mapped to another
+// listen port by a previous line is reported, nginx can only listen to one port
+// for it.
+func ParseLegacy(r io.Reader) ([]LegacyEntry, []LegacyError) {
+	var entries []LegacyEntry
+	var errs []LegacyError
+	seen := make(map[string]bool)
+	// ports is the entry of every k8s service port, key is name.namespace:port/protocol.
+	ports := make(map[string]LegacyEntry)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		line := strings.Map(func(r rune) rune {
+			switch r {
+			case '"', '\'', ' ', '\t', '\r':
+				return -1
+			}
+			return r
+		}, text)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// the shell version skips the duplicate lines.
+		if seen[line] {
+			continue
+		}
+		seen[line] = true
+
+		fields := splitLegacyFields(line)
+		entry := LegacyEntry{
+			Line:      n,
+			Text:      text,
+			Name:      strings.ToLower(fields[1]),
+			Namespace: strings.ToLower(fields[2]),
+			Protocol:  strings.ToLower(fields[4]),
+		}
+		if len(entry.Protocol) == 0 {
+			entry.Protocol = "tcp"
+		}
+		// the shell version fails if any field is empty.
+		if len(fields[0]) == 0 || len(entry.Name) == 0 || len(entry.Namespace) == 0 || len(fields[3]) == 0 {
+			errs = append(errs, LegacyError{Line: n, Text: text, Err: "should be in format listenPort: name.namespace:port:protocol"})
+			continue
+		}
+		var err error
+		if entry.ListenPort, err = parseLegacyPort(fields[0]); err != nil {
+			errs = append(errs, LegacyError{Line: n, Text: text, Err: "invalid listen port: " + err.Error()})
+			continue
+		}
+		if entry.Port, err = parseLegacyPort(fields[3]); err != nil {
+			errs = append(errs, LegacyError{Line: n, Text: text, Err: "invalid service port: " + err.Error()})
+			continue
+		}
+		switch entry.Protocol {
+		case "tcp", "udp", "http", "https":
+		default:
+			errs = append(errs, LegacyError{Line: n, Text: text, Err: fmt.Sprintf("unsupported protocol %q, should be one of tcp, udp, http and https", entry.Protocol)})
+			continue
+		}
+		key := fmt.Sprintf("%s.%s:%d/%s", entry.Name, entry.Namespace, entry.Port, entry.K8sProtocol())
+		if prev, ok := ports[key]; ok {
+			if prev.ListenPort != entry.ListenPort {
+				errs = append(errs, LegacyError{Line: n, Text: text, Err: fmt.Sprintf("service port %d/%s is already mapped to listen port %d on line %d",
+					entry.Port, entry.K8sProtocol(), prev.ListenPort, prev.Line)})
+			}
+			continue
+		}
+		ports[key] = entry
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, LegacyError{Err: err.Error()})
+	}
+	return entries, errs
+}
+
+// legacyFields is the number of the fields used by the shell version.
+const legacyFields = 5
+
+// splitLegacyFields splits the line the same as awk -F '[.|:|/]': every one of
+// ".", "|", ":" and "/" is a separator, the empty fields are kept. It always
+// returns the first 5 fields, the missing fields are empty and the extra fields
+// are ignored.
+func splitLegacyFields(line string) []string {
+	fields := strings.Split(strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '|', ':', '/':
+			return '.'
+		}
+		return r
+	}, line), ".")
+	for len(fields) < legacyFields {
+		fields = append(fields, "")
+	}
+	return fields[:legacyFields]
+}
+
+func parseLegacyPort(s string) (int32, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%d is not between 1 and 65535", port)
+	}
+	return int32(port), nil
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLegacyArchivedConf(t *testing.T) {
+	// the example config shipped with the archived shell version.
+	file, err := os.Open("../../archived/k8s-loadbalancer.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	entries, errs := ParseLegacy(file)
+	if len(errs) != 0 {
+		t.Fatalf("ParseLegacy() errors = %v", errs)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("ParseLegacy() returns %d entries, want 10", len(entries))
+	}
+	want := []LegacyEntry{
+		{ListenPort: 80, Name: "iot-k01-kong-proxy", Namespace: "yeiot", Port: 80, Protocol: "http"},
+		{ListenPort: 443, Name: "iot-k01-kong-proxy", Namespace: "yeiot", Port: 443, Protocol: "tcp"},
+		{ListenPort: 5883, Name: "iot-s03-coap-adp", Namespace: "yeiot", Port: 5883, Protocol: "udp"},
+	}
+	for _, w := range want {
+		var found bool
+		for _, e := range entries {
+			e.Line, e.Text = 0, ""
+			if e == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("entry %s is not parsed", w)
+		}
+	}
+}
+
+func TestParseLegacyFields(t *testing.T) {
+	tests := []struct {
+		line  string
+		entry string
+		err   string
+	}{
+		// the format in the archived parseConfig.sh.
+		{line: `53: kube-dns.kube-system:53`, entry: "53: kube-dns.kube-system:53:tcp"},
+		{line: `  "9000":  'example-go/default':8080  `, entry: "9000: example-go.default:8080:tcp"},
+		{line: `53: kube-dns.kube-system:53|udp`, entry: "53: kube-dns.kube-system:53:udp"},
+		{line: `8443/gitea.gitea/22/TCP`, entry: "8443: gitea.gitea:22:tcp"},
+		{line: `80: Web.Default:80:`, entry: "80: web.default:80:tcp"},
+		// awk ignores the fields after the fifth.
+		{line: `80: web.default:80:http:extra`, entry: "80: web.default:80:http"},
+		// awk keeps the empty fields, so the fields are not shifted.
+		{line: `80:: web.default:80`, err: "should be in format"},
+		{line: `80: web..default:80`, err: "should be in format"},
+		{line: `80: web.default`, err: "should be in format"},
+		{line: `80: web.default:80:sctp`, err: "unsupported protocol"},
+		{line: `http: web.default:80`, err: "invalid listen port"},
+	}
+	for _, tt := range tests {
+		entries, errs := ParseLegacy(strings.NewReader(tt.line))
+		if len(tt.err) != 0 {
+			if len(errs) != 1 || !strings.Contains(errs[0].Err, tt.err) {
+				t.Errorf("ParseLegacy(%q) errors = %v, want %q", tt.line, errs, tt.err)
+			}
+			continue
+		}
+		if len(errs) != 0 || len(entries) != 1 {
+			t.Errorf("ParseLegacy(%q) = %v, %v", tt.line, entries, errs)
+			continue
+		}
+		if got := entries[0].String(); got != tt.entry {
+			t.Errorf("ParseLegacy(%q) = %q, want %q", tt.line, got, tt.entry)
+		}
+	}
+}
+
+func TestParseLegacyDuplicatePort(t *testing.T) {
+	conf := `# the same k8s service port mapped to two listen ports.
+80:   web.default:80:http
+8080: web.default:80:tcp
+80:   web.default:80
+53:   kube-dns.kube-system:53:udp
+53:   kube-dns.kube-system:53:tcp
+`
+	entries, errs := ParseLegacy(strings.NewReader(conf))
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.String())
+	}
+	want := []string{"80: web.default:80:http", "53: kube-dns.kube-system:53:udp", "53: kube-dns.kube-system:53:tcp"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+	if len(errs) != 1 || errs[0].Line != 3 || !strings.Contains(errs[0].Err, "already mapped to listen port 80 on line 2") {
+		t.Errorf("errors = %v, want the line 3 reported", errs)
+	}
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+)
+
+// InScope returns true if the k8s services in the namespace are watched by the
+// controller: the namespace is in --namespaces (empty means all namespaces) and
+// not in --exclude-namespaces.
+func InScope(namespace string) bool {
+	for _, ns := range args.GetExcludeNamespaces() {
+		if ns == namespace {
+			return false
+		}
+	}
+	namespaces := args.GetNamespaces()
+	if len(namespaces) == 0 {
+		return true
+	}
+	for _, ns := range namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
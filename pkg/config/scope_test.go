@@ -0,0 +1,37 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+)
+
+func TestInScope(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []string
+		exclude    []string
+		in         []string
+		out        []string
+	}{
+		{name: "all namespaces", in: []string{"default", "kube-system"}},
+		{name: "include", namespaces: []string{"tenant-a"}, in: []string{"tenant-a"}, out: []string{"default", "tenant-b"}},
+		{name: "exclude without include", exclude: []string{"kube-system"}, in: []string{"default", "tenant-a"}, out: []string{"kube-system"}},
+		{name: "include and exclude", namespaces: []string{"tenant-a", "tenant-b"}, exclude: []string{"tenant-b"},
+			in: []string{"tenant-a"}, out: []string{"tenant-b", "default"}},
+	}
+	t.Cleanup(func() { args.NewBuilder().SetNamespaces(nil).SetExcludeNamespaces(nil) })
+	for _, tt := range tests {
+		args.NewBuilder().SetNamespaces(tt.namespaces).SetExcludeNamespaces(tt.exclude)
+		for _, ns := range tt.in {
+			if !InScope(ns) {
+				t.Errorf("%s: InScope(%s) = false, want true", tt.name, ns)
+			}
+		}
+		for _, ns := range tt.out {
+			if InScope(ns) {
+				t.Errorf("%s: InScope(%s) = true, want false", tt.name, ns)
+			}
+		}
+	}
+}
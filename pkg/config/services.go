@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ServiceConfig selects the k8s service explicitly. The selected k8s service is
+// load balanced without the annotation "loadbalancer=enabled", but its type
+// must still be LoadBalancer.
+type ServiceConfig struct {
+	// Cluster is the name of the cluster in --kubeconfig, empty means the
+	// k8s service in any cluster.
+	Cluster   string `json:"cluster,omitempty"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Ports is the k8s service ports load balanced, all the ports are load
+	// balanced if it's empty.
+	Ports []ServicePortConfig `json:"ports,omitempty"`
+}
+
+// ServicePortConfig is a k8s service port load balanced.
+type ServicePortConfig struct {
+	// Port is the k8s service port, spec.ports[].port.
+	Port int32 `json:"port"`
+	// Protocol is the k8s service port protocol, TCP or UDP, default to TCP.
+	Protocol string `json:"protocol,omitempty"`
+	// ListenPort is the nginx listen port, default to Port. It takes precedence
+	// over the annotation "nginx-listen-port".
+	ListenPort int32 `json:"listenPort,omitempty"`
+}
+
+var (
+	servicesLocker sync.RWMutex
+	// services is the k8s services selected by the config file, key is cluster/namespace/name.
+	services = make(map[string]ServiceConfig)
+)
+
+// validateServices validates the k8s services selected by the config file,
+// the protocols are normalized to upper case.
+func validateServices(list []ServiceConfig) error {
+	seen := make(map[string]bool)
+	for i := range list {
+		svc := &list[i]
+		if len(svc.Namespace) == 0 || len(svc.Name) == 0 {
+			return fmt.Errorf("services[%d]: namespace and name are required", i)
+		}
+		key := svc.Cluster + "/" + svc.Namespace + "/" + svc.Name
+		if seen[key] {
+			return fmt.Errorf("services[%d]: duplicate service %s", i, strings.TrimPrefix(key, "/"))
+		}
+		seen[key] = true
+		ports := make(map[string]bool)
+		for j := range svc.Ports {
+			port := &svc.Ports[j]
+			if len(port.Protocol) == 0 {
+				port.Protocol = string(corev1.ProtocolTCP)
+			}
+			port.Protocol = strings.ToUpper(port.Protocol)
+			if port.Protocol != string(corev1.ProtocolTCP) && port.Protocol != string(corev1.ProtocolUDP) {
+				return fmt.Errorf("services[%d].ports[%d]: invalid protocol %q, should be TCP or UDP", i, j, port.Protocol)
+			}
+			if port.Port < 1 || port.Port > 65535 {
+				return fmt.Errorf("services[%d].ports[%d]: port must be between 1 and 65535, got %d", i, j, port.Port)
+			}
+			if port.ListenPort != 0 && (port.ListenPort < 1 || port.ListenPort > 65535) {
+				return fmt.Errorf("services[%d].ports[%d]: listenPort must be between 1 and 65535, got %d", i, j, port.ListenPort)
+			}
+			portKey := fmt.Sprintf("%d/%s", port.Port, port.Protocol)
+			if ports[portKey] {
+				return fmt.Errorf("services[%d].ports[%d]: duplicate port %s", i, j, portKey)
+			}
+			ports[portKey] = true
+		}
+	}
+	return nil
+}
+
+// SetServices replaces the k8s services selected by the config file. The k8s
+// services out of the scope are never watched, they're logged.
+func SetServices(list []ServiceConfig) {
+	servicesLocker.Lock()
+	defer servicesLocker.Unlock()
+	services = make(map[string]ServiceConfig)
+	for _, svc := range list {
+		if len(svc.Cluster) != 0 && !hasCluster(svc.Cluster) {
+			logrus.Warnf("service %s/%s selected by the config file is in cluster %q not in --kubeconfig", svc.Namespace, svc.Name, svc.Cluster)
+		}
+		if !InScope(svc.Namespace) {
+			logrus.Warnf("service %s/%s selected by the config file is out of the scope, namespace %q is not watched", svc.Namespace, svc.Name, svc.Namespace)
+		}
+		services[svc.Cluster+"/"+svc.Namespace+"/"+svc.Name] = svc
+	}
+}
+
+// LookupService returns the config of the k8s service if it's selected by the config
+// file, the config of the cluster takes precedence over the one without cluster.
+func LookupService(cluster, namespace, name string) (ServiceConfig, bool) {
+	servicesLocker.RLock()
+	defer servicesLocker.RUnlock()
+	if svc, ok := services[cluster+"/"+namespace+"/"+name]; ok {
+		return svc, ok
+	}
+	svc, ok := services["/"+namespace+"/"+name]
+	return svc, ok
+}
+
+// Port returns the config of the k8s service port, ok is true if the port is
+// load balanced. All the ports are load balanced if no port is specified.
+func (s ServiceConfig) Port(port int32, protocol string) (ServicePortConfig, bool) {
+	if len(s.Ports) == 0 {
+		return ServicePortConfig{Port: port, Protocol: protocol}, true
+	}
+	for _, p := range s.Ports {
+		if p.Port == port && strings.EqualFold(p.Protocol, protocol) {
+			return p, true
+		}
+	}
+	return ServicePortConfig{}, false
+}
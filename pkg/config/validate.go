@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/firewall"
+	"github.com/forbearing/k8s-loadbalancer/pkg/healthcheck"
+	"github.com/forbearing/k8s-loadbalancer/pkg/keepalived"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/forbearing/k8s-loadbalancer/pkg/shard"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Validate validates the whole configuration in the args, all the invalid settings
+// are reported together, every one with the flag name and where its value comes from.
+// The args are validated before they're published, the args in effect are untouched.
+func Validate(a *args.Args) error {
+	var errs []string
+	invalid := func(flag, format string, v ...interface{}) {
+		errs = append(errs, fmt.Sprintf("%s: %s", Describe(flag), fmt.Sprintf(format, v...)))
+	}
+	oneOf := func(flag, val string, valid ...string) {
+		for _, v := range valid {
+			if val == v {
+				return
+			}
+		}
+		invalid(flag, "invalid value %q, should be one of %s", val, strings.Join(valid, ", "))
+	}
+
+	if p := a.GetPort(); p < 1 || p > 65535 {
+		invalid("port", "must be between 1 and 65535, got %d", p)
+	}
+	if a.GetBindAddress() == nil {
+		invalid("bind-address", "must be a ip address")
+	}
+	if addr := a.GetDebugAddress(); len(addr) != 0 {
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			invalid("debug-address", "%s", err.Error())
+		} else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			invalid("debug-address", "invalid port %q", port)
+		}
+	}
+	clusters, err := parseKubeconfig(a.GetKubeconfig())
+	if err != nil {
+		invalid("kubeconfig", "%s", err.Error())
+	} else {
+		if err := setClusterIDs(clusters, a.GetClusterID()); err != nil {
+			invalid("cluster-id", "%s", err.Error())
+		}
+		if _, err := coordinationCluster(clusters, a.GetCoordinationCluster()); err != nil {
+			invalid("coordination-cluster", "%s", err.Error())
+		}
+	}
+	for _, host := range a.GetUpstream() {
+		items := strings.SplitN(host, "=", 2)
+		if len(items) != 2 {
+			continue
+		}
+		if _, ok := findCluster(clusters, items[0]); !ok {
+			invalid("upstream", "%q: cluster %q is not in --kubeconfig", host, items[0])
+		}
+	}
+	if a.GetNumWorker() <= 0 {
+		invalid("worker", "must be greater than 0, got %d", a.GetNumWorker())
+	}
+	oneOf("log-level", strings.ToUpper(a.GetLogLevel()), "ERROR", "WARNING", "WARN", "INFO", "DEBUG", "TRACE")
+	oneOf("log-format", strings.ToUpper(a.GetLogFormat()), "TEXT", "JSON")
+
+	if len(a.GetUpstreamFailTimeout()) != 0 && !nginx.IsValidTime(a.GetUpstreamFailTimeout()) {
+		invalid("upstream-fail-timeout", "invalid nginx time %q", a.GetUpstreamFailTimeout())
+	}
+	if _, err := labels.Parse(a.GetUpstreamNodeSelector()); err != nil {
+		invalid("upstream-node-selector", "%s", err.Error())
+	}
+
+	oneOf("health-check", a.GetHealthCheckMode(), string(healthcheck.ModeNone), string(healthcheck.ModeTCP), string(healthcheck.ModeHTTP))
+	if a.GetHealthCheckInterval() <= 0 {
+		invalid("health-check-interval", "must be greater than 0")
+	}
+	if a.GetHealthCheckTimeout() <= 0 {
+		invalid("health-check-timeout", "must be greater than 0")
+	}
+	if a.GetHealthCheckRise() <= 0 {
+		invalid("health-check-rise", "must be greater than 0")
+	}
+	if a.GetHealthCheckFall() <= 0 {
+		invalid("health-check-fall", "must be greater than 0")
+	}
+
+	if len(a.GetNginxDir()) == 0 {
+		invalid("nginx-dir", "must not be empty")
+	}
+	oneOf("nginx-process-manager", a.GetNginxProcessManager(), string(nginx.ProcessManagerSystemd), string(nginx.ProcessManagerSupervisor))
+	oneOf("nginx-conf-mode", a.GetNginxConfMode(), string(nginx.NginxConfModeManaged), string(nginx.NginxConfModeUnmanaged))
+	if cm := a.GetNginxConfConfigMap(); len(cm) != 0 && len(strings.SplitN(cm, "/", 2)) != 2 {
+		invalid("nginx-conf-configmap", "should be in format namespace/name, got %q", cm)
+	}
+
+	if a.GetEnableFirewall() {
+		oneOf("firewall-backend", a.GetFirewallBackend(), string(firewall.BackendAuto), string(firewall.BackendNftables), string(firewall.BackendFirewalld), string(firewall.BackendUFW))
+	}
+	if len(a.GetVIPInterface()) != 0 {
+		if _, err := net.InterfaceByName(a.GetVIPInterface()); err != nil {
+			invalid("vip-interface", "%s", err.Error())
+		}
+	}
+	if a.GetAnnounceInterval() < 0 {
+		invalid("announce-interval", "must not be negative")
+	}
+	if err := keepalived.Validate(a); err != nil {
+		invalid("keepalived", "%s", err.Error())
+	}
+	if a.GetKeepalived() && len(a.GetVIPInterface()) != 0 {
+		invalid("keepalived", "--vip-interface and --keepalived are mutually exclusive, the VIPs are managed by keepalived")
+	}
+
+	for _, flag := range []string{"namespaces", "exclude-namespaces"} {
+		namespaces := a.GetNamespaces()
+		if flag == "exclude-namespaces" {
+			namespaces = a.GetExcludeNamespaces()
+		}
+		for _, ns := range namespaces {
+			if msgs := validation.IsDNS1123Label(ns); len(msgs) != 0 {
+				invalid(flag, "invalid namespace %q: %s", ns, strings.Join(msgs, ", "))
+			}
+		}
+	}
+	for _, ns := range a.GetExcludeNamespaces() {
+		for _, allowed := range a.GetNamespaces() {
+			if ns == allowed {
+				invalid("exclude-namespaces", "namespace %q is also in --namespaces", ns)
+			}
+		}
+	}
+	if _, err := labels.Parse(a.GetServiceSelector()); err != nil {
+		invalid("service-selector", "%s", err.Error())
+	}
+	if err := shard.Validate(a); err != nil {
+		invalid("shard", "%s", err.Error())
+	}
+	// the member Lease of the dry-run instance would take the k8s services from the others.
+	if a.GetDryRun() && a.GetShard() {
+		invalid("shard", "can't be used with --dry-run")
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("%d invalid settings: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Watch polls the config file every interval until stopCh closed, onChange is
+// called when the file content changed. The invalid config is logged and
+// ignored, the last valid config keeps working.
+func Watch(stopCh <-chan struct{}, file string, interval time.Duration, onChange func()) {
+	last, err := ioutil.ReadFile(file)
+	if err != nil {
+		logrus.Warnf("read config file %s failed: %s", file, err.Error())
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			logrus.Warnf("read config file %s failed: %s", file, err.Error())
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+		if _, err := Parse(data); err != nil {
+			logrus.Errorf("config file %s changed but invalid, ignored: %s", file, err.Error())
+			continue
+		}
+		logrus.Infof("config file %s changed", file)
+		onChange()
+	}
+}
@@ -0,0 +1,287 @@
+package controller
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/forbearing/k8s/util/annotations"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// The annotations used to tune the nginx config generated for the k8s service.
+const (
+	// AnnotationProxyTimeout is the timeout between two successive read or write operations,
+	// stream "proxy_timeout" and http "proxy_read_timeout"/"proxy_send_timeout", eg: 1h.
+	AnnotationProxyTimeout = "loadbalancer/proxy-timeout"
+	// AnnotationProxyConnectTimeout is the timeout for establishing a connection with the upstream, eg: 5s.
+	AnnotationProxyConnectTimeout = "loadbalancer/proxy-connect-timeout"
+	// AnnotationProxyReadTimeout is the http "proxy_read_timeout", overrides AnnotationProxyTimeout.
+	AnnotationProxyReadTimeout = "loadbalancer/proxy-read-timeout"
+	// AnnotationProxySendTimeout is the http "proxy_send_timeout", overrides AnnotationProxyTimeout.
+	AnnotationProxySendTimeout = "loadbalancer/proxy-send-timeout"
+	// AnnotationBufferSize is the size of the buffer used for reading the data from the upstream, eg: 16k.
+	AnnotationBufferSize = "loadbalancer/buffer-size"
+	// AnnotationClientMaxBodySize is the http maximum allowed size of the client request body, eg: 1m.
+	AnnotationClientMaxBodySize = "loadbalancer/client-max-body-size"
+	// AnnotationMaxConns limits the maximum number of simultaneous connections to every upstream server.
+	AnnotationMaxConns = "loadbalancer/max-conns"
+	// AnnotationMaxFails is the number of unsuccessful attempts to consider a upstream server unavailable.
+	AnnotationMaxFails = "loadbalancer/max-fails"
+	// AnnotationFailTimeout is the time during which AnnotationMaxFails attempts should happen,
+	// and the time the upstream server will be considered unavailable, eg: 10s.
+	AnnotationFailTimeout = "loadbalancer/fail-timeout"
+	// AnnotationProxyResponses is the number of datagrams expected from the upstream in response to a udp datagram.
+	AnnotationProxyResponses = "loadbalancer/proxy-responses"
+	// AnnotationProxyNextUpstream is "on", "off" or the http conditions passing a request
+	// to the next upstream server, eg: "error timeout http_502".
+	AnnotationProxyNextUpstream = "loadbalancer/proxy-next-upstream"
+	// AnnotationProxyNextUpstreamTries limits the number of tries passing a request to the next upstream server.
+	AnnotationProxyNextUpstreamTries = "loadbalancer/proxy-next-upstream-tries"
+	// AnnotationProxyNextUpstreamTimeout limits the time passing a request to the next upstream server, eg: 10s.
+	AnnotationProxyNextUpstreamTimeout = "loadbalancer/proxy-next-upstream-timeout"
+	// AnnotationBackendProtocol is the protocol nginx proxies the TCP ports of the k8s service as,
+	// "TCP", "HTTP" or "HTTPS", it overrides the appProtocol of the ports.
+	AnnotationBackendProtocol = "loadbalancer/backend-protocol"
+	// AnnotationSSLCertificate and AnnotationSSLCertificateKey are the absolute paths of the
+	// certificate and key files on the nginx host used by the HTTPS ports.
+	AnnotationSSLCertificate    = "loadbalancer/ssl-certificate"
+	AnnotationSSLCertificateKey = "loadbalancer/ssl-certificate-key"
+	// AnnotationIP is the ip address nginx listen to for the k8s service, overrides spec.loadBalancerIP.
+	AnnotationIP = "loadbalancer/ip"
+	// AnnotationIPPool is the name of the ip pool the k8s service address allocated from.
+	AnnotationIPPool = "loadbalancer/ip-pool"
+	// AnnotationAllocatedIP is the ip address allocated to the k8s service from the ip pool,
+	// it's set by the controller.
+	AnnotationAllocatedIP = "loadbalancer/allocated-ip"
+)
+
+// The annotations or labels of the k8s node used to set the upstream parameters
+// of the node, they override the parameters specified by k8s service and arguments.
+const (
+	AnnotationUpstreamWeight      = "loadbalancer/upstream-weight"
+	AnnotationUpstreamMaxFails    = "loadbalancer/upstream-max-fails"
+	AnnotationUpstreamFailTimeout = "loadbalancer/upstream-fail-timeout"
+	AnnotationUpstreamMaxConns    = "loadbalancer/upstream-max-conns"
+	AnnotationUpstreamBackup      = "loadbalancer/upstream-backup"
+)
+
+// httpNextUpstreamConditions is the conditions supported by http "proxy_next_upstream".
+var httpNextUpstreamConditions = map[string]bool{
+	"error": true, "timeout": true, "invalid_header": true, "non_idempotent": true,
+	"http_500": true, "http_502": true, "http_503": true, "http_504": true,
+	"http_403": true, "http_404": true, "http_429": true,
+}
+
+// annotationParser parses and validates the annotation values,
+// the invalid value is ignored and recorded in errs.
+type annotationParser struct {
+	get  func(key string) string
+	errs []error
+}
+
+func (p *annotationParser) time(key string, field *string) {
+	val := p.get(key)
+	if len(val) == 0 {
+		return
+	}
+	if !nginx.IsValidTime(val) {
+		p.errs = append(p.errs, fmt.Errorf(`invalid annotation "%s: %s", should be a nginx time, eg: 30s, 1m, 1h`, key, val))
+		return
+	}
+	*field = val
+}
+
+func (p *annotationParser) size(key string, field *string) {
+	val := p.get(key)
+	if len(val) == 0 {
+		return
+	}
+	if !nginx.IsValidSize(val) {
+		p.errs = append(p.errs, fmt.Errorf(`invalid annotation "%s: %s", should be a nginx size, eg: 16k, 1m, 1g`, key, val))
+		return
+	}
+	*field = val
+}
+
+// int parses the non-negative integer, returns true if the value is set and valid.
+func (p *annotationParser) int(key string, field *int) bool {
+	val := p.get(key)
+	if len(val) == 0 {
+		return false
+	}
+	num, err := strconv.Atoi(val)
+	if err != nil || num < 0 {
+		p.errs = append(p.errs, fmt.Errorf(`invalid annotation "%s: %s", should be a non-negative integer`, key, val))
+		return false
+	}
+	*field = num
+	return true
+}
+
+// intPtr is the same as int, but set the field only if the value is set and valid.
+func (p *annotationParser) intPtr(key string, field **int) {
+	var num int
+	if p.int(key, &num) {
+		*field = &num
+	}
+}
+
+func (p *annotationParser) bool(key string, field *bool) {
+	val := p.get(key)
+	if len(val) == 0 {
+		return
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		p.errs = append(p.errs, fmt.Errorf(`invalid annotation "%s: %s", should be "true" or "false"`, key, val))
+		return
+	}
+	*field = b
+}
+
+func (p *annotationParser) path(key string, field *string) {
+	val := p.get(key)
+	if len(val) == 0 {
+		return
+	}
+	if !filepath.IsAbs(val) || strings.ContainsAny(val, " \t\n;{}") {
+		p.errs = append(p.errs, fmt.Errorf(`invalid annotation "%s: %s", should be an absolute file path`, key, val))
+		return
+	}
+	*field = val
+}
+
+func (p *annotationParser) nextUpstream(key string, field *string) {
+	val := strings.Join(strings.Fields(p.get(key)), " ")
+	if len(val) == 0 {
+		return
+	}
+	if val != "on" && val != "off" {
+		for _, cond := range strings.Fields(val) {
+			if !httpNextUpstreamConditions[cond] {
+				p.errs = append(p.errs, fmt.Errorf(`invalid annotation "%s: %s", should be "on", "off" or the http conditions, eg: "error timeout http_502"`, key, val))
+				return
+			}
+		}
+	}
+	*field = val
+}
+
+func (p *annotationParser) err() error {
+	return utilerrors.NewAggregate(p.errs)
+}
+
+// parseTuning parses the tuning annotations of the k8s service object.
+// The invalid annotation value is ignored and reported in the returned error.
+func parseTuning(obj runtime.Object) (nginx.ServiceTuning, error) {
+	var tuning nginx.ServiceTuning
+	p := &annotationParser{get: func(key string) string { return annotations.Get(obj, key) }}
+
+	p.time(AnnotationProxyTimeout, &tuning.ProxyTimeout)
+	p.time(AnnotationProxyConnectTimeout, &tuning.ProxyConnectTimeout)
+	p.time(AnnotationProxyReadTimeout, &tuning.ProxyReadTimeout)
+	p.time(AnnotationProxySendTimeout, &tuning.ProxySendTimeout)
+	p.size(AnnotationBufferSize, &tuning.BufferSize)
+	p.size(AnnotationClientMaxBodySize, &tuning.ClientMaxBodySize)
+	p.int(AnnotationMaxConns, &tuning.MaxConns)
+	p.intPtr(AnnotationMaxFails, &tuning.MaxFails)
+	p.time(AnnotationFailTimeout, &tuning.FailTimeout)
+	p.intPtr(AnnotationProxyResponses, &tuning.ProxyResponses)
+	p.nextUpstream(AnnotationProxyNextUpstream, &tuning.ProxyNextUpstream)
+	p.int(AnnotationProxyNextUpstreamTries, &tuning.ProxyNextUpstreamTries)
+	p.time(AnnotationProxyNextUpstreamTimeout, &tuning.ProxyNextUpstreamTimeout)
+	p.path(AnnotationSSLCertificate, &tuning.SSLCertificate)
+	p.path(AnnotationSSLCertificateKey, &tuning.SSLCertificateKey)
+
+	return tuning, p.err()
+}
+
+// httpAnnotations is the annotations only used by the ports proxied as HTTP or HTTPS.
+var httpAnnotations = []string{
+	AnnotationProxyReadTimeout,
+	AnnotationProxySendTimeout,
+	AnnotationClientMaxBodySize,
+	AnnotationSSLCertificate,
+	AnnotationSSLCertificateKey,
+}
+
+// validateHTTPAnnotations returns error if the k8s service has the annotations
+// only used by HTTP or HTTPS, but none of its ports is proxied as HTTP or HTTPS.
+func validateHTTPAnnotations(svc *corev1.Service) error {
+	for _, port := range svc.Spec.Ports {
+		if protocol := proxyProtocol(svc, port); protocol == nginx.ProtocolHTTP || protocol == nginx.ProtocolHTTPS {
+			return nil
+		}
+	}
+	var keys []string
+	for _, key := range httpAnnotations {
+		if _, ok := svc.Annotations[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return fmt.Errorf(`annotations %s are ignored, no port is proxied as HTTP or HTTPS, set the port appProtocol or annotation "%s"`,
+		strings.Join(keys, ", "), AnnotationBackendProtocol)
+}
+
+// parseBackendProtocol parses the annotation "loadbalancer/backend-protocol",
+// it returns empty if the annotation not specified or invalid.
+func parseBackendProtocol(svc *corev1.Service) (nginx.Protocol, error) {
+	val := strings.TrimSpace(svc.Annotations[AnnotationBackendProtocol])
+	if len(val) == 0 {
+		return "", nil
+	}
+	switch protocol := nginx.Protocol(strings.ToUpper(val)); protocol {
+	case nginx.ProtocolTCP, nginx.ProtocolHTTP, nginx.ProtocolHTTPS:
+		return protocol, nil
+	}
+	return "", fmt.Errorf(`invalid annotation "%s: %s", should be "TCP", "HTTP" or "HTTPS"`, AnnotationBackendProtocol, val)
+}
+
+// proxyProtocol returns the protocol nginx proxies the k8s service port as. The
+// UDP and SCTP ports are proxied as is, the TCP ports are proxied as the annotation
+// "loadbalancer/backend-protocol", or the appProtocol "http" and "https".
+func proxyProtocol(svc *corev1.Service, port corev1.ServicePort) nginx.Protocol {
+	if len(port.Protocol) != 0 && port.Protocol != corev1.ProtocolTCP {
+		return nginx.Protocol(port.Protocol)
+	}
+	if protocol, _ := parseBackendProtocol(svc); len(protocol) != 0 {
+		return protocol
+	}
+	if port.AppProtocol != nil {
+		switch strings.ToLower(*port.AppProtocol) {
+		case "http":
+			return nginx.ProtocolHTTP
+		case "https":
+			return nginx.ProtocolHTTPS
+		}
+	}
+	return nginx.ProtocolTCP
+}
+
+// parseNodeUpstreamParams parses the upstream parameters from the k8s node
+// annotations or labels, the annotation takes precedence over the label.
+func parseNodeUpstreamParams(annotations, labels map[string]string) (nginx.UpstreamParams, error) {
+	var params nginx.UpstreamParams
+	p := &annotationParser{get: func(key string) string {
+		if val, ok := annotations[key]; ok {
+			return val
+		}
+		return labels[key]
+	}}
+
+	p.int(AnnotationUpstreamWeight, &params.Weight)
+	p.intPtr(AnnotationUpstreamMaxFails, &params.MaxFails)
+	p.time(AnnotationUpstreamFailTimeout, &params.FailTimeout)
+	p.int(AnnotationUpstreamMaxConns, &params.MaxConns)
+	p.bool(AnnotationUpstreamBackup, &params.Backup)
+
+	return params, p.err()
+}
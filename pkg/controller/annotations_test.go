@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	appProtocol := func(s string) *string { return &s }
+	tests := []struct {
+		name       string
+		annotation string
+		port       corev1.ServicePort
+		want       nginx.Protocol
+	}{
+		{"tcp", "", corev1.ServicePort{Protocol: corev1.ProtocolTCP}, nginx.ProtocolTCP},
+		{"default protocol", "", corev1.ServicePort{}, nginx.ProtocolTCP},
+		{"udp", "", corev1.ServicePort{Protocol: corev1.ProtocolUDP}, nginx.ProtocolUDP},
+		{"appProtocol http", "", corev1.ServicePort{Protocol: corev1.ProtocolTCP, AppProtocol: appProtocol("http")}, nginx.ProtocolHTTP},
+		{"appProtocol HTTPS", "", corev1.ServicePort{Protocol: corev1.ProtocolTCP, AppProtocol: appProtocol("HTTPS")}, nginx.ProtocolHTTPS},
+		{"appProtocol unknown", "", corev1.ServicePort{Protocol: corev1.ProtocolTCP, AppProtocol: appProtocol("grpc")}, nginx.ProtocolTCP},
+		{"annotation http", "http", corev1.ServicePort{Protocol: corev1.ProtocolTCP}, nginx.ProtocolHTTP},
+		{"annotation overrides appProtocol", "tcp", corev1.ServicePort{Protocol: corev1.ProtocolTCP, AppProtocol: appProtocol("https")}, nginx.ProtocolTCP},
+		{"annotation ignored by udp", "https", corev1.ServicePort{Protocol: corev1.ProtocolUDP}, nginx.ProtocolUDP},
+		{"invalid annotation", "grpc", corev1.ServicePort{Protocol: corev1.ProtocolTCP, AppProtocol: appProtocol("http")}, nginx.ProtocolHTTP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+			if len(tt.annotation) != 0 {
+				svc.Annotations[AnnotationBackendProtocol] = tt.annotation
+			}
+			if got := proxyProtocol(svc, tt.port); got != tt.want {
+				t.Errorf("proxyProtocol() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBackendProtocolInvalid(t *testing.T) {
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationBackendProtocol: "grpc"}}}
+	if _, err := parseBackendProtocol(svc); err == nil {
+		t.Error("parseBackendProtocol() returns nil error for invalid protocol")
+	}
+}
+
+func TestTuningAnnotationsRendered(t *testing.T) {
+	dir := setupNginxDir(t, "10.0.0.1")
+
+	appProtocol := "http"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "api",
+			Annotations: map[string]string{
+				AnnotationClientMaxBodySize: "1m",
+				AnnotationProxyReadTimeout:  "30s",
+				AnnotationProxySendTimeout:  "40s",
+				AnnotationBufferSize:        "8k",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, NodePort: 30080, Protocol: corev1.ProtocolTCP, AppProtocol: &appProtocol},
+				{Name: "tcp", Port: 81, NodePort: 30081, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	if err := validateHTTPAnnotations(svc); err != nil {
+		t.Errorf("validateHTTPAnnotations() = %v, want nil", err)
+	}
+	nginxService := ConstructNginxService("", "abc", svc)
+	nginxService.Action = nginx.ActionTypeAdd
+	if err, _ := nginx.GenerateVirtualHostConf(nginxService); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file     string
+		contains []string
+	}{
+		{
+			file: "sites-enabled/http.default.api.http.abc",
+			contains: []string{
+				"client_max_body_size 1m;",
+				"proxy_read_timeout 30s;",
+				"proxy_send_timeout 40s;",
+				"proxy_buffer_size 8k;",
+			},
+		},
+		{
+			file:     "sites-stream/tcp.default.api.tcp.abc",
+			contains: []string{"proxy_buffer_size   8k;"},
+		},
+	}
+	for _, tt := range tests {
+		data, err := ioutil.ReadFile(filepath.Join(dir, tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range tt.contains {
+			if !strings.Contains(string(data), s) {
+				t.Errorf("%s does not contain %q:\n%s", tt.file, s, data)
+			}
+		}
+	}
+}
+
+func TestValidateHTTPAnnotations(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationClientMaxBodySize: "1m"}},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+	}
+	if err := validateHTTPAnnotations(svc); err == nil {
+		t.Error("validateHTTPAnnotations() returns nil for the http annotation on tcp port")
+	}
+	svc.Annotations[AnnotationBackendProtocol] = "HTTP"
+	if err := validateHTTPAnnotations(svc); err != nil {
+		t.Errorf("validateHTTPAnnotations() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var (
+	controllersLocker sync.RWMutex
+	// controllers is all the controllers created, one for every cluster in
+	// --kubeconfig. The nginx listen addresses, VIPs and firewall rules of the
+	// host are shared by all the clusters.
+	controllers []*Controller
+)
+
+// register adds the controller to the controllers sharing the host.
+func register(c *Controller) {
+	controllersLocker.Lock()
+	defer controllersLocker.Unlock()
+	controllers = append(controllers, c)
+}
+
+// allControllers returns the controllers of all the clusters.
+func allControllers() []*Controller {
+	controllersLocker.RLock()
+	defer controllersLocker.RUnlock()
+	return append([]*Controller{}, controllers...)
+}
+
+// synced returns true if the informer caches of the controller synced.
+func (c *Controller) synced() bool {
+	return atomic.LoadInt32(&c.cacheSynced) == 1
+}
+
+// serviceKey returns the key of the k8s service in format namespace/name, prefixed
+// with the cluster name if multiple clusters specified. It's used by the ip address
+// management and the sharding.
+func (c *Controller) serviceKey(namespace, name string) string {
+	if len(c.cluster) == 0 {
+		return namespace + "/" + name
+	}
+	return c.cluster + "/" + namespace + "/" + name
+}
+
+// enqueueAllClusters enqueues all the k8s services meet the condition in all the clusters.
+func enqueueAllClusters() {
+	for _, c := range allControllers() {
+		c.enqueueAll()
+	}
+}
+
+// getClusterID returns the identity of the cluster, it's empty before resolved.
+func (c *Controller) getClusterID() string {
+	return c.clusterID.Load().(string)
+}
+
+// resolveClusterID sets the cluster id to the uid of the kube-system namespace
+// if --cluster-id not specified, it's retried until stopCh closed.
+func (c *Controller) resolveClusterID(stopCh <-chan struct{}) error {
+	if len(c.getClusterID()) != 0 {
+		return nil
+	}
+	err := wait.PollImmediateUntil(5*time.Second, func() (bool, error) {
+		ns, err := c.serviceHandler.Clientset().CoreV1().Namespaces().Get(context.TODO(), metav1.NamespaceSystem, metav1.GetOptions{})
+		if err != nil {
+			logrus.Errorf("get the uid of namespace %s as the cluster id failed: %s", metav1.NamespaceSystem, err.Error())
+			return false, nil
+		}
+		c.clusterID.Store(string(ns.UID))
+		return true, nil
+	}, stopCh)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("cluster %q id is %s", c.cluster, c.getClusterID())
+	return nil
+}
+
+// pruneConfFiles removes the nginx config files generated for the cluster before
+// but not for any k8s service meeting the condition now, eg: the k8s services
+// deleted when the controller was not running. It's called before the workers
+// start, so the files are not generated concurrently.
+func (c *Controller) pruneConfFiles() {
+	keep := make(map[string]bool)
+	for _, svc := range c.listServices(logrus.WithField("event", "prune")) {
+		for _, file := range nginx.ConfigFiles(c.constructNginxService(svc)) {
+			keep[file] = true
+		}
+	}
+	n := &nginx.Nginx{Runtime: c.runtime}
+	for n.Prune(c.getClusterID(), c.cluster, keep) {
+	}
+	if err := n.Err(); err != nil {
+		logrus.Errorf("remove stale nginx config files failed: %s", err.Error())
+	}
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"sync"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/config"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// SetSelectedServices replaces the k8s services selected by the config file,
+// the nginx config of the k8s services added, removed or changed is regenerated.
+func SetSelectedServices(list []config.ServiceConfig) {
+	reselect(logrus.WithField("event", "config"), func() {
+		config.SetServices(list)
+	})
+}
+
+// selectionLocker makes the condition of the k8s services to be load balanced,
+// the k8s services selected by the config file and the shard members, unchanged
+// while a k8s service event is handled. The event handlers hold the read lock,
+// reselect holds the write lock until the changed k8s services enqueued, so an
+// event never sees the condition half changed.
+var selectionLocker sync.RWMutex
+
+// selection is the k8s services of a cluster meeting the condition before the
+// condition changed.
+type selection struct {
+	services []*corev1.Service
+	// before is the nginx.Service of every k8s service meeting the condition.
+	before map[string]*nginx.Service
+}
+
+// reselect calls change which changes the condition of the k8s services to be
+// load balanced, the nginx config of the k8s services of all the clusters meeting
+// the condition or not anymore, or whose nginx.Service changed, is regenerated.
+func reselect(logger *logrus.Entry, change func()) {
+	selectionLocker.Lock()
+	defer selectionLocker.Unlock()
+	// the k8s services are processed by Run if the informer caches not synced.
+	ctrls := allControllers()
+	selections := make([]*selection, len(ctrls))
+	for i, c := range ctrls {
+		selections[i] = c.snapshot(logger)
+	}
+	change()
+	for i, c := range ctrls {
+		if selections[i] != nil {
+			c.reconcileSelection(logger, selections[i])
+		}
+	}
+}
+
+// snapshot returns the k8s services meeting the condition now, it returns nil
+// if the informer caches not synced.
+func (c *Controller) snapshot(logger *logrus.Entry) *selection {
+	if !c.synced() {
+		return nil
+	}
+	services, err := c.serviceLister.List(labels.Everything())
+	if err != nil {
+		logrus.Errorf("list k8s services failed: %s", err.Error())
+		return nil
+	}
+	s := &selection{services: services, before: make(map[string]*nginx.Service)}
+	for _, svc := range services {
+		if c.isMeetCondition(logger, svc) {
+			s.before[c.serviceKey(svc.Namespace, svc.Name)] = c.constructNginxService(svc)
+		}
+	}
+	return s
+}
+
+// reconcileSelection regenerates the nginx config of the k8s services whose
+// condition or nginx.Service changed since the snapshot.
+func (c *Controller) reconcileSelection(logger *logrus.Entry, s *selection) {
+	for _, svc := range s.services {
+		key := c.serviceKey(svc.Namespace, svc.Name)
+		old, meetBefore := s.before[key]
+		meetNow := c.isMeetCondition(logger, svc)
+		var current *nginx.Service
+		if meetNow {
+			current = c.constructNginxService(svc)
+		}
+		if meetBefore && meetNow && nginxServiceEqual(old, current) {
+			continue
+		}
+		logger.WithField("service", key).Info("service selection changed, regenerate nginx config")
+		if meetBefore {
+			old.Action = nginx.ActionTypeDel
+			c.workqueue.Add(old)
+			defer c.enqueueConflicted(old)
+		}
+		if meetNow {
+			c.validateAnnotations(svc)
+			c.enqueueService(svc)
+		} else if meetBefore {
+			c.releaseAddress(key)
+		}
+	}
+}
+
+// RerenderAll regenerates the nginx config of all the k8s services of all the
+// clusters meeting the condition and reloads nginx only once, it's called after
+// the configuration reloaded. The k8s services losing the port conflict or
+// waiting for the ip address allocation are left to the workers. The clusters
+// whose informer caches not synced are skipped.
+func RerenderAll() error {
+	var services []*nginx.Service
+	var runtime nginx.Runtime
+	selectionLocker.RLock()
+	for _, c := range allControllers() {
+		if !c.synced() {
+			continue
+		}
+		runtime = c.runtime
+		for _, svc := range c.listServices(logrus.WithField("event", "reload")) {
+			if owner, _ := c.findPortConflict(svc); len(owner) != 0 {
+				continue
+			}
+			nginxService := c.constructNginxService(svc)
+			nginxService.Action = nginx.ActionTypeAdd
+			if ok, err := c.allocateAddress(nginxService); !ok || err != nil {
+				continue
+			}
+			services = append(services, nginxService)
+		}
+	}
+	selectionLocker.RUnlock()
+	if runtime == nil {
+		return nil
+	}
+	logrus.Infof("regenerate nginx config of %d k8s services", len(services))
+	return (&nginx.Nginx{Runtime: runtime}).DoAll(services)
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+func TestReselectBlocksEvents(t *testing.T) {
+	c := newTestController(t)
+	registerTestController(t, c)
+	t.Cleanup(func() { config.SetServices(nil) })
+
+	// the k8s service is load balanced only if it's selected by the config file.
+	svc := newTestService("default", "web", 80)
+	svc.Annotations = nil
+
+	changing, release, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		reselect(logrus.WithField("event", "test"), func() {
+			close(changing)
+			<-release
+			config.SetServices([]config.ServiceConfig{{Namespace: "default", Name: "web"}})
+		})
+	}()
+	<-changing
+	go func() {
+		c.addService(svc)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("the k8s service event is handled while the selection is changing")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the k8s service event is not handled after the selection changed")
+	}
+	// the event sees the new selection only.
+	if n := c.workqueue.Len(); n != 1 {
+		t.Errorf("workqueue length = %d, want 1", n)
+	}
+}
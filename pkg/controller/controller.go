@@ -4,15 +4,25 @@ import (
 	"fmt"
 	"reflect"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/forbearing/k8s-loadbalancer/pkg/announce"
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/config"
+	"github.com/forbearing/k8s-loadbalancer/pkg/firewall"
+	"github.com/forbearing/k8s-loadbalancer/pkg/healthcheck"
 	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/forbearing/k8s/node"
 	"github.com/forbearing/k8s/service"
 	"github.com/forbearing/k8s/util/annotations"
+	"github.com/forbearing/k8s/util/recorder"
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	corelisters "k8s.io/client-go/listers/core/v1"
@@ -26,6 +36,17 @@ const (
 	AnnotationNginxListenPort = "nginx-listen-port"
 )
 
+const controllerAgentName = "k8s-loadbalancer"
+
+// healthcheckOnce starts the active health checking once for all the clusters.
+var healthcheckOnce sync.Once
+
+const (
+	// EventReasonInvalidAnnotation is the reason of the event recorded when
+	// the k8s service has invalid annotation value.
+	EventReasonInvalidAnnotation = "InvalidAnnotation"
+)
+
 type QueueType string
 
 const (
@@ -34,29 +55,102 @@ const (
 )
 
 type Controller struct {
+	// cluster is the name of the cluster in --kubeconfig, empty if only one
+	// cluster specified without name.
+	cluster string
+	// clusterID is the identity of the cluster recorded in the generated nginx
+	// config files, it's resolved before the workers start.
+	clusterID atomic.Value
+
 	serviceHandler *service.Handler
 	serviceLister  corelisters.ServiceLister
 	serviceSynced  cache.InformerSynced
 
+	// nodeLister is nil if upstream hosts are not discovered from k8s nodes.
+	nodeLister     corelisters.NodeLister
+	nodeSynced     cache.InformerSynced
+	upstreamLocker sync.Mutex
+	upstreamHosts  []nginx.UpstreamHost
+	cacheSynced    int32
+
 	workqueue workqueue.RateLimitingInterface
 
+	// runtime manages the nginx daemon.
+	runtime nginx.Runtime
+	// firewall opens the nginx listen ports, nil if the firewall is disabled.
+	firewall firewall.Backend
+
 	recorder record.EventRecorder
 }
 
-func NewController(serviceHandler *service.Handler) *Controller {
+// NewController creates a loadbalancer controller for the cluster, one controller
+// is created for every cluster in --kubeconfig. The serviceHandlers are returned
+// by ServiceHandlers, the k8s services are list-and-watched by their informers.
+// The nodeHandler is used to discover upstream hosts from k8s nodes, it can be nil.
+// The runtime manages the nginx daemon, nginx.DefaultRuntime() is used if it's nil.
+// The fw opens the nginx listen ports in the host firewall, it can be nil.
+func NewController(cluster config.Cluster, serviceHandlers []*service.Handler, nodeHandler *node.Handler, runtime nginx.Runtime, fw firewall.Backend) *Controller {
+	if runtime == nil {
+		runtime = nginx.DefaultRuntime()
+	}
+	serviceHandler := serviceHandlers[0]
 	controller := &Controller{
+		cluster:        cluster.Name,
 		serviceHandler: serviceHandler,
 		serviceLister:  serviceHandler.Lister(),
 		serviceSynced:  serviceHandler.Informer().HasSynced,
 		workqueue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "loadbalancer"),
+		recorder:       recorder.New(serviceHandler.Clientset(), controllerAgentName),
+		runtime:        runtime,
+		firewall:       fw,
+	}
+	controller.clusterID.Store(cluster.ID)
+	// the events are dropped in dry-run mode, the k8s services are not touched.
+	if nginx.DryRun() {
+		controller.recorder = &record.FakeRecorder{}
+	}
+	// the controller is always the leader if the leader election is disabled,
+	// the leader election is not run in dry-run mode.
+	if !args.GetLeaderElect() || nginx.DryRun() {
+		atomic.StoreInt32(&leading, 1)
+	}
+	// the k8s services in every namespace are watched by its own informer.
+	if len(serviceHandlers) > 1 {
+		var listers multiServiceLister
+		var synced []cache.InformerSynced
+		for _, h := range serviceHandlers {
+			listers = append(listers, h.Lister())
+			synced = append(synced, h.Informer().HasSynced)
+		}
+		controller.serviceLister = listers
+		controller.serviceSynced = func() bool {
+			for _, hasSynced := range synced {
+				if !hasSynced() {
+					return false
+				}
+			}
+			return true
+		}
 	}
 
 	logrus.Info("Setting up event handlers")
-	serviceHandler.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    controller.addService,
-		UpdateFunc: controller.updateService,
-		DeleteFunc: controller.deleteService,
-	})
+	for _, h := range serviceHandlers {
+		h.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    controller.addService,
+			UpdateFunc: controller.updateService,
+			DeleteFunc: controller.deleteService,
+		})
+	}
+	register(controller)
+	if nodeHandler != nil {
+		controller.nodeLister = nodeHandler.Lister()
+		controller.nodeSynced = nodeHandler.Informer().HasSynced
+		nodeHandler.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    controller.addNode,
+			UpdateFunc: controller.updateNode,
+			DeleteFunc: controller.deleteNode,
+		})
+	}
 
 	return controller
 }
@@ -69,13 +163,55 @@ func (c *Controller) Run(workers int, stopCh <-chan struct{}) error {
 	logrus.Info("Starting loadbalancer controller")
 
 	logrus.Info("Waiting for informe cache to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.serviceSynced); !ok {
+	cacheSyncs := []cache.InformerSynced{c.serviceSynced}
+	if c.nodeSynced != nil {
+		cacheSyncs = append(cacheSyncs, c.nodeSynced)
+	}
+	if ok := cache.WaitForCacheSync(stopCh, cacheSyncs...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
+	if err := c.resolveClusterID(stopCh); err != nil {
+		return err
+	}
+	// the stale nginx config files left by last run are removed.
+	c.pruneConfFiles()
+	atomic.StoreInt32(&c.cacheSynced, 1)
+	// the k8s services of the other clusters synced before may conflict with
+	// the k8s services of this cluster, they are checked again.
+	for _, other := range allControllers() {
+		if other != c && other.synced() {
+			other.enqueueAll()
+		}
+	}
+	// discover the upstream hosts from k8s nodes before workers start.
+	c.syncUpstreamHosts()
+	// restore the ip addresses in use before workers start.
+	c.restoreAllocations()
+	// reconcile the VIPs, the stale VIPs left by last run are removed.
+	syncVIPs()
+	// the leadership may be acquired before the caches synced, the VIPs of
+	// the cluster are not announced until now.
+	if isLeading() {
+		announce.Reset()
+	}
+	// reconcile the firewall rules, the stale rules left by last run are removed.
+	// it's retried periodically if failed.
+	go wait.Until(syncFirewall, time.Minute, stopCh)
+	// the VIPs are applied only when changed, they're reconciled periodically.
+	go wait.Until(resyncVIPs, time.Minute, stopCh)
+	firewallOnce.Do(func() {
+		go runFirewallWorker(firewallQueue, syncFirewall, stopCh)
+	})
 
 	logrus.Info("Starting workers")
 	go wait.Until(c.runWorkers, time.Second, stopCh)
 
+	// the upstreams status changed by the active health checking will cause
+	// all the k8s services nginx config regenerated, it's shared by all the clusters.
+	healthcheckOnce.Do(func() {
+		go healthcheck.Run(stopCh, enqueueAllClusters)
+	})
+
 	logrus.Info("Started workers")
 	<-stopCh
 	logrus.Info("Shutting down workers")
@@ -101,6 +237,9 @@ func (c *Controller) processNextWorkItem() bool {
 		"namespace": nginxService.Namespace,
 		"name":      nginxService.Name,
 	})
+	if len(c.cluster) != 0 {
+		l = l.WithField("cluster", c.cluster)
+	}
 
 	err := func(obj interface{}) error {
 		defer c.workqueue.Done(obj)
@@ -109,6 +248,9 @@ func (c *Controller) processNextWorkItem() bool {
 		}
 		c.workqueue.Forget(obj)
 		l.Info("Successfully processed nginx config")
+		if c.firewall != nil {
+			queueFirewallSync()
+		}
 		return nil
 	}(obj)
 
@@ -163,27 +305,44 @@ func (c *Controller) processNginx(obj interface{}) error {
 	if !ok {
 		return fmt.Errorf("object type is not *nginx.Service")
 	}
-	n := &nginx.Nginx{}
+	// the k8s service may be enqueued before the cluster id resolved.
+	nginxService.ClusterID = c.getClusterID()
+	// the k8s service will be processed again after the ip address allocated.
+	if ok, err := c.allocateAddress(nginxService); !ok || err != nil {
+		return err
+	}
+	// the VIP must exist before nginx listen to it.
+	syncVIPs()
+	n := &nginx.Nginx{Runtime: c.runtime}
 	for n.Do(nginxService) {
 	}
-	return n.Err()
+	if err := n.Err(); err != nil {
+		return err
+	}
+	if err := c.updateServedBy(nginxService); err != nil {
+		return err
+	}
+	return c.updateStatus(nginxService)
 }
 
 // addService
 func (c *Controller) addService(obj interface{}) {
+	selectionLocker.RLock()
+	defer selectionLocker.RUnlock()
 	logger := logrus.WithField("event", "add")
-	nginxService := c.constructNginxService(obj)
 	// determine whether the service object is LoadBalancer type and have specified annotation.
 	// if not meet the condition, skip enqueue.
 	if c.isMeetCondition(logger, obj) {
+		c.validateAnnotations(obj)
 		// enqueue Service object containing the nginx configuration filename we shoud create
-		nginxService.Action = nginx.ActionTypeAdd
-		c.workqueue.Add(nginxService)
+		c.enqueueService(obj.(*corev1.Service))
 	}
 }
 
 // updateService
 func (c *Controller) updateService(oldObj, newObj interface{}) {
+	selectionLocker.RLock()
+	defer selectionLocker.RUnlock()
 	logger := logrus.WithField("event", "update")
 	// two different version of the same service object always have different ResourceVersion.
 	// if ResourceVersion is the same, skip enqueue.
@@ -197,8 +356,10 @@ func (c *Controller) updateService(oldObj, newObj interface{}) {
 	oldNginxService := c.constructNginxService(oldObj)
 	newNginxService := c.constructNginxService(newObj)
 
-	// if the old nginx.Service deep equal to the new nginx.Service, it's no need to enqueue
-	if reflect.DeepEqual(oldNginxService, newNginxService) {
+	// if the old nginx.Service deep equal to the new nginx.Service, it's no need to enqueue,
+	// unless the k8s service is assigned to another shard pool.
+	if nginxServiceEqual(oldNginxService, newNginxService) &&
+		oldSvc.Annotations[AnnotationPool] == newSvc.Annotations[AnnotationPool] {
 		return
 	}
 
@@ -210,19 +371,26 @@ func (c *Controller) updateService(oldObj, newObj interface{}) {
 		// enqueue Service object containing the nginx configuration filename we should remove
 		oldNginxService.Action = nginx.ActionTypeDel
 		c.workqueue.Add(oldNginxService)
+		// the old listen address is released.
+		defer c.enqueueConflicted(oldNginxService)
 	}
 	// determine whether the new service object is LoadBalancer type and have specified annotation.
 	// if not meet the condition, skip enqueue.
 	if c.isMeetCondition(logger.WithField("version", "new"), newObj) {
+		c.validateAnnotations(newObj)
 		// enqueue Service object containing the nginx configuration filename we should create
-		newNginxService.Action = nginx.ActionTypeAdd
-		c.workqueue.Add(newNginxService)
+		c.enqueueService(newSvc)
+	} else {
+		// the k8s service is not load balanced anymore.
+		c.releaseAddress(c.serviceKey(newSvc.Namespace, newSvc.Name))
 	}
 
 }
 
 // deleteService
 func (c *Controller) deleteService(obj interface{}) {
+	selectionLocker.RLock()
+	defer selectionLocker.RUnlock()
 	logger := logrus.WithField("event", "delete")
 	nginxService := c.constructNginxService(obj)
 	// determine whether the service object is LoadBalancer type and have specified annotation.
@@ -231,6 +399,9 @@ func (c *Controller) deleteService(obj interface{}) {
 		// enqueue items containing the nginx configuration filename we should remove
 		nginxService.Action = nginx.ActionTypeDel
 		c.workqueue.Add(nginxService)
+		// the listen address is released.
+		c.enqueueConflicted(nginxService)
+		c.releaseAddress(c.serviceKey(nginxService.Namespace, nginxService.Name))
 	}
 }
 
@@ -262,16 +433,86 @@ func (c *Controller) isMeetCondition(logger *logrus.Entry, obj interface{}) bool
 		l.Debugf(`service type is "%s", skip enqueue`, serviceType)
 		return false
 	}
-	// if the k8s service don't contains the annotation, return false
-	if !annotations.Has(obj.(runtime.Object), AnnotationLoadBalancer) {
+	// the k8s service selected by the config file doesn't need the annotation.
+	if _, ok := config.LookupService(c.cluster, accessor.GetNamespace(), accessor.GetName()); ok {
+		l.Debugf("service selected by the config file")
+	} else if !annotations.Has(obj.(runtime.Object), AnnotationLoadBalancer) {
+		// if the k8s service don't contains the annotation, return false
 		l.Debugf(`service don't have annotation: "%s", skip enqueue`, AnnotationLoadBalancer)
 		return false
 	}
+	// the k8s service served by another member is skipped.
+	if !c.ownsService(accessor) {
+		l.Debugf("service is served by another shard member, skip enqueue")
+		return false
+	}
 
 	l.Debugf("service meet condition, start enqueue")
 	return true
 }
 
+// validateAnnotations records a warning event for the k8s service if it has
+// invalid tuning annotations, the invalid annotations will not passed to nginx.
+func (c *Controller) validateAnnotations(obj interface{}) {
+	svcObj, ok := obj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	if err := ValidateAnnotations(svcObj); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"namespace": svcObj.Namespace,
+			"name":      svcObj.Name,
+		}).Warn(err)
+		c.recorder.Event(svcObj, corev1.EventTypeWarning, EventReasonInvalidAnnotation, err.Error())
+	}
+}
+
+// ValidateAnnotations returns all the invalid tuning annotations of the k8s service.
+// It's also used to validate the k8s services offline by the "render" subcommand.
+func ValidateAnnotations(svcObj *corev1.Service) error {
+	var errs []error
+	if _, err := parseTuning(svcObj); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseListenIP(svcObj); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseBackendProtocol(svcObj); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateHTTPAnnotations(svcObj); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// statusAnnotations is the annotations written by the controller itself to record
+// the state of the k8s service, they never change the nginx config.
+var statusAnnotations = []string{AnnotationServedBy, AnnotationAllocatedIP}
+
+// nginxServiceEqual returns true if the nginx.Service are the same, the status
+// annotations are ignored, the k8s service updated by the controller itself
+// is not regenerated.
+func nginxServiceEqual(a, b *nginx.Service) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return reflect.DeepEqual(withoutStatusAnnotations(a), withoutStatusAnnotations(b))
+}
+
+// withoutStatusAnnotations returns a copy of the nginx.Service without the status annotations.
+func withoutStatusAnnotations(service *nginx.Service) *nginx.Service {
+	copied := *service
+	copied.Annotations = make(map[string]string, len(service.Annotations))
+	for key, val := range service.Annotations {
+		copied.Annotations[key] = val
+	}
+	for _, key := range statusAnnotations {
+		delete(copied.Annotations, key)
+	}
+	return &copied
+}
+
 // constructNginxService
 func (c *Controller) constructNginxService(obj interface{}) *nginx.Service {
 	// obj always is *corev1.Service, it's not necessary to asset.
@@ -281,36 +522,66 @@ func (c *Controller) constructNginxService(obj interface{}) *nginx.Service {
 		logrus.Errorf("the object is not *corev1.Service")
 		return &nginx.Service{}
 	}
+	return ConstructNginxService(c.cluster, c.getClusterID(), svcObj)
+}
 
+// ConstructNginxService converts the k8s service of the cluster to the nginx.Service
+// the nginx config files generated for. It's also used to render the nginx config
+// files offline by the "render" subcommand.
+func ConstructNginxService(cluster, clusterID string, svcObj *corev1.Service) *nginx.Service {
+	var obj runtime.Object = svcObj
 	var nginxService = &nginx.Service{
-		Namespace: svcObj.Namespace,
-		Name:      svcObj.Name,
-	}
-	serviceType, err := c.serviceHandler.GetType(obj)
-	if err != nil {
-		logrus.Errorf("service handler get service type error: %s", err.Error())
+		Cluster:     cluster,
+		ClusterID:   clusterID,
+		Namespace:   svcObj.Namespace,
+		Name:        svcObj.Name,
+		Annotations: annotations.GetAll(obj),
 	}
-	if serviceType == string(corev1.ServiceTypeLoadBalancer) {
+	// the invalid tuning annotations are ignored, they are reported by validateAnnotations.
+	nginxService.Tuning, _ = parseTuning(svcObj)
+	// the invalid listen ip is ignored, nginx listen to all addresses.
+	nginxService.ListenIP, _ = parseListenIP(svcObj)
+	nginxService.IPFamilies = parseIPFamilies(svcObj)
+	if svcObj.Spec.Type == corev1.ServiceTypeLoadBalancer {
 		nginxService.MeetType = true
 	}
-	if annotations.Has(obj.(runtime.Object), AnnotationLoadBalancer) {
+	if annotations.Has(obj, AnnotationLoadBalancer) {
 		nginxService.MeetAnnotations = true
 	}
 
+	svcConfig, selected := config.LookupService(cluster, svcObj.Namespace, svcObj.Name)
+	nginxService.MeetConfig = selected
+
 	var ports []nginx.ServicePort
 	for _, p := range svcObj.Spec.Ports {
 		port := nginx.ServicePort{
-			Name:     p.Name,
-			Port:     p.Port,
-			NodePort: p.NodePort,
-			Protocol: string(p.Protocol),
+			Name:          p.Name,
+			Port:          p.Port,
+			NodePort:      p.NodePort,
+			Protocol:      string(p.Protocol),
+			ProxyProtocol: proxyProtocol(svcObj, p),
+		}
+		// the protocol is defaulted to TCP by the apiserver, but not in the manifests.
+		if len(port.Protocol) == 0 {
+			port.Protocol = string(corev1.ProtocolTCP)
 		}
 		// the AnnotationNginxListenPort is a annotation contains nginx listen port
-		listenPortStr := annotations.Get(obj.(runtime.Object), AnnotationNginxListenPort)
+		listenPortStr := annotations.Get(obj, AnnotationNginxListenPort)
 		listenPort, err := strconv.Atoi(listenPortStr)
 		if err == nil {
 			port.ListenPort = int32(listenPort)
 		}
+		// the k8s service selected by the config file only load balances the
+		// ports specified, the listen port in config file takes precedence.
+		if selected {
+			portConfig, ok := svcConfig.Port(p.Port, string(p.Protocol))
+			if !ok {
+				continue
+			}
+			if portConfig.ListenPort != 0 {
+				port.ListenPort = portConfig.ListenPort
+			}
+		}
 		ports = append(ports, port)
 	}
 	nginxService.Ports = ports
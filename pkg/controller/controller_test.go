@@ -0,0 +1,246 @@
+package controller
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// newTestController returns a controller whose informer caches contain the k8s
+// services, it's synced and not registered to the controllers sharing the host.
+func newTestController(t *testing.T, services ...*corev1.Service) *Controller {
+	t.Helper()
+	c := &Controller{
+		serviceLister: newTestLister(t, services...),
+		serviceSynced: func() bool { return true },
+		workqueue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		runtime:       nginx.NewFakeRuntime(),
+		recorder:      record.NewFakeRecorder(100),
+		cacheSynced:   1,
+	}
+	c.clusterID.Store("abc")
+	t.Cleanup(c.workqueue.ShutDown)
+	return c
+}
+
+// newTestLister returns the lister of the k8s services.
+func newTestLister(t *testing.T, services ...*corev1.Service) corelisters.ServiceLister {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, svc := range services {
+		if err := indexer.Add(svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return corelisters.NewServiceLister(indexer)
+}
+
+// newTestService returns a LoadBalancer k8s service with the annotation
+// "loadbalancer=enabled" and a TCP port.
+func newTestService(namespace, name string, port int32) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            name,
+			ResourceVersion: "1",
+			Annotations:     map[string]string{"loadbalancer": "enabled"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{{Name: "tcp", Port: port, NodePort: 30000 + port, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+}
+
+// registerTestController registers the controller to the controllers sharing
+// the host, it's unregistered when the test finished.
+func registerTestController(t *testing.T, c *Controller) {
+	register(c)
+	t.Cleanup(func() {
+		controllersLocker.Lock()
+		defer controllersLocker.Unlock()
+		for i, other := range controllers {
+			if other == c {
+				controllers = append(controllers[:i], controllers[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+// setupNginxDir generates the nginx config files into a temporary directory
+// with the upstream hosts, it's restored to /etc/nginx when the test finished.
+func setupNginxDir(t *testing.T, upstream ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, sub := range []string{"sites-stream", "sites-enabled"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nginx.SetNginxDir(dir)
+	args.NewBuilder().SetUpstream(upstream).SetUpstreamMaxFails(-1)
+	t.Cleanup(func() {
+		nginx.SetNginxDir("/etc/nginx")
+		args.NewBuilder().SetUpstream(nil)
+	})
+	return dir
+}
+
+// processAll processes all the items in the workqueue.
+func processAll(t *testing.T, c *Controller) {
+	t.Helper()
+	for c.workqueue.Len() != 0 {
+		c.processNextWorkItem()
+	}
+}
+
+func TestProcessNginx(t *testing.T) {
+	dir := setupNginxDir(t, "10.0.0.1")
+	svc := newTestService("default", "web", 80)
+	c := newTestController(t, svc)
+	fake := c.runtime.(*nginx.FakeRuntime)
+	file := filepath.Join(dir, "sites-stream", "tcp.default.web.tcp.abc")
+
+	// the k8s service added generates the nginx config and reloads nginx.
+	c.addService(svc)
+	processAll(t, c)
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("nginx config not generated: %v", err)
+	}
+	if fake.Count("TestConf") == 0 || fake.Count("Reload") == 0 {
+		t.Errorf("nginx is not tested and reloaded, calls: %v", fake.Calls())
+	}
+
+	// the k8s service resynced without change doesn't reload nginx.
+	fake.Reset()
+	c.enqueueService(svc)
+	processAll(t, c)
+	if n := fake.Count("Reload"); n != 0 {
+		t.Errorf("nginx reloaded %d times for the unchanged k8s service, calls: %v", n, fake.Calls())
+	}
+
+	// the k8s service updated without change of nginx.Service is not enqueued.
+	updated := svc.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Labels = map[string]string{"foo": "bar"}
+	c.updateService(svc, updated)
+	if n := c.workqueue.Len(); n != 0 {
+		t.Errorf("workqueue length after the irrelevant update = %d, want 0", n)
+	}
+
+	// the failed reload restarts nginx.
+	fake.Reset()
+	fake.SetError("Reload", errors.New("reload failed"))
+	changed := updated.DeepCopy()
+	changed.ResourceVersion = "3"
+	changed.Spec.Ports[0].NodePort = 31000
+	c.updateService(updated, changed)
+	processAll(t, c)
+	fake.SetError("Reload", nil)
+	if n := fake.Count("Restart"); n == 0 {
+		t.Errorf("nginx is not restarted after the reload failed, calls: %v", fake.Calls())
+	}
+	data, err := os.ReadFile(file)
+	if err != nil || !strings.Contains(string(data), "10.0.0.1:31000") {
+		t.Errorf("nginx config not regenerated: %v\n%s", err, data)
+	}
+
+	// the k8s service deleted removes the nginx config and reloads nginx.
+	fake.Reset()
+	c.deleteService(changed)
+	processAll(t, c)
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("nginx config not removed: %v", err)
+	}
+	if n := fake.Count("Reload"); n != 1 {
+		t.Errorf("nginx reloaded %d times after the k8s service deleted, want 1, calls: %v", n, fake.Calls())
+	}
+}
+
+func TestProcessNginxTestConfFailed(t *testing.T) {
+	setupNginxDir(t, "10.0.0.1")
+	svc := newTestService("default", "web", 80)
+	c := newTestController(t, svc)
+	fake := c.runtime.(*nginx.FakeRuntime)
+	fake.SetError("TestConf", errors.New("nginx: [emerg] invalid"))
+
+	c.addService(svc)
+	processAll(t, c)
+	if n := fake.Count("Reload"); n != 0 {
+		t.Errorf("nginx reloaded %d times with the invalid config, calls: %v", n, fake.Calls())
+	}
+}
+
+func TestPortConflict(t *testing.T) {
+	dir := setupNginxDir(t, "10.0.0.1")
+	older := newTestService("default", "older", 80)
+	older.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	newer := newTestService("default", "newer", 80)
+	newer.CreationTimestamp = metav1.Now()
+	c := newTestController(t, older, newer)
+	registerTestController(t, c)
+
+	c.addService(older)
+	c.addService(newer)
+	processAll(t, c)
+	if _, err := os.Stat(filepath.Join(dir, "sites-stream", "tcp.default.older.tcp.abc")); err != nil {
+		t.Errorf("nginx config of the older k8s service not generated: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sites-stream", "tcp.default.newer.tcp.abc")); !os.IsNotExist(err) {
+		t.Errorf("nginx config of the conflicting k8s service generated: %v", err)
+	}
+	select {
+	case event := <-c.recorder.(*record.FakeRecorder).Events:
+		if !strings.Contains(event, EventReasonPortConflict) {
+			t.Errorf("event = %q, want %s", event, EventReasonPortConflict)
+		}
+	default:
+		t.Error("no event recorded for the port conflict")
+	}
+}
+
+func TestUpdateServiceStatusAnnotations(t *testing.T) {
+	setupNginxDir(t, "10.0.0.1")
+	old := newTestService("default", "web", 80)
+	c := newTestController(t, old)
+
+	patched := old.DeepCopy()
+	patched.ResourceVersion = "2"
+	patched.Annotations[AnnotationServedBy] = "lb-1"
+	c.updateService(old, patched)
+	if n := c.workqueue.Len(); n != 0 {
+		t.Fatalf("served-by patched, %d items enqueued, want 0", n)
+	}
+
+	// the allocated ip address is compared by the listen ip, not the annotation.
+	allocated := patched.DeepCopy()
+	allocated.ResourceVersion = "3"
+	allocated.Annotations[AnnotationAllocatedIP] = "10.0.0.100"
+	c.updateService(patched, allocated)
+	if n := c.workqueue.Len(); n == 0 {
+		t.Fatal("the listen ip allocated, but nothing enqueued")
+	}
+	processAll(t, c)
+
+	updated := allocated.DeepCopy()
+	updated.ResourceVersion = "4"
+	updated.Annotations[AnnotationServedBy] = "lb-2"
+	updated.Annotations[AnnotationAllocatedIP] = " 10.0.0.100"
+	c.updateService(allocated, updated)
+	if n := c.workqueue.Len(); n != 0 {
+		t.Fatalf("the status annotations patched, %d items enqueued, want 0", n)
+	}
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/firewall"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// firewallSyncDelay is how long the firewall sync requested by a work item is
+// delayed, the syncs requested in the meantime, eg: by a burst of endpoint
+// events, are merged into one.
+var firewallSyncDelay = time.Second
+
+// firewallKey is the only key of firewallQueue.
+const firewallKey = "firewall"
+
+var (
+	firewallLocker sync.Mutex
+	// firewallQueue is the firewall syncs requested, it's shared by all the clusters.
+	firewallQueue = workqueue.NewNamedDelayingQueue("firewall")
+	// firewallOnce starts the firewall worker once for all the clusters.
+	firewallOnce sync.Once
+)
+
+// queueFirewallSync requests a firewall sync after firewallSyncDelay, it's merged
+// with the sync already requested.
+func queueFirewallSync() {
+	firewallQueue.AddAfter(firewallKey, firewallSyncDelay)
+}
+
+// runFirewallWorker calls sync for every firewall sync requested until stopCh closed.
+func runFirewallWorker(queue workqueue.DelayingInterface, sync func(), stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		queue.ShutDown()
+	}()
+	for {
+		key, shutdown := queue.Get()
+		if shutdown {
+			return
+		}
+		sync()
+		queue.Done(key)
+	}
+}
+
+// syncFirewall opens the nginx listen ports of all the k8s services of all the
+// clusters meeting the condition on their listen ip addresses, restricted to
+// their loadBalancerSourceRanges,
+// and closes the ports of the k8s services gone away. The clusters whose informer
+// caches not synced use their last rules recorded in the state file, so their
+// ports are not closed even if they're unreachable since the controller started. It does nothing if the firewall is disabled.
+func syncFirewall() {
+	firewallLocker.Lock()
+	defer firewallLocker.Unlock()
+	logger := logrus.WithField("event", "firewall")
+	var backend firewall.Backend
+	var rules []firewall.Rule
+	var synced bool
+	for _, c := range allControllers() {
+		if c.firewall == nil {
+			return
+		}
+		backend = c.firewall
+		if !c.synced() {
+			rules = append(rules, lastState(c.cluster).Rules...)
+			continue
+		}
+		synced = true
+		var clusterRules []firewall.Rule
+		for _, svc := range c.listServices(logger) {
+			sourceRanges := svc.Spec.LoadBalancerSourceRanges
+			if err := firewall.ValidateSourceRanges(sourceRanges); err != nil {
+				logger.WithField("service", c.serviceKey(svc.Namespace, svc.Name)).
+					Warnf("skip opening ports: %s", err.Error())
+				continue
+			}
+			nginxService := c.constructNginxService(svc)
+			for _, port := range nginxService.Ports {
+				listenPort := port.Port
+				if port.ListenPort != 0 {
+					listenPort = port.ListenPort
+				}
+				// the k8s services sharing the port on different ip addresses
+				// keep their own source ranges.
+				clusterRules = append(clusterRules, firewall.Rule{
+					IP:           nginxService.ListenIP,
+					Port:         listenPort,
+					Protocol:     port.Protocol,
+					SourceRanges: sourceRanges,
+				})
+			}
+		}
+		recordState(c.cluster, func(state *clusterState) { state.Rules = clusterRules })
+		rules = append(rules, clusterRules...)
+	}
+	if backend == nil || !synced {
+		return
+	}
+	if err := firewall.Sync(backend, rules); err != nil {
+		logrus.Errorf("sync firewall failed: %s", err.Error())
+	}
+}
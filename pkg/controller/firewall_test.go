@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/firewall"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestFirewallSyncDebounced(t *testing.T) {
+	queue := workqueue.NewNamedDelayingQueue("test-firewall")
+	var count int32
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go runFirewallWorker(queue, func() { atomic.AddInt32(&count, 1) }, stopCh)
+
+	waitCount := func(want int32) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&count) < want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// the syncs requested by the burst are not run later.
+		time.Sleep(200 * time.Millisecond)
+		if got := atomic.LoadInt32(&count); got != want {
+			t.Fatalf("firewall synced %d times, want %d", got, want)
+		}
+	}
+	// a burst of work items syncs the firewall once.
+	for i := 0; i < 100; i++ {
+		queue.AddAfter(firewallKey, 50*time.Millisecond)
+	}
+	waitCount(1)
+	queue.AddAfter(firewallKey, 50*time.Millisecond)
+	waitCount(2)
+}
+
+func TestProcessQueuesFirewallSync(t *testing.T) {
+	setupNginxDir(t, "10.0.0.1")
+	setupStateFile(t, map[string]clusterState{})
+	delay := firewallSyncDelay
+	firewallSyncDelay = time.Hour
+	t.Cleanup(func() { firewallSyncDelay = delay })
+
+	var services []*corev1.Service
+	for i := 0; i < 10; i++ {
+		services = append(services, newTestService("default", fmt.Sprintf("web%d", i), int32(80+i)))
+	}
+	fw := &fakeFirewall{}
+	c := newTestController(t, services...)
+	c.firewall = fw
+	registerTestController(t, c)
+	for _, svc := range services {
+		c.addService(svc)
+	}
+	processAll(t, c)
+	// the firewall is synced by the firewall worker later, not by every work item.
+	if fw.rules != nil {
+		t.Fatalf("firewall synced by the work items: %v", fw.rules)
+	}
+}
+
+func TestFirewallSharedPort(t *testing.T) {
+	setupStateFile(t, map[string]clusterState{})
+	restricted := newTestService("default", "restricted", 80)
+	restricted.Annotations[AnnotationIP] = "10.0.0.1"
+	restricted.Spec.LoadBalancerSourceRanges = []string{"192.168.0.0/16"}
+	open := newTestService("default", "open", 80)
+	open.Annotations[AnnotationIP] = "10.0.0.2"
+	fw := &fakeFirewall{}
+	c := newTestController(t, restricted, open)
+	c.firewall = fw
+	registerTestController(t, c)
+
+	syncFirewall()
+	// the k8s service without source ranges doesn't open the port of the other one.
+	want := []firewall.Rule{
+		{IP: "10.0.0.1", Port: 80, Protocol: "tcp", SourceRanges: []string{"192.168.0.0/16"}},
+		{IP: "10.0.0.2", Port: 80, Protocol: "tcp"},
+	}
+	if !reflect.DeepEqual(fw.rules, want) {
+		t.Fatalf("firewall rules = %v, want %v", fw.rules, want)
+	}
+}
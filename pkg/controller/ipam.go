@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/ipam"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// EventReasonIPAllocated is the reason of the event recorded when the
+	// k8s service is allocated an ip address from the ip pool.
+	EventReasonIPAllocated = "IPAllocated"
+	// EventReasonIPAllocationFailed is the reason of the event recorded when
+	// the k8s service can't get an ip address from the ip pool.
+	EventReasonIPAllocationFailed = "IPAllocationFailed"
+)
+
+// restoreAllocations restores the ip addresses assigned to the k8s services
+// from the requested ip addresses and the "loadbalancer/allocated-ip" annotations,
+// it's called before the workers start, so the ip addresses in use will
+// not be allocated again.
+func (c *Controller) restoreAllocations() {
+	if !ipam.Enabled() {
+		return
+	}
+	services := c.listServices(logrus.WithField("event", "ipam"))
+	for _, svc := range services {
+		if ip, err := requestedIP(svc); err == nil && len(ip) != 0 && ipam.InPools(ip) {
+			if err := ipam.Assign(c.serviceKey(svc.Namespace, svc.Name), ip, true); err != nil {
+				logrus.Warnf("restore ip address of %s/%s failed: %s", svc.Namespace, svc.Name, err.Error())
+			}
+		}
+	}
+	for _, svc := range services {
+		if ip, err := requestedIP(svc); err != nil || len(ip) != 0 {
+			continue
+		}
+		if ip := allocatedIP(svc); len(ip) != 0 {
+			if err := ipam.Assign(c.serviceKey(svc.Namespace, svc.Name), ip, false); err != nil {
+				logrus.Warnf("restore ip address of %s/%s failed: %s", svc.Namespace, svc.Name, err.Error())
+			}
+		}
+	}
+}
+
+// allocateAddress makes sure the k8s service has an ip address if it should be
+// allocated from the ip pool. The allocated ip address is persisted in the
+// annotation "loadbalancer/allocated-ip", and the k8s service will be processed
+// again with the address. It returns false if the nginx config should not be
+// generated now.
+func (c *Controller) allocateAddress(nginxService *nginx.Service) (bool, error) {
+	if !ipam.Enabled() || nginxService.Action != nginx.ActionTypeAdd {
+		return true, nil
+	}
+	svc, err := c.serviceLister.Services(nginxService.Namespace).Get(nginxService.Name)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	key := c.serviceKey(svc.Namespace, svc.Name)
+	l := logrus.WithFields(logrus.Fields{
+		"namespace": svc.Namespace,
+		"name":      svc.Name,
+	})
+
+	// the requested ip address is used as is, it's recorded only if it's in the pools.
+	if ip, err := requestedIP(svc); err != nil || len(ip) != 0 {
+		if err != nil || !ipam.InPools(ip) {
+			c.releaseAddress(key)
+			return true, nil
+		}
+		if err := ipam.Assign(key, ip, true); err != nil {
+			l.Warn(err)
+			c.recorder.Event(svc, corev1.EventTypeWarning, EventReasonIPAllocationFailed, err.Error())
+			return false, nil
+		}
+		return true, nil
+	}
+
+	pool, err := ipam.SelectPool(svc.Namespace, svc.Annotations[AnnotationIPPool])
+	if err != nil {
+		l.Warn(err)
+		c.recorder.Event(svc, corev1.EventTypeWarning, EventReasonIPAllocationFailed, err.Error())
+		return false, nil
+	}
+	// no pool for the k8s service, nginx listen to all addresses.
+	if pool == nil {
+		c.releaseAddress(key)
+		return true, nil
+	}
+	if ip := allocatedIP(svc); len(ip) != 0 && pool.Contains(net.ParseIP(ip)) {
+		err := ipam.Assign(key, ip, false)
+		if err == nil {
+			return true, nil
+		}
+		l.Warnf("allocated ip address is not available: %s", err.Error())
+	}
+
+	ip, err := ipam.Allocate(key, pool)
+	if err != nil {
+		l.Warn(err)
+		c.recorder.Event(svc, corev1.EventTypeWarning, EventReasonIPAllocationFailed, err.Error())
+		return false, nil
+	}
+	// the allocated ip address is not recorded in the k8s service in dry-run
+	// mode, it's used directly instead of waiting for the k8s service updated.
+	if nginx.DryRun() {
+		l.Infof("dry-run: would allocate ip address %s from pool %q", ip, pool.Name)
+		nginxService.ListenIP = ip
+		return true, nil
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{AnnotationAllocatedIP: ip},
+		},
+	})
+	if _, err := c.serviceHandler.Clientset().CoreV1().Services(svc.Namespace).Patch(
+		context.TODO(), svc.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		ipam.Release(key)
+		return false, err
+	}
+	l.Infof("allocated ip address %s from pool %q", ip, pool.Name)
+	c.recorder.Eventf(svc, corev1.EventTypeNormal, EventReasonIPAllocated, "allocated ip address %s from pool %q", ip, pool.Name)
+	return false, nil
+}
+
+// releaseAddress releases the ip address assigned to the k8s service, the k8s
+// services are enqueued if the ip address is freed, so the k8s services failed
+// to allocate ip address can get it.
+func (c *Controller) releaseAddress(key string) {
+	if !ipam.Enabled() {
+		return
+	}
+	if ipam.Release(key) {
+		c.enqueueAll()
+	}
+}
+
+// updateStatus sets the ip address nginx listen to in the k8s service
+// status.loadBalancer.ingress, it does nothing if the ip address management
+// is disabled or nginx listen to all addresses.
+func (c *Controller) updateStatus(nginxService *nginx.Service) error {
+	if !ipam.Enabled() || nginxService.Action != nginx.ActionTypeAdd || len(nginxService.ListenIP) == 0 {
+		return nil
+	}
+	if nginx.DryRun() {
+		logrus.Debugf("dry-run: skip updating the status of %s", nginxService)
+		return nil
+	}
+	svc, err := c.serviceLister.Services(nginxService.Namespace).Get(nginxService.Name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ingress := []corev1.LoadBalancerIngress{{IP: nginxService.ListenIP}}
+	if reflect.DeepEqual(svc.Status.LoadBalancer.Ingress, ingress) {
+		return nil
+	}
+	svc = svc.DeepCopy()
+	svc.Status.LoadBalancer.Ingress = ingress
+	_, err = c.serviceHandler.Clientset().CoreV1().Services(svc.Namespace).UpdateStatus(context.TODO(), svc, metav1.UpdateOptions{})
+	return err
+}
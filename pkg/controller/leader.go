@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"sync/atomic"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/announce"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/sirupsen/logrus"
+)
+
+// leading is 1 if the controller is the leader holding the VIPs, the VIPs of
+// all the clusters are held by the leader.
+var leading int32
+
+// OnStartedLeading is called when the controller becomes the leader,
+// the VIPs are acquired and announced, and nginx is started or reloaded to
+// listen to the VIPs. It may be called before the caches synced, the VIPs are
+// acquired and announced again after the caches synced.
+func OnStartedLeading() {
+	logrus.Info("Started leading")
+	atomic.StoreInt32(&leading, 1)
+	syncVIPs()
+	announce.Reset()
+	reloadNginx()
+}
+
+// OnStoppedLeading is called when the controller loses the leadership,
+// the VIPs are released and not announced anymore.
+func OnStoppedLeading() {
+	logrus.Warn("Stopped leading")
+	atomic.StoreInt32(&leading, 0)
+	syncVIPs()
+}
+
+// isLeading returns true if the controller is the leader,
+// it's always true if the leader election is disabled.
+func isLeading() bool {
+	return atomic.LoadInt32(&leading) == 1
+}
+
+// reloadNginx starts or reloads nginx by the runtime of the first cluster,
+// all the clusters share the same nginx daemon.
+func reloadNginx() {
+	all := allControllers()
+	if len(all) == 0 {
+		return
+	}
+	if err := (&nginx.Nginx{Runtime: all[0].runtime}).Reload(); err != nil {
+		logrus.Errorf("start or reload nginx after leadership acquired failed: %s", err.Error())
+	}
+}
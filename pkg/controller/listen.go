@@ -0,0 +1,371 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/announce"
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/keepalived"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/forbearing/k8s-loadbalancer/pkg/vip"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const (
+	// EventReasonPortConflict is the reason of the event recorded when the nginx
+	// listen address of the k8s service is already used by another k8s service.
+	EventReasonPortConflict = "PortConflict"
+)
+
+// parseListenIP returns the ip address nginx listen to for the k8s service, it's
+// the requested ip address, or the ip address allocated from the ip pool.
+// It returns empty string if neither exists.
+func parseListenIP(svc *corev1.Service) (string, error) {
+	ip, err := requestedIP(svc)
+	if err != nil || len(ip) != 0 {
+		return ip, err
+	}
+	return allocatedIP(svc), nil
+}
+
+// requestedIP returns the ip address requested by the k8s service, the
+// annotation "loadbalancer/ip" takes precedence over spec.loadBalancerIP.
+// It returns empty string if neither is specified.
+func requestedIP(svc *corev1.Service) (string, error) {
+	key, val := AnnotationIP, strings.TrimSpace(svc.Annotations[AnnotationIP])
+	if len(val) == 0 {
+		key, val = "spec.loadBalancerIP", strings.TrimSpace(svc.Spec.LoadBalancerIP)
+	}
+	if len(val) == 0 {
+		return "", nil
+	}
+	ip := net.ParseIP(val)
+	if ip == nil {
+		return "", fmt.Errorf("invalid %s %q: not a ip address", key, val)
+	}
+	return ip.String(), nil
+}
+
+// allocatedIP returns the ip address allocated to the k8s service from the ip pool.
+func allocatedIP(svc *corev1.Service) string {
+	ip := net.ParseIP(strings.TrimSpace(svc.Annotations[AnnotationAllocatedIP]))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// parseIPFamilies returns the ip families nginx listen to for the k8s service.
+// It's spec.ipFamilies, and both IPv4 and IPv6 if spec.ipFamilyPolicy is
+// PreferDualStack or RequireDualStack, because the nginx host may be dual-stack
+// even if the k8s cluster is not.
+func parseIPFamilies(svc *corev1.Service) []nginx.IPFamily {
+	policy := svc.Spec.IPFamilyPolicy
+	if policy != nil && (*policy == corev1.IPFamilyPolicyPreferDualStack || *policy == corev1.IPFamilyPolicyRequireDualStack) {
+		return []nginx.IPFamily{nginx.IPv4, nginx.IPv6}
+	}
+	var families []nginx.IPFamily
+	for _, family := range svc.Spec.IPFamilies {
+		families = append(families, nginx.IPFamily(family))
+	}
+	return families
+}
+
+// listenKeys returns the nginx listen addresses of the k8s service, format is
+// "address/protocol". The listen address is "ip:port", "port" or "[::]:port",
+// so the same port on different ip addresses is not a conflict.
+func listenKeys(nginxService *nginx.Service) []string {
+	var keys []string
+	for _, port := range nginxService.Ports {
+		listenPort := port.Port
+		if port.ListenPort != 0 {
+			listenPort = port.ListenPort
+		}
+		for _, addr := range nginx.ListenAddresses(nginxService, listenPort) {
+			keys = append(keys, fmt.Sprintf("%s/%s", addr, strings.ToLower(port.Protocol)))
+		}
+	}
+	return keys
+}
+
+// findPortConflict returns the k8s service already owning the nginx listen address
+// of svc and the conflicting listen address, the k8s services of all the clusters
+// are checked because they share the host. The oldest k8s service owns the listen
+// address. It returns empty if there is no conflict, otherwise the owner is in
+// format namespace/name, prefixed with the cluster name if multiple clusters specified.
+func (c *Controller) findPortConflict(svc *corev1.Service) (string, string) {
+	keys := make(map[string]struct{})
+	for _, key := range listenKeys(c.constructNginxService(svc)) {
+		keys[key] = struct{}{}
+	}
+	for _, oc := range allControllers() {
+		for _, other := range oc.listServices(logrus.WithField("event", "conflict")) {
+			if oc == c && other.Namespace == svc.Namespace && other.Name == svc.Name {
+				continue
+			}
+			if !isOlder(oc.cluster, other, c.cluster, svc) {
+				continue
+			}
+			for _, key := range listenKeys(oc.constructNginxService(other)) {
+				if _, ok := keys[key]; ok {
+					return oc.serviceKey(other.Namespace, other.Name), key
+				}
+			}
+		}
+	}
+	return "", ""
+}
+
+// FindPortConflict is the same as findPortConflict, but the k8s services of the
+// cluster are given instead of listed from the informers. It's used to check the
+// k8s services offline by the "render" subcommand.
+func FindPortConflict(cluster, clusterID string, svc *corev1.Service, services []*corev1.Service) (string, string) {
+	keys := make(map[string]struct{})
+	for _, key := range listenKeys(ConstructNginxService(cluster, clusterID, svc)) {
+		keys[key] = struct{}{}
+	}
+	for _, other := range services {
+		if other.Namespace == svc.Namespace && other.Name == svc.Name {
+			continue
+		}
+		if !isOlder(cluster, other, cluster, svc) {
+			continue
+		}
+		for _, key := range listenKeys(ConstructNginxService(cluster, clusterID, other)) {
+			if _, ok := keys[key]; ok {
+				return other.Namespace + "/" + other.Name, key
+			}
+		}
+	}
+	return "", ""
+}
+
+// isOlder returns true if svc a is created before svc b, the cluster/namespace/name
+// is compared if they are created at the same time.
+func isOlder(clusterA string, a *corev1.Service, clusterB string, b *corev1.Service) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return clusterA+"/"+a.Namespace+"/"+a.Name < clusterB+"/"+b.Namespace+"/"+b.Name
+}
+
+// enqueueService enqueues the k8s service meeting the condition. If its nginx
+// listen address is owned by another k8s service, a warning event is recorded
+// and its nginx config is removed instead.
+func (c *Controller) enqueueService(svc *corev1.Service) {
+	nginxService := c.constructNginxService(svc)
+	nginxService.Action = nginx.ActionTypeAdd
+	if owner, key := c.findPortConflict(svc); len(owner) != 0 {
+		msg := fmt.Sprintf("nginx listen address %s is already used by service %s", key, owner)
+		logrus.WithFields(logrus.Fields{
+			"namespace": svc.Namespace,
+			"name":      svc.Name,
+		}).Warn(msg)
+		c.recorder.Event(svc, corev1.EventTypeWarning, EventReasonPortConflict, msg)
+		nginxService.Action = nginx.ActionTypeDel
+	}
+	c.workqueue.Add(nginxService)
+}
+
+// enqueueConflicted enqueues the k8s services of all the clusters whose nginx
+// listen address is the same as the nginxService, it's called after the nginxService
+// releases its listen address, so the k8s service lost the conflict before can
+// take it over.
+func (c *Controller) enqueueConflicted(nginxService *nginx.Service) {
+	keys := make(map[string]struct{})
+	for _, key := range listenKeys(nginxService) {
+		keys[key] = struct{}{}
+	}
+	for _, oc := range allControllers() {
+		for _, svc := range oc.listServices(logrus.WithField("event", "conflict")) {
+			if oc == c && svc.Namespace == nginxService.Namespace && svc.Name == nginxService.Name {
+				continue
+			}
+			for _, key := range listenKeys(oc.constructNginxService(svc)) {
+				if _, ok := keys[key]; ok {
+					oc.enqueueService(svc)
+					break
+				}
+			}
+		}
+	}
+}
+
+// listServices returns all the k8s services meeting the condition.
+func (c *Controller) listServices(logger *logrus.Entry) []*corev1.Service {
+	services, err := c.serviceLister.List(labels.Everything())
+	if err != nil {
+		logrus.Errorf("list k8s services failed: %s", err.Error())
+		return nil
+	}
+	var result []*corev1.Service
+	for _, svc := range services {
+		if c.isMeetCondition(logger, svc) {
+			result = append(result, svc)
+		}
+	}
+	return result
+}
+
+// syncVIPs makes the nginx listen ip addresses of all the k8s services of all the
+// clusters available on the host. If --vip-interface is specified, the ip addresses not existing on
+// the host are added to the interface and announced, and the ones added before
+// but not used anymore are removed, only the leader holds the VIPs. If --keepalived
+// is specified, the ip addresses are the keepalived VIPs. It does nothing if
+// neither is specified.
+//
+// The VIPs are applied only when they or the leadership changed since the last
+// successful sync, so the work items not changing the VIPs don't touch the host.
+func syncVIPs() {
+	if len(args.GetVIPInterface()) == 0 && !keepalived.Enabled() {
+		return
+	}
+	ips, clusters, unsynced, synced := collectVIPs()
+	if !synced {
+		return
+	}
+	set := newVIPSet(ips, clusters, unsynced, isLeading())
+	vipLocker.Lock()
+	defer vipLocker.Unlock()
+	if syncedVIPs != nil && reflect.DeepEqual(*syncedVIPs, set) {
+		return
+	}
+	if err := applyVIPs(ips, clusters, unsynced); err != nil {
+		logrus.Error(err)
+		syncedVIPs = nil
+		return
+	}
+	syncedVIPs = &set
+}
+
+// resyncVIPs applies the VIPs even if they're not changed, eg: the VIP removed
+// from the interface manually is added back.
+func resyncVIPs() {
+	vipLocker.Lock()
+	syncedVIPs = nil
+	vipLocker.Unlock()
+	syncVIPs()
+}
+
+// vipSet is the VIPs computed by collectVIPs and the leadership.
+type vipSet struct {
+	ips      []string
+	clusters map[string][]string
+	unsynced []string
+	leading  bool
+}
+
+var (
+	vipLocker sync.Mutex
+	// syncedVIPs is the VIPs applied by the last successful sync,
+	// nil means nothing applied or the last sync failed.
+	syncedVIPs *vipSet
+	// applyVIPs applies the VIPs to the host, it's replaced in testing.
+	applyVIPs = applyHostVIPs
+)
+
+// newVIPSet returns the sorted copy of the VIPs, the order of the k8s services
+// listed doesn't matter.
+func newVIPSet(ips []string, clusters map[string][]string, unsynced []string, leading bool) vipSet {
+	sorted := func(items []string) []string {
+		items = append([]string{}, items...)
+		sort.Strings(items)
+		return items
+	}
+	set := vipSet{ips: sorted(ips), clusters: make(map[string][]string), unsynced: sorted(unsynced), leading: leading}
+	for id, clusterIPs := range clusters {
+		set.clusters[id] = sorted(clusterIPs)
+	}
+	return set
+}
+
+// applyHostVIPs adds the VIPs to --vip-interface or renders them into keepalived.conf.
+func applyHostVIPs(ips []string, clusters map[string][]string, unsynced []string) error {
+	var errs []error
+	if len(args.GetVIPInterface()) != 0 {
+		if err := syncInterfaceVIPs(ips, clusters, unsynced); err != nil {
+			errs = append(errs, fmt.Errorf("sync VIPs failed: %s", err.Error()))
+		}
+	}
+	// keepalived.conf is only diffed in dry-run mode.
+	if err := keepalived.Sync(ips); err != nil {
+		errs = append(errs, fmt.Errorf("sync keepalived failed: %s", err.Error()))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// syncInterfaceVIPs adds the VIPs to --vip-interface and announces them, all
+// the VIPs are released when the controller is not the leader, including the
+// ones of the unsynced clusters. The VIPs are not added in dry-run mode.
+func syncInterfaceVIPs(ips []string, clusters map[string][]string, unsynced []string) error {
+	if nginx.DryRun() {
+		logrus.Infof("dry-run: would sync VIPs %v", ips)
+		return nil
+	}
+	if !isLeading() {
+		released := make(map[string][]string)
+		for cluster := range clusters {
+			released[cluster] = nil
+		}
+		clusters, unsynced = released, nil
+	}
+	acquired, err := vip.Sync(args.GetVIPInterface(), clusters, unsynced)
+	// the VIPs acquired are announced even if some of them failed.
+	announce.Set(args.GetVIPInterface(), acquired)
+	return err
+}
+
+// collectVIPs returns the VIPs of all the clusters and the VIPs of every synced
+// cluster keyed by the cluster id. The clusters not synced yet, eg: unreachable,
+// don't block the other clusters, their ids are returned as unsynced and their
+// last VIPs recorded in the state file are used, the VIPs not in the partial
+// cache would be removed otherwise. synced is false if none of them synced.
+func collectVIPs() (ips []string, clusters map[string][]string, unsynced []string, synced bool) {
+	clusters = make(map[string][]string)
+	for _, c := range allControllers() {
+		id := c.getClusterID()
+		if !c.synced() {
+			state := lastState(c.cluster)
+			if len(id) == 0 {
+				id = state.ID
+			}
+			if len(id) != 0 {
+				unsynced = append(unsynced, id)
+			}
+			ips = append(ips, state.VIPs...)
+			continue
+		}
+		synced = true
+		var clusterIPs []string
+		for _, svc := range c.listServices(logrus.WithField("event", "vip")) {
+			if ip, _ := parseListenIP(svc); len(ip) != 0 {
+				clusterIPs = append(clusterIPs, ip)
+			}
+		}
+		clusters[id] = append([]string{}, clusterIPs...)
+		ips = append(ips, clusterIPs...)
+		recordState(c.cluster, func(state *clusterState) { state.ID, state.VIPs = id, clusterIPs })
+	}
+	return dedup(ips), clusters, unsynced, synced
+}
+
+// dedup removes the duplicate items.
+func dedup(items []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, item := range items {
+		if !seen[item] {
+			seen[item] = true
+			result = append(result, item)
+		}
+	}
+	return result
+}
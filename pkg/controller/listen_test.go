@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+)
+
+// setupApplyVIPs enables keepalived and records the VIPs applied instead of
+// touching the host, they're restored when the test finished.
+func setupApplyVIPs(t *testing.T) *[][]string {
+	var applied [][]string
+	args.NewBuilder().SetKeepalived(true)
+	apply := applyVIPs
+	applyVIPs = func(ips []string, clusters map[string][]string, unsynced []string) error {
+		applied = append(applied, newVIPSet(ips, nil, nil, false).ips)
+		return nil
+	}
+	syncedVIPs = nil
+	t.Cleanup(func() {
+		args.NewBuilder().SetKeepalived(false)
+		applyVIPs = apply
+		syncedVIPs = nil
+		atomic.StoreInt32(&leading, 0)
+	})
+	return &applied
+}
+
+func TestSyncVIPsOnlyChanged(t *testing.T) {
+	setupNginxDir(t, "10.0.0.1")
+	setupStateFile(t, map[string]clusterState{})
+	applied := setupApplyVIPs(t)
+	a := newTestService("default", "a", 80)
+	a.Annotations[AnnotationIP] = "10.0.0.10"
+	b := newTestService("default", "b", 81)
+	c := newTestController(t, a, b)
+	registerTestController(t, c)
+
+	c.addService(a)
+	c.addService(b)
+	processAll(t, c)
+	c.enqueueAll()
+	processAll(t, c)
+	if want := [][]string{{"10.0.0.10"}}; !reflect.DeepEqual(*applied, want) {
+		t.Fatalf("VIPs applied = %v, want %v", *applied, want)
+	}
+
+	// the VIP set changed.
+	b.Annotations[AnnotationIP] = "10.0.0.11"
+	c.addService(b)
+	processAll(t, c)
+	if want := [][]string{{"10.0.0.10"}, {"10.0.0.10", "10.0.0.11"}}; !reflect.DeepEqual(*applied, want) {
+		t.Fatalf("VIPs applied = %v, want %v", *applied, want)
+	}
+
+	// the leadership changed, nginx is reloaded to listen to the VIPs.
+	rt := c.runtime.(*nginx.FakeRuntime)
+	rt.Reset()
+	OnStartedLeading()
+	if len(*applied) != 3 {
+		t.Fatalf("VIPs are not applied after the leadership acquired: %v", *applied)
+	}
+	if rt.Count("Reload") != 1 {
+		t.Errorf("nginx is not reloaded after the leadership acquired: %v", rt.Calls())
+	}
+	// nginx not running is started.
+	rt.Reset()
+	rt.SetStatus(nginx.Status{Installed: true})
+	OnStoppedLeading()
+	OnStartedLeading()
+	if rt.Count("Start") == 0 || rt.Count("Reload") != 0 {
+		t.Errorf("nginx is not started after the leadership acquired: %v", rt.Calls())
+	}
+	applied0 := len(*applied)
+	// the periodic resync applies the VIPs even if not changed.
+	resyncVIPs()
+	if len(*applied) != applied0+1 {
+		t.Fatalf("VIPs are not applied by resync: %v", *applied)
+	}
+}
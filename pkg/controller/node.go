@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"sync/atomic"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// addNode
+func (c *Controller) addNode(obj interface{}) {
+	c.syncUpstreamHosts()
+}
+
+// updateNode
+func (c *Controller) updateNode(oldObj, newObj interface{}) {
+	oldNode := oldObj.(*corev1.Node)
+	newNode := newObj.(*corev1.Node)
+	if oldNode.ResourceVersion == newNode.ResourceVersion {
+		return
+	}
+	c.syncUpstreamHosts()
+}
+
+// deleteNode
+func (c *Controller) deleteNode(obj interface{}) {
+	c.syncUpstreamHosts()
+}
+
+// syncUpstreamHosts discovers the upstream hosts from the k8s nodes, if the upstream
+// hosts changed, all the k8s services will be enqueued to regenerate nginx config.
+// It does nothing before the informer caches synced.
+func (c *Controller) syncUpstreamHosts() {
+	if c.nodeLister == nil || atomic.LoadInt32(&c.cacheSynced) == 0 {
+		return
+	}
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		logrus.Errorf("list k8s nodes failed: %s", err.Error())
+		return
+	}
+
+	// hosts should not be nil, nil means using the hosts specified by --upstream.
+	hosts := []nginx.UpstreamHost{}
+	var errs []error
+	for _, node := range nodes {
+		if !isNodeReady(node) {
+			logrus.WithField("node", node.Name).Debug("node is not ready, skip it")
+			continue
+		}
+		addresses := nodeAddresses(node)
+		if len(addresses) == 0 {
+			logrus.WithField("node", node.Name).Warn("node has no address, skip it")
+			continue
+		}
+		params, err := parseNodeUpstreamParams(node.Annotations, node.Labels)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, address := range addresses {
+			hosts = append(hosts, nginx.UpstreamHost{Host: address, Params: params})
+		}
+	}
+
+	// the order of the k8s nodes listed is not stable, the hosts are sorted so
+	// the same nodes are not considered as changed.
+	sort.SliceStable(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+
+	c.upstreamLocker.Lock()
+	defer c.upstreamLocker.Unlock()
+	if reflect.DeepEqual(hosts, c.upstreamHosts) {
+		return
+	}
+	for _, err := range errs {
+		logrus.Warn(err)
+	}
+	logrus.Infof("upstream hosts changed: %v", hosts)
+	c.upstreamHosts = hosts
+	nginx.SetUpstreamHosts(c.cluster, hosts)
+	c.enqueueAll()
+}
+
+// enqueueAll enqueues all the k8s services meet the condition.
+func (c *Controller) enqueueAll() {
+	for _, svc := range c.listServices(logrus.WithField("event", "resync")) {
+		c.enqueueService(svc)
+	}
+}
+
+// isNodeReady returns true if the k8s node condition "Ready" is true.
+func isNodeReady(node *corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// nodeAddresses returns the k8s node addresses used as upstream hosts, one address
+// for every ip family, so both IPv4 and IPv6 addresses are returned for the
+// dual-stack node. The precedence is: InternalIP > ExternalIP. The Hostname is
+// returned if the node has no ip address.
+func nodeAddresses(node *corev1.Node) []string {
+	var v4, v6 string
+	for _, addrType := range []corev1.NodeAddressType{corev1.NodeInternalIP, corev1.NodeExternalIP} {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type != addrType {
+				continue
+			}
+			ip := net.ParseIP(addr.Address)
+			switch {
+			case ip == nil:
+				// not a ip address, skip it.
+			case ip.To4() != nil && len(v4) == 0:
+				v4 = ip.String()
+			case ip.To4() == nil && len(v6) == 0:
+				v6 = ip.String()
+			}
+		}
+	}
+	var addresses []string
+	for _, addr := range []string{v4, v6} {
+		if len(addr) != 0 {
+			addresses = append(addresses, addr)
+		}
+	}
+	if len(addresses) != 0 {
+		return addresses
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeHostName {
+			return []string{addr.Address}
+		}
+	}
+	return nil
+}
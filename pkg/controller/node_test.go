@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// orderedNodeLister lists the k8s nodes in the order of the slice.
+type orderedNodeLister []*corev1.Node
+
+func (l orderedNodeLister) List(selector labels.Selector) ([]*corev1.Node, error) {
+	return l, nil
+}
+
+func (l orderedNodeLister) Get(name string) (*corev1.Node, error) {
+	for _, node := range l {
+		if node.Name == name {
+			return node, nil
+		}
+	}
+	return nil, errors.NewNotFound(corev1.Resource("node"), name)
+}
+
+func newTestNode(name, ip string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+			Addresses:  []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}},
+		},
+	}
+}
+
+func TestSyncUpstreamHostsOrder(t *testing.T) {
+	var nodes orderedNodeLister
+	for i := 1; i <= 5; i++ {
+		nodes = append(nodes, newTestNode(fmt.Sprintf("node%d", i), fmt.Sprintf("10.0.0.%d", i)))
+	}
+	c := newTestController(t, newTestService("default", "web", 80))
+	c.cluster = t.Name()
+	c.nodeLister = nodes
+	c.syncUpstreamHosts()
+	if got := c.workqueue.Len(); got != 1 {
+		t.Fatalf("workqueue length after the first sync = %d, want 1", got)
+	}
+	item, _ := c.workqueue.Get()
+	c.workqueue.Done(item)
+
+	// the same nodes listed in the reverse order are not a change.
+	var reversed orderedNodeLister
+	for i := len(nodes) - 1; i >= 0; i-- {
+		reversed = append(reversed, nodes[i])
+	}
+	c.nodeLister = reversed
+	c.syncUpstreamHosts()
+	if got := c.workqueue.Len(); got != 0 {
+		t.Errorf("workqueue length after the nodes reordered = %d, want 0", got)
+	}
+
+	// the node removed is a change.
+	c.nodeLister = reversed[1:]
+	c.syncUpstreamHosts()
+	if got := c.workqueue.Len(); got != 1 {
+		t.Errorf("workqueue length after a node removed = %d, want 1", got)
+	}
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s/service"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// ServiceHandlers returns the service handlers whose informers list-and-watch the
+// k8s services in the scope. One informer is created for every namespace in
+// --namespaces, so the controller only needs the namespaced permissions. Otherwise
+// one informer watches all the namespaces, the namespaces in --exclude-namespaces
+// are filtered out by the field selector. --service-selector is the label selector
+// of all the informers.
+func ServiceHandlers(handler *service.Handler) []*service.Handler {
+	namespaces := watchedNamespaces()
+	if len(namespaces) == 0 {
+		handler.SetInformerFactoryTweakListOptions(tweakListOptions)
+		return []*service.Handler{handler}
+	}
+	var handlers []*service.Handler
+	for _, ns := range namespaces {
+		h := handler.WithNamespace(ns)
+		h.SetInformerFactoryNamespace(ns)
+		h.SetInformerFactoryTweakListOptions(tweakListOptions)
+		handlers = append(handlers, h)
+	}
+	return handlers
+}
+
+// watchedNamespaces returns the namespaces in --namespaces without duplicates,
+// an informer is created for every one of them. It's empty if all the namespaces
+// are watched by one informer.
+func watchedNamespaces() []string {
+	var namespaces []string
+	seen := make(map[string]bool)
+	for _, ns := range args.GetNamespaces() {
+		if seen[ns] {
+			continue
+		}
+		seen[ns] = true
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
+
+// tweakListOptions sets the label selector --service-selector and the field
+// selector filtering out the namespaces in --exclude-namespaces.
+func tweakListOptions(options *metav1.ListOptions) {
+	options.LabelSelector = args.GetServiceSelector()
+	var selectors []fields.Selector
+	for _, ns := range args.GetExcludeNamespaces() {
+		selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", ns))
+	}
+	if len(selectors) != 0 {
+		options.FieldSelector = fields.AndSelectors(selectors...).String()
+	}
+}
+
+// multiServiceLister merges the listers of the namespaced informers created
+// for --namespaces.
+type multiServiceLister []corelisters.ServiceLister
+
+// List lists the k8s services in all the namespaces.
+func (l multiServiceLister) List(selector labels.Selector) ([]*corev1.Service, error) {
+	var result []*corev1.Service
+	for _, lister := range l {
+		services, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, services...)
+	}
+	return result, nil
+}
+
+// Services returns the lister of the k8s services in the namespace.
+func (l multiServiceLister) Services(namespace string) corelisters.ServiceNamespaceLister {
+	return multiServiceNamespaceLister{listers: l, namespace: namespace}
+}
+
+type multiServiceNamespaceLister struct {
+	listers   multiServiceLister
+	namespace string
+}
+
+// List lists the k8s services in the namespace.
+func (l multiServiceNamespaceLister) List(selector labels.Selector) ([]*corev1.Service, error) {
+	var result []*corev1.Service
+	for _, lister := range l.listers {
+		services, err := lister.Services(l.namespace).List(selector)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, services...)
+	}
+	return result, nil
+}
+
+// Get returns the k8s service in the namespace, the namespace not watched has
+// no k8s service.
+func (l multiServiceNamespaceLister) Get(name string) (*corev1.Service, error) {
+	for _, lister := range l.listers {
+		svc, err := lister.Services(l.namespace).Get(name)
+		if err == nil {
+			return svc, nil
+		}
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return nil, errors.NewNotFound(corev1.Resource("service"), name)
+}
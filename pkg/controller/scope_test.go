@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// setupScope sets --namespaces, --exclude-namespaces and --service-selector,
+// they're cleared when the test finished.
+func setupScope(t *testing.T, namespaces, exclude []string, selector string) {
+	args.NewBuilder().SetNamespaces(namespaces).SetExcludeNamespaces(exclude).SetServiceSelector(selector)
+	t.Cleanup(func() {
+		args.NewBuilder().SetNamespaces(nil).SetExcludeNamespaces(nil).SetServiceSelector("")
+	})
+}
+
+func TestTweakListOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []string
+		exclude    []string
+		selector   string
+		options    metav1.ListOptions
+		// watched and excluded is the namespaces matched and not matched by the field selector.
+		watched  []string
+		excluded []string
+	}{
+		{
+			name:    "all namespaces",
+			options: metav1.ListOptions{},
+			watched: []string{"default", "kube-system"},
+		},
+		{
+			name:     "label selector",
+			selector: "tenant=a,tier!=internal",
+			options:  metav1.ListOptions{LabelSelector: "tenant=a,tier!=internal"},
+			watched:  []string{"default", "kube-system"},
+		},
+		{
+			name:     "exclude without include",
+			exclude:  []string{"kube-system", "monitoring"},
+			options:  metav1.ListOptions{FieldSelector: "metadata.namespace!=kube-system,metadata.namespace!=monitoring"},
+			watched:  []string{"default", "tenant-a"},
+			excluded: []string{"kube-system", "monitoring"},
+		},
+		{
+			name:       "include and exclude",
+			namespaces: []string{"tenant-a", "tenant-b"},
+			exclude:    []string{"tenant-b"},
+			selector:   "tenant=a",
+			options:    metav1.ListOptions{LabelSelector: "tenant=a", FieldSelector: "metadata.namespace!=tenant-b"},
+			watched:    []string{"tenant-a"},
+			excluded:   []string{"tenant-b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupScope(t, tt.namespaces, tt.exclude, tt.selector)
+			options := metav1.ListOptions{}
+			tweakListOptions(&options)
+			if !reflect.DeepEqual(options, tt.options) {
+				t.Fatalf("tweakListOptions() = %+v, want %+v", options, tt.options)
+			}
+			selector, err := fields.ParseSelector(options.FieldSelector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ns := range tt.watched {
+				if !selector.Matches(fields.Set{"metadata.namespace": ns}) {
+					t.Errorf("field selector %q does not match namespace %s", options.FieldSelector, ns)
+				}
+			}
+			for _, ns := range tt.excluded {
+				if selector.Matches(fields.Set{"metadata.namespace": ns}) {
+					t.Errorf("field selector %q matches the excluded namespace %s", options.FieldSelector, ns)
+				}
+			}
+			if _, err := labels.Parse(options.LabelSelector); err != nil {
+				t.Errorf("invalid label selector %q: %s", options.LabelSelector, err)
+			}
+		})
+	}
+}
+
+func TestWatchedNamespaces(t *testing.T) {
+	// one informer watches all the namespaces, the excluded ones are filtered
+	// out by the field selector.
+	setupScope(t, nil, []string{"kube-system"}, "")
+	if namespaces := watchedNamespaces(); len(namespaces) != 0 {
+		t.Errorf("watchedNamespaces() = %v, want all namespaces", namespaces)
+	}
+
+	setupScope(t, []string{"tenant-a", "tenant-b", "tenant-a"}, nil, "")
+	if namespaces, want := watchedNamespaces(), []string{"tenant-a", "tenant-b"}; !reflect.DeepEqual(namespaces, want) {
+		t.Errorf("watchedNamespaces() = %v, want %v", namespaces, want)
+	}
+}
+
+func TestMultiServiceLister(t *testing.T) {
+	lister := multiServiceLister{
+		newTestLister(t, newTestService("tenant-a", "web", 80), newTestService("tenant-a", "db", 3306)),
+		newTestLister(t, newTestService("tenant-b", "web", 81)),
+	}
+	names := func(services []*corev1.Service) []string {
+		var result []string
+		for _, svc := range services {
+			result = append(result, svc.Namespace+"/"+svc.Name)
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	services, err := lister.List(labels.Everything())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(services), []string{"tenant-a/db", "tenant-a/web", "tenant-b/web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+	if services, err = lister.Services("tenant-b").List(labels.Everything()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(services), []string{"tenant-b/web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Services(tenant-b).List() = %v, want %v", got, want)
+	}
+	if svc, err := lister.Services("tenant-b").Get("web"); err != nil || svc.Spec.Ports[0].Port != 81 {
+		t.Errorf("Services(tenant-b).Get(web) = %v, %v", svc, err)
+	}
+	// the namespace not watched has no k8s service.
+	if _, err := lister.Services("kube-system").Get("web"); !errors.IsNotFound(err) {
+		t.Errorf("Services(kube-system).Get(web) error = %v, want not found", err)
+	}
+	if services, err = lister.Services("kube-system").List(labels.Everything()); err != nil || len(services) != 0 {
+		t.Errorf("Services(kube-system).List() = %v, %v, want empty", names(services), err)
+	}
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/forbearing/k8s-loadbalancer/pkg/shard"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// AnnotationPool assigns the k8s service to the shard members of the pool
+	// (--shard-pool), the k8s service without it is assigned to the members
+	// without pool.
+	AnnotationPool = "loadbalancer/pool"
+	// AnnotationServedBy is the shard member serving the k8s service, it's
+	// written by the member.
+	AnnotationServedBy = "loadbalancer/served-by"
+)
+
+// OnMembersChanged is called when the shard members changed, the nginx config
+// of the k8s services assigned to this member or not anymore is regenerated.
+func OnMembersChanged(members []shard.Member) {
+	reselect(logrus.WithField("event", "shard"), func() {
+		shard.SetMembers(members)
+	})
+}
+
+// ownsService returns true if this member serves the k8s service, it's always
+// true if the sharding is disabled.
+func (c *Controller) ownsService(obj metav1.Object) bool {
+	if !shard.Enabled() {
+		return true
+	}
+	return shard.Owns(c.serviceKey(obj.GetNamespace(), obj.GetName()), obj.GetAnnotations()[AnnotationPool])
+}
+
+// updateServedBy sets the annotation "loadbalancer/served-by" of the k8s service
+// to this member, it does nothing if the sharding is disabled.
+func (c *Controller) updateServedBy(nginxService *nginx.Service) error {
+	if !shard.Enabled() || nginxService.Action != nginx.ActionTypeAdd {
+		return nil
+	}
+	svc, err := c.serviceLister.Services(nginxService.Namespace).Get(nginxService.Name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if svc.Annotations[AnnotationServedBy] == shard.Self() {
+		return nil
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{AnnotationServedBy: shard.Self()},
+		},
+	})
+	_, err = c.serviceHandler.Clientset().CoreV1().Services(svc.Namespace).Patch(
+		context.TODO(), svc.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/firewall"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/sirupsen/logrus"
+)
+
+// stateFile records the last VIPs and firewall rules of every cluster, they're
+// kept while the cluster is unreachable, even if it's unreachable since the
+// controller started, so its VIPs are not removed and its ports are not closed.
+var stateFile = "/var/lib/k8s-loadbalancer/clusters.json"
+
+// clusterState is the last state of a cluster whose informer caches synced.
+type clusterState struct {
+	// ID is the cluster id, it's unknown before the cluster connected
+	// if --cluster-id not specified.
+	ID    string          `json:"id"`
+	VIPs  []string        `json:"vips"`
+	Rules []firewall.Rule `json:"rules"`
+}
+
+var (
+	stateLocker sync.Mutex
+	// states is the last state of every cluster keyed by the cluster name,
+	// nil means the state file is not loaded yet.
+	states map[string]clusterState
+)
+
+// lastState returns the last state of the cluster.
+func lastState(cluster string) clusterState {
+	stateLocker.Lock()
+	defer stateLocker.Unlock()
+	loadStates()
+	return states[cluster]
+}
+
+// recordState records the state of the cluster into the state file if it
+// changed, the state file is not written in dry-run mode.
+func recordState(cluster string, update func(*clusterState)) {
+	stateLocker.Lock()
+	defer stateLocker.Unlock()
+	loadStates()
+	state := states[cluster]
+	update(&state)
+	if reflect.DeepEqual(state, states[cluster]) {
+		return
+	}
+	states[cluster] = state
+	if nginx.DryRun() {
+		return
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(stateFile), 0755); err == nil {
+			err = ioutil.WriteFile(stateFile, data, 0644)
+		}
+	}
+	if err != nil {
+		logrus.Errorf("record the state of the clusters failed: %s", err.Error())
+	}
+}
+
+// loadStates loads the state file once, the clusters not in the configuration
+// anymore are dropped. The caller should hold stateLocker.
+func loadStates() {
+	if states != nil {
+		return
+	}
+	states = make(map[string]clusterState)
+	data, err := ioutil.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &states)
+	}
+	if err != nil {
+		logrus.Errorf("load the state of the clusters failed: %s", err.Error())
+		states = make(map[string]clusterState)
+		return
+	}
+	configured := make(map[string]bool)
+	for _, c := range allControllers() {
+		configured[c.cluster] = true
+	}
+	for cluster := range states {
+		if !configured[cluster] {
+			delete(states, cluster)
+		}
+	}
+}
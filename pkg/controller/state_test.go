@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/firewall"
+)
+
+// fakeFirewall records the rules synced.
+type fakeFirewall struct{ rules []firewall.Rule }
+
+func (f *fakeFirewall) Name() string                     { return "fake" }
+func (f *fakeFirewall) Sync(rules []firewall.Rule) error { f.rules = rules; return nil }
+
+// setupStateFile writes the state of the clusters into a temporary state file,
+// the state file is restored when the test finished.
+func setupStateFile(t *testing.T, previous map[string]clusterState) string {
+	t.Helper()
+	file := stateFile
+	stateFile = filepath.Join(t.TempDir(), "clusters.json")
+	data, err := json.Marshal(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(stateFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	states = nil
+	t.Cleanup(func() {
+		stateFile = file
+		states = nil
+	})
+	return stateFile
+}
+
+func TestUnsyncedClusterKeepsLastState(t *testing.T) {
+	file := setupStateFile(t, map[string]clusterState{
+		"b": {
+			ID:    "idb",
+			VIPs:  []string{"10.0.0.9"},
+			Rules: []firewall.Rule{{Port: 8080, Protocol: "tcp"}},
+		},
+		// the cluster removed from the configuration.
+		"c": {ID: "idc", VIPs: []string{"10.0.0.10"}},
+	})
+	fw := &fakeFirewall{}
+
+	svc := newTestService("default", "web", 80)
+	svc.Annotations[AnnotationIP] = "10.0.0.1"
+	a := newTestController(t, svc)
+	a.cluster, a.firewall = "a", fw
+	registerTestController(t, a)
+	// the cluster b is unreachable since the controller started, its id is unknown.
+	b := newTestController(t)
+	b.cluster, b.firewall = "b", fw
+	b.clusterID.Store("")
+	atomic.StoreInt32(&b.cacheSynced, 0)
+	registerTestController(t, b)
+
+	syncFirewall()
+	want := []firewall.Rule{{IP: "10.0.0.1", Port: 80, Protocol: "tcp"}, {Port: 8080, Protocol: "tcp"}}
+	if !reflect.DeepEqual(fw.rules, want) {
+		t.Fatalf("firewall rules = %v, want %v", fw.rules, want)
+	}
+
+	ips, clusters, unsynced, synced := collectVIPs()
+	if !synced {
+		t.Fatal("no cluster synced")
+	}
+	if want := []string{"10.0.0.1", "10.0.0.9"}; !reflect.DeepEqual(ips, want) {
+		t.Fatalf("VIPs = %v, want %v", ips, want)
+	}
+	if want := map[string][]string{"abc": {"10.0.0.1"}}; !reflect.DeepEqual(clusters, want) {
+		t.Fatalf("VIPs of the synced clusters = %v, want %v", clusters, want)
+	}
+	if want := []string{"idb"}; !reflect.DeepEqual(unsynced, want) {
+		t.Fatalf("unsynced clusters = %v, want %v", unsynced, want)
+	}
+
+	// the state of the synced cluster is recorded, the removed cluster is dropped.
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded map[string]clusterState
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recorded["c"]; ok {
+		t.Fatal("the state of the removed cluster is kept")
+	}
+	if got := recorded["a"]; got.ID != "abc" || !reflect.DeepEqual(got.VIPs, []string{"10.0.0.1"}) || len(got.Rules) != 1 {
+		t.Fatalf("state of cluster a = %+v", got)
+	}
+	if got := recorded["b"]; !reflect.DeepEqual(got.VIPs, []string{"10.0.0.9"}) || len(got.Rules) != 1 {
+		t.Fatalf("state of cluster b = %+v", got)
+	}
+}
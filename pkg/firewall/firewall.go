@@ -0,0 +1,205 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BackendType is the host firewall the controller opens the nginx listen ports in.
+type BackendType string
+
+const (
+	// BackendAuto picks firewalld or ufw if it's active, otherwise nftables.
+	BackendAuto      BackendType = "auto"
+	BackendNftables  BackendType = "nftables"
+	BackendFirewalld BackendType = "firewalld"
+	BackendUFW       BackendType = "ufw"
+)
+
+// Rule opens the port/protocol of the ip address to the source ranges, the port
+// of all the addresses is opened if IP is empty, and it's opened to everyone if
+// SourceRanges is empty.
+type Rule struct {
+	IP           string   `json:"ip,omitempty"`
+	Port         int32    `json:"port"`
+	Protocol     string   `json:"protocol"`
+	SourceRanges []string `json:"sourceRanges,omitempty"`
+}
+
+func (r Rule) String() string {
+	s := fmt.Sprintf("%d/%s", r.Port, r.Protocol)
+	if len(r.IP) != 0 {
+		s = fmt.Sprintf("%s %s", r.IP, s)
+	}
+	if len(r.SourceRanges) == 0 {
+		return s
+	}
+	return fmt.Sprintf("%s from %s", s, strings.Join(r.SourceRanges, ","))
+}
+
+// Backend applies the rules to the host firewall.
+type Backend interface {
+	// Name returns the name of the backend.
+	Name() string
+	// Sync makes the rules managed by the controller exactly the provided rules,
+	// the rules not provided, such as the stale rules left by a crash, are removed.
+	Sync(rules []Rule) error
+}
+
+var (
+	locker sync.Mutex
+	// applied is the rules applied by the last successful Sync,
+	// nil means nothing applied since the controller started.
+	applied []Rule
+)
+
+// NewBackend creates the firewall backend.
+func NewBackend(typ BackendType) (Backend, error) {
+	switch typ {
+	case BackendAuto:
+		return detectBackend()
+	case BackendNftables:
+		return &nftables{}, nil
+	case BackendFirewalld:
+		return &firewalld{}, nil
+	case BackendUFW:
+		return &ufw{}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall backend: %q", typ)
+}
+
+// detectBackend returns firewalld or ufw if it's active, because the rules
+// added by nftables directly may be overridden by them. Otherwise returns nftables.
+func detectBackend() (Backend, error) {
+	if err := exec.Command("firewall-cmd", "--state").Run(); err == nil {
+		return &firewalld{}, nil
+	}
+	if out, err := exec.Command("ufw", "status").Output(); err == nil && bytes.Contains(out, []byte("Status: active")) {
+		return &ufw{}, nil
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		return &nftables{}, nil
+	}
+	return nil, fmt.Errorf("no supported firewall found, install one of nftables, firewalld or ufw")
+}
+
+// Sync normalizes the rules and applies them by the backend, it does nothing
+// if the rules are the same as the last applied.
+func Sync(backend Backend, rules []Rule) error {
+	rules = normalize(rules)
+	locker.Lock()
+	defer locker.Unlock()
+	if applied != nil && reflect.DeepEqual(applied, rules) {
+		return nil
+	}
+	if err := backend.Sync(rules); err != nil {
+		return fmt.Errorf("%s: %s", backend.Name(), err.Error())
+	}
+	logrus.Infof("%s firewall synced, %d ports opened", backend.Name(), len(rules))
+	applied = rules
+	return nil
+}
+
+// normalize merges the rules of the same ip, port and protocol, and sorts them.
+// A port/protocol of an ip opened to everyone by any rule is opened to everyone,
+// the same port of the other ip addresses keeps its source ranges. The rules of
+// an ip address are sorted before the rules of all the addresses, so they're
+// matched first by the backends evaluating the rules in order.
+func normalize(rules []Rule) []Rule {
+	type key struct {
+		ip       string
+		port     int32
+		protocol string
+	}
+	merged := make(map[key]map[string]struct{})
+	for _, r := range rules {
+		k := key{ip: strings.TrimSpace(r.IP), port: r.Port, protocol: strings.ToLower(r.Protocol)}
+		sources, ok := merged[k]
+		if ok && sources == nil {
+			continue
+		}
+		if len(r.SourceRanges) == 0 {
+			merged[k] = nil
+			continue
+		}
+		if sources == nil {
+			sources = make(map[string]struct{})
+			merged[k] = sources
+		}
+		for _, s := range r.SourceRanges {
+			sources[strings.TrimSpace(s)] = struct{}{}
+		}
+	}
+	result := []Rule{}
+	for k, sources := range merged {
+		rule := Rule{IP: k.ip, Port: k.port, Protocol: k.protocol}
+		for s := range sources {
+			rule.SourceRanges = append(rule.SourceRanges, s)
+		}
+		sort.Strings(rule.SourceRanges)
+		result = append(result, rule)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if (len(result[i].IP) == 0) != (len(result[j].IP) == 0) {
+			return len(result[i].IP) != 0
+		}
+		if result[i].IP != result[j].IP {
+			return result[i].IP < result[j].IP
+		}
+		if result[i].Port != result[j].Port {
+			return result[i].Port < result[j].Port
+		}
+		return result[i].Protocol < result[j].Protocol
+	})
+	return result
+}
+
+// ValidateSourceRanges returns error if any of the source ranges is not a valid CIDR.
+// The rule with invalid source ranges should not be synced, otherwise the whole
+// ruleset will be rejected by the firewall.
+func ValidateSourceRanges(ranges []string) error {
+	for _, r := range ranges {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(r)); err != nil {
+			return fmt.Errorf("invalid source range %q: %s", r, err.Error())
+		}
+	}
+	return nil
+}
+
+// isIPv6CIDR returns true if the CIDR is an IPv6 network.
+func isIPv6CIDR(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+// isIPv6 returns true if the ip is an IPv6 address.
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// execute runs the command and returns the error with the stderr output.
+func execute(stdin string, command ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	if len(stdin) != 0 {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	cmd.Stderr = &stderr
+	logrus.Debug(strings.Join(command, " "))
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() != 0 {
+			return fmt.Errorf("%s: %s: %s", strings.Join(command, " "), err.Error(), strings.TrimSpace(stderr.String()))
+		}
+		return fmt.Errorf("%s: %s", strings.Join(command, " "), err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package firewall
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sharedPortRules is the rules of two k8s services sharing the port on different
+// ip addresses, only one of them has source ranges.
+var sharedPortRules = []Rule{
+	{IP: "10.0.0.2", Port: 80, Protocol: "TCP"},
+	{IP: "10.0.0.1", Port: 80, Protocol: "tcp", SourceRanges: []string{"192.168.0.0/16"}},
+	{Port: 53, Protocol: "udp"},
+}
+
+func TestNormalizeSharedPort(t *testing.T) {
+	rules := normalize(append(sharedPortRules,
+		Rule{IP: "10.0.0.1", Port: 80, Protocol: "tcp", SourceRanges: []string{"172.16.0.0/12"}}))
+	want := []Rule{
+		{IP: "10.0.0.1", Port: 80, Protocol: "tcp", SourceRanges: []string{"172.16.0.0/12", "192.168.0.0/16"}},
+		{IP: "10.0.0.2", Port: 80, Protocol: "tcp"},
+		{Port: 53, Protocol: "udp"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("normalize() = %v, want %v", rules, want)
+	}
+
+	// the same ip is opened to everyone by any rule.
+	rules = normalize([]Rule{
+		{IP: "10.0.0.1", Port: 80, Protocol: "tcp", SourceRanges: []string{"192.168.0.0/16"}},
+		{IP: "10.0.0.1", Port: 80, Protocol: "tcp"},
+	})
+	if want := []Rule{{IP: "10.0.0.1", Port: 80, Protocol: "tcp"}}; !reflect.DeepEqual(rules, want) {
+		t.Errorf("normalize() = %v, want %v", rules, want)
+	}
+}
+
+func TestBackendsSharedPort(t *testing.T) {
+	rules := normalize(sharedPortRules)
+
+	ruleset := (&nftables{}).ruleset(rules, nil)
+	for _, s := range []string{
+		"\t\tip daddr 10.0.0.1 ip saddr { 192.168.0.0/16 } tcp dport 80 accept\n",
+		"\t\tip daddr 10.0.0.1 tcp dport 80 drop\n",
+		"\t\tip daddr 10.0.0.2 tcp dport 80 accept\n",
+		"\t\tudp dport 53 accept\n",
+	} {
+		if !strings.Contains(ruleset, s) {
+			t.Errorf("nftables ruleset does not contain %q:\n%s", s, ruleset)
+		}
+	}
+	if strings.Contains(ruleset, "\t\ttcp dport 80") {
+		t.Errorf("nftables ruleset matches the port of all the addresses:\n%s", ruleset)
+	}
+
+	u := &ufw{}
+	var ufwRules []string
+	for _, e := range expand(rules) {
+		ufwRules = append(ufwRules, strings.Join(u.rule(e), " "))
+	}
+	wantUFW := []string{
+		"allow proto tcp from 192.168.0.0/16 to 10.0.0.1 port 80",
+		"allow proto tcp from any to 10.0.0.2 port 80",
+		"allow proto udp from any to any port 53",
+	}
+	if !reflect.DeepEqual(ufwRules, wantUFW) {
+		t.Errorf("ufw rules = %q, want %q", ufwRules, wantUFW)
+	}
+
+	f := &firewalld{}
+	var firewalldArgs []string
+	for _, e := range expand(rules) {
+		firewalldArgs = append(firewalldArgs, f.arg("add", e))
+	}
+	wantFirewalld := []string{
+		`--add-rich-rule=rule family="ipv4" source address="192.168.0.0/16" destination address="10.0.0.1" port port="80" protocol="tcp" accept`,
+		`--add-rich-rule=rule family="ipv4" destination address="10.0.0.2" port port="80" protocol="tcp" accept`,
+		`--add-port=53/udp`,
+	}
+	if !reflect.DeepEqual(firewalldArgs, wantFirewalld) {
+		t.Errorf("firewalld args = %q, want %q", firewalldArgs, wantFirewalld)
+	}
+}
+
+func TestIPv6Rule(t *testing.T) {
+	rules := normalize([]Rule{{IP: "fd00::1", Port: 443, Protocol: "tcp", SourceRanges: []string{"10.0.0.0/8", "fd00::/8"}}})
+	ruleset := (&nftables{}).ruleset(rules, nil)
+	if !strings.Contains(ruleset, "\t\tip6 daddr fd00::1 ip6 saddr { fd00::/8 } tcp dport 443 accept\n") ||
+		strings.Contains(ruleset, "10.0.0.0/8") {
+		t.Errorf("unexpected nftables ruleset:\n%s", ruleset)
+	}
+	// the IPv4 source never reaches the IPv6 address.
+	if entries := expand(rules); len(entries) != 1 || entries[0].Source != "fd00::/8" {
+		t.Errorf("entries = %+v", entries)
+	}
+}
@@ -0,0 +1,55 @@
+package firewall
+
+import "fmt"
+
+// firewalld opens the ports in the default zone of firewalld. The ports with
+// source ranges are opened by rich rules.
+type firewalld struct {
+	changed bool
+}
+
+var _ Backend = &firewalld{}
+
+func (f *firewalld) Name() string { return string(BackendFirewalld) }
+
+// Sync changes the permanent configuration and reloads firewalld if anything changed.
+func (f *firewalld) Sync(rules []Rule) error {
+	f.changed = false
+	if err := syncEntries(f.Name(), rules, f.add, f.remove); err != nil {
+		return err
+	}
+	if !f.changed {
+		return nil
+	}
+	return execute("", "firewall-cmd", "--reload")
+}
+
+func (f *firewalld) add(e entry) error {
+	f.changed = true
+	return execute("", "firewall-cmd", "--permanent", f.arg("add", e))
+}
+
+func (f *firewalld) remove(e entry) error {
+	f.changed = true
+	return execute("", "firewall-cmd", "--permanent", f.arg("remove", e))
+}
+
+// arg returns the firewall-cmd argument to add or remove the entry, the entry
+// of an ip or with a source is added by a rich rule.
+func (f *firewalld) arg(op string, e entry) string {
+	if len(e.Source) == 0 && len(e.IP) == 0 {
+		return fmt.Sprintf("--%s-port=%d/%s", op, e.Port, e.Protocol)
+	}
+	family := "ipv4"
+	if isIPv6CIDR(e.Source) || isIPv6(e.IP) {
+		family = "ipv6"
+	}
+	rule := fmt.Sprintf(`rule family="%s"`, family)
+	if len(e.Source) != 0 {
+		rule += fmt.Sprintf(` source address="%s"`, e.Source)
+	}
+	if len(e.IP) != 0 {
+		rule += fmt.Sprintf(` destination address="%s"`, e.IP)
+	}
+	return fmt.Sprintf(`--%s-rich-rule=%s port port="%d" protocol="%s" accept`, op, rule, e.Port, e.Protocol)
+}
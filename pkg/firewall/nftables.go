@@ -0,0 +1,142 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// nftablesTable is the nftables table owned by the controller. All the rules
+// live in this table, so the rules of other tables are never touched.
+const nftablesTable = "k8s-loadbalancer"
+
+// nftablesPriority is the priority of the input chain of the owned table, it's
+// evaluated before the input chains of the common "inet filter" table (priority 0),
+// so the sources not allowed are dropped before any accept rule of other tables.
+const nftablesPriority = -5
+
+// nftablesFilterChain is the input chain of the common "inet filter" table, the
+// previous versions inserted the accept rules marked by nftablesComment into it.
+const (
+	nftablesFilterTable = "filter"
+	nftablesFilterChain = "input"
+	nftablesComment     = "k8s-loadbalancer"
+)
+
+// nftables opens the ports in the nftables table owned by the controller.
+//
+// The input chain of the owned table has policy accept and runs before the other
+// input chains: the ports with source ranges accept the allowed sources and drop
+// the others, the ports without source ranges are accepted. An accept only ends
+// the evaluation of its own chain, so a drop by the other tables, eg: the policy
+// drop of "inet filter", still takes effect, the ports should be allowed there too.
+type nftables struct{}
+
+var _ Backend = &nftables{}
+
+func (n *nftables) Name() string { return string(BackendNftables) }
+
+// Sync replaces the whole table in one transaction, so the stale rules are removed.
+// The table is deleted if there is no rule. The rules left in the input chain of
+// the "inet filter" table by the previous versions are removed in the same transaction.
+func (n *nftables) Sync(rules []Rule) error {
+	chain, err := n.filterChain()
+	if err != nil {
+		return err
+	}
+	return execute(n.ruleset(rules, chain), "nft", "-f", "-")
+}
+
+// filterChain returns the input chain of the "inet filter" table with the handles
+// of the rules marked by the controller, it returns nil if the chain not exists.
+func (n *nftables) filterChain() (*nftablesChain, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("nft", "-a", "list", "chain", "inet", nftablesFilterTable, nftablesFilterChain)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// the table or the chain not exists.
+		if strings.Contains(stderr.String(), "No such file or directory") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list chain inet %s %s: %s: %s", nftablesFilterTable, nftablesFilterChain,
+			err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return parseFilterChain(string(out)), nil
+}
+
+// nftablesChain is the existing input chain of the "inet filter" table.
+type nftablesChain struct {
+	// handles is the handles of the rules inserted by the controller.
+	handles []int
+}
+
+// nftablesHandleRegexp matches the rule marked by the controller in "nft -a list chain" output.
+var nftablesHandleRegexp = regexp.MustCompile(`comment "` + nftablesComment + `" # handle (\d+)`)
+
+// parseFilterChain parses the "nft -a list chain" output.
+func parseFilterChain(output string) *nftablesChain {
+	chain := &nftablesChain{}
+	for _, match := range nftablesHandleRegexp.FindAllStringSubmatch(output, -1) {
+		handle, _ := strconv.Atoi(match[1])
+		chain.handles = append(chain.handles, handle)
+	}
+	return chain
+}
+
+// ruleset returns the nft script replacing the owned table with the rules, and
+// deleting the marked rules in the input chain of the "inet filter" table if any.
+func (n *nftables) ruleset(rules []Rule, chain *nftablesChain) string {
+	var b strings.Builder
+	// declaring the table before deleting it makes the deletion never fail.
+	fmt.Fprintf(&b, "table inet %s\n", nftablesTable)
+	fmt.Fprintf(&b, "delete table inet %s\n", nftablesTable)
+	if chain != nil {
+		for _, handle := range chain.handles {
+			fmt.Fprintf(&b, "delete rule inet %s %s handle %d\n", nftablesFilterTable, nftablesFilterChain, handle)
+		}
+	}
+	if len(rules) == 0 {
+		return b.String()
+	}
+	fmt.Fprintf(&b, "table inet %s {\n", nftablesTable)
+	b.WriteString("\tchain input {\n")
+	fmt.Fprintf(&b, "\t\ttype filter hook input priority %d; policy accept;\n", nftablesPriority)
+	// the rules of an ip address are before the rules of all the addresses.
+	for _, r := range rules {
+		match := fmt.Sprintf("%s dport %d", r.Protocol, r.Port)
+		daddr := ""
+		if len(r.IP) != 0 {
+			daddr = fmt.Sprintf("ip daddr %s ", r.IP)
+			if isIPv6(r.IP) {
+				daddr = fmt.Sprintf("ip6 daddr %s ", r.IP)
+			}
+		}
+		if len(r.SourceRanges) == 0 {
+			fmt.Fprintf(&b, "\t\t%s%s accept\n", daddr, match)
+			continue
+		}
+		var v4, v6 []string
+		for _, s := range r.SourceRanges {
+			if isIPv6CIDR(s) {
+				v6 = append(v6, s)
+			} else {
+				v4 = append(v4, s)
+			}
+		}
+		// the source of the other ip family never reaches the ip.
+		if len(v4) != 0 && (len(r.IP) == 0 || !isIPv6(r.IP)) {
+			fmt.Fprintf(&b, "\t\t%sip saddr { %s } %s accept\n", daddr, strings.Join(v4, ", "), match)
+		}
+		if len(v6) != 0 && (len(r.IP) == 0 || isIPv6(r.IP)) {
+			fmt.Fprintf(&b, "\t\t%sip6 saddr { %s } %s accept\n", daddr, strings.Join(v6, ", "), match)
+		}
+		fmt.Fprintf(&b, "\t\t%s%s drop\n", daddr, match)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,89 @@
+package firewall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFilterChain(t *testing.T) {
+	output := `table inet filter {
+	chain input { # handle 1
+		type filter hook input priority filter; policy drop;
+		ct state established,related accept # handle 4
+		tcp dport 22 accept # handle 5
+		tcp dport 80 accept comment "k8s-loadbalancer" # handle 12
+		ip saddr { 10.0.0.0/8 } udp dport 53 accept comment "k8s-loadbalancer" # handle 13
+	}
+}
+`
+	chain := parseFilterChain(output)
+	if want := []int{12, 13}; !reflect.DeepEqual(chain.handles, want) {
+		t.Errorf("handles = %v, want %v", chain.handles, want)
+	}
+}
+
+func TestNftablesRuleset(t *testing.T) {
+	rules := []Rule{
+		{Port: 80, Protocol: "tcp"},
+		{Port: 53, Protocol: "udp", SourceRanges: []string{"10.0.0.0/8", "fd00::/8"}},
+	}
+	n := &nftables{}
+
+	// without the inet filter table only the owned table is replaced.
+	ruleset := n.ruleset(rules, nil)
+	if strings.Contains(ruleset, "inet filter") {
+		t.Errorf("ruleset touches the inet filter table:\n%s", ruleset)
+	}
+
+	// all the rules are in the owned table, the marked rules left in the inet filter table are removed.
+	ruleset = n.ruleset(rules, &nftablesChain{handles: []int{12}})
+	for _, s := range []string{
+		"delete table inet k8s-loadbalancer\n",
+		"delete rule inet filter input handle 12\n",
+		"\t\ttype filter hook input priority -5; policy accept;\n",
+		"\t\ttcp dport 80 accept\n",
+		"\t\tip saddr { 10.0.0.0/8 } udp dport 53 accept\n",
+		"\t\tip6 saddr { fd00::/8 } udp dport 53 accept\n",
+		"\t\tudp dport 53 drop\n",
+	} {
+		if !strings.Contains(ruleset, s) {
+			t.Errorf("ruleset does not contain %q:\n%s", s, ruleset)
+		}
+	}
+	if strings.Contains(ruleset, "insert") || strings.Contains(ruleset, "add rule") {
+		t.Errorf("ruleset adds rules out of the owned table:\n%s", ruleset)
+	}
+
+	// the owned table is deleted if no rule.
+	ruleset = n.ruleset(nil, nil)
+	if strings.Contains(ruleset, "chain input") {
+		t.Errorf("unexpected ruleset:\n%s", ruleset)
+	}
+}
+
+// fakeNft puts the fake nft command into PATH, it fails with the stderr.
+func fakeNft(t *testing.T, stderr string) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho '" + stderr + "' >&2\nexit 1\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "nft"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestFilterChainErrors(t *testing.T) {
+	n := &nftables{}
+	fakeNft(t, "Error: No such file or directory; did you mean table 'filter' in family ip?")
+	if chain, err := n.filterChain(); chain != nil || err != nil {
+		t.Errorf("filterChain() = %v, %v, want the chain not exists", chain, err)
+	}
+
+	fakeNft(t, "Error: Operation not permitted")
+	if _, err := n.filterChain(); err == nil || !strings.Contains(err.Error(), "Operation not permitted") {
+		t.Errorf("filterChain() error = %v, want the permission error", err)
+	}
+}
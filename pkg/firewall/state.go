@@ -0,0 +1,125 @@
+package firewall
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stateDir is the directory the rules applied to firewalld and ufw are recorded in.
+// firewalld and ufw have no place to mark the rules owned by the controller,
+// so the recorded rules are used to remove the stale ones.
+var stateDir = "/var/lib/k8s-loadbalancer"
+
+// entry is a single port/protocol rule of an ip opened to a single source, IP is
+// empty for all the addresses, Source is empty if the port is opened to everyone.
+type entry struct {
+	IP       string `json:"ip,omitempty"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol"`
+	Source   string `json:"source,omitempty"`
+}
+
+// expand expands the rules to entries.
+func expand(rules []Rule) []entry {
+	var entries []entry
+	for _, r := range rules {
+		if len(r.SourceRanges) == 0 {
+			entries = append(entries, entry{IP: r.IP, Port: r.Port, Protocol: r.Protocol})
+			continue
+		}
+		for _, s := range r.SourceRanges {
+			// the source of the other ip family never reaches the ip.
+			if len(r.IP) != 0 && isIPv6(r.IP) != isIPv6CIDR(s) {
+				continue
+			}
+			entries = append(entries, entry{IP: r.IP, Port: r.Port, Protocol: r.Protocol, Source: s})
+		}
+	}
+	return entries
+}
+
+// syncEntries adds the entries of the rules not applied yet, and removes the
+// applied entries recorded in the state file but not in the rules.
+func syncEntries(name string, rules []Rule, add, remove func(entry) error) error {
+	stateFile := filepath.Join(stateDir, "firewall-"+name+".json")
+	recorded, err := loadEntries(stateFile)
+	if err != nil {
+		return err
+	}
+	desired := expand(rules)
+	desiredSet := make(map[entry]struct{})
+	for _, e := range desired {
+		desiredSet[e] = struct{}{}
+	}
+	recordedSet := make(map[entry]struct{})
+	for _, e := range recorded {
+		recordedSet[e] = struct{}{}
+	}
+
+	// record the union before changing the firewall, so the entries added
+	// will be removed by next sync even if the controller crashed.
+	union := append([]entry{}, recorded...)
+	for _, e := range desired {
+		if _, ok := recordedSet[e]; !ok {
+			union = append(union, e)
+		}
+	}
+	if err := saveEntries(stateFile, union); err != nil {
+		return err
+	}
+	for _, e := range desired {
+		if _, ok := recordedSet[e]; ok {
+			continue
+		}
+		if err := add(e); err != nil {
+			return err
+		}
+	}
+	for _, e := range recorded {
+		if _, ok := desiredSet[e]; ok {
+			continue
+		}
+		// the entry may be removed manually, don't stop the sync.
+		if err := remove(e); err != nil {
+			logrus.Warnf("remove %s firewall rule failed: %s", name, err.Error())
+		}
+	}
+	return saveEntries(stateFile, desired)
+}
+
+// loadEntries reads the entries recorded in the state file,
+// returns nothing if the state file not exists.
+func loadEntries(filename string) ([]entry, error) {
+	data, err := ioutil.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// saveEntries records the entries into the state file.
+func saveEntries(filename string, entries []entry) error {
+	if entries == nil {
+		entries = []entry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
@@ -0,0 +1,38 @@
+package firewall
+
+import "strconv"
+
+// ufwComment is the comment of the ufw rules added by the controller.
+const ufwComment = "k8s-loadbalancer"
+
+// ufw opens the ports by "ufw allow".
+type ufw struct{}
+
+var _ Backend = &ufw{}
+
+func (u *ufw) Name() string { return string(BackendUFW) }
+
+// Sync adds and deletes the ufw rules, ufw applies the changes immediately.
+func (u *ufw) Sync(rules []Rule) error {
+	return syncEntries(u.Name(), rules, u.add, u.remove)
+}
+
+func (u *ufw) add(e entry) error {
+	return execute("", append(append([]string{"ufw"}, u.rule(e)...), "comment", ufwComment)...)
+}
+
+func (u *ufw) remove(e entry) error {
+	return execute("", append([]string{"ufw", "delete"}, u.rule(e)...)...)
+}
+
+// rule returns the ufw rule arguments of the entry.
+func (u *ufw) rule(e entry) []string {
+	source, dest := e.Source, e.IP
+	if len(source) == 0 {
+		source = "any"
+	}
+	if len(dest) == 0 {
+		dest = "any"
+	}
+	return []string{"allow", "proto", e.Protocol, "from", source, "to", dest, "port", strconv.Itoa(int(e.Port))}
+}
@@ -0,0 +1,253 @@
+package healthcheck
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Mode is the way the controller probes the upstream hosts.
+type Mode string
+
+const (
+	// ModeNone disables the active health checking.
+	ModeNone Mode = "none"
+	// ModeTCP probes the upstream hosts by tcp connect to the k8s service NodePort.
+	ModeTCP Mode = "tcp"
+	// ModeHTTP probes the upstream hosts by http GET the kube-proxy healthz endpoint.
+	ModeHTTP Mode = "http"
+)
+
+var (
+	locker sync.RWMutex
+	// targets is the probe targets registered by every k8s service, key is the service key.
+	targets = make(map[string][]Target)
+	// statuses is the probe status of every target.
+	statuses = make(map[Target]*status)
+)
+
+func init() {
+	metrics.Register("healthcheck", writeMetrics)
+}
+
+// Target is the upstream host and port to probe.
+type Target struct {
+	Host string
+	Port int32
+}
+
+func (t Target) String() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(int(t.Port)))
+}
+
+// status is the probe status of a target. The target is considered down after
+// "fall" consecutive failed probes, and up again after "rise" consecutive
+// successful probes, so it will not flap.
+type status struct {
+	down      bool
+	successes int
+	failures  int
+	total     int
+	failed    int
+}
+
+// Enabled returns true if the active health checking is enabled.
+func Enabled() bool {
+	return Mode(args.GetHealthCheckMode()) == ModeTCP || Mode(args.GetHealthCheckMode()) == ModeHTTP
+}
+
+// Register registers the upstream host and port of the k8s service to probe,
+// the targets registered before by the same key will be replaced.
+func Register(key string, hosts []string, port int32) {
+	if !Enabled() {
+		return
+	}
+	var ts []Target
+	for _, host := range hosts {
+		ts = append(ts, toProbeTarget(Target{Host: host, Port: port}))
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	targets[key] = ts
+}
+
+// Unregister unregisters the targets of the k8s service.
+func Unregister(key string) {
+	locker.Lock()
+	defer locker.Unlock()
+	delete(targets, key)
+}
+
+// IsDown returns true if the upstream host and port is considered down.
+// It always returns false if the active health checking is disabled.
+func IsDown(host string, port int32) bool {
+	if !Enabled() {
+		return false
+	}
+	locker.RLock()
+	defer locker.RUnlock()
+	st, ok := statuses[toProbeTarget(Target{Host: host, Port: port})]
+	return ok && st.down
+}
+
+// toProbeTarget converts the upstream target to the target actually probed,
+// in http mode all the NodePorts of a host share the kube-proxy healthz port.
+func toProbeTarget(t Target) Target {
+	if Mode(args.GetHealthCheckMode()) == ModeHTTP {
+		t.Port = int32(args.GetHealthCheckPort())
+	}
+	return t
+}
+
+// Run probes all the registered targets every --health-check-interval until
+// stopCh closed. onChange is called when any target becomes up or down.
+func Run(stopCh <-chan struct{}, onChange func()) {
+	if !Enabled() {
+		return
+	}
+	logrus.Infof("Starting %s health checking", args.GetHealthCheckMode())
+	ticker := time.NewTicker(args.GetHealthCheckInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if probeAll() {
+				onChange()
+			}
+		}
+	}
+}
+
+// probeAll probes all the registered targets concurrently,
+// returns true if any target status changed.
+func probeAll() bool {
+	locker.RLock()
+	set := make(map[Target]struct{})
+	for _, ts := range targets {
+		for _, t := range ts {
+			set[t] = struct{}{}
+		}
+	}
+	locker.RUnlock()
+
+	results := make(map[Target]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for t := range set {
+		wg.Add(1)
+		go func(t Target) {
+			defer wg.Done()
+			err := probe(t)
+			mu.Lock()
+			results[t] = err
+			mu.Unlock()
+		}(t)
+	}
+	wg.Wait()
+	return record(set, results)
+}
+
+// record updates the status of the targets by the probe results, the targets not
+// in set are forgotten. It returns true if any target becomes up or down.
+func record(set map[Target]struct{}, results map[Target]error) bool {
+	locker.Lock()
+	defer locker.Unlock()
+	changed := false
+	for t, err := range results {
+		st, ok := statuses[t]
+		if !ok {
+			st = &status{}
+			statuses[t] = st
+		}
+		st.total++
+		if err != nil {
+			st.failed++
+			st.failures++
+			st.successes = 0
+			logrus.WithField("target", t.String()).Debugf("probe failed: %s", err.Error())
+			if !st.down && st.failures >= args.GetHealthCheckFall() {
+				st.down = true
+				changed = true
+				logrus.WithField("target", t.String()).Warnf("upstream is down after %d failed probes: %s", st.failures, err.Error())
+			}
+		} else {
+			st.successes++
+			st.failures = 0
+			if st.down && st.successes >= args.GetHealthCheckRise() {
+				st.down = false
+				changed = true
+				logrus.WithField("target", t.String()).Infof("upstream is up after %d successful probes", st.successes)
+			}
+		}
+	}
+	// forget the targets no longer registered.
+	for t := range statuses {
+		if _, ok := set[t]; !ok {
+			delete(statuses, t)
+		}
+	}
+	return changed
+}
+
+// probe probes the target once.
+func probe(t Target) error {
+	timeout := args.GetHealthCheckTimeout()
+	switch Mode(args.GetHealthCheckMode()) {
+	case ModeHTTP:
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(fmt.Sprintf("http://%s%s", t.String(), args.GetHealthCheckPath()))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+		return nil
+	default:
+		conn, err := net.DialTimeout("tcp", t.String(), timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// writeMetrics writes the probe status of every target.
+func writeMetrics(w io.Writer) {
+	locker.RLock()
+	defer locker.RUnlock()
+	var ts []Target
+	for t := range statuses {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].String() < ts[j].String() })
+
+	metrics.WriteHeader(w, "k8s_loadbalancer_upstream_up", "gauge", "Whether the upstream target is considered up by the active health checking.")
+	for _, t := range ts {
+		up := 1.0
+		if statuses[t].down {
+			up = 0
+		}
+		metrics.WriteSample(w, "k8s_loadbalancer_upstream_up", up, "host", t.Host, "port", strconv.Itoa(int(t.Port)))
+	}
+	metrics.WriteHeader(w, "k8s_loadbalancer_upstream_probes_total", "counter", "The total number of probes to the upstream target.")
+	for _, t := range ts {
+		metrics.WriteSample(w, "k8s_loadbalancer_upstream_probes_total", float64(statuses[t].total), "host", t.Host, "port", strconv.Itoa(int(t.Port)))
+	}
+	metrics.WriteHeader(w, "k8s_loadbalancer_upstream_probe_failures_total", "counter", "The total number of failed probes to the upstream target.")
+	for _, t := range ts {
+		metrics.WriteSample(w, "k8s_loadbalancer_upstream_probe_failures_total", float64(statuses[t].failed), "host", t.Host, "port", strconv.Itoa(int(t.Port)))
+	}
+}
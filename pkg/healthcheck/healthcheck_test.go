@@ -0,0 +1,108 @@
+package healthcheck
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+)
+
+// setupHealthCheck enables the tcp health checking with the rise and fall,
+// the probe status is cleared when the test finished.
+func setupHealthCheck(t *testing.T, rise, fall int) {
+	args.NewBuilder().SetHealthCheckMode(string(ModeTCP)).SetHealthCheckRise(rise).SetHealthCheckFall(fall)
+	t.Cleanup(func() {
+		args.NewBuilder().SetHealthCheckMode(string(ModeNone))
+		locker.Lock()
+		targets = make(map[string][]Target)
+		statuses = make(map[Target]*status)
+		locker.Unlock()
+	})
+}
+
+func TestRiseFall(t *testing.T) {
+	failed := errors.New("connection refused")
+	tests := []struct {
+		name string
+		// probes is the probe results in order, true means succeeded.
+		probes []bool
+		// down is whether the target is down after every probe.
+		down []bool
+		// changed is whether the status changed by every probe.
+		changed []bool
+	}{
+		{
+			name:    "down after fall failures",
+			probes:  []bool{false, false, false, false},
+			down:    []bool{false, false, true, true},
+			changed: []bool{false, false, true, false},
+		},
+		{
+			name:    "success resets the failures",
+			probes:  []bool{false, false, true, false, false, false},
+			down:    []bool{false, false, false, false, false, true},
+			changed: []bool{false, false, false, false, false, true},
+		},
+		{
+			name:    "up after rise successes",
+			probes:  []bool{false, false, false, true, true},
+			down:    []bool{false, false, true, true, false},
+			changed: []bool{false, false, true, false, true},
+		},
+		{
+			name:    "failure resets the successes",
+			probes:  []bool{false, false, false, true, false, true, true},
+			down:    []bool{false, false, true, true, true, true, false},
+			changed: []bool{false, false, true, false, false, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupHealthCheck(t, 2, 3)
+			target := Target{Host: "10.0.0.1", Port: 30080}
+			set := map[Target]struct{}{target: {}}
+			for i, ok := range tt.probes {
+				var err error
+				if !ok {
+					err = failed
+				}
+				if changed := record(set, map[Target]error{target: err}); changed != tt.changed[i] {
+					t.Errorf("probe %d: changed = %t, want %t", i, changed, tt.changed[i])
+				}
+				if down := IsDown(target.Host, target.Port); down != tt.down[i] {
+					t.Errorf("probe %d: down = %t, want %t", i, down, tt.down[i])
+				}
+			}
+			locker.RLock()
+			st := statuses[target]
+			locker.RUnlock()
+			if st.total != len(tt.probes) {
+				t.Errorf("total probes = %d, want %d", st.total, len(tt.probes))
+			}
+		})
+	}
+}
+
+func TestForgetUnregisteredTargets(t *testing.T) {
+	setupHealthCheck(t, 1, 1)
+	a, b := Target{Host: "10.0.0.1", Port: 30080}, Target{Host: "10.0.0.2", Port: 30080}
+	failed := errors.New("timeout")
+	record(map[Target]struct{}{a: {}, b: {}}, map[Target]error{a: failed, b: failed})
+	if !IsDown(a.Host, a.Port) || !IsDown(b.Host, b.Port) {
+		t.Fatal("targets are not down after failed probes")
+	}
+	record(map[Target]struct{}{a: {}}, map[Target]error{a: failed})
+	if IsDown(b.Host, b.Port) {
+		t.Error("the status of the unregistered target is kept")
+	}
+}
+
+func TestIsDownDisabled(t *testing.T) {
+	setupHealthCheck(t, 1, 1)
+	target := Target{Host: "10.0.0.1", Port: 30080}
+	record(map[Target]struct{}{target: {}}, map[Target]error{target: errors.New("timeout")})
+	args.NewBuilder().SetHealthCheckMode(string(ModeNone))
+	if IsDown(target.Host, target.Port) {
+		t.Error("target is down while the health checking disabled")
+	}
+}
@@ -0,0 +1,155 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var (
+	locker sync.Mutex
+	// pools is the ip address pools, nil if the ip address management is disabled.
+	pools []*Pool
+	// assigned is the ip address assigned to every k8s service, key is namespace/name.
+	assigned = make(map[string]string)
+	// owners is the k8s services every ip address assigned to. An ip address
+	// allocated from the pool has only one owner, while an ip address requested
+	// explicitly may be shared by multiple k8s services.
+	owners = make(map[string]map[string]bool)
+)
+
+// SetConfig enables the ip address management with the pools.
+func SetConfig(cfg *Config) {
+	locker.Lock()
+	defer locker.Unlock()
+	pools = cfg.Pools
+}
+
+// Enabled returns true if the ip address management is enabled.
+func Enabled() bool {
+	locker.Lock()
+	defer locker.Unlock()
+	return len(pools) != 0
+}
+
+// SelectPool returns the pool the k8s service in namespace allocated from. The
+// pool specified by name takes precedence, otherwise the first pool for the
+// namespace, otherwise the first pool for all namespaces. It returns nil if no
+// pool matches, and returns error if the pool specified by name not found.
+func SelectPool(namespace, name string) (*Pool, error) {
+	locker.Lock()
+	defer locker.Unlock()
+	if len(name) != 0 {
+		for _, pool := range pools {
+			if pool.Name == name {
+				return pool, nil
+			}
+		}
+		return nil, fmt.Errorf("ip pool %q not found", name)
+	}
+	for _, pool := range pools {
+		if pool.hasNamespace(namespace) {
+			return pool, nil
+		}
+	}
+	for _, pool := range pools {
+		if len(pool.Namespaces) == 0 {
+			return pool, nil
+		}
+	}
+	return nil, nil
+}
+
+// InPools returns true if the ip address is in any pool.
+func InPools(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	locker.Lock()
+	defer locker.Unlock()
+	for _, pool := range pools {
+		if pool.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the ip address assigned to the k8s service.
+func Lookup(key string) string {
+	locker.Lock()
+	defer locker.Unlock()
+	return assigned[key]
+}
+
+// Assign assigns the ip address to the k8s service, the ip address assigned
+// before is released. If shared is false, it returns error if the ip address
+// is already assigned to another k8s service.
+func Assign(key, ip string, shared bool) error {
+	locker.Lock()
+	defer locker.Unlock()
+	for owner, exclusive := range owners[ip] {
+		if owner != key && (!shared || exclusive) {
+			return fmt.Errorf("ip address %s is already assigned to %s", ip, owner)
+		}
+	}
+	release(key)
+	assign(key, ip, !shared)
+	return nil
+}
+
+// Allocate allocates a free ip address from the pool for the k8s service.
+// The ip address already assigned to the k8s service is returned if it's in the pool.
+func Allocate(key string, pool *Pool) (string, error) {
+	locker.Lock()
+	defer locker.Unlock()
+	if ip, ok := assigned[key]; ok && pool.Contains(net.ParseIP(ip)) {
+		return ip, nil
+	}
+	for _, r := range pool.ranges {
+		for ip := r.start; bytes.Compare(ip, r.end) <= 0; ip = nextIP(ip) {
+			if len(owners[ip.String()]) == 0 {
+				release(key)
+				assign(key, ip.String(), true)
+				return ip.String(), nil
+			}
+			// the last address, nextIP overflows.
+			if ip.Equal(r.end) {
+				break
+			}
+		}
+	}
+	return "", fmt.Errorf("no free ip address in pool %q", pool.Name)
+}
+
+// Release releases the ip address assigned to the k8s service,
+// returns true if the ip address is freed and can be allocated to others.
+func Release(key string) bool {
+	locker.Lock()
+	defer locker.Unlock()
+	return release(key)
+}
+
+func assign(key, ip string, exclusive bool) {
+	assigned[key] = ip
+	if owners[ip] == nil {
+		owners[ip] = make(map[string]bool)
+	}
+	owners[ip][key] = exclusive
+}
+
+func release(key string) bool {
+	ip, ok := assigned[key]
+	if !ok {
+		return false
+	}
+	delete(assigned, key)
+	delete(owners[ip], key)
+	if len(owners[ip]) == 0 {
+		delete(owners, ip)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package ipam
+
+import (
+	"strings"
+	"testing"
+)
+
+// setupPools enables the ip address management with the pool of addresses,
+// and forgets all the ip addresses assigned before.
+func setupPools(t *testing.T, addresses ...string) *Pool {
+	t.Helper()
+	cfg, err := ParseConfig([]byte("pools:\n- name: default\n  addresses: [" + strings.Join(addresses, ", ") + "]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetConfig(cfg)
+	locker.Lock()
+	assigned = make(map[string]string)
+	owners = make(map[string]map[string]bool)
+	locker.Unlock()
+	t.Cleanup(func() { SetConfig(&Config{}) })
+	return cfg.Pools[0]
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		addr       string
+		start, end string
+		err        bool
+	}{
+		{addr: "192.168.1.0/29", start: "192.168.1.1", end: "192.168.1.6"},
+		{addr: "192.168.1.5/29", start: "192.168.1.1", end: "192.168.1.6"},
+		{addr: "192.168.1.0/31", start: "192.168.1.0", end: "192.168.1.1"},
+		{addr: "192.168.1.1/32", start: "192.168.1.1", end: "192.168.1.1"},
+		{addr: " 192.168.1.100 - 192.168.1.150 ", start: "192.168.1.100", end: "192.168.1.150"},
+		{addr: "192.168.1.100-192.168.1.100", start: "192.168.1.100", end: "192.168.1.100"},
+		{addr: "192.168.1.200", start: "192.168.1.200", end: "192.168.1.200"},
+		{addr: "fd00::/126", start: "fd00::", end: "fd00::3"},
+		{addr: "fd00::1/128", start: "fd00::1", end: "fd00::1"},
+		{addr: "fd00::10-fd00::1f", start: "fd00::10", end: "fd00::1f"},
+		{addr: "fd00::1", start: "fd00::1", end: "fd00::1"},
+		{addr: "192.168.1.0/33", err: true},
+		{addr: "192.168.1.150-192.168.1.100", err: true},
+		{addr: "192.168.1.100-fd00::1", err: true},
+		{addr: "192.168.1.100-", err: true},
+		{addr: "192.168.1.256", err: true},
+	}
+	for _, test := range tests {
+		r, err := parseRange(test.addr)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseRange(%q) = %s-%s, want error", test.addr, r.start, r.end)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRange(%q) failed: %s", test.addr, err)
+			continue
+		}
+		if r.start.String() != test.start || r.end.String() != test.end {
+			t.Errorf("parseRange(%q) = %s-%s, want %s-%s", test.addr, r.start, r.end, test.start, test.end)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		want      []string
+	}{
+		{name: "cidr", addresses: []string{"192.168.1.0/30"}, want: []string{"192.168.1.1", "192.168.1.2"}},
+		{name: "/31", addresses: []string{"192.168.1.0/31"}, want: []string{"192.168.1.0", "192.168.1.1"}},
+		{name: "/32", addresses: []string{"192.168.1.1/32"}, want: []string{"192.168.1.1"}},
+		{name: "range", addresses: []string{"192.168.1.254-192.168.2.1"},
+			want: []string{"192.168.1.254", "192.168.1.255", "192.168.2.0", "192.168.2.1"}},
+		{name: "single", addresses: []string{"192.168.1.200"}, want: []string{"192.168.1.200"}},
+		{name: "multiple", addresses: []string{"192.168.1.200", "192.168.1.100-192.168.1.101"},
+			want: []string{"192.168.1.200", "192.168.1.100", "192.168.1.101"}},
+		{name: "ipv6 cidr", addresses: []string{"fd00::/127"}, want: []string{"fd00::", "fd00::1"}},
+		{name: "ipv6 range", addresses: []string{"fd00::fffe-fd00::1:1"},
+			want: []string{"fd00::fffe", "fd00::ffff", "fd00::1:0", "fd00::1:1"}},
+		// the end of the range is the last address, nextIP overflows.
+		{name: "last address", addresses: []string{"255.255.255.254-255.255.255.255"},
+			want: []string{"255.255.255.254", "255.255.255.255"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := setupPools(t, test.addresses...)
+			for i, want := range test.want {
+				key := "default/svc" + string(rune('a'+i))
+				ip, err := Allocate(key, pool)
+				if err != nil {
+					t.Fatalf("Allocate(%s) failed: %s", key, err)
+				}
+				if ip != want {
+					t.Fatalf("Allocate(%s) = %s, want %s", key, ip, want)
+				}
+				// the ip address already assigned is returned again.
+				if ip, _ := Allocate(key, pool); ip != want {
+					t.Fatalf("Allocate(%s) again = %s, want %s", key, ip, want)
+				}
+			}
+			if ip, err := Allocate("default/exhausted", pool); err == nil {
+				t.Errorf("Allocate() from exhausted pool = %s, want error", ip)
+			}
+		})
+	}
+}
+
+func TestReleaseThenReallocate(t *testing.T) {
+	pool := setupPools(t, "192.168.1.1-192.168.1.2")
+	for _, key := range []string{"default/a", "default/b"} {
+		if _, err := Allocate(key, pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !Release("default/a") {
+		t.Errorf("Release(default/a) = false, want true")
+	}
+	if Release("default/a") {
+		t.Errorf("Release(default/a) again = true, want false")
+	}
+	if ip := Lookup("default/a"); len(ip) != 0 {
+		t.Errorf("Lookup(default/a) = %s after released", ip)
+	}
+	if ip, err := Allocate("default/c", pool); err != nil || ip != "192.168.1.1" {
+		t.Errorf("Allocate(default/c) = %s, %v, want 192.168.1.1", ip, err)
+	}
+	if ip, err := Allocate("default/d", pool); err == nil {
+		t.Errorf("Allocate(default/d) from exhausted pool = %s, want error", ip)
+	}
+}
+
+func TestAssign(t *testing.T) {
+	pool := setupPools(t, "192.168.1.1-192.168.1.2")
+
+	// the ip address allocated from the pool is never shared.
+	if _, err := Allocate("default/a", pool); err != nil {
+		t.Fatal(err)
+	}
+	if err := Assign("default/b", "192.168.1.1", true); err == nil {
+		t.Errorf("Assign() the allocated ip address succeeded, want error")
+	}
+
+	// the ip address requested explicitly is shared only if every owner allows it.
+	if err := Assign("default/b", "192.168.1.2", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Assign("default/c", "192.168.1.2", true); err == nil {
+		t.Errorf("Assign() the exclusive ip address succeeded, want error")
+	}
+	if err := Assign("default/b", "192.168.1.2", true); err != nil {
+		t.Errorf("Assign() the ip address to its owner again failed: %s", err)
+	}
+	if err := Assign("default/c", "192.168.1.2", true); err != nil {
+		t.Errorf("Assign() the shared ip address failed: %s", err)
+	}
+	if err := Assign("default/d", "192.168.1.2", false); err == nil {
+		t.Errorf("Assign() the shared ip address exclusively succeeded, want error")
+	}
+	if ip, err := Allocate("default/d", pool); err == nil {
+		t.Errorf("Allocate() from the pool of assigned addresses = %s, want error", ip)
+	}
+
+	// the shared ip address is freed after the last owner released.
+	if Release("default/b") {
+		t.Errorf("Release(default/b) = true, want false as shared with default/c")
+	}
+	if !Release("default/c") {
+		t.Errorf("Release(default/c) = false, want true")
+	}
+	if ip, err := Allocate("default/d", pool); err != nil || ip != "192.168.1.2" {
+		t.Errorf("Allocate(default/d) = %s, %v, want 192.168.1.2", ip, err)
+	}
+
+	// the ip address assigned before is released when assigned another one.
+	if err := Assign("default/a", "10.0.0.1", false); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := Allocate("default/e", pool); err != nil || ip != "192.168.1.1" {
+		t.Errorf("Allocate(default/e) = %s, %v, want 192.168.1.1", ip, err)
+	}
+	if !InPools("192.168.1.1") || InPools("10.0.0.1") || InPools("invalid") {
+		t.Errorf("InPools() returns unexpected result")
+	}
+}
@@ -0,0 +1,180 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the ip address pools the LoadBalancer services are allocated from.
+type Config struct {
+	Pools []*Pool `json:"pools"`
+}
+
+// Pool is a set of ip addresses.
+type Pool struct {
+	// Name is the pool name, selected by the annotation "loadbalancer/ip-pool".
+	Name string `json:"name"`
+	// Addresses is the CIDRs, ranges or single addresses of the pool,
+	// eg: 192.168.1.0/28, 192.168.1.100-192.168.1.150, 192.168.1.200.
+	Addresses []string `json:"addresses"`
+	// Namespaces is the namespaces the pool is used for when the pool is not
+	// selected by annotation. The pool without namespaces is used for all namespaces.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	ranges []ipRange
+}
+
+// ipRange is the addresses from start to end, both included.
+type ipRange struct {
+	start, end net.IP
+}
+
+// ParseConfig parses the yaml data into Config and validates it.
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse ip pool config failed: %s", err.Error())
+	}
+	if len(cfg.Pools) == 0 {
+		return nil, fmt.Errorf("no ip pool defined")
+	}
+	names := make(map[string]bool)
+	for _, pool := range cfg.Pools {
+		if len(pool.Name) == 0 {
+			return nil, fmt.Errorf("ip pool name is empty")
+		}
+		if names[pool.Name] {
+			return nil, fmt.Errorf("duplicate ip pool name: %q", pool.Name)
+		}
+		names[pool.Name] = true
+		if len(pool.Addresses) == 0 {
+			return nil, fmt.Errorf("ip pool %q has no addresses", pool.Name)
+		}
+		for _, addr := range pool.Addresses {
+			r, err := parseRange(addr)
+			if err != nil {
+				return nil, fmt.Errorf("ip pool %q: %s", pool.Name, err.Error())
+			}
+			pool.ranges = append(pool.ranges, r)
+		}
+	}
+	return cfg, nil
+}
+
+// LoadConfig reads the ip pool config from file.
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// Contains returns true if the ip address is in the pool.
+func (p *Pool) Contains(ip net.IP) bool {
+	for _, r := range p.ranges {
+		if r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNamespace returns true if the pool is used for the namespace by default.
+func (p *Pool) hasNamespace(namespace string) bool {
+	for _, ns := range p.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange parses the CIDR, range or single address. The network and broadcast
+// addresses of the IPv4 CIDR are excluded, except for /31 and /32.
+func parseRange(s string) (ipRange, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.Contains(s, "/"):
+		ip, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return ipRange{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		start, end := ipnet.IP, lastIP(ipnet)
+		if ones, bits := ipnet.Mask.Size(); ip.To4() != nil && bits-ones > 1 {
+			start, end = nextIP(start), prevIP(end)
+		}
+		return ipRange{start: normalize(start), end: normalize(end)}, nil
+	case strings.Contains(s, "-"):
+		items := strings.SplitN(s, "-", 2)
+		start, end := net.ParseIP(strings.TrimSpace(items[0])), net.ParseIP(strings.TrimSpace(items[1]))
+		if start == nil || end == nil {
+			return ipRange{}, fmt.Errorf("invalid range %q", s)
+		}
+		start, end = normalize(start), normalize(end)
+		if len(start) != len(end) || bytes.Compare(start, end) > 0 {
+			return ipRange{}, fmt.Errorf("invalid range %q", s)
+		}
+		return ipRange{start: start, end: end}, nil
+	default:
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return ipRange{}, fmt.Errorf("invalid address %q", s)
+		}
+		return ipRange{start: normalize(ip), end: normalize(ip)}, nil
+	}
+}
+
+func (r ipRange) contains(ip net.IP) bool {
+	ip = normalize(ip)
+	return len(ip) == len(r.start) && bytes.Compare(ip, r.start) >= 0 && bytes.Compare(ip, r.end) <= 0
+}
+
+// normalize returns the 4 bytes form of IPv4 address, 16 bytes form of IPv6 address.
+func normalize(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// lastIP returns the last address of the network.
+func lastIP(ipnet *net.IPNet) net.IP {
+	ip := normalize(ipnet.IP)
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^ipnet.Mask[len(ipnet.Mask)-len(ip)+i]
+	}
+	return last
+}
+
+// nextIP returns ip + 1.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// prevIP returns ip - 1.
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
@@ -0,0 +1,168 @@
+package keepalived
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	locker sync.Mutex
+	tmpl   = template.Must(template.New("keepalived.conf").Parse(TemplateKeepalivedConf))
+)
+
+// Params is the parameters used to render keepalived.conf.
+type Params struct {
+	// Instance is the name of the VRRP instance.
+	Instance  string
+	Interface string
+	RouterID  int
+	Priority  int
+	AuthPass  string
+	// HealthzURL is the controller /healthz endpoint checked by the track_script.
+	HealthzURL string
+	// IPv4 and IPv6 is the VIPs floating between the LB hosts.
+	IPv4 []string
+	IPv6 []string
+}
+
+// Enabled returns true if the controller manages keepalived.
+func Enabled() bool {
+	return args.GetKeepalived()
+}
+
+// Validate checks the keepalived arguments in a.
+func Validate(a *args.Args) error {
+	if !a.GetKeepalived() {
+		return nil
+	}
+	if len(a.GetKeepalivedInterface()) == 0 {
+		return errors.New("--keepalived-interface is required")
+	}
+	if id := a.GetKeepalivedRouterID(); id < 1 || id > 255 {
+		return fmt.Errorf("--keepalived-router-id must be between 1 and 255, got %d", id)
+	}
+	if p := a.GetKeepalivedPriority(); p < 1 || p > 254 {
+		return fmt.Errorf("--keepalived-priority must be between 1 and 254, got %d", p)
+	}
+	// keepalived only uses the first 8 characters of the password.
+	if len(a.GetKeepalivedAuthPass()) > 8 {
+		return errors.New("--keepalived-auth-pass must not be longer than 8 characters")
+	}
+	return nil
+}
+
+// Sync renders keepalived.conf with the VIPs. If the config changed, keepalived
+// configuration is tested and keepalived is reloaded, the previous config is
+// restored if the test failed. In dry-run mode the diff of keepalived.conf and
+// the commands are only logged and served by /debug/dry-run.
+func Sync(vips []string) error {
+	if !Enabled() {
+		return nil
+	}
+	locker.Lock()
+	defer locker.Unlock()
+
+	data, err := render(newParams(vips))
+	if err != nil {
+		return err
+	}
+	confFile := args.GetKeepalivedConf()
+	oldData, err := nginx.ReadFile(confFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil && bytes.Equal(oldData, data) {
+		logrus.Debugf("%s is the same, skip generate it", confFile)
+		return nil
+	}
+
+	logrus.Infof("generate %s, VIPs: %v", confFile, vips)
+	if !nginx.DryRun() {
+		if err := os.MkdirAll(filepath.Dir(confFile), 0755); err != nil {
+			return err
+		}
+	}
+	// the file is only diffed in dry-run mode.
+	if err := nginx.WriteFile(confFile, string(data)); err != nil {
+		return err
+	}
+	// test keepalived configuration, restore the previous one if failed.
+	rt := getRuntime()
+	if err := rt.TestConf(confFile); err != nil {
+		if oldData != nil {
+			nginx.WriteFile(confFile, string(oldData))
+		} else {
+			nginx.RemoveFile(confFile)
+		}
+		return fmt.Errorf("test keepalived configuration failed: %s", err.Error())
+	}
+	// reload keepalived, if failed, restart keepalived.
+	if err := rt.Reload(); err != nil {
+		logrus.Warnf("reload keepalived failed: %s", err.Error())
+		return rt.Restart()
+	}
+	return nil
+}
+
+// newParams returns the parameters from the arguments and the VIPs.
+func newParams(vips []string) *Params {
+	host := args.GetBindAddress()
+	if host == nil || host.IsUnspecified() {
+		host = net.IPv4(127, 0, 0, 1)
+	}
+	params := &Params{
+		Instance:   "k8s_loadbalancer",
+		Interface:  args.GetKeepalivedInterface(),
+		RouterID:   args.GetKeepalivedRouterID(),
+		Priority:   args.GetKeepalivedPriority(),
+		AuthPass:   args.GetKeepalivedAuthPass(),
+		HealthzURL: fmt.Sprintf("http://%s/healthz", net.JoinHostPort(host.String(), strconv.Itoa(args.GetPort()))),
+	}
+	for _, vip := range vips {
+		ip := net.ParseIP(vip)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			params.IPv4 = append(params.IPv4, ip.String())
+		default:
+			params.IPv6 = append(params.IPv6, ip.String())
+		}
+	}
+	sort.Strings(params.IPv4)
+	sort.Strings(params.IPv6)
+	return params
+}
+
+// render renders keepalived.conf with the parameters.
+func render(params *Params) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, params); err != nil {
+		return nil, fmt.Errorf("render keepalived.conf failed: %s", err.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+// execute runs the command and returns the error with the stderr output.
+func execute(command ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
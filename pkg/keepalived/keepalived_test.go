@@ -0,0 +1,137 @@
+package keepalived
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+)
+
+// fakeRuntime records the calls, the call in errors fails.
+type fakeRuntime struct {
+	calls  []string
+	errors map[string]error
+}
+
+func (r *fakeRuntime) call(name string) error {
+	r.calls = append(r.calls, name)
+	return r.errors[name]
+}
+func (r *fakeRuntime) TestConf(file string) error { return r.call("testconf") }
+func (r *fakeRuntime) Reload() error              { return r.call("reload") }
+func (r *fakeRuntime) Restart() error             { return r.call("restart") }
+
+// setupKeepalived enables keepalived with the config file in a temporary directory
+// and the fake runtime, they're restored when the test finished.
+func setupKeepalived(t *testing.T, rt Runtime) string {
+	t.Helper()
+	confFile := filepath.Join(t.TempDir(), "keepalived.conf")
+	args.NewBuilder().SetKeepalived(true).SetKeepalivedConf(confFile).
+		SetKeepalivedInterface("eth0").SetKeepalivedRouterID(51).SetKeepalivedPriority(100)
+	SetRuntime(rt)
+	t.Cleanup(func() {
+		args.NewBuilder().SetKeepalived(false).SetKeepalivedConf("/etc/keepalived/keepalived.conf")
+		SetRuntime(nil)
+	})
+	return confFile
+}
+
+func TestSync(t *testing.T) {
+	rt := &fakeRuntime{}
+	confFile := setupKeepalived(t, rt)
+
+	if err := Sync([]string{"10.0.0.2", "fd00::1", "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"10.0.0.1", "10.0.0.2", "fd00::1", "interface eth0"} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("keepalived.conf does not contain %q:\n%s", s, data)
+		}
+	}
+	if want := []string{"testconf", "reload"}; !reflect.DeepEqual(rt.calls, want) {
+		t.Errorf("calls = %v, want %v", rt.calls, want)
+	}
+
+	// the same VIPs, keepalived is not reloaded.
+	rt.calls = nil
+	if err := Sync([]string{"10.0.0.1", "10.0.0.2", "fd00::1"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.calls) != 0 {
+		t.Errorf("calls = %v, want none", rt.calls)
+	}
+
+	// restart keepalived if reload failed.
+	rt.calls, rt.errors = nil, map[string]error{"reload": errors.New("reload failed")}
+	if err := Sync([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"testconf", "reload", "restart"}; !reflect.DeepEqual(rt.calls, want) {
+		t.Errorf("calls = %v, want %v", rt.calls, want)
+	}
+}
+
+func TestSyncTestConfFailed(t *testing.T) {
+	rt := &fakeRuntime{}
+	confFile := setupKeepalived(t, rt)
+	if err := Sync([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	oldData, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the previous config is restored and keepalived is not reloaded.
+	rt.calls, rt.errors = nil, map[string]error{"testconf": errors.New("invalid")}
+	if err := Sync([]string{"10.0.0.2"}); err == nil {
+		t.Fatal("Sync() returns nil error when the config test failed")
+	}
+	if data, _ := ioutil.ReadFile(confFile); string(data) != string(oldData) {
+		t.Errorf("keepalived.conf is not restored:\n%s", data)
+	}
+	if want := []string{"testconf"}; !reflect.DeepEqual(rt.calls, want) {
+		t.Errorf("calls = %v, want %v", rt.calls, want)
+	}
+
+	// the config is removed if there is no previous one.
+	os.Remove(confFile)
+	if err := Sync([]string{"10.0.0.2"}); err == nil {
+		t.Fatal("Sync() returns nil error when the config test failed")
+	}
+	if _, err := os.Stat(confFile); !os.IsNotExist(err) {
+		t.Errorf("keepalived.conf exists after the config test failed")
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	confFile := setupKeepalived(t, nil)
+	args.NewBuilder().SetDryRun(true)
+	t.Cleanup(func() { args.NewBuilder().SetDryRun(false) })
+
+	if err := Sync([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(confFile); !os.IsNotExist(err) {
+		t.Fatalf("%s written in dry-run mode", confFile)
+	}
+	w := httptest.NewRecorder()
+	nginx.DryRunHandler(w, httptest.NewRequest("GET", "/debug/dry-run", nil))
+	out := w.Body.String()
+	for _, s := range []string{confFile, "+        10.0.0.1", "keepalived --config-test --use-file " + confFile, "reload keepalived"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("/debug/dry-run does not contain %q:\n%s", s, out)
+		}
+	}
+}
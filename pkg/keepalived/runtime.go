@@ -0,0 +1,79 @@
+package keepalived
+
+import (
+	"sync"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+)
+
+// Runtime manages the keepalived daemon.
+type Runtime interface {
+	// TestConf tests the keepalived configuration file.
+	TestConf(file string) error
+	// Reload reloads keepalived, keepalived is enabled and started if not running.
+	Reload() error
+	// Restart restarts keepalived.
+	Restart() error
+}
+
+var (
+	runtimeLocker  sync.Mutex
+	defaultRuntime Runtime
+)
+
+// SetRuntime sets the Runtime keepalived is managed by, the default is
+// ServiceRuntime, or DryRunRuntime in dry-run mode. It's useful in testing.
+func SetRuntime(rt Runtime) {
+	runtimeLocker.Lock()
+	defer runtimeLocker.Unlock()
+	defaultRuntime = rt
+}
+
+// getRuntime returns the Runtime keepalived is managed by.
+func getRuntime() Runtime {
+	runtimeLocker.Lock()
+	defer runtimeLocker.Unlock()
+	if defaultRuntime == nil && nginx.DryRun() {
+		return &DryRunRuntime{}
+	}
+	if defaultRuntime == nil {
+		defaultRuntime = &ServiceRuntime{service: nginx.NewServiceManager("keepalived")}
+	}
+	return defaultRuntime
+}
+
+// ServiceRuntime manages keepalived by the service manager of the host, systemd
+// or OpenRC. The commands are executed directly without the shell.
+type ServiceRuntime struct {
+	service *nginx.ServiceManager
+}
+
+var _ Runtime = &ServiceRuntime{}
+
+func (r *ServiceRuntime) TestConf(file string) error {
+	return execute("keepalived", "--config-test", "--use-file", file)
+}
+
+func (r *ServiceRuntime) Reload() error {
+	if !r.service.IsActive() {
+		if err := r.service.Enable(); err != nil {
+			return err
+		}
+		return r.service.Start()
+	}
+	return r.service.Reload()
+}
+
+func (r *ServiceRuntime) Restart() error { return r.service.Restart() }
+
+// DryRunRuntime never touches the host, it records the commands would be run
+// to /debug/dry-run like the nginx commands, it's used in dry-run mode.
+type DryRunRuntime struct{}
+
+var _ Runtime = &DryRunRuntime{}
+
+func (r *DryRunRuntime) TestConf(file string) error {
+	return nginx.DryRunCommand("keepalived --config-test --use-file " + file)
+}
+func (r *DryRunRuntime) Reload() error  { return nginx.DryRunCommand("reload keepalived") }
+func (r *DryRunRuntime) Restart() error { return nginx.DryRunCommand("restart keepalived") }
@@ -0,0 +1,57 @@
+package keepalived
+
+// TemplateKeepalivedConf is the template of keepalived.conf, the data is *Params.
+// The VRRP instance starts as BACKUP, the host with the highest priority becomes
+// MASTER. The priority is decreased if nginx or the controller is not healthy.
+const TemplateKeepalivedConf = `# Generated by k8s-loadbalancer, DO NOT EDIT.
+global_defs {
+    script_user root
+    enable_script_security
+}
+
+vrrp_script chk_nginx {
+    script "/bin/sh -c 'pidof nginx > /dev/null'"
+    interval 2
+    weight -50
+    fall 2
+    rise 2
+}
+
+vrrp_script chk_k8s_loadbalancer {
+    script "/bin/sh -c 'curl -sf -o /dev/null {{ .HealthzURL }}'"
+    interval 2
+    weight -50
+    fall 2
+    rise 2
+}
+
+vrrp_instance {{ .Instance }} {
+    state BACKUP
+    interface {{ .Interface }}
+    virtual_router_id {{ .RouterID }}
+    priority {{ .Priority }}
+    advert_int 1
+{{- if .AuthPass }}
+    authentication {
+        auth_type PASS
+        auth_pass {{ .AuthPass }}
+    }
+{{- end }}
+    virtual_ipaddress {
+{{- range .IPv4 }}
+        {{ . }}
+{{- end }}
+    }
+{{- if .IPv6 }}
+    virtual_ipaddress_excluded {
+{{- range .IPv6 }}
+        {{ . }}
+{{- end }}
+    }
+{{- end }}
+    track_script {
+        chk_nginx
+        chk_k8s_loadbalancer
+    }
+}
+`
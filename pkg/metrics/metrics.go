@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	locker     sync.RWMutex
+	collectors = make(map[string]Collector)
+)
+
+// Collector writes the metrics in prometheus text format to w.
+type Collector func(w io.Writer)
+
+// Register registers the collector with the name, the collector with the
+// same name will be replaced.
+func Register(name string, collector Collector) {
+	locker.Lock()
+	defer locker.Unlock()
+	collectors[name] = collector
+}
+
+// Write writes all the registered metrics to w, sorted by the collector name.
+func Write(w io.Writer) {
+	locker.RLock()
+	defer locker.RUnlock()
+	var names []string
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		collectors[name](w)
+	}
+}
+
+// WriteHeader writes the HELP and TYPE line of the metric.
+func WriteHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// WriteSample writes a sample of the metric, labels is the label key and value pairs.
+func WriteSample(w io.Writer, name string, value float64, labels ...string) {
+	if len(labels) == 0 {
+		fmt.Fprintf(w, "%s %v\n", name, value)
+		return
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	fmt.Fprintf(w, "%s{%s} %v\n", name, strings.Join(pairs, ","), value)
+}
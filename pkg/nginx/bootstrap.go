@@ -0,0 +1,103 @@
+package nginx
+
+import (
+	"errors"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/sirupsen/logrus"
+)
+
+// healthCacheTTL is how long the cached nginx health state is trusted
+// before checking the nginx status again.
+const healthCacheTTL = 30 * time.Second
+
+// health is the cached health state of nginx on the host, protected by locker.
+var health struct {
+	// bootstrapped is true if the host bootstrapped successfully,
+	// it's reset when nginx is detected missing or broken.
+	bootstrapped bool
+	// checkedAt is the last time the nginx status checked.
+	checkedAt time.Time
+}
+
+// Bootstrap prepares the host for nginx: creates the directories, installs the
+// nginx package if --manage-nginx-install is true, generates nginx.conf in
+// "managed" mode or verifies it in "unmanaged" mode, enables and starts nginx.
+// It's called once at startup, and again only if nginx is detected missing or broken.
+func Bootstrap(rt Runtime) error {
+	locker.Lock()
+	defer locker.Unlock()
+	return bootstrap(rt)
+}
+
+// bootstrap is the same as Bootstrap, but the caller should hold the locker.
+func bootstrap(rt Runtime) error {
+	logrus.Info("bootstrapping nginx")
+	// it will check whether nginx config dir exist
+	if err := rt.Prepare(); err != nil {
+		return err
+	}
+	if args.GetManageNginxInstall() {
+		// install nginx if nginx not installed
+		if err := rt.Install(); err != nil {
+			return err
+		}
+	} else {
+		status, err := rt.Status()
+		if err != nil {
+			return err
+		}
+		if !status.Installed {
+			return errors.New("nginx is not installed and --manage-nginx-install is false")
+		}
+	}
+	// nginx is started with the managed nginx.conf, not the default one of the
+	// distribution. It's generated after installed, so it's not overwritten.
+	if NginxConfMode(args.GetNginxConfMode()) != NginxConfModeUnmanaged {
+		if err, _ := GenerateNginxConf(); err != nil {
+			return err
+		}
+	} else if err := VerifyNginxConf(rt); err != nil {
+		// the nginx.conf managed by user is verified again by the next bootstrap.
+		return err
+	}
+	if err := rt.Enable(); err != nil {
+		return err
+	}
+	if err := rt.Start(); err != nil {
+		return err
+	}
+	health.bootstrapped = true
+	health.checkedAt = time.Now()
+	return nil
+}
+
+// ensureHealthy bootstraps the host if it's not bootstrapped, otherwise uses the
+// cached health state, and checks the nginx status only if the cache expired.
+// The caller should hold the locker.
+func ensureHealthy(rt Runtime) error {
+	if !health.bootstrapped {
+		return bootstrap(rt)
+	}
+	if time.Since(health.checkedAt) < healthCacheTTL {
+		return nil
+	}
+	status, err := rt.Status()
+	if err != nil {
+		return err
+	}
+	health.checkedAt = time.Now()
+	if !status.Installed || !status.Running {
+		logrus.Warnf("nginx is unhealthy (installed: %t, running: %t), bootstrap it again", status.Installed, status.Running)
+		health.bootstrapped = false
+		return bootstrap(rt)
+	}
+	return nil
+}
+
+// markUnhealthy makes the next ensureHealthy bootstrap the host again.
+// The caller should hold the locker.
+func markUnhealthy() {
+	health.bootstrapped = false
+}
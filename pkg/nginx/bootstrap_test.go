@@ -0,0 +1,51 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+)
+
+// startCheckRuntime records whether nginx.conf exists when nginx is started.
+type startCheckRuntime struct {
+	*FakeRuntime
+	nginxConf        string
+	nginxConfExisted bool
+}
+
+func (r *startCheckRuntime) Start() error {
+	_, err := os.Stat(r.nginxConf)
+	r.nginxConfExisted = err == nil
+	return r.FakeRuntime.Start()
+}
+
+func TestBootstrapGeneratesNginxConf(t *testing.T) {
+	tests := []struct {
+		mode NginxConfMode
+		want bool
+	}{
+		{NginxConfModeManaged, true},
+		{NginxConfModeUnmanaged, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			dir := setupNginxDir(t, "10.0.0.1")
+			args.NewBuilder().SetNginxConfMode(string(tt.mode))
+			t.Cleanup(func() { args.NewBuilder().SetNginxConfMode(string(NginxConfModeManaged)) })
+
+			rt := &startCheckRuntime{FakeRuntime: NewFakeRuntime(), nginxConf: filepath.Join(dir, "nginx.conf")}
+			rt.SetConf(includeConf(dir))
+			if err := Bootstrap(rt); err != nil {
+				t.Fatal(err)
+			}
+			if rt.Count("Start") != 1 {
+				t.Fatalf("nginx is not started, calls: %v", rt.Calls())
+			}
+			if rt.nginxConfExisted != tt.want {
+				t.Errorf("nginx.conf existed when nginx started = %t, want %t", rt.nginxConfExisted, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package nginx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// osReleaseFile is the file containing the operating system identification data.
+var osReleaseFile = "/etc/os-release"
+
+// DistroFamily is the family of the linux distribution, the distributions in
+// the same family share the package manager and the nginx package layout.
+type DistroFamily string
+
+const (
+	DistroFamilyDebian DistroFamily = "debian"
+	DistroFamilyRHEL   DistroFamily = "rhel"
+	DistroFamilyFedora DistroFamily = "fedora"
+	DistroFamilySUSE   DistroFamily = "suse"
+	DistroFamilyArch   DistroFamily = "arch"
+	DistroFamilyAlpine DistroFamily = "alpine"
+)
+
+// InitSystem is the service manager of the linux distribution.
+type InitSystem string
+
+const (
+	InitSystemSystemd InitSystem = "systemd"
+	InitSystemOpenRC  InitSystem = "openrc"
+)
+
+// distroFamilies maps the os-release ID or ID_LIKE to the distribution family.
+var distroFamilies = map[string]DistroFamily{
+	"debian":              DistroFamilyDebian,
+	"ubuntu":              DistroFamilyDebian,
+	"rhel":                DistroFamilyRHEL,
+	"centos":              DistroFamilyRHEL,
+	"rocky":               DistroFamilyRHEL,
+	"almalinux":           DistroFamilyRHEL,
+	"ol":                  DistroFamilyRHEL,
+	"fedora":              DistroFamilyFedora,
+	"opensuse":            DistroFamilySUSE,
+	"opensuse-leap":       DistroFamilySUSE,
+	"opensuse-tumbleweed": DistroFamilySUSE,
+	"sles":                DistroFamilySUSE,
+	"suse":                DistroFamilySUSE,
+	"arch":                DistroFamilyArch,
+	"alpine":              DistroFamilyAlpine,
+}
+
+// Distro is the linux distribution detected from os-release.
+type Distro struct {
+	// ID, IDLike, VersionID and Name is the os-release ID, ID_LIKE, VERSION_ID and NAME.
+	ID        string
+	IDLike    []string
+	VersionID string
+	Name      string
+
+	Family DistroFamily
+}
+
+// ParseOSRelease parses the os-release format data into key value pairs,
+// the quotes around the values are removed.
+func ParseOSRelease(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.SplitN(line, "=", 2)
+		if len(items) != 2 {
+			continue
+		}
+		val := items[1]
+		if unquoted, err := strconv.Unquote(val); err == nil {
+			val = unquoted
+		} else {
+			val = strings.Trim(val, `"'`)
+		}
+		values[items[0]] = val
+	}
+	return values, scanner.Err()
+}
+
+// DetectDistro detects the linux distribution from the os-release data.
+// It returns error if the distribution is not supported.
+func DetectDistro(r io.Reader) (*Distro, error) {
+	values, err := ParseOSRelease(r)
+	if err != nil {
+		return nil, err
+	}
+	distro := &Distro{
+		ID:        strings.ToLower(values["ID"]),
+		IDLike:    strings.Fields(strings.ToLower(values["ID_LIKE"])),
+		VersionID: values["VERSION_ID"],
+		Name:      values["NAME"],
+	}
+	// the ID takes precedence over the ID_LIKE.
+	for _, id := range append([]string{distro.ID}, distro.IDLike...) {
+		if family, ok := distroFamilies[id]; ok {
+			distro.Family = family
+			return distro, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported linux distribution: %q (ID=%s, ID_LIKE=%s), supported families are debian, rhel, fedora, suse, arch and alpine",
+		distro.Name, distro.ID, values["ID_LIKE"])
+}
+
+// DetectHostDistro detects the linux distribution of the host from /etc/os-release.
+func DetectHostDistro() (*Distro, error) {
+	file, err := os.Open(osReleaseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return DetectDistro(file)
+}
+
+// NginxUser returns the user the nginx package runs the worker processes as.
+func (d *Distro) NginxUser() string {
+	switch d.Family {
+	case DistroFamilyDebian:
+		return "www-data"
+	case DistroFamilyArch:
+		return "http"
+	default:
+		return "nginx"
+	}
+}
+
+// InitSystem returns the service manager of the distribution.
+func (d *Distro) InitSystem() InitSystem {
+	if d.Family == DistroFamilyAlpine {
+		return InitSystemOpenRC
+	}
+	return InitSystemSystemd
+}
+
+// InstallCommands returns the commands to install the nginx package.
+func (d *Distro) InstallCommands() [][]string {
+	switch d.Family {
+	case DistroFamilyDebian:
+		return [][]string{
+			{"apt-get", "update"},
+			{"apt-get", "install", "-y", "nginx"},
+		}
+	case DistroFamilyRHEL, DistroFamilyFedora:
+		return [][]string{{d.rpmPackageManager(), "install", "-y", "nginx"}}
+	case DistroFamilySUSE:
+		return [][]string{{"zypper", "--non-interactive", "install", "nginx"}}
+	case DistroFamilyArch:
+		return [][]string{{"pacman", "-S", "--noconfirm", "--needed", "nginx"}}
+	case DistroFamilyAlpine:
+		return [][]string{{"apk", "add", "--no-cache", "nginx"}}
+	}
+	return nil
+}
+
+// RemoveCommands returns the commands to uninstall the nginx package.
+func (d *Distro) RemoveCommands() [][]string {
+	switch d.Family {
+	case DistroFamilyDebian:
+		return [][]string{{"apt-get", "purge", "-y", "nginx", "nginx-common", "nginx-core"}}
+	case DistroFamilyRHEL, DistroFamilyFedora:
+		return [][]string{{d.rpmPackageManager(), "remove", "-y", "nginx"}}
+	case DistroFamilySUSE:
+		return [][]string{{"zypper", "--non-interactive", "remove", "nginx"}}
+	case DistroFamilyArch:
+		return [][]string{{"pacman", "-Rns", "--noconfirm", "nginx"}}
+	case DistroFamilyAlpine:
+		return [][]string{{"apk", "del", "nginx"}}
+	}
+	return nil
+}
+
+// rpmPackageManager returns dnf if it exists, otherwise returns yum.
+func (d *Distro) rpmPackageManager() string {
+	if _, err := exec.LookPath("dnf"); err == nil {
+		return "dnf"
+	}
+	return "yum"
+}
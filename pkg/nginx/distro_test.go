@@ -0,0 +1,67 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetectDistro(t *testing.T) {
+	tests := []struct {
+		file      string
+		id        string
+		versionID string
+		family    DistroFamily
+		init      InitSystem
+		user      string
+		install   [][]string
+	}{
+		{"debian", "debian", "12", DistroFamilyDebian, InitSystemSystemd, "www-data",
+			[][]string{{"apt-get", "update"}, {"apt-get", "install", "-y", "nginx"}}},
+		{"ubuntu", "ubuntu", "22.04", DistroFamilyDebian, InitSystemSystemd, "www-data",
+			[][]string{{"apt-get", "update"}, {"apt-get", "install", "-y", "nginx"}}},
+		{"rhel", "rhel", "9.2", DistroFamilyRHEL, InitSystemSystemd, "nginx", nil},
+		{"rocky", "rocky", "9.3", DistroFamilyRHEL, InitSystemSystemd, "nginx", nil},
+		{"alpine", "alpine", "3.19.1", DistroFamilyAlpine, InitSystemOpenRC, "nginx",
+			[][]string{{"apk", "add", "--no-cache", "nginx"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			file, err := os.Open(filepath.Join("testdata", "os-release", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			distro, err := DetectDistro(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if distro.ID != tt.id || distro.VersionID != tt.versionID || distro.Family != tt.family {
+				t.Errorf("DetectDistro() = %s %s %s, want %s %s %s",
+					distro.ID, distro.VersionID, distro.Family, tt.id, tt.versionID, tt.family)
+			}
+			if got := distro.InitSystem(); got != tt.init {
+				t.Errorf("InitSystem() = %s, want %s", got, tt.init)
+			}
+			if got := distro.NginxUser(); got != tt.user {
+				t.Errorf("NginxUser() = %s, want %s", got, tt.user)
+			}
+			// the rpm package manager depends on the host, dnf or yum.
+			if tt.install != nil && !reflect.DeepEqual(distro.InstallCommands(), tt.install) {
+				t.Errorf("InstallCommands() = %v, want %v", distro.InstallCommands(), tt.install)
+			}
+		})
+	}
+}
+
+func TestDetectDistroUnsupported(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "os-release", "gentoo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := DetectDistro(file); err == nil {
+		t.Error("DetectDistro() returns nil error for gentoo")
+	}
+}
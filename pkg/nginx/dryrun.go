@@ -0,0 +1,236 @@
+package nginx
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/sirupsen/logrus"
+)
+
+// maxDryRunCommands is the number of the latest commands kept in dry-run mode.
+const maxDryRunCommands = 100
+
+// dryRun is the state of the host the controller would make in dry-run mode.
+var dryRun = struct {
+	sync.Mutex
+	// files is the content of the files would be written, nil means the file
+	// would be removed. The files not in it are the same as on disk.
+	files map[string]*string
+	// commands is the latest commands would be run.
+	commands []string
+}{files: make(map[string]*string)}
+
+// DryRun returns true if the controller computes the nginx config files and
+// commands without touching the host, see --dry-run.
+func DryRun() bool {
+	return args.GetDryRun()
+}
+
+// readFile reads the file, it's the content would be written in dry-run mode.
+func readFile(file string) ([]byte, error) {
+	if DryRun() {
+		dryRun.Lock()
+		data, ok := dryRun.files[file]
+		dryRun.Unlock()
+		if ok && data == nil {
+			return nil, &os.PathError{Op: "open", Path: file, Err: os.ErrNotExist}
+		}
+		if ok {
+			return []byte(*data), nil
+		}
+	}
+	return ioutil.ReadFile(file)
+}
+
+// writeFile writes the file, the diff against the file on disk is logged instead
+// in dry-run mode.
+func writeFile(file, data string) error {
+	if DryRun() {
+		dryRun.Lock()
+		dryRun.files[file] = &data
+		dryRun.Unlock()
+		logrus.Infof("dry-run: would write %s\n%s", file, diffFile(file, &data))
+		return nil
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(data)
+	return err
+}
+
+// removeFile removes the file, the diff against the file on disk is logged instead
+// in dry-run mode. It's not an error if the file not exists.
+func removeFile(file string) error {
+	if DryRun() {
+		if _, err := readFile(file); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		dryRun.Lock()
+		dryRun.files[file] = nil
+		dryRun.Unlock()
+		logrus.Infof("dry-run: would remove %s\n%s", file, diffFile(file, nil))
+		return nil
+	}
+	if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// readDir returns the names of the regular files in the directory, including
+// the files would be written and excluding the files would be removed in dry-run mode.
+func readDir(dir string) ([]string, error) {
+	seen := make(map[string]bool)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			seen[info.Name()] = true
+		}
+	}
+	if DryRun() {
+		dryRun.Lock()
+		for file, data := range dryRun.files {
+			if filepath.Dir(file) == filepath.Clean(dir) {
+				seen[filepath.Base(file)] = data != nil
+			}
+		}
+		dryRun.Unlock()
+	}
+	var names []string
+	for name, ok := range seen {
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// diffFile returns the unified diff of the file on disk and the data, nil data
+// means the file would be removed. The missing side is /dev/null like "diff -u".
+func diffFile(file string, data *string) string {
+	var oldLines, newLines []string
+	fromFile, toFile := "/dev/null", "/dev/null"
+	if b, err := ioutil.ReadFile(file); err == nil {
+		oldLines, fromFile = splitLines(string(b)), file
+	}
+	if data != nil {
+		newLines, toFile = splitLines(*data), file
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        oldLines,
+		B:        newLines,
+		FromFile: fromFile,
+		ToFile:   toFile,
+		Context:  3,
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return diff
+}
+
+// splitLines splits the data into lines, every line keeps its "\n".
+func splitLines(data string) []string {
+	lines := strings.SplitAfter(data, "\n")
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// dryRunCommand records the command would be run in dry-run mode.
+func dryRunCommand(command string) error {
+	logrus.Infof("dry-run: would run %q", command)
+	dryRun.Lock()
+	defer dryRun.Unlock()
+	dryRun.commands = append(dryRun.commands, fmt.Sprintf("%s %s", time.Now().Format(time.RFC3339), command))
+	if len(dryRun.commands) > maxDryRunCommands {
+		dryRun.commands = dryRun.commands[len(dryRun.commands)-maxDryRunCommands:]
+	}
+	return nil
+}
+
+// ReadFile, WriteFile and RemoveFile are readFile, writeFile and removeFile for
+// the other files managed by the controller, eg: keepalived.conf, so they're
+// diffed and served by /debug/dry-run as the nginx config files in dry-run mode.
+func ReadFile(file string) ([]byte, error) { return readFile(file) }
+func WriteFile(file, data string) error    { return writeFile(file, data) }
+func RemoveFile(file string) error         { return removeFile(file) }
+
+// DryRunCommand records the command would be run in dry-run mode.
+func DryRunCommand(command string) error { return dryRunCommand(command) }
+
+// DryRunHandler serves the unified diffs of all the files would be written or
+// removed against the files on disk, and the latest commands would be run.
+func DryRunHandler(w http.ResponseWriter, r *http.Request) {
+	if !DryRun() {
+		http.Error(w, "--dry-run is not enabled", http.StatusNotFound)
+		return
+	}
+	dryRun.Lock()
+	files := make(map[string]*string, len(dryRun.files))
+	for file, data := range dryRun.files {
+		files[file] = data
+	}
+	commands := append([]string{}, dryRun.commands...)
+	dryRun.Unlock()
+
+	var names []string
+	for file := range files {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, file := range names {
+		if diff := diffFile(file, files[file]); len(diff) != 0 {
+			fmt.Fprintln(w, diff)
+		}
+	}
+	fmt.Fprintf(w, "# commands would be run\n%s\n", strings.Join(commands, "\n"))
+}
+
+// DryRunRuntime is a Runtime which never touches the host, it logs and records
+// the commands would be run, it's used in dry-run mode.
+type DryRunRuntime struct{}
+
+var _ Runtime = &DryRunRuntime{}
+
+func (r *DryRunRuntime) Prepare() error {
+	return dryRunCommand("mkdir -p " + strings.Join(confDirs(), " "))
+}
+func (r *DryRunRuntime) Install() error  { return dryRunCommand("install nginx") }
+func (r *DryRunRuntime) Remove() error   { return dryRunCommand("remove nginx") }
+func (r *DryRunRuntime) Enable() error   { return dryRunCommand("enable nginx") }
+func (r *DryRunRuntime) Start() error    { return dryRunCommand("start nginx") }
+func (r *DryRunRuntime) Stop() error     { return dryRunCommand("stop nginx") }
+func (r *DryRunRuntime) TestConf() error { return dryRunCommand(strings.Join(nginxCommand("-t"), " ")) }
+func (r *DryRunRuntime) Reload() error   { return dryRunCommand("reload nginx") }
+func (r *DryRunRuntime) Restart() error  { return dryRunCommand("restart nginx") }
+
+// DumpConf dumps the nginx configuration on the host as the ShellRuntime does, it's read-only.
+func (r *DryRunRuntime) DumpConf() (string, error) {
+	return (&ShellRuntime{}).DumpConf()
+}
+
+// Status checks nginx on the host as the ShellRuntime does, it's read-only, so
+// the commands would be run to install or start nginx are recorded.
+func (r *DryRunRuntime) Status() (Status, error) {
+	return (&ShellRuntime{}).Status()
+}
@@ -0,0 +1,142 @@
+package nginx
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+)
+
+// setupDryRun enables the dry-run mode with nothing would be written or run,
+// it's disabled when the test finished.
+func setupDryRun(t *testing.T) {
+	reset := func() {
+		dryRun.Lock()
+		dryRun.files = make(map[string]*string)
+		dryRun.commands = nil
+		dryRun.Unlock()
+	}
+	reset()
+	args.NewBuilder().SetDryRun(true)
+	t.Cleanup(func() {
+		args.NewBuilder().SetDryRun(false)
+		reset()
+	})
+}
+
+// writeTestFile writes the file on disk.
+func writeTestFile(t *testing.T, file, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dryRunOutput returns the output of /debug/dry-run.
+func dryRunOutput() string {
+	w := httptest.NewRecorder()
+	DryRunHandler(w, httptest.NewRequest("GET", "/debug/dry-run", nil))
+	return w.Body.String()
+}
+
+func TestDryRunGenerateFile(t *testing.T) {
+	dir := setupNginxDir(t)
+	setupDryRun(t)
+	file := filepath.Join(dir, "sites-stream", "tcp.default.web.web.abc")
+	writeTestFile(t, file, "listen 80;\n")
+
+	if err, changed := generateFile(file, "listen 81;\n"); err != nil || !changed {
+		t.Fatalf("generateFile() = %v, %v, want nil, true", err, changed)
+	}
+	if data := readTestFile(t, file); data != "listen 80;\n" {
+		t.Fatalf("file on disk changed in dry-run mode: %q", data)
+	}
+	// the later changes are computed against the content would be written.
+	if err, changed := generateFile(file, "listen 81;\n"); err != nil || changed {
+		t.Fatalf("generateFile() = %v, %v, want nil, false", err, changed)
+	}
+	if out := dryRunOutput(); !strings.Contains(out, "-listen 80;\n+listen 81;\n") {
+		t.Fatalf("/debug/dry-run has no diff of %s:\n%s", file, out)
+	}
+
+	created := filepath.Join(dir, "sites-stream", "udp.default.dns.dns.abc")
+	if err, changed := generateFile(created, "listen 53 udp;\n"); err != nil || !changed {
+		t.Fatalf("generateFile() = %v, %v, want nil, true", err, changed)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Fatalf("%s created in dry-run mode", created)
+	}
+}
+
+func TestDryRunReadDir(t *testing.T) {
+	dir := setupNginxDir(t)
+	setupDryRun(t)
+	streamDir := filepath.Join(dir, "sites-stream")
+	writeTestFile(t, filepath.Join(streamDir, "a"), "a")
+	writeTestFile(t, filepath.Join(streamDir, "b"), "b")
+
+	if err := writeFile(filepath.Join(streamDir, "c"), "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeFile(filepath.Join(streamDir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	names, err := readDir(streamDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("readDir() = %v, want %v", names, want)
+	}
+	if _, err := os.Stat(filepath.Join(streamDir, "a")); err != nil {
+		t.Fatalf("file removed in dry-run mode: %s", err.Error())
+	}
+}
+
+func TestDryRunPrune(t *testing.T) {
+	dir := setupNginxDir(t)
+	setupDryRun(t)
+	stale := filepath.Join(dir, "sites-stream", "tcp.default.gone.web.abc")
+	writeTestFile(t, stale, "# cluster-id: abc\nserver {\n}\n")
+
+	n := &Nginx{Runtime: &DryRunRuntime{}}
+	n.Prune("abc", "", nil)
+	if err := n.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Fatalf("file removed in dry-run mode: %s", err.Error())
+	}
+	names, err := readDir(filepath.Join(dir, "sites-stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("readDir() = %v, want the stale file would be removed", names)
+	}
+	out := dryRunOutput()
+	for _, s := range []string{"+++ /dev/null", `"nginx -t"`, "reload nginx"} {
+		if !strings.Contains(out, strings.Trim(s, `"`)) {
+			t.Errorf("/debug/dry-run does not contain %q:\n%s", s, out)
+		}
+	}
+}
+
+func TestDryRunRuntimeStatus(t *testing.T) {
+	want, err := (&ShellRuntime{}).Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := (&DryRunRuntime{}).Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("DryRunRuntime.Status() = %+v, want the status of the host %+v", got, want)
+	}
+}
@@ -4,20 +4,26 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
-	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
-	"path/filepath"
-	"strings"
+	"strconv"
 
-	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/healthcheck"
 	"github.com/sirupsen/logrus"
 )
 
 // GenerateNginxConf generate /etc/nginx/nginx.conf config file.
 // it will return true, if /etc/nginx/nginx.conf changed
 func GenerateNginxConf() (error, bool) {
-	return generateFile(nginxConfFile, TemplateNginxConf)
+	if nginxConfParams == nil {
+		logrus.Debug("nginx.conf parameters not loaded, keep the existing nginx.conf")
+		return nil, false
+	}
+	configData, err := renderNginxConf(nginxConfParams)
+	if err != nil {
+		return err, false
+	}
+	return generateFile(nginxConfFile, configData)
 }
 
 // GenerateVirtualHostConf generate /etc/nginx/sites-enabled/xxx.conf config file for proxy traffic.
@@ -25,38 +31,80 @@ func GenerateVirtualHostConf(service *Service) (error, bool) {
 	var changed bool
 
 	// if upstream host is empty, skip generate nginx config file.
-	if len(args.GetUpstream()) == 0 {
-		logrus.Warn("upstream is empty, skip generate nginx config")
+	hosts := GetUpstreamHosts(service.Cluster)
+	if len(hosts) == 0 {
+		logrus.Warnf("upstream of %s is empty, skip generate nginx config", service)
 		return nil, false
 	}
-	logrus.Debugf("upstream host are: %v", args.GetUpstream())
+	hosts = selectUpstreamHosts(hosts, service)
+	logrus.Debugf("upstream host are: %v", hosts)
 
+	// the upstream parameters precedence is: node > k8s service > global arguments.
+	params := defaultUpstreamParams().Merge(service.Tuning.UpstreamParams())
 	for _, port := range service.Ports {
-		// upstreamName format is namespace.name.portName
-		upstreamName := fmt.Sprintf("%s.%s.%s", service.Namespace, service.Name, port.Name)
-		var upstreamHosts strings.Builder
-		for _, host := range args.GetUpstream() {
-			upstreamHosts.WriteString(fmt.Sprintf("    server %s:%d;\n", host, port.NodePort))
+		upstreamName := upstreamName(service, port)
+		var upstreams []Upstream
+		var hostNames []string
+		for _, host := range hosts {
+			upstream := Upstream{
+				Host:           host.Host,
+				Port:           port.NodePort,
+				UpstreamParams: params.Merge(host.Params),
+			}
+			// the host failed the active health checking is marked down.
+			if healthcheck.IsDown(host.Host, port.NodePort) {
+				logrus.Debugf("upstream %s is down", upstream.Address())
+				upstream.Down = true
+			}
+			upstreams = append(upstreams, upstream)
+			hostNames = append(hostNames, host.Host)
+		}
+		// nginx rejects all the traffic if every server is down, fail open instead,
+		// the hosts may still serve although the probes failed, eg: blocked probes.
+		if allDown(upstreams) {
+			logrus.Warnf("all the upstreams of %s are down, fail open", upstreamName)
+			for i := range upstreams {
+				upstreams[i].Down = false
+			}
+		}
+		data := &TemplateData{
+			Service:      service,
+			Port:         port,
+			ListenPort:   port.Port,
+			UpstreamName: upstreamName,
+			Upstreams:    upstreams,
+			Annotations:  service.Annotations,
+			Tuning:       service.Tuning,
 		}
-		var configData string
-		// configFile format is tcp.upstreamName or udp.upstreamName
-		configFile := filepath.Join(tcpConfDir, fmt.Sprintf("%s.%s", strings.ToLower(port.Protocol), upstreamName))
 		// the field port.ListenPort, set by annotation, is used to manually specify the nginx listen port.
 		if port.ListenPort != 0 {
 			logrus.Debugf("use the LisetnPort: %v", port.ListenPort)
-			configData = fmt.Sprintf(TemplateTCP, upstreamName, upstreamHosts.String(), port.ListenPort, upstreamName, upstreamName)
-		} else {
-			// the configData is string type containing the content of the nginx config file,
-			// we will write it to file.
-			configData = fmt.Sprintf(TemplateTCP, upstreamName, upstreamHosts.String(), port.Port, upstreamName, upstreamName)
+			data.ListenPort = port.ListenPort
 		}
+		data.ListenAddresses = ListenAddresses(service, data.ListenPort)
+		data.ListenAddress = data.ListenAddresses[0]
+		configFile := configFile(service, port)
+
+		// the configData is string type containing the content of the nginx config file,
+		// we will write it to file. The header records the cluster id owning the file.
+		configData, err := renderTemplate(templateNameForPort(port), data)
+		if err != nil {
+			return err, false
+		}
+		configData = fileHeader(service) + configData
 
 		switch service.Action {
 		case ActionTypeDel:
 			// if action is ActionTypeDel, it means that k8s service object was deleted,
 			// and we should delete the corresponding nginx configuration file.
 			logrus.Debugf("remove nginx config: %s", configFile)
-			if err := os.Remove(configFile); err != nil {
+			healthcheck.Unregister(upstreamName)
+			// the file generated for other cluster is never removed.
+			if err := checkOwner(configFile, service.ClusterID); err != nil {
+				logrus.Warnf("skip removing %s", err.Error())
+				continue
+			}
+			if err := removeFile(configFile); err != nil {
 				logrus.Errorf("remove %s failed", err)
 				return err, false
 			}
@@ -65,6 +113,11 @@ func GenerateVirtualHostConf(service *Service) (error, bool) {
 			// if action is ActionTypeAdd, it means that k8s service object exists.
 			// we should create the corresponding nginx configuration file.
 			//logrus.Debugf(configFile)
+			healthcheck.Register(upstreamName, hostNames, port.NodePort)
+			// the file generated for other cluster is never overwritten.
+			if err := checkOwner(configFile, service.ClusterID); err != nil {
+				return err, false
+			}
 			err, isChanged := generateFile(configFile, configData)
 			if err != nil {
 				return err, false
@@ -77,6 +130,58 @@ func GenerateVirtualHostConf(service *Service) (error, bool) {
 	return nil, changed
 }
 
+// ListenAddress returns the address of the nginx "listen" directive,
+// it's "ip:port" if ip is not empty, otherwise it's "port".
+func ListenAddress(ip string, port int32) string {
+	if len(ip) == 0 {
+		return strconv.Itoa(int(port))
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(int(port)))
+}
+
+// ListenAddresses returns the addresses of the nginx "listen" directives for the
+// k8s service. It's the ListenIP if specified, otherwise the wildcard address of
+// every ip family of the k8s service: "port" for IPv4 and "[::]:port" for IPv6.
+func ListenAddresses(service *Service, port int32) []string {
+	if len(service.ListenIP) != 0 {
+		return []string{ListenAddress(service.ListenIP, port)}
+	}
+	var addrs []string
+	if service.HasIPFamily(IPv4) {
+		addrs = append(addrs, ListenAddress("", port))
+	}
+	if service.HasIPFamily(IPv6) {
+		addrs = append(addrs, ListenAddress("::", port))
+	}
+	return addrs
+}
+
+// selectUpstreamHosts returns the upstream hosts whose ip family the k8s service
+// has, because the NodePort is only reachable by the node addresses of the k8s
+// service ip families. The host names are always selected. All the hosts are
+// returned if none is selected, eg: the IPv6 only k8s service with --upstream IPv4 hosts.
+func selectUpstreamHosts(hosts []UpstreamHost, service *Service) []UpstreamHost {
+	var selected []UpstreamHost
+	for _, host := range hosts {
+		ip := net.ParseIP(host.Host)
+		switch {
+		case ip == nil:
+			// the host name is resolved by nginx, always selected.
+		case ip.To4() != nil && !service.HasIPFamily(IPv4):
+			continue
+		case ip.To4() == nil && !service.HasIPFamily(IPv6):
+			continue
+		}
+		selected = append(selected, host)
+	}
+	if len(selected) == 0 {
+		logrus.Warnf("no upstream host matches the ip families %v of service %s, use all the upstream hosts",
+			service.IPFamilies, service)
+		return hosts
+	}
+	return selected
+}
+
 // generateFile
 func generateFile(configFile, configData string) (error, bool) {
 	var (
@@ -86,25 +191,17 @@ func generateFile(configFile, configData string) (error, bool) {
 	)
 
 	// if config file not exist, create it.
-	if _, err = os.Stat(configFile); errors.Is(err, os.ErrNotExist) {
+	if oldData, err = readFile(configFile); errors.Is(err, os.ErrNotExist) {
 		logrus.Debugf("%s not exist, create it", configFile)
-		file, err := os.Create(configFile)
-		if err != nil {
-			return err, false
-		}
-		if _, err := file.WriteString(configData); err != nil {
+		if err := writeFile(configFile, configData); err != nil {
 			return err, false
 		}
-		file.Close()
 		return nil, true
 	} else if err != nil {
 		return err, false
 	}
 
 	// calculate the nginx config file hash
-	if oldData, err = ioutil.ReadFile(configFile); err != nil {
-		return err, false
-	}
 	newData = []byte(configData)
 	if oldHashCode, err = genHashCode(oldData); err != nil {
 		return err, false
@@ -119,14 +216,9 @@ func generateFile(configFile, configData string) (error, bool) {
 	// if config file hash not the same, generate the nginx config and overwirte it.
 	if oldHashCode != newHashCode {
 		logrus.Debugf("%s hash is not the same, generate it.", configFile)
-		file, err := os.Create(configFile)
-		if err != nil {
-			return err, false
-		}
-		if _, err := file.WriteString(configData); err != nil {
+		if err := writeFile(configFile, configData); err != nil {
 			return err, false
 		}
-		file.Close()
 		return nil, true
 	}
 	logrus.Debugf("%s hash is same, skip generate it.", configFile)
@@ -141,3 +233,13 @@ func genHashCode(data []byte) (string, error) {
 	}
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
+
+// allDown returns true if every upstream is marked down by the active health checking.
+func allDown(upstreams []Upstream) bool {
+	for _, upstream := range upstreams {
+		if !upstream.Down {
+			return false
+		}
+	}
+	return len(upstreams) != 0
+}
@@ -0,0 +1,86 @@
+package nginx
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/healthcheck"
+)
+
+// waitDown waits until the health checking marks the upstream host down or up.
+func waitDown(t *testing.T, host string, port int32, down bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for healthcheck.IsDown(host, port) != down {
+		if time.Now().After(deadline) {
+			t.Fatalf("upstream %s:%d down is not %t", host, port, down)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGenerateFailOpen(t *testing.T) {
+	dir := setupNginxDir(t, "127.0.0.1", "127.0.0.2")
+	args.NewBuilder().SetHealthCheckMode(string(healthcheck.ModeTCP)).SetHealthCheckInterval(10 * time.Millisecond).
+		SetHealthCheckTimeout(time.Second).SetHealthCheckRise(1).SetHealthCheckFall(1)
+	t.Cleanup(func() { args.NewBuilder().SetHealthCheckMode(string(healthcheck.ModeNone)) })
+
+	// only 127.0.0.1 accepts the connections to the NodePort.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	nodePort := int32(listener.Addr().(*net.TCPAddr).Port)
+	service := &Service{Action: ActionTypeAdd, Namespace: "default", Name: "web", Ports: []ServicePort{{Name: "web", Port: 80, NodePort: nodePort, Protocol: "TCP"}}}
+	file := filepath.Join(dir, "sites-stream", "tcp.default.web.web")
+	if err, _ := GenerateVirtualHostConf(service); err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go healthcheck.Run(stopCh, func() {})
+
+	tests := []struct {
+		name string
+		// down is the upstream hosts down.
+		down []string
+		// want is the servers rendered.
+		want []string
+	}{
+		{
+			name: "one down",
+			down: []string{"127.0.0.2"},
+			want: []string{"127.0.0.1:" + strconv.Itoa(int(nodePort)) + ";", "127.0.0.2:" + strconv.Itoa(int(nodePort)) + " down;"},
+		},
+		{
+			name: "all down",
+			down: []string{"127.0.0.1", "127.0.0.2"},
+			want: []string{"127.0.0.1:" + strconv.Itoa(int(nodePort)) + ";", "127.0.0.2:" + strconv.Itoa(int(nodePort)) + ";"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.down) == 2 {
+				listener.Close()
+			}
+			for _, host := range tt.down {
+				waitDown(t, host, nodePort, true)
+			}
+			if err, _ := GenerateVirtualHostConf(service); err != nil {
+				t.Fatal(err)
+			}
+			data := readTestFile(t, file)
+			for _, s := range tt.want {
+				if !strings.Contains(data, s) {
+					t.Errorf("%s does not contain %q:\n%s", file, s, data)
+				}
+			}
+		})
+	}
+}
@@ -8,8 +8,7 @@ import (
 	"os/exec"
 	"sync"
 
-	"github.com/forbearing/k8s-loadbalancer/pkg/logger"
-	"github.com/sirupsen/logrus"
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
 )
 
 var (
@@ -17,9 +16,20 @@ var (
 )
 
 type Nginx struct {
+	// Runtime manages the nginx daemon, DefaultRuntime() is used if it's nil.
+	Runtime Runtime
+
 	err error
 }
 
+// runtime returns the Runtime used to manage the nginx daemon.
+func (n *Nginx) runtime() Runtime {
+	if n.Runtime == nil {
+		return DefaultRuntime()
+	}
+	return n.Runtime
+}
+
 // Err returns the first errors that was encountered by the Do() function.
 func (n *Nginx) Err() error {
 	return n.err
@@ -40,48 +50,32 @@ func (n *Nginx) Do(service *Service) bool {
 	defer locker.Unlock()
 	var err error
 	var changed bool
+	rt := n.runtime()
 
 	//// if nginx cann't start, Doctor will make it start.
 	//Doctor()
 
-	// prepare nginx
-	// it will check whether nginx config dir exist
-	if err = Prepare(); err != nil {
-		n.setErr(err)
-		return false
-	}
-	// install nginx if nginx not installed
-	if err = Install(); err != nil {
-		n.setErr(err)
-		return false
-	}
-	// enable nginx
-	if err = Enabled(); err != nil {
+	// the host is bootstrapped (prepare, install and enable nginx) once, after that
+	// only to check the cached health state, bootstrap again if nginx is missing or broken.
+	if err = ensureHealthy(rt); err != nil {
 		n.setErr(err)
 		return false
 	}
 
-	// generate nginx config
-	if err, changed = GenerateNginxConf(); err != nil {
-		n.setErr(err)
-		return false
+	// the /etc/nginx/nginx.conf managed by user is verified once by bootstrap.
+	if NginxConfMode(args.GetNginxConfMode()) != NginxConfModeUnmanaged {
+		// generate nginx config
+		if err, changed = GenerateNginxConf(); err != nil {
+			n.setErr(err)
+			return false
+		}
 	}
 	// if /etc/nginx/nginx.conf changed, test nginx config and reload nginx.
 	if changed {
-		// test nginx configuration
-		// if test nginx config file failed, delete the test failed config file.
-		if err = TestConf(); err != nil {
+		if err = testAndReload(rt); err != nil {
 			n.setErr(err)
 			return false
 		}
-		// reload nginx
-		if err = Reload(); err != nil {
-			// if failed reload nginx, restart nginx.
-			if err = Restart(); err != nil {
-				n.setErr(err)
-				return false
-			}
-		}
 	}
 
 	// generate nginx virtual host config
@@ -91,112 +85,98 @@ func (n *Nginx) Do(service *Service) bool {
 	}
 	// if nginx virtual host config changed, test nginx config and reload nginx.
 	if changed {
-		// test nginx configuration
-		// if test nginx config file failed, delete the test failed config file.
-		if err = TestConf(); err != nil {
+		if err = testAndReload(rt); err != nil {
 			n.setErr(err)
 			return false
 		}
-		// reload nginx
-		if err = Reload(); err != nil {
-			// if failed reload nginx, restart nginx.
-			if err = Restart(); err != nil {
-				n.setErr(err)
-				return false
-			}
-		}
 	}
 
 	// everything is done.
 	return false
 }
 
-// Prepare will create the direcotry needed by nginx before processing nginx.
-// You should always call Prepare() before do anything to nginx
-func Prepare() error {
-	return executeCommand(
-		[]string{"bash", "-c", NGINX_PREPARE},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
-}
-
-// Install will intall the nginx package in linux.
-func Install() error {
-	return executeCommand(
-		[]string{"bash", "-c", NGINX_INSTALL},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
-}
-
-// Remove() will uninstall the nginx package in linux.
-func Remove() error {
-	return executeCommand(
-		[]string{"bash", "-c", NGINX_REMOVE},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
-}
-
-// Start will start nginx daemon by systemctl.
-func Start() error {
-	return executeCommand(
-		[]string{"bash", "-c", NGINX_START},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
-}
-
-// Stop will stop nginx daemon by systemctl.
-func Stop() error {
-	return executeCommand(
-		[]string{"bash", "-c", NGINX_STOP},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
-}
-
-// Reload will reload nginx daemon by systemctl.
-func Reload() error {
-	return executeCommand(
-		[]string{"bash", "-c", NGINX_RELOAD},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
-}
-
-// Restart will restart nginx daemon by systemctl.
-func Restart() error {
-	return executeCommand(
-		[]string{"bash", "-c", NGINX_RESTART},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
-}
+// DoAll generates the nginx config of all the services and reloads nginx at most
+// once, it's used to re-render all the k8s services after the configuration
+// reloaded. The service failed to generate is skipped and the first error is
+// returned, the others are still generated. Unlike Do, it's never retried.
+func (n *Nginx) DoAll(services []*Service) error {
+	locker.Lock()
+	defer locker.Unlock()
+	var changed bool
+	rt := n.runtime()
 
-// EnabledNow will enabled and start nginx daemon by systemctl.
-func EnabledNow() error {
-	return executeCommand(
-		[]string{"bash", "-c", NGINX_ENABLENOW},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
+	if err := ensureHealthy(rt); err != nil {
+		n.setErr(err)
+		return err
+	}
+	if NginxConfMode(args.GetNginxConfMode()) != NginxConfModeUnmanaged {
+		err, confChanged := GenerateNginxConf()
+		if err != nil {
+			n.setErr(err)
+			return err
+		}
+		changed = confChanged
+	}
+	var failed error
+	for _, service := range services {
+		err, vhostChanged := GenerateVirtualHostConf(service)
+		if err != nil {
+			if failed == nil {
+				failed = fmt.Errorf("%s: %s", service, err.Error())
+			}
+			continue
+		}
+		changed = changed || vhostChanged
+	}
+	// test nginx config and reload nginx once for all the services.
+	if changed {
+		if err := testAndReload(rt); err != nil {
+			n.setErr(err)
+			return err
+		}
+	}
+	if failed != nil {
+		n.setErr(failed)
+	}
+	return failed
 }
 
-// Enabled will enabled nginx daemon by systemctl.
-func Enabled() error {
-	return executeCommand(
-		[]string{"bash", "-c", NGINX_ENABLE},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
-}
+// Reload starts nginx if it's not running, otherwise tests the nginx configuration
+// and reloads nginx. It's called after the VIPs acquired, so nginx binds the VIPs
+// even if it failed to bind them before, eg: the nonlocal bind is disabled.
+func (n *Nginx) Reload() error {
+	locker.Lock()
+	defer locker.Unlock()
+	rt := n.runtime()
 
-// TestConf will test nginx configuration file.
-func TestConf() error {
-	return executeCommand([]string{"bash", "-c", NGINX_TESTCONF},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
+	status, err := rt.Status()
+	if err != nil {
+		return err
+	}
+	if !status.Installed || !status.Running {
+		// bootstrap installs and starts nginx.
+		markUnhealthy()
+		return ensureHealthy(rt)
+	}
+	return testAndReload(rt)
 }
 
-// Doctor will delete the test failed nginx config file.
-func Doctor() error {
-	return executeCommand(
-		[]string{"bash", "-c", NGINX_DOCTOR},
-		logger.New().WriterLevel(logrus.DebugLevel),
-		&bytes.Buffer{})
+// testAndReload tests the nginx configuration and reloads nginx, nginx is
+// restarted if the reload failed.
+func testAndReload(rt Runtime) error {
+	// test nginx configuration
+	if err := rt.TestConf(); err != nil {
+		return err
+	}
+	// reload nginx
+	if err := rt.Reload(); err != nil {
+		// if failed reload nginx, restart nginx.
+		if err = rt.Restart(); err != nil {
+			markUnhealthy()
+			return err
+		}
+	}
+	return nil
 }
 
 // executeCommand execute linux command.
@@ -0,0 +1,190 @@
+package nginx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// NginxConfMode decides whether the controller owns /etc/nginx/nginx.conf.
+type NginxConfMode string
+
+const (
+	// NginxConfModeManaged will render /etc/nginx/nginx.conf from TemplateNginxConf.
+	NginxConfModeManaged NginxConfMode = "managed"
+	// NginxConfModeUnmanaged never touch /etc/nginx/nginx.conf, only verify that
+	// it includes the directories the controller writes to.
+	NginxConfModeUnmanaged NginxConfMode = "unmanaged"
+)
+
+// NginxConfParamsKey is the key of the ConfigMap data holding the nginx.conf parameters.
+const NginxConfParamsKey = "nginx-conf.yaml"
+
+var (
+	nginxConfParams = DefaultNginxConfParams()
+
+	// defaultNginxUsers is the users we pick from when the user isn't specified
+	// and the distribution can't be detected.
+	defaultNginxUsers = []string{"www-data", "nginx", "http"}
+
+	defaultNginxUserOnce sync.Once
+	// defaultNginxUserName is the nginx user used if it's not specified.
+	defaultNginxUserName string
+)
+
+// NginxConfParams is the parameters used to render /etc/nginx/nginx.conf.
+type NginxConfParams struct {
+	// User is the user nginx worker processes run as. If empty, the user created
+	// by the nginx package of the distribution will be used.
+	User               string   `json:"user,omitempty"`
+	WorkerProcesses    string   `json:"workerProcesses,omitempty"`
+	WorkerConnections  int      `json:"workerConnections,omitempty"`
+	WorkerRlimitNofile int      `json:"workerRlimitNofile,omitempty"`
+	HTTPLogFormat      string   `json:"httpLogFormat,omitempty"`
+	StreamLogFormat    string   `json:"streamLogFormat,omitempty"`
+	Gzip               bool     `json:"gzip"`
+	GzipCompLevel      int      `json:"gzipCompLevel,omitempty"`
+	GzipTypes          []string `json:"gzipTypes,omitempty"`
+}
+
+// DefaultNginxConfParams returns the nginx.conf parameters used when nothing specified.
+func DefaultNginxConfParams() *NginxConfParams {
+	return &NginxConfParams{
+		WorkerProcesses:    "auto",
+		WorkerConnections:  10240,
+		WorkerRlimitNofile: 65535,
+		StreamLogFormat: `$remote_addr [$time_local] ` +
+			`$protocol $status $bytes_sent $bytes_received ` +
+			`$session_time "$upstream_addr" ` +
+			`"$upstream_bytes_sent" "$upstream_bytes_received" "$upstream_connect_time"`,
+		Gzip:          true,
+		GzipCompLevel: 9,
+		GzipTypes: []string{"text/plain", "text/css", "application/json", "application/javascript",
+			"application/x-javascript", "text/xml", "application/xml", "application/xml+rss", "text/javascript"},
+	}
+}
+
+// ParseNginxConfParams parses the yaml data into NginxConfParams,
+// the fields not specified in data keep the default value.
+func ParseNginxConfParams(data []byte) (*NginxConfParams, error) {
+	params := DefaultNginxConfParams()
+	if err := yaml.UnmarshalStrict(data, params); err != nil {
+		return nil, fmt.Errorf("parse nginx.conf parameters failed: %s", err.Error())
+	}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// LoadNginxConfParams reads the nginx.conf parameters from file.
+func LoadNginxConfParams(filename string) (*NginxConfParams, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseNginxConfParams(data)
+}
+
+// Validate checks the nginx.conf parameters.
+func (p *NginxConfParams) Validate() error {
+	if p.WorkerConnections <= 0 {
+		return fmt.Errorf("workerConnections must be greater than 0, got %d", p.WorkerConnections)
+	}
+	if p.WorkerRlimitNofile <= 0 {
+		return fmt.Errorf("workerRlimitNofile must be greater than 0, got %d", p.WorkerRlimitNofile)
+	}
+	if p.GzipCompLevel < 1 || p.GzipCompLevel > 9 {
+		return fmt.Errorf("gzipCompLevel must be between 1 and 9, got %d", p.GzipCompLevel)
+	}
+	for _, format := range []string{p.HTTPLogFormat, p.StreamLogFormat} {
+		if strings.Contains(format, "'") {
+			return fmt.Errorf("log format must not contain single quote: %s", format)
+		}
+	}
+	return nil
+}
+
+// SetNginxConfParams sets the parameters used by GenerateNginxConf, nil keeps
+// the existing nginx.conf until the parameters set, eg: the ConfigMap of the
+// parameters is unreachable when the controller starts.
+func SetNginxConfParams(params *NginxConfParams) {
+	locker.Lock()
+	defer locker.Unlock()
+	nginxConfParams = params
+}
+
+// ParseNginxConfParamsConfigMap parses the nginx.conf parameters in the key
+// "nginx-conf.yaml" of the ConfigMap.
+func ParseNginxConfParamsConfigMap(cm *corev1.ConfigMap) (*NginxConfParams, error) {
+	data, ok := cm.Data[NginxConfParamsKey]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s/%s has no key %q", cm.Namespace, cm.Name, NginxConfParamsKey)
+	}
+	return ParseNginxConfParams([]byte(data))
+}
+
+// renderNginxConf renders TemplateNginxConf with the nginx.conf parameters.
+func renderNginxConf(params *NginxConfParams) (string, error) {
+	p := *params
+	if len(p.User) == 0 {
+		p.User = defaultNginxUser()
+	}
+	return renderTemplate(TemplateNameNginxConf, &p)
+}
+
+// defaultNginxUser returns the user created by the nginx package of the host
+// distribution, it's detected once.
+func defaultNginxUser() string {
+	defaultNginxUserOnce.Do(func() {
+		if distro, err := DetectHostDistro(); err == nil {
+			defaultNginxUserName = distro.NginxUser()
+			logrus.Debugf("nginx user not specified, use %q of %s", defaultNginxUserName, distro.Name)
+			return
+		}
+		for _, name := range defaultNginxUsers {
+			if _, err := user.Lookup(name); err == nil {
+				defaultNginxUserName = name
+				break
+			}
+		}
+		logrus.Debugf("nginx user not specified, use %q", defaultNginxUserName)
+	})
+	return defaultNginxUserName
+}
+
+// VerifyNginxConf checks the nginx configuration dumped by the runtime includes
+// the directories the controller generates the stream and http config files into,
+// the commented out includes are ignored. It's used when the controller doesn't
+// own /etc/nginx/nginx.conf.
+func VerifyNginxConf(rt Runtime) error {
+	dump, err := rt.DumpConf()
+	if err != nil {
+		return err
+	}
+	included := make(map[string]bool)
+	for _, line := range strings.Split(dump, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		// eg: "include /etc/nginx/sites-stream/*;"
+		fields := strings.Fields(strings.Replace(line, ";", " ; ", -1))
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "include" {
+				included[fields[i+1]] = true
+			}
+		}
+	}
+	for _, dir := range []string{tcpConfDir, httpConfDir} {
+		if !included[dir+"/*"] {
+			return fmt.Errorf("nginx configuration must contains %q", fmt.Sprintf("include %s/*;", dir))
+		}
+	}
+	return nil
+}
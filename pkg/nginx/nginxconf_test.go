@@ -0,0 +1,169 @@
+package nginx
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// includeConf returns the nginx configuration including the directories
+// the controller generates the config files into.
+func includeConf(dir string) string {
+	return "http {\n    include " + filepath.Join(dir, "sites-enabled") + "/*;\n}\n" +
+		"stream {\n    include " + filepath.Join(dir, "sites-stream") + "/*;\n}\n"
+}
+
+func TestParseNginxConfParams(t *testing.T) {
+	params, err := ParseNginxConfParams([]byte("user: nginx\nworkerConnections: 1024\ngzip: false\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.User != "nginx" || params.WorkerConnections != 1024 || params.Gzip {
+		t.Errorf("params = %+v", params)
+	}
+	// the fields not specified keep the default value.
+	defaults := DefaultNginxConfParams()
+	if params.WorkerRlimitNofile != defaults.WorkerRlimitNofile || params.StreamLogFormat != defaults.StreamLogFormat {
+		t.Errorf("the default values are not kept: %+v", params)
+	}
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"unknown field", "workerConnection: 1024\n", "unknown field"},
+		{"worker connections", "workerConnections: -1\n", "workerConnections"},
+		{"worker rlimit nofile", "workerRlimitNofile: -1\n", "workerRlimitNofile"},
+		{"gzip comp level", "gzipCompLevel: 10\n", "gzipCompLevel"},
+		{"log format quote", "httpLogFormat: \"$remote_addr '\"\n", "single quote"},
+		{"invalid yaml", "gzip: [\n", "parse nginx.conf parameters failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseNginxConfParams([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseNginxConfParams() error = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNginxConfParamsConfigMap(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "nginx"},
+		Data:       map[string]string{NginxConfParamsKey: "workerConnections: 2048\n"},
+	}
+	params, err := ParseNginxConfParamsConfigMap(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.WorkerConnections != 2048 {
+		t.Errorf("workerConnections = %d, want 2048", params.WorkerConnections)
+	}
+
+	cm.Data = map[string]string{"nginx.yaml": "workerConnections: 2048\n"}
+	if _, err := ParseNginxConfParamsConfigMap(cm); err == nil || !strings.Contains(err.Error(), NginxConfParamsKey) {
+		t.Errorf("ParseNginxConfParamsConfigMap() error = %v, want the key missing", err)
+	}
+	cm.Data = map[string]string{NginxConfParamsKey: "gzipCompLevel: 0\n"}
+	if _, err := ParseNginxConfParamsConfigMap(cm); err == nil {
+		t.Error("the invalid parameters in the ConfigMap are accepted")
+	}
+}
+
+func TestRenderNginxConf(t *testing.T) {
+	dir := setupNginxDir(t, "10.0.0.1")
+	params := DefaultNginxConfParams()
+	params.User = "nobody"
+	params.WorkerConnections = 4096
+	params.HTTPLogFormat = "$remote_addr $status"
+	params.Gzip = false
+	data, err := renderNginxConf(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"user nobody;",
+		"worker_connections 4096;",
+		"log_format main '$remote_addr $status';",
+		"access_log /var/log/nginx/access.log main;",
+		"gzip off;",
+		"include " + dir + "/sites-enabled/*;",
+		"include " + dir + "/sites-stream/*;",
+	} {
+		if !strings.Contains(data, s) {
+			t.Errorf("nginx.conf does not contain %q:\n%s", s, data)
+		}
+	}
+
+	// the user of the host is used if not specified.
+	params.User = ""
+	if data, err = renderNginxConf(params); err != nil {
+		t.Fatal(err)
+	}
+	if user := defaultNginxUser(); len(user) != 0 && !strings.Contains(data, "user "+user+";") {
+		t.Errorf("nginx.conf does not use the default user %q:\n%s", user, data)
+	}
+}
+
+func TestVerifyNginxConf(t *testing.T) {
+	dir := setupNginxDir(t)
+	stream := "include " + filepath.Join(dir, "sites-stream") + "/*;"
+	http := "include " + filepath.Join(dir, "sites-enabled") + "/*;"
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{"included", includeConf(dir), false},
+		{"one line", "stream { " + stream + " } http { " + http + " }", false},
+		{"stream missing", "http {\n    " + http + "\n}\n", true},
+		{"commented out", "http {\n    " + http + "\n}\nstream {\n    # " + stream + "\n}\n", true},
+		{"other directory", "http {\n    " + http + "\n}\nstream {\n    include /etc/nginx/stream.d/*;\n}\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := NewFakeRuntime()
+			rt.SetConf(tt.conf)
+			if err := VerifyNginxConf(rt); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyNginxConf() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnmanagedNginxConfVerifiedOnce(t *testing.T) {
+	dir := setupNginxDir(t, "10.0.0.1")
+	args.NewBuilder().SetNginxConfMode(string(NginxConfModeUnmanaged))
+	t.Cleanup(func() { args.NewBuilder().SetNginxConfMode(string(NginxConfModeManaged)) })
+	health.bootstrapped = false
+	t.Cleanup(func() { health.bootstrapped = false })
+
+	rt := NewFakeRuntime()
+	rt.SetConf(includeConf(dir))
+	n := &Nginx{Runtime: rt}
+	for _, name := range []string{"a", "b", "c"} {
+		n.Do(&Service{Namespace: "default", Name: name, Ports: []ServicePort{{Name: "web", Port: 80, NodePort: 30080, Protocol: "TCP"}}})
+		if err := n.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.DoAll(nil); err != nil {
+		t.Fatal(err)
+	}
+	if count := rt.Count("DumpConf"); count != 1 {
+		t.Errorf("nginx configuration dumped %d times, want once by bootstrap", count)
+	}
+
+	// the nginx.conf not including the directories fails the bootstrap.
+	health.bootstrapped = false
+	rt.SetConf("http {\n}\n")
+	if err := n.DoAll(nil); err == nil {
+		t.Error("the nginx.conf not including the directories is accepted")
+	}
+}
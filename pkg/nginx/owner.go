@@ -0,0 +1,225 @@
+package nginx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The keys of the generated nginx config file header, the header is the comment
+// lines "# key: value" at the beginning of the file.
+const (
+	headerClusterID = "cluster-id"
+	headerCluster   = "cluster"
+	headerService   = "service"
+)
+
+// upstreamName returns the nginx upstream name of the k8s service port, format is
+// namespace.name.portName, prefixed with the cluster name if multiple clusters
+// specified and suffixed with the cluster id, eg: cluster.namespace.name.portName.clusterID.
+func upstreamName(service *Service, port ServicePort) string {
+	name := fmt.Sprintf("%s.%s.%s", service.Namespace, service.Name, port.Name)
+	if len(service.Cluster) != 0 {
+		name = service.Cluster + "." + name
+	}
+	if len(service.ClusterID) != 0 {
+		name = name + "." + service.ClusterID
+	}
+	return name
+}
+
+// configFile returns the nginx config file of the k8s service port, format is
+// tcp.upstreamName, udp.upstreamName, http.upstreamName or https.upstreamName.
+// The stream config files are in sites-stream, the http ones are in sites-enabled.
+func configFile(service *Service, port ServicePort) string {
+	protocol := port.proxyProtocol()
+	dir := tcpConfDir
+	switch protocol {
+	case ProtocolUDP:
+		dir = udpConfDir
+	case ProtocolHTTP:
+		dir = httpConfDir
+	case ProtocolHTTPS:
+		dir = httpsConfDir
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s.%s", strings.ToLower(string(protocol)), upstreamName(service, port)))
+}
+
+// ConfigFiles returns the nginx config files of all the ports of the k8s service.
+func ConfigFiles(service *Service) []string {
+	var files []string
+	for _, port := range service.Ports {
+		files = append(files, configFile(service, port))
+	}
+	return files
+}
+
+// fileHeader returns the header of the nginx config file generated for the k8s
+// service, it records the cluster id owning the file.
+func fileHeader(service *Service) string {
+	header := "# Generated by k8s-loadbalancer, DO NOT EDIT.\n"
+	header += fmt.Sprintf("# %s: %s\n", headerClusterID, service.ClusterID)
+	if len(service.Cluster) != 0 {
+		header += fmt.Sprintf("# %s: %s\n", headerCluster, service.Cluster)
+	}
+	header += fmt.Sprintf("# %s: %s\n", headerService, service)
+	return header
+}
+
+// readHeader returns the header of the nginx config file, it's empty if the
+// file is not generated by k8s-loadbalancer.
+func readHeader(file string) (map[string]string, error) {
+	data, err := readFile(file)
+	if err != nil {
+		return nil, err
+	}
+	header := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		items := strings.SplitN(strings.TrimPrefix(line, "#"), ": ", 2)
+		if len(items) == 2 {
+			header[strings.TrimSpace(items[0])] = strings.TrimSpace(items[1])
+		}
+	}
+	return header, scanner.Err()
+}
+
+// checkOwner returns error if the nginx config file exists but not generated for
+// the cluster id, eg: generated by the controller of another cluster, or by hand.
+func checkOwner(file, clusterID string) error {
+	header, err := readHeader(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	id, ok := header[headerClusterID]
+	if !ok {
+		return fmt.Errorf("%s is not generated by k8s-loadbalancer", file)
+	}
+	if id != clusterID {
+		return fmt.Errorf("%s is owned by cluster %q, not %q", file, id, clusterID)
+	}
+	return nil
+}
+
+// Prune removes the nginx config files generated for the cluster id and the cluster
+// name in --kubeconfig but not in keep, eg: the k8s services deleted when the
+// controller was not running, and reloads nginx if any removed. The legacy files
+// of the cluster generated before the cluster id recorded are removed too, their
+// listen ports conflict with the files replacing them. The files of the other
+// clusters and the files not generated by k8s-loadbalancer are left untouched.
+func (n *Nginx) Prune(clusterID, cluster string, keep map[string]bool) bool {
+	locker.Lock()
+	defer locker.Unlock()
+	if len(clusterID) == 0 {
+		n.setErr(errors.New("cluster id is required to prune the nginx config files"))
+		return false
+	}
+
+	var changed bool
+	for _, dir := range confDirs() {
+		names, err := readDir(dir)
+		if err != nil {
+			n.setErr(err)
+			return false
+		}
+		for _, name := range names {
+			file := filepath.Join(dir, name)
+			if keep[file] {
+				continue
+			}
+			header, err := readHeader(file)
+			if err != nil {
+				n.setErr(err)
+				return false
+			}
+			id, ok := header[headerClusterID]
+			if !ok && isLegacyFile(file, cluster) {
+				// the file generated before the cluster id recorded is replaced
+				// by the file suffixed with the cluster id.
+				logrus.Infof("remove legacy nginx config generated without cluster id: %s", file)
+				if err := removeFile(file); err != nil {
+					n.setErr(err)
+					return false
+				}
+				changed = true
+				continue
+			}
+			if !ok {
+				logrus.Debugf("%s is not generated by k8s-loadbalancer, skip removing it", file)
+				continue
+			}
+			if id != clusterID || header[headerCluster] != cluster {
+				continue
+			}
+			logrus.Infof("remove stale nginx config: %s", file)
+			if err := removeFile(file); err != nil {
+				n.setErr(err)
+				return false
+			}
+			changed = true
+		}
+	}
+	if changed {
+		if err := testAndReload(n.runtime()); err != nil {
+			n.setErr(err)
+			return false
+		}
+	}
+	return false
+}
+
+// isLegacyFile returns true if the file is generated for the cluster name by the
+// old version without the cluster id, its name is protocol.upstreamName without
+// the cluster id suffix, eg: tcp.namespace.name.portName, and it defines the
+// upstream of the name. The namespace, name and port name never contain dots.
+func isLegacyFile(file, cluster string) bool {
+	items := strings.SplitN(filepath.Base(file), ".", 2)
+	if len(items) != 2 {
+		return false
+	}
+	switch Protocol(strings.ToUpper(items[0])) {
+	case ProtocolTCP, ProtocolUDP, ProtocolHTTP, ProtocolHTTPS:
+	default:
+		return false
+	}
+	upstream := items[1]
+	parts := strings.Split(upstream, ".")
+	if len(cluster) == 0 && len(parts) != 3 {
+		return false
+	}
+	if len(cluster) != 0 && (len(parts) != 4 || parts[0] != cluster) {
+		return false
+	}
+	data, err := readFile(file)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(data), "upstream "+upstream+" {")
+}
+
+// confDirs returns the directories the controller generates the stream and
+// http config files into.
+func confDirs() []string {
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, dir := range []string{tcpConfDir, udpConfDir, httpConfDir, httpsConfDir} {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
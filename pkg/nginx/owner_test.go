@@ -0,0 +1,73 @@
+package nginx
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// legacyConf returns the stream config file of the upstream generated before
+// the cluster id recorded.
+func legacyConf(upstream string) string {
+	return fmt.Sprintf(`
+upstream %s {
+    server 10.0.0.1:30080;
+}
+server {
+    listen 80;
+    proxy_pass          %s;
+}
+`, upstream, upstream)
+}
+
+func TestPruneLegacyFiles(t *testing.T) {
+	dir := setupNginxDir(t, "10.0.0.1")
+	// the /etc/nginx tree generated before the cluster id recorded.
+	files := map[string]string{
+		"sites-stream/tcp.default.web.web":   legacyConf("default.web.web"),
+		"sites-stream/udp.default.gone.dns":  legacyConf("default.gone.dns"),
+		"sites-stream/tcp.b.default.web.web": legacyConf("b.default.web.web"),
+		"sites-stream/tcp.default.manual.db": "server {\n    listen 3306;\n}\n",
+		"sites-stream/custom.conf":           "upstream custom {\n}\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	service := &Service{
+		Action:    ActionTypeAdd,
+		ClusterID: "abc",
+		Namespace: "default",
+		Name:      "web",
+		Ports:     []ServicePort{{Name: "web", Port: 80, NodePort: 30080, Protocol: string(ProtocolTCP)}},
+	}
+	if err, _ := GenerateVirtualHostConf(service); err != nil {
+		t.Fatal(err)
+	}
+	keep := map[string]bool{filepath.Join(dir, "sites-stream/tcp.default.web.web.abc"): true}
+	n := &Nginx{Runtime: NewFakeRuntime()}
+	n.Prune("abc", "", keep)
+	if err := n.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, removed := range map[string]bool{
+		"sites-stream/tcp.default.web.web.abc": false,
+		"sites-stream/tcp.default.web.web":     true,
+		"sites-stream/udp.default.gone.dns":    true,
+		// the legacy file of the cluster "b" is pruned by its own controller.
+		"sites-stream/tcp.b.default.web.web": false,
+		"sites-stream/tcp.default.manual.db": false,
+		"sites-stream/custom.conf":           false,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := !errors.Is(err, os.ErrNotExist); exists == removed {
+			t.Errorf("%s exists: %v, want %v", name, exists, !removed)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package nginx
+
+import (
+	"sync"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+)
+
+var (
+	defaultRuntime     Runtime
+	defaultRuntimeOnce sync.Once
+)
+
+// Runtime manages the lifecycle of the nginx daemon on the host.
+// The ShellRuntime manages nginx by shell scripts and systemctl,
+// the SupervisorRuntime runs nginx as a child process of the controller,
+// the DryRunRuntime only logs the commands in dry-run mode, and the FakeRuntime
+// only records the calls, it's used for testing.
+type Runtime interface {
+	// Prepare creates the directories needed by nginx.
+	Prepare() error
+	// Install installs the nginx package if it's not installed.
+	Install() error
+	// Remove uninstalls the nginx package.
+	Remove() error
+	// Enable makes nginx start on boot, or starts nginx if it's supervised.
+	Enable() error
+	// Start starts nginx.
+	Start() error
+	// Stop stops nginx.
+	Stop() error
+	// TestConf tests the nginx configuration.
+	TestConf() error
+	// DumpConf returns the whole nginx configuration including all the included files.
+	DumpConf() (string, error)
+	// Reload reloads the nginx configuration.
+	Reload() error
+	// Restart restarts nginx.
+	Restart() error
+	// Status returns the current status of nginx.
+	Status() (Status, error)
+}
+
+// Status is the status of nginx on the host.
+type Status struct {
+	// Installed is true if the nginx binary found.
+	Installed bool
+	// Running is true if the nginx daemon is running.
+	Running bool
+}
+
+// NewRuntime returns the Runtime according to --nginx-process-manager,
+// it's the DryRunRuntime in dry-run mode.
+func NewRuntime() Runtime {
+	if DryRun() {
+		return &DryRunRuntime{}
+	}
+	switch ProcessManager(args.GetNginxProcessManager()) {
+	case ProcessManagerSupervisor:
+		return &SupervisorRuntime{ShellRuntime: &ShellRuntime{}, supervisor: supervisor}
+	default:
+		return &ShellRuntime{}
+	}
+}
+
+// DefaultRuntime returns the Runtime used when Nginx.Runtime is not set,
+// it's created by NewRuntime once.
+func DefaultRuntime() Runtime {
+	defaultRuntimeOnce.Do(func() {
+		defaultRuntime = NewRuntime()
+	})
+	return defaultRuntime
+}
+
+// Shutdown stops the supervised nginx, it should be called before the controller exits.
+// It does nothing if nginx is not supervised.
+func Shutdown() error {
+	return supervisor.Stop()
+}
@@ -0,0 +1,111 @@
+package nginx
+
+import "sync"
+
+// FakeRuntime is a Runtime which never touches the host, it records every call
+// so the behaviour of the caller (eg: which services trigger which reloads)
+// can be tested without root or nginx.
+type FakeRuntime struct {
+	mu sync.Mutex
+	// calls is the name of the methods called in order.
+	calls []string
+	// errors is the error returned by the method, key is the method name.
+	errors map[string]error
+	status Status
+	conf   string
+}
+
+var _ Runtime = &FakeRuntime{}
+
+// NewFakeRuntime returns a FakeRuntime that nginx is installed and running.
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		errors: make(map[string]error),
+		status: Status{Installed: true, Running: true},
+	}
+}
+
+func (f *FakeRuntime) Prepare() error  { return f.record("Prepare") }
+func (f *FakeRuntime) Install() error  { return f.record("Install") }
+func (f *FakeRuntime) Remove() error   { return f.record("Remove") }
+func (f *FakeRuntime) Enable() error   { return f.record("Enable") }
+func (f *FakeRuntime) Start() error    { return f.record("Start") }
+func (f *FakeRuntime) Stop() error     { return f.record("Stop") }
+func (f *FakeRuntime) TestConf() error { return f.record("TestConf") }
+func (f *FakeRuntime) Reload() error   { return f.record("Reload") }
+func (f *FakeRuntime) Restart() error  { return f.record("Restart") }
+
+func (f *FakeRuntime) DumpConf() (string, error) {
+	err := f.record("DumpConf")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conf, err
+}
+
+func (f *FakeRuntime) Status() (Status, error) {
+	err := f.record("Status")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status, err
+}
+
+// SetError makes the method returns the error, nil error clears it.
+func (f *FakeRuntime) SetError(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.errors, method)
+		return
+	}
+	f.errors[method] = err
+}
+
+// SetStatus sets the status returned by Status.
+func (f *FakeRuntime) SetStatus(status Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+// SetConf sets the nginx configuration returned by DumpConf.
+func (f *FakeRuntime) SetConf(conf string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conf = conf
+}
+
+// Calls returns the name of the methods called in order.
+func (f *FakeRuntime) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := make([]string, len(f.calls))
+	copy(calls, f.calls)
+	return calls
+}
+
+// Count returns the number of times the method called.
+func (f *FakeRuntime) Count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var count int
+	for _, call := range f.calls {
+		if call == method {
+			count++
+		}
+	}
+	return count
+}
+
+// Reset clears the recorded calls.
+func (f *FakeRuntime) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+func (f *FakeRuntime) record(method string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, method)
+	return f.errors[method]
+}
@@ -0,0 +1,150 @@
+package nginx
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// ShellRuntime manages nginx by the package manager of the distribution and
+// the service manager of the host, systemd or OpenRC. The commands are executed
+// directly without the shell.
+type ShellRuntime struct{}
+
+var _ Runtime = &ShellRuntime{}
+
+// Prepare will create the direcotry needed by nginx before processing nginx.
+// You should always call Prepare() before do anything to nginx
+func (r *ShellRuntime) Prepare() error {
+	for _, dir := range confDirs() {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Install will intall the nginx package in linux by the package manager
+// of the distribution detected from /etc/os-release.
+func (r *ShellRuntime) Install() error {
+	distro, err := DetectHostDistro()
+	if err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("nginx"); err != nil {
+		logrus.Infof("installing nginx on %s", distro.Name)
+		if err := r.run(distro.InstallCommands()); err != nil {
+			return err
+		}
+	}
+	// the debian/ubuntu default site listens to port 80, which may conflict with the k8s services.
+	if distro.Family == DistroFamilyDebian {
+		defaultSite := filepath.Join(nginxDir, "sites-enabled", "default")
+		if info, err := os.Lstat(defaultSite); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return os.Remove(defaultSite)
+		}
+	}
+	return nil
+}
+
+// Remove will uninstall the nginx package in linux by the package manager
+// of the distribution detected from /etc/os-release.
+func (r *ShellRuntime) Remove() error {
+	distro, err := DetectHostDistro()
+	if err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("nginx"); err != nil {
+		return nil
+	}
+	service := &ServiceManager{Name: "nginx", Init: distro.InitSystem()}
+	service.Stop()
+	service.Disable()
+	logrus.Infof("removing nginx on %s", distro.Name)
+	return r.run(distro.RemoveCommands())
+}
+
+// Enable will enabled nginx daemon by systemctl or rc-update.
+func (r *ShellRuntime) Enable() error { return r.service().Enable() }
+
+// Start will start nginx daemon by systemctl or rc-service.
+func (r *ShellRuntime) Start() error { return r.service().Start() }
+
+// Stop will stop nginx daemon by systemctl or rc-service.
+func (r *ShellRuntime) Stop() error { return r.service().Stop() }
+
+// TestConf will test nginx configuration file.
+func (r *ShellRuntime) TestConf() error {
+	return r.run([][]string{nginxCommand("-t")})
+}
+
+// DumpConf dumps the whole nginx configuration by "nginx -T".
+func (r *ShellRuntime) DumpConf() (string, error) {
+	var out bytes.Buffer
+	if err := executeCommand(nginxCommand("-T"), &out, &bytes.Buffer{}); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Reload will reload nginx daemon by systemctl or rc-service.
+func (r *ShellRuntime) Reload() error { return r.service().Reload() }
+
+// Restart will restart nginx daemon by systemctl or rc-service.
+func (r *ShellRuntime) Restart() error { return r.service().Restart() }
+
+// Status checks whether the nginx binary exists and the nginx daemon is active.
+func (r *ShellRuntime) Status() (Status, error) {
+	var status Status
+	if _, err := exec.LookPath("nginx"); err == nil {
+		status.Installed = true
+	}
+	status.Running = r.service().IsActive()
+	return status, nil
+}
+
+// emergFileRegexp matches the config file in the nginx -t emerg message, eg:
+// nginx: [emerg] unknown directive "foo" in /etc/nginx/sites-stream/tcp.default.web.web:3
+var emergFileRegexp = regexp.MustCompile(`\[emerg\].* in (/\S+):\d+`)
+
+// Doctor will delete the test failed nginx config file.
+func (r *ShellRuntime) Doctor() error {
+	var errBuf bytes.Buffer
+	if err := executeCommand(nginxCommand("-t"), nil, &errBuf); err == nil {
+		return nil
+	}
+	match := emergFileRegexp.FindStringSubmatch(errBuf.String())
+	if match == nil {
+		return nil
+	}
+	logrus.Warnf("%s test failed, remove it", match[1])
+	return os.RemoveAll(match[1])
+}
+
+// service returns the nginx service managed by the service manager of the host.
+func (r *ShellRuntime) service() *ServiceManager {
+	return NewServiceManager("nginx")
+}
+
+// run runs the commands one by one, stops at the first failed command.
+func (r *ShellRuntime) run(cmds [][]string) error {
+	for _, cmd := range cmds {
+		logrus.Debug(strings.Join(cmd, " "))
+		if err := executeCommand(cmd, logger.New().WriterLevel(logrus.DebugLevel), &bytes.Buffer{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package nginx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeNginxBinary puts the fake nginx command into PATH, it records the
+// arguments of every invocation joined by "|" into the returned file, and runs
+// in the foreground until killed if started by "-g 'daemon off;'".
+func fakeNginxBinary(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\n(IFS='|'; echo \"$*\") >> " + argsFile + "\n" +
+		"if [ \"$1\" = -g ]; then exec sleep 60; fi\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "nginx"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return argsFile
+}
+
+// readArgs returns the arguments of every invocation recorded by the fake nginx.
+func readArgs(t *testing.T, argsFile string) []string {
+	t.Helper()
+	data, err := ioutil.ReadFile(argsFile)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestShellRuntimeNginxArgs(t *testing.T) {
+	dir := setupNginxDir(t)
+	argsFile := fakeNginxBinary(t)
+	confFlags := "|-p|" + dir + "|-c|" + filepath.Join(dir, "nginx.conf")
+
+	r := &ShellRuntime{}
+	if err := r.TestConf(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.DumpConf(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Doctor(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-t" + confFlags, "-T" + confFlags, "-t" + confFlags}
+	if got := readArgs(t, argsFile); !reflect.DeepEqual(got, want) {
+		t.Errorf("nginx args = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+package nginx
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// ServiceManager manages a system service by the service manager of the host,
+// systemctl for systemd, rc-service and rc-update for OpenRC. The commands are
+// executed directly instead of by the shell, bash is not installed on every
+// distribution, eg: alpine.
+type ServiceManager struct {
+	// Name is the name of the system service, eg: nginx, keepalived.
+	Name string
+	// Init is the service manager of the host.
+	Init InitSystem
+}
+
+// NewServiceManager returns the ServiceManager of the system service, the service
+// manager is detected from /etc/os-release, default to systemd if the distribution
+// can't be detected.
+func NewServiceManager(name string) *ServiceManager {
+	init := InitSystemSystemd
+	if distro, err := DetectHostDistro(); err == nil {
+		init = distro.InitSystem()
+	}
+	return &ServiceManager{Name: name, Init: init}
+}
+
+// The actions of the system service.
+const (
+	serviceActionStart    = "start"
+	serviceActionStop     = "stop"
+	serviceActionReload   = "reload"
+	serviceActionRestart  = "restart"
+	serviceActionEnable   = "enable"
+	serviceActionDisable  = "disable"
+	serviceActionIsActive = "is-active"
+)
+
+// command returns the command doing the action on the system service.
+func (m *ServiceManager) command(action string) []string {
+	if m.Init == InitSystemOpenRC {
+		switch action {
+		case serviceActionEnable:
+			return []string{"rc-update", "add", m.Name, "default"}
+		case serviceActionDisable:
+			return []string{"rc-update", "del", m.Name, "default"}
+		case serviceActionIsActive:
+			return []string{"rc-service", m.Name, "status"}
+		default:
+			return []string{"rc-service", m.Name, action}
+		}
+	}
+	switch action {
+	case serviceActionIsActive:
+		return []string{"systemctl", "is-active", "--quiet", m.Name}
+	default:
+		return []string{"systemctl", action, m.Name}
+	}
+}
+
+// run runs the command doing the action on the system service.
+func (m *ServiceManager) run(action string) error {
+	command := m.command(action)
+	logrus.Debug(strings.Join(command, " "))
+	return executeCommand(command, logger.New().WriterLevel(logrus.DebugLevel), &bytes.Buffer{})
+}
+
+// IsActive returns true if the system service is running.
+func (m *ServiceManager) IsActive() bool {
+	return executeCommand(m.command(serviceActionIsActive), nil, &bytes.Buffer{}) == nil
+}
+
+// IsEnabled returns true if the system service starts on boot.
+func (m *ServiceManager) IsEnabled() bool {
+	if m.Init == InitSystemOpenRC {
+		var out bytes.Buffer
+		if err := executeCommand([]string{"rc-update", "show", "default"}, &out, &bytes.Buffer{}); err != nil {
+			return false
+		}
+		return openrcEnabled(out.String(), m.Name)
+	}
+	return executeCommand([]string{"systemctl", "is-enabled", "--quiet", m.Name}, nil, &bytes.Buffer{}) == nil
+}
+
+// openrcEnabled returns true if the service is in the output of "rc-update show",
+// every line is in format "service | runlevels".
+func openrcEnabled(output, name string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		items := strings.SplitN(line, "|", 2)
+		if strings.TrimSpace(items[0]) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Start starts the system service if it's not running.
+func (m *ServiceManager) Start() error {
+	if m.IsActive() {
+		return nil
+	}
+	return m.run(serviceActionStart)
+}
+
+// Stop stops the system service.
+func (m *ServiceManager) Stop() error { return m.run(serviceActionStop) }
+
+// Reload reloads the configuration of the system service.
+func (m *ServiceManager) Reload() error { return m.run(serviceActionReload) }
+
+// Restart restarts the system service.
+func (m *ServiceManager) Restart() error { return m.run(serviceActionRestart) }
+
+// Enable makes the system service start on boot if it's not enabled.
+func (m *ServiceManager) Enable() error {
+	if m.IsEnabled() {
+		return nil
+	}
+	return m.run(serviceActionEnable)
+}
+
+// Disable makes the system service not start on boot.
+func (m *ServiceManager) Disable() error { return m.run(serviceActionDisable) }
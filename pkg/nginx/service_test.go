@@ -0,0 +1,43 @@
+package nginx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestServiceManagerCommand(t *testing.T) {
+	tests := []struct {
+		init   InitSystem
+		action string
+		want   []string
+	}{
+		{InitSystemSystemd, serviceActionStart, []string{"systemctl", "start", "nginx"}},
+		{InitSystemSystemd, serviceActionReload, []string{"systemctl", "reload", "nginx"}},
+		{InitSystemSystemd, serviceActionEnable, []string{"systemctl", "enable", "nginx"}},
+		{InitSystemSystemd, serviceActionIsActive, []string{"systemctl", "is-active", "--quiet", "nginx"}},
+		{InitSystemOpenRC, serviceActionStart, []string{"rc-service", "nginx", "start"}},
+		{InitSystemOpenRC, serviceActionReload, []string{"rc-service", "nginx", "reload"}},
+		{InitSystemOpenRC, serviceActionEnable, []string{"rc-update", "add", "nginx", "default"}},
+		{InitSystemOpenRC, serviceActionDisable, []string{"rc-update", "del", "nginx", "default"}},
+		{InitSystemOpenRC, serviceActionIsActive, []string{"rc-service", "nginx", "status"}},
+	}
+	for _, tt := range tests {
+		m := &ServiceManager{Name: "nginx", Init: tt.init}
+		if got := m.command(tt.action); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s command(%s) = %v, want %v", tt.init, tt.action, got, tt.want)
+		}
+	}
+}
+
+func TestOpenrcEnabled(t *testing.T) {
+	output := `             crond | default
+        keepalived | default
+      nginx-debug | default
+`
+	if !openrcEnabled(output, "keepalived") {
+		t.Error("openrcEnabled(keepalived) = false, want true")
+	}
+	if openrcEnabled(output, "nginx") {
+		t.Error("openrcEnabled(nginx) = true, want false")
+	}
+}
@@ -0,0 +1,263 @@
+package nginx
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ProcessManager is the way the nginx daemon is managed.
+type ProcessManager string
+
+const (
+	// ProcessManagerSystemd manages nginx daemon by systemctl.
+	ProcessManagerSystemd ProcessManager = "systemd"
+	// ProcessManagerSupervisor runs nginx in the foreground as a child process of the controller.
+	ProcessManagerSupervisor ProcessManager = "supervisor"
+)
+
+var (
+	// supervisorMinBackoff and supervisorMaxBackoff is the range of the delay before
+	// restarting the nginx exited unexpectedly, the delay doubles on every restart.
+	supervisorMinBackoff = time.Second
+	supervisorMaxBackoff = time.Minute
+	// supervisorResetBackoff resets the delay if nginx has been running long enough.
+	supervisorResetBackoff = time.Minute
+	// supervisorStopTimeout is the time waiting for nginx graceful shutdown before killing it.
+	supervisorStopTimeout = 10 * time.Second
+)
+
+// supervisor is the nginx process supervisor used by ProcessManagerSupervisor.
+var supervisor = &Supervisor{}
+
+// SupervisorRuntime is the Runtime runs nginx as a supervised child process,
+// the package and configuration management are the same as ShellRuntime.
+type SupervisorRuntime struct {
+	*ShellRuntime
+	supervisor *Supervisor
+}
+
+var _ Runtime = &SupervisorRuntime{}
+
+// Enable starts the supervised nginx if it's not started.
+func (r *SupervisorRuntime) Enable() error { return r.supervisor.Start() }
+
+// Start starts the supervised nginx.
+func (r *SupervisorRuntime) Start() error { return r.supervisor.Start() }
+
+// Stop stops the supervised nginx.
+func (r *SupervisorRuntime) Stop() error { return r.supervisor.Stop() }
+
+// Reload sends SIGHUP to the supervised nginx.
+func (r *SupervisorRuntime) Reload() error { return r.supervisor.Reload() }
+
+// Restart restarts the supervised nginx.
+func (r *SupervisorRuntime) Restart() error { return r.supervisor.Restart() }
+
+// Status returns whether the nginx binary exists and the supervised nginx is running.
+func (r *SupervisorRuntime) Status() (Status, error) {
+	status, err := r.ShellRuntime.Status()
+	if err != nil {
+		return status, err
+	}
+	status.Running = r.supervisor.Running()
+	return status, nil
+}
+
+// Supervisor runs nginx in the foreground (daemon off) as a child process, reloads
+// it by sending SIGHUP to the master process, and restarts it with back-off when
+// it exits unexpectedly. The nginx stderr output is forwarded into the controller log.
+type Supervisor struct {
+	mu sync.Mutex
+	// run is the nginx supervised since the last Start, nil if the supervisor
+	// is not started.
+	run *supervisedRun
+	// command returns the command running nginx in the foreground, it's
+	// "nginx -g 'daemon off;' -p <nginx dir> -c <nginx dir>/nginx.conf" if nil.
+	command func() *exec.Cmd
+}
+
+// supervisedRun is the nginx supervised from Start to Stop, every Start creates
+// a new one, so the supervising goroutine of the stopped one never touches it.
+type supervisedRun struct {
+	// cmd is the running nginx master process, nil if nginx exited and not
+	// restarted yet. It's guarded by Supervisor.mu.
+	cmd *exec.Cmd
+	// stopCh is closed when Stop is called, nginx is never spawned after it's closed.
+	stopCh chan struct{}
+	// doneCh is closed when the supervising goroutine exited.
+	doneCh chan struct{}
+}
+
+// stopped returns true if Stop is called, it must be called with Supervisor.mu held.
+func (r *supervisedRun) stopped() bool {
+	select {
+	case <-r.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Start starts nginx and supervises it, it does nothing if nginx is already supervised.
+func (s *Supervisor) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.run != nil {
+		return nil
+	}
+	cmd, err := s.spawn()
+	if err != nil {
+		return err
+	}
+	run := &supervisedRun{cmd: cmd, stopCh: make(chan struct{}), doneCh: make(chan struct{})}
+	s.run = run
+	go s.supervise(run)
+	return nil
+}
+
+// Stop stops nginx gracefully by SIGQUIT, nginx will be killed if it does not
+// exit in time. It does nothing if nginx is not supervised. nginx is not
+// restarted after Stop, even if it's waiting for the back-off delay.
+func (s *Supervisor) Stop() error {
+	s.mu.Lock()
+	run := s.run
+	if run == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.run = nil
+	close(run.stopCh)
+	if run.cmd != nil {
+		logrus.Info("stopping nginx")
+		if err := run.cmd.Process.Signal(syscall.SIGQUIT); err != nil {
+			logrus.Debugf("send SIGQUIT to nginx failed: %s", err.Error())
+		}
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-run.doneCh:
+	case <-time.After(supervisorStopTimeout):
+		logrus.Warn("nginx does not exit in time, kill it")
+		s.mu.Lock()
+		if run.cmd != nil {
+			// the nginx workers are killed together with the master, they
+			// hold the stderr pipe, so the master can't be waited until they exit.
+			syscall.Kill(-run.cmd.Process.Pid, syscall.SIGKILL)
+		}
+		s.mu.Unlock()
+		<-run.doneCh
+	}
+	return nil
+}
+
+// Reload reloads nginx configuration by sending SIGHUP to the nginx master process.
+func (s *Supervisor) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.run == nil || s.run.cmd == nil {
+		return errors.New("nginx is not running")
+	}
+	logrus.Info("send SIGHUP to nginx")
+	return s.run.cmd.Process.Signal(syscall.SIGHUP)
+}
+
+// Restart stops and starts nginx.
+func (s *Supervisor) Restart() error {
+	if err := s.Stop(); err != nil {
+		return err
+	}
+	return s.Start()
+}
+
+// Running returns true if the nginx master process is running.
+func (s *Supervisor) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.run != nil && s.run.cmd != nil
+}
+
+// spawn starts the nginx master process in the foreground.
+func (s *Supervisor) spawn() (*exec.Cmd, error) {
+	command := nginxCommand("-g", "daemon off;")
+	cmd := exec.Command(command[0], command[1:]...)
+	if s.command != nil {
+		cmd = s.command()
+	}
+	// nginx runs in its own process group, so the master and the workers can be killed together.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// forward the nginx stderr output into the controller log.
+	cmd.Stderr = logrus.WithField("source", "nginx").WriterLevel(logrus.WarnLevel)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	logrus.Infof("nginx started, pid: %d", cmd.Process.Pid)
+	return cmd, nil
+}
+
+// supervise waits nginx to exit and restarts it with back-off, until the run stopped.
+func (s *Supervisor) supervise(run *supervisedRun) {
+	defer close(run.doneCh)
+	backoff := supervisorMinBackoff
+	s.mu.Lock()
+	cmd := run.cmd
+	s.mu.Unlock()
+	for {
+		startedAt := time.Now()
+		err := cmd.Wait()
+		if w, ok := cmd.Stderr.(io.Closer); ok {
+			w.Close()
+		}
+		s.mu.Lock()
+		run.cmd = nil
+		stopped := run.stopped()
+		s.mu.Unlock()
+		if stopped {
+			logrus.Info("nginx stopped")
+			return
+		}
+		if err != nil {
+			logrus.Errorf("nginx exited unexpectedly: %s", err.Error())
+		} else {
+			logrus.Error("nginx exited unexpectedly")
+		}
+		if time.Since(startedAt) > supervisorResetBackoff {
+			backoff = supervisorMinBackoff
+		}
+
+		// restart nginx with back-off until it started or the supervisor stopped.
+		for {
+			logrus.Infof("restart nginx in %s", backoff)
+			select {
+			case <-run.stopCh:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > supervisorMaxBackoff {
+				backoff = supervisorMaxBackoff
+			}
+			// Stop may be called when the back-off delay elapsed, nginx is
+			// spawned with the lock held, so it's either killed by Stop or never spawned.
+			s.mu.Lock()
+			if run.stopped() {
+				s.mu.Unlock()
+				return
+			}
+			cmd, err = s.spawn()
+			if err == nil {
+				run.cmd = cmd
+			}
+			s.mu.Unlock()
+			if err == nil {
+				break
+			}
+			logrus.Errorf("start nginx failed: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package nginx
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNginx returns a Supervisor running the shell script instead of nginx,
+// and the commands it spawned.
+func fakeNginx(script string) (*Supervisor, func() []*exec.Cmd) {
+	var mu sync.Mutex
+	var cmds []*exec.Cmd
+	s := &Supervisor{command: func() *exec.Cmd {
+		cmd := exec.Command("sh", "-c", script)
+		mu.Lock()
+		cmds = append(cmds, cmd)
+		mu.Unlock()
+		return cmd
+	}}
+	return s, func() []*exec.Cmd {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*exec.Cmd{}, cmds...)
+	}
+}
+
+// setSupervisorTimings sets the supervisor back-off and stop timeout, they are
+// restored when the test finished.
+func setSupervisorTimings(t *testing.T, backoff, stopTimeout time.Duration) {
+	minBackoff, maxBackoff, timeout := supervisorMinBackoff, supervisorMaxBackoff, supervisorStopTimeout
+	supervisorMinBackoff, supervisorMaxBackoff, supervisorStopTimeout = backoff, backoff, stopTimeout
+	t.Cleanup(func() {
+		supervisorMinBackoff, supervisorMaxBackoff, supervisorStopTimeout = minBackoff, maxBackoff, timeout
+	})
+}
+
+// stopWithin calls Stop and fails the test if it does not return in time.
+func stopWithin(t *testing.T, s *Supervisor, timeout time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Stop does not return in time")
+	}
+}
+
+func TestSupervisorStopDuringBackoff(t *testing.T) {
+	setSupervisorTimings(t, 5*time.Millisecond, time.Second)
+	// nginx exits as soon as started, so Stop races with the respawn.
+	for i := 0; i < 50; i++ {
+		s, spawned := fakeNginx("sleep 0.005")
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Duration(i%10) * time.Millisecond)
+		stopWithin(t, s, 3*time.Second)
+		if s.Running() {
+			t.Fatal("nginx is running after Stop")
+		}
+		cmds := spawned()
+		for _, cmd := range cmds {
+			if cmd.ProcessState == nil {
+				t.Fatalf("nginx pid %d outlives Stop", cmd.Process.Pid)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if n := len(spawned()); n != len(cmds) {
+			t.Fatalf("nginx spawned %d times after Stop", n-len(cmds))
+		}
+	}
+}
+
+func TestSupervisorStopKillsCurrent(t *testing.T) {
+	setSupervisorTimings(t, 5*time.Millisecond, 100*time.Millisecond)
+	// the first nginx exits, the restarted one ignores SIGQUIT and must be killed.
+	s, spawned := fakeNginx(`trap "" QUIT; sleep 60`)
+	s.command = func(command func() *exec.Cmd) func() *exec.Cmd {
+		var first = true
+		return func() *exec.Cmd {
+			if first {
+				first = false
+				return exec.Command("true")
+			}
+			return command()
+		}
+	}(s.command)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for len(spawned()) == 0 || !s.Running() {
+		if time.Now().After(deadline) {
+			t.Fatal("nginx is not restarted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	stopWithin(t, s, 3*time.Second)
+	for _, cmd := range spawned() {
+		if cmd.ProcessState == nil {
+			t.Fatalf("nginx pid %d outlives Stop", cmd.Process.Pid)
+		}
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	setSupervisorTimings(t, 5*time.Millisecond, time.Second)
+	s, spawned := fakeNginx(`trap "" HUP; exec sleep 60`)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Errorf("Reload() = %v, want nil", err)
+	}
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Running() {
+		t.Error("nginx is not running after Restart")
+	}
+	stopWithin(t, s, 3*time.Second)
+	cmds := spawned()
+	if len(cmds) != 2 {
+		t.Fatalf("nginx spawned %d times, want 2", len(cmds))
+	}
+	for _, cmd := range cmds {
+		if cmd.ProcessState == nil {
+			t.Fatalf("nginx pid %d outlives Stop", cmd.Process.Pid)
+		}
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("Reload() returns nil after Stop")
+	}
+}
+
+func TestSupervisorNginxArgs(t *testing.T) {
+	dir := setupNginxDir(t)
+	argsFile := fakeNginxBinary(t)
+
+	s := &Supervisor{}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopWithin(t, s, 3*time.Second)
+	want := []string{"-g|daemon off;|-p|" + dir + "|-c|" + filepath.Join(dir, "nginx.conf")}
+	var got []string
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = readArgs(t, argsFile); reflect.DeepEqual(got, want) {
+			return
+		}
+	}
+	t.Errorf("nginx args = %q, want %q", got, want)
+}
@@ -0,0 +1,203 @@
+package nginx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// The name of the templates. Every template can be overridden by a file named
+// "<name>.tmpl" in the template directory specified by --template-dir.
+const (
+	TemplateNameNginxConf = "nginx.conf"
+	TemplateNameTCP       = "tcp"
+	TemplateNameUDP       = "udp"
+	TemplateNameHTTP      = "http"
+	TemplateNameHTTPS     = "https"
+)
+
+// templateFileSuffix is the suffix of the user supplied template file.
+const templateFileSuffix = ".tmpl"
+
+var (
+	templateLocker sync.RWMutex
+	templates      = mustParseBuiltinTemplates()
+
+	// templateFuncs is the extra functions can be used in the templates.
+	templateFuncs = template.FuncMap{
+		"join":  strings.Join,
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		// nginxDir returns the nginx config directory specified by --nginx-dir.
+		"nginxDir": func() string { return nginxDir },
+		// nginxLogDir returns the directory of the nginx log files.
+		"nginxLogDir": func() string { return nginxLogDir },
+		// nginxPidFile returns the nginx pid file.
+		"nginxPidFile": func() string { return nginxPidFile },
+	}
+)
+
+// TemplateData is the data model passed to the tcp, udp, http and https templates.
+type TemplateData struct {
+	// Service is the nginx.Service the config file generated for,
+	// contains the k8s service namespace, name and annotations.
+	Service *Service
+	// Port is the k8s service port the config file generated for.
+	Port ServicePort
+	// ListenPort is the port nginx listen to, it's the k8s service port
+	// or the port specified by annotation "nginx-listen-port".
+	ListenPort int32
+	// ListenAddresses is the addresses of the nginx "listen" directives. It's
+	// "ip:port" if the k8s service has ListenIP, otherwise it's "port" for IPv4
+	// and "[::]:port" for IPv6, depending on the k8s service ip families.
+	ListenAddresses []string
+	// ListenAddress is the first of ListenAddresses, kept for the templates
+	// only listen to one address.
+	ListenAddress string
+	// UpstreamName is the nginx upstream name, format is namespace.name.portName,
+	// prefixed with the cluster name and suffixed with the cluster id.
+	UpstreamName string
+	// Upstreams is the upstream servers nginx proxies traffic to.
+	Upstreams []Upstream
+	// Annotations is the annotations of the k8s service.
+	Annotations map[string]string
+	// Tuning is the nginx tuning parsed from the k8s service annotations.
+	Tuning ServiceTuning
+}
+
+// builtinTemplates returns the builtin templates.
+func builtinTemplates() map[string]string {
+	return map[string]string{
+		TemplateNameNginxConf: TemplateNginxConf,
+		TemplateNameTCP:       TemplateTCP,
+		TemplateNameUDP:       TemplateUDP,
+		TemplateNameHTTP:      TemplateHTTP,
+		TemplateNameHTTPS:     TemplateHTTPS,
+	}
+}
+
+// mustParseBuiltinTemplates parse the builtin templates, panic if failed.
+func mustParseBuiltinTemplates() map[string]*template.Template {
+	tmpls, err := parseTemplates("")
+	if err != nil {
+		panic(err)
+	}
+	return tmpls
+}
+
+// parseTemplates parses the builtin templates and overrides them by the
+// template files found in dir. dir is ignored if it's empty.
+func parseTemplates(dir string) (map[string]*template.Template, error) {
+	tmpls := make(map[string]*template.Template)
+	for name, text := range builtinTemplates() {
+		if len(dir) != 0 {
+			filename := filepath.Join(dir, name+templateFileSuffix)
+			data, err := ioutil.ReadFile(filename)
+			switch {
+			case err == nil:
+				text = string(data)
+			case errors.Is(err, os.ErrNotExist):
+			default:
+				return nil, err
+			}
+		}
+		tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parse template %q failed: %s", name, err.Error())
+		}
+		tmpls[name] = tmpl
+	}
+	return tmpls, nil
+}
+
+// validateTemplates executes every template with the sample data, to make
+// sure the templates only reference the fields existing in the data model.
+func validateTemplates(tmpls map[string]*template.Template) error {
+	service := &Service{
+		Namespace:   "default",
+		Name:        "sample",
+		Annotations: map[string]string{},
+		Ports:       []ServicePort{{Name: "http", Port: 80, NodePort: 30080, Protocol: string(ProtocolTCP)}},
+	}
+	vhostData := &TemplateData{
+		Service:         service,
+		Port:            service.Ports[0],
+		ListenPort:      service.Ports[0].Port,
+		ListenAddresses: []string{"80", "[::]:80"},
+		ListenAddress:   "80",
+		UpstreamName:    "default.sample.http",
+		Upstreams:       []Upstream{{Host: "127.0.0.1", Port: 30080}},
+		Annotations:     service.Annotations,
+	}
+	for name, tmpl := range tmpls {
+		var data interface{} = vhostData
+		if name == TemplateNameNginxConf {
+			data = DefaultNginxConfParams()
+		}
+		if err := tmpl.Execute(ioutil.Discard, data); err != nil {
+			return fmt.Errorf("validate template %q failed: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// LoadTemplates loads the templates, the builtin templates are overridden by
+// the "<name>.tmpl" files in dir. All templates are validated before taking effect.
+func LoadTemplates(dir string) error {
+	if len(dir) != 0 {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("template directory %s is not a directory", dir)
+		}
+	}
+	tmpls, err := parseTemplates(dir)
+	if err != nil {
+		return err
+	}
+	if err := validateTemplates(tmpls); err != nil {
+		return err
+	}
+	templateLocker.Lock()
+	defer templateLocker.Unlock()
+	templates = tmpls
+	return nil
+}
+
+// renderTemplate renders the template with the provided data.
+func renderTemplate(name string, data interface{}) (string, error) {
+	templateLocker.RLock()
+	tmpl, ok := templates[name]
+	templateLocker.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("template %q not found", name)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("render template %q failed: %s", name, err.Error())
+	}
+	return buf.String(), nil
+}
+
+// templateNameForPort returns the template name used for the k8s service port,
+// it's selected by the protocol nginx proxies the port as.
+func templateNameForPort(port ServicePort) string {
+	switch port.proxyProtocol() {
+	case ProtocolUDP:
+		return TemplateNameUDP
+	case ProtocolHTTP:
+		return TemplateNameHTTP
+	case ProtocolHTTPS:
+		return TemplateNameHTTPS
+	default:
+		return TemplateNameTCP
+	}
+}
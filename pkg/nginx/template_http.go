@@ -1,58 +1,48 @@
 package nginx
 
-/*
-upstream #UPSTREAM_NAME# {
-}
-server {
-    listen              #LISTEN_PORT#;
-    server_name         "#SERVER_NAME#";
-
-    access_log          /var/log/nginx/#ACCESS_LOG#.log ;
-
-    large_client_header_buffers 8 16k;
-    client_max_body_size 10G;
-
-    location / {
-        proxy_http_version 1.1;
-        proxy_read_timeout 1800;
-        proxy_connect_timeout 1800;
-        proxy_send_timeout 1800;
-        proxy_set_header    Accept-Encoding "";
-        proxy_set_header    Host              $http_host;
-        proxy_set_header    X-Real-IP         $remote_addr;
-        proxy_set_header    X-Forwarded-For   $proxy_add_x_forwarded_for;
-        proxy_set_header    X-Forwarded-By    $server_addr:$server_port;
-        proxy_set_header    X-Forwarded-Proto $scheme;
-        proxy_pass          http://#UPSTREAM_NAME#;
-    }
-}
-*/
-
+// TemplateHTTP is the text/template used to render the nginx http config file
+// for the k8s service port proxied as HTTP, the template data is *TemplateData.
 var TemplateHTTP = `
-upstream %s {
-%s
+upstream {{ .UpstreamName }} {
+{{- range .Upstreams }}
+    server {{ .Address }}{{ .Params }};
+{{- end }}
 }
 server {
-    listen              %d;
-    server_name         "%s";
+{{- range .ListenAddresses }}
+    listen              {{ . }};
+{{- end }}
+    server_name         _;
 
-    access_log          /var/log/nginx/%s.log ;
+    access_log          {{ nginxLogDir }}/{{ .UpstreamName }}.log ;
 
     large_client_header_buffers 8 16k;
-    client_max_body_size 10G;
+    client_max_body_size {{ or .Tuning.ClientMaxBodySize "10G" }};
 
     location / {
         proxy_http_version 1.1;
-        proxy_read_timeout 1800;
-        proxy_connect_timeout 1800;
-        proxy_send_timeout 1800;
+        proxy_read_timeout {{ or .Tuning.ProxyReadTimeout .Tuning.ProxyTimeout "1800" }};
+        proxy_connect_timeout {{ or .Tuning.ProxyConnectTimeout "1800" }};
+        proxy_send_timeout {{ or .Tuning.ProxySendTimeout .Tuning.ProxyTimeout "1800" }};
+{{- if .Tuning.BufferSize }}
+        proxy_buffer_size {{ .Tuning.BufferSize }};
+{{- end }}
+{{- if .Tuning.ProxyNextUpstream }}
+        proxy_next_upstream {{ if eq .Tuning.ProxyNextUpstream "on" }}error timeout{{ else }}{{ .Tuning.ProxyNextUpstream }}{{ end }};
+{{- end }}
+{{- if .Tuning.ProxyNextUpstreamTries }}
+        proxy_next_upstream_tries {{ .Tuning.ProxyNextUpstreamTries }};
+{{- end }}
+{{- if .Tuning.ProxyNextUpstreamTimeout }}
+        proxy_next_upstream_timeout {{ .Tuning.ProxyNextUpstreamTimeout }};
+{{- end }}
         proxy_set_header    Accept-Encoding "";
         proxy_set_header    Host              $http_host;
         proxy_set_header    X-Real-IP         $remote_addr;
         proxy_set_header    X-Forwarded-For   $proxy_add_x_forwarded_for;
         proxy_set_header    X-Forwarded-By    $server_addr:$server_port;
         proxy_set_header    X-Forwarded-Proto $scheme;
-        proxy_pass          http://%s;
+        proxy_pass          http://{{ .UpstreamName }};
     }
 }
 `
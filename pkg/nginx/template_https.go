@@ -1,62 +1,59 @@
 package nginx
 
-/*
-upstream #UPSTREAM_NAME# {
-}
-server {
-    listen              #LISTEN_PORT# ssl;
-    server_name         "#SERVER_NAME#";
-
-    ssl_certificate     /etc/nginx/ssl/www.example.com.crt;
-    ssl_certificate_key /etc/nginx/ssl/www.example.com.key;
-    ssl_session_timeout 5m;
-    ssl_ciphers         ECDH+AESGCM:DH+AESGCM:ECDH+AES256:DH+AES256:ECDH+AES128:DH+AES:ECDH+3DES:DH+3DES:RSA+AESGCM:RSA+AES:RSA+3DES:!aNULL:!MD5:!DSS;
-    ssl_protocols       TLSv1 TLSv1.1 TLSv1.2 TLSv1.3;
-    ssl_prefer_server_ciphers on;
-    large_client_header_buffers 8 16k;
-    client_max_body_size 10G;
-
-    access_log          /var/log/nginx/#ACCESS_LOG#.log;
-
-    location / {
-        proxy_http_version 1.1;
-        proxy_set_header    Host              $http_host;
-        proxy_set_header    X-Real-IP         $remote_addr;
-        proxy_set_header    X-Forwarded-For   $proxy_add_x_forwarded_for;
-        proxy_set_header    X-Forwarded-Proto $scheme;
-        proxy_ssl_session_reuse off;
-        proxy_pass              https://#UPSTREAM_NAME#;
-    }
-}
-*/
-
+// TemplateHTTPS is the text/template used to render the nginx http config file
+// for the k8s service port proxied as HTTPS, the template data is *TemplateData.
 var TemplateHTTPS = `
-upstream %s {
-%s
+upstream {{ .UpstreamName }} {
+{{- range .Upstreams }}
+    server {{ .Address }}{{ .Params }};
+{{- end }}
 }
 server {
-    listen              %d ssl;
-    server_name         "%s";
+{{- range .ListenAddresses }}
+    listen              {{ . }} ssl;
+{{- end }}
+    server_name         _;
 
-    ssl_certificate     /etc/nginx/ssl/www.example.com.crt;
-    ssl_certificate_key /etc/nginx/ssl/www.example.com.key;
+    ssl_certificate     {{ or .Tuning.SSLCertificate (printf "%s/ssl/tls.crt" nginxDir) }};
+    ssl_certificate_key {{ or .Tuning.SSLCertificateKey (printf "%s/ssl/tls.key" nginxDir) }};
     ssl_session_timeout 5m;
     ssl_ciphers         ECDH+AESGCM:DH+AESGCM:ECDH+AES256:DH+AES256:ECDH+AES128:DH+AES:ECDH+3DES:DH+3DES:RSA+AESGCM:RSA+AES:RSA+3DES:!aNULL:!MD5:!DSS;
     ssl_protocols       TLSv1 TLSv1.1 TLSv1.2 TLSv1.3;
     ssl_prefer_server_ciphers on;
     large_client_header_buffers 8 16k;
-    client_max_body_size 10G;
+    client_max_body_size {{ or .Tuning.ClientMaxBodySize "10G" }};
 
-    access_log          /var/log/nginx/%s.log;
+    access_log          {{ nginxLogDir }}/{{ .UpstreamName }}.log;
 
     location / {
         proxy_http_version 1.1;
+{{- if or .Tuning.ProxyReadTimeout .Tuning.ProxyTimeout }}
+        proxy_read_timeout {{ or .Tuning.ProxyReadTimeout .Tuning.ProxyTimeout }};
+{{- end }}
+{{- if .Tuning.ProxyConnectTimeout }}
+        proxy_connect_timeout {{ .Tuning.ProxyConnectTimeout }};
+{{- end }}
+{{- if or .Tuning.ProxySendTimeout .Tuning.ProxyTimeout }}
+        proxy_send_timeout {{ or .Tuning.ProxySendTimeout .Tuning.ProxyTimeout }};
+{{- end }}
+{{- if .Tuning.BufferSize }}
+        proxy_buffer_size {{ .Tuning.BufferSize }};
+{{- end }}
+{{- if .Tuning.ProxyNextUpstream }}
+        proxy_next_upstream {{ if eq .Tuning.ProxyNextUpstream "on" }}error timeout{{ else }}{{ .Tuning.ProxyNextUpstream }}{{ end }};
+{{- end }}
+{{- if .Tuning.ProxyNextUpstreamTries }}
+        proxy_next_upstream_tries {{ .Tuning.ProxyNextUpstreamTries }};
+{{- end }}
+{{- if .Tuning.ProxyNextUpstreamTimeout }}
+        proxy_next_upstream_timeout {{ .Tuning.ProxyNextUpstreamTimeout }};
+{{- end }}
         proxy_set_header    Host              $http_host;
         proxy_set_header    X-Real-IP         $remote_addr;
         proxy_set_header    X-Forwarded-For   $proxy_add_x_forwarded_for;
         proxy_set_header    X-Forwarded-Proto $scheme;
         proxy_ssl_session_reuse off;
-        proxy_pass              https://%s;
+        proxy_pass              https://{{ .UpstreamName }};
     }
 }
 `
@@ -1,9 +1,13 @@
 package nginx
 
+// TemplateNginxConf is the text/template used to render /etc/nginx/nginx.conf
+// when the nginx.conf mode is "managed", the template data is *NginxConfParams.
 var TemplateNginxConf = `
-user www-data;
-worker_processes auto;
-pid /run/nginx.pid;
+{{- if .User }}
+user {{ .User }};
+{{- end }}
+worker_processes {{ .WorkerProcesses }};
+pid {{ nginxPidFile }};
 
 # Also set
 # /etc/security/limits.conf
@@ -11,16 +15,16 @@ pid /run/nginx.pid;
 #   web hard nofile 65535
 # /etc/default/nginx
 #       ULIMIT="-n 65535"
-worker_rlimit_nofile 65535;
+worker_rlimit_nofile {{ .WorkerRlimitNofile }};
 
-include /etc/nginx/modules-enabled/*.conf;
-include /etc/nginx/modules/*.conf;
+include {{ nginxDir }}/modules-enabled/*.conf;
+include {{ nginxDir }}/modules/*.conf;
 
 events {
     # Determines how many clients will be served by each worker process.
     # (Max clients = worker_connections * worker_processes)
     # Should be equal to "ulimit -n / worker_processes"
-    worker_connections 10240;
+    worker_connections {{ .WorkerConnections }};
 
     # Let each process accept multiple connections.
     # Accept as many connections as possible, after nginx gets notification
@@ -79,7 +83,7 @@ http {
 
     types_hash_max_size 2048;
 
-    include /etc/nginx/mime.types;
+    include {{ nginxDir }}/mime.types;
     default_type application/octet-stream;
 
     ##
@@ -99,36 +103,35 @@ http {
     # Logging Settings
     ##
 
-    access_log /var/log/nginx/access.log;
-    error_log /var/log/nginx/error.log;
+{{ if .HTTPLogFormat }}    log_format main '{{ .HTTPLogFormat }}';
+{{ end }}    access_log {{ nginxLogDir }}/access.log{{ if .HTTPLogFormat }} main{{ end }};
+    error_log {{ nginxLogDir }}/error.log;
 
     ##
     # Gzip Settings
     ##
 
-    gzip on;
+{{ if .Gzip }}    gzip on;
     gzip_disable "MSIE [1-6]\.";
     gzip_proxied expired no-cache no-store private auth;
     # Default is 6 (1<n<9), but 2 -- even 1 -- is enough. The higher it is, the
     # more CPU cycles will be wasted.
-    gzip_comp_level 9;
+    gzip_comp_level {{ .GzipCompLevel }};
     gzip_min_length 500; # Default 20
-    gzip_types text/plain text/css application/json application/javascript application/x-javascript text/xml application/xml application/xml+rss text/javascript;
-
+    gzip_types {{ join .GzipTypes " " }};
+{{ else }}    gzip off;
+{{ end }}
 ##
 # Virtual Host Configs
 ##
 
-include /etc/nginx/conf.d/*.conf;
-include /etc/nginx/sites-enabled/*;
+include {{ nginxDir }}/conf.d/*.conf;
+include {{ nginxDir }}/sites-enabled/*;
 }
 
 
 stream {
-    log_format proxy '$remote_addr [$time_local] '
-        '$protocol $status $bytes_sent $bytes_received '
-        '$session_time "$upstream_addr" '
-        '"$upstream_bytes_sent" "$upstream_bytes_received" "$upstream_connect_time"';
-    include /etc/nginx/sites-stream/*;
+    log_format proxy '{{ .StreamLogFormat }}';
+    include {{ nginxDir }}/sites-stream/*;
 }
 `
@@ -1,28 +1,33 @@
 package nginx
 
-/*
-upstream #UPSTREAM_NAME# {
-}
-server {
-    listen #LISTEN_PORT#;
-    proxy_timeout       1m;
-    proxy_responses     1;
-    proxy_buffer_size   16k;
-    proxy_pass          #UPSTREAM_NAME#;
-    access_log          /var/log/nginx/#ACCESS_LOG#.log proxy;
-}
-*/
-
+// TemplateTCP is the text/template used to render the nginx stream config file
+// for the k8s service port with protocol TCP, the template data is *TemplateData.
 var TemplateTCP = `
-upstream %s {
-%s
+upstream {{ .UpstreamName }} {
+{{- range .Upstreams }}
+    server {{ .Address }}{{ .Params }};
+{{- end }}
 }
 server {
-    listen %d;
-    proxy_timeout       1m;
-    proxy_responses     1;
-    proxy_buffer_size   16k;
-    proxy_pass          %s;
-    access_log          /var/log/nginx/%s.log proxy;
+{{- range .ListenAddresses }}
+    listen {{ . }};
+{{- end }}
+    proxy_timeout       {{ or .Tuning.ProxyTimeout "1m" }};
+{{- if .Tuning.ProxyConnectTimeout }}
+    proxy_connect_timeout {{ .Tuning.ProxyConnectTimeout }};
+{{- end }}
+    proxy_responses     {{ if .Tuning.ProxyResponses }}{{ .Tuning.ProxyResponses }}{{ else }}1{{ end }};
+    proxy_buffer_size   {{ or .Tuning.BufferSize "16k" }};
+{{- if .Tuning.ProxyNextUpstream }}
+    proxy_next_upstream {{ if eq .Tuning.ProxyNextUpstream "off" }}off{{ else }}on{{ end }};
+{{- end }}
+{{- if .Tuning.ProxyNextUpstreamTries }}
+    proxy_next_upstream_tries {{ .Tuning.ProxyNextUpstreamTries }};
+{{- end }}
+{{- if .Tuning.ProxyNextUpstreamTimeout }}
+    proxy_next_upstream_timeout {{ .Tuning.ProxyNextUpstreamTimeout }};
+{{- end }}
+    proxy_pass          {{ .UpstreamName }};
+    access_log          {{ nginxLogDir }}/{{ .UpstreamName }}.log proxy;
 }
 `
@@ -0,0 +1,225 @@
+package nginx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+)
+
+// setupNginxDir generates the nginx config files into a temporary directory
+// with the upstream hosts, it's restored to /etc/nginx when the test finished.
+func setupNginxDir(t *testing.T, upstream ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, sub := range []string{"sites-stream", "sites-enabled"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetNginxDir(dir)
+	args.NewBuilder().SetUpstream(upstream).SetUpstreamMaxFails(-1)
+	t.Cleanup(func() {
+		SetNginxDir("/etc/nginx")
+		args.NewBuilder().SetUpstream(nil)
+	})
+	return dir
+}
+
+// readTestFile returns the content of the file, the test fails if not exists.
+func readTestFile(t *testing.T, file string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestTemplateNameForPort(t *testing.T) {
+	tests := []struct {
+		port ServicePort
+		want string
+	}{
+		{ServicePort{Protocol: "TCP"}, TemplateNameTCP},
+		{ServicePort{Protocol: "tcp"}, TemplateNameTCP},
+		{ServicePort{Protocol: "UDP"}, TemplateNameUDP},
+		{ServicePort{Protocol: "SCTP"}, TemplateNameTCP},
+		{ServicePort{Protocol: "TCP", ProxyProtocol: ProtocolTCP}, TemplateNameTCP},
+		{ServicePort{Protocol: "TCP", ProxyProtocol: ProtocolHTTP}, TemplateNameHTTP},
+		{ServicePort{Protocol: "TCP", ProxyProtocol: ProtocolHTTPS}, TemplateNameHTTPS},
+	}
+	for _, tt := range tests {
+		if got := templateNameForPort(tt.port); got != tt.want {
+			t.Errorf("templateNameForPort(%+v) = %q, want %q", tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateVirtualHostConfProtocol(t *testing.T) {
+	tests := []struct {
+		protocol Protocol
+		file     string
+		contains []string
+	}{
+		{
+			protocol: ProtocolTCP,
+			file:     "sites-stream/tcp.default.web.web.abc",
+			contains: []string{"listen 80;", "proxy_pass          default.web.web.abc;"},
+		},
+		{
+			protocol: ProtocolUDP,
+			file:     "sites-stream/udp.default.web.web.abc",
+			contains: []string{"listen 80 udp;", "proxy_pass          default.web.web.abc;"},
+		},
+		{
+			protocol: ProtocolHTTP,
+			file:     "sites-enabled/http.default.web.web.abc",
+			contains: []string{"listen              80;", "proxy_pass          http://default.web.web.abc;"},
+		},
+		{
+			protocol: ProtocolHTTPS,
+			file:     "sites-enabled/https.default.web.web.abc",
+			contains: []string{"listen              80 ssl;", "ssl_certificate     ", "proxy_pass              https://default.web.web.abc;"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.protocol), func(t *testing.T) {
+			dir := setupNginxDir(t, "10.0.0.1")
+			protocol := string(tt.protocol)
+			if tt.protocol != ProtocolUDP {
+				protocol = string(ProtocolTCP)
+			}
+			service := &Service{
+				Action:    ActionTypeAdd,
+				ClusterID: "abc",
+				Namespace: "default",
+				Name:      "web",
+				Ports:     []ServicePort{{Name: "web", Port: 80, NodePort: 30080, Protocol: protocol, ProxyProtocol: tt.protocol}},
+			}
+			if err, changed := GenerateVirtualHostConf(service); err != nil || !changed {
+				t.Fatalf("GenerateVirtualHostConf() = %v, %v, want nil, true", err, changed)
+			}
+			data := readTestFile(t, filepath.Join(dir, tt.file))
+			for _, s := range append(tt.contains, "server 10.0.0.1:30080;") {
+				if !strings.Contains(data, s) {
+					t.Errorf("%s does not contain %q:\n%s", tt.file, s, data)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateVirtualHostConfIPv6(t *testing.T) {
+	tests := []struct {
+		name        string
+		listenIP    string
+		families    []IPFamily
+		contains    []string
+		notContains []string
+	}{
+		{
+			name:        "ipv6 listen ip",
+			listenIP:    "fd00::10",
+			families:    []IPFamily{IPv6},
+			contains:    []string{"listen [fd00::10]:80;", "server [fd00::1]:30080;", "server node1:30080;"},
+			notContains: []string{"listen 80;", "server 10.0.0.1:30080;"},
+		},
+		{
+			name:        "ipv6",
+			families:    []IPFamily{IPv6},
+			contains:    []string{"listen [::]:80;", "server [fd00::1]:30080;", "server node1:30080;"},
+			notContains: []string{"listen 80;", "server 10.0.0.1:30080;"},
+		},
+		{
+			name:     "dual-stack",
+			families: []IPFamily{IPv4, IPv6},
+			contains: []string{"listen 80;", "listen [::]:80;", "server 10.0.0.1:30080;", "server [fd00::1]:30080;", "server node1:30080;"},
+		},
+		{
+			name:        "ipv4",
+			contains:    []string{"listen 80;", "server 10.0.0.1:30080;", "server node1:30080;"},
+			notContains: []string{"listen [::]:80;", "server [fd00::1]:30080;"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupNginxDir(t, "10.0.0.1", "fd00::1", "node1")
+			service := &Service{
+				Action:     ActionTypeAdd,
+				ClusterID:  "abc",
+				Namespace:  "default",
+				Name:       "web",
+				ListenIP:   tt.listenIP,
+				IPFamilies: tt.families,
+				Ports:      []ServicePort{{Name: "web", Port: 80, NodePort: 30080, Protocol: "TCP"}},
+			}
+			if err, changed := GenerateVirtualHostConf(service); err != nil || !changed {
+				t.Fatalf("GenerateVirtualHostConf() = %v, %v, want nil, true", err, changed)
+			}
+			file := "sites-stream/tcp.default.web.web.abc"
+			data := readTestFile(t, filepath.Join(dir, file))
+			for _, s := range tt.contains {
+				if !strings.Contains(data, s) {
+					t.Errorf("%s does not contain %q:\n%s", file, s, data)
+				}
+			}
+			for _, s := range tt.notContains {
+				if strings.Contains(data, s) {
+					t.Errorf("%s contains %q:\n%s", file, s, data)
+				}
+			}
+		})
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	tests := []struct {
+		listenIP string
+		families []IPFamily
+		want     []string
+	}{
+		{want: []string{"80"}},
+		{families: []IPFamily{IPv4}, want: []string{"80"}},
+		{families: []IPFamily{IPv6}, want: []string{"[::]:80"}},
+		{families: []IPFamily{IPv6, IPv4}, want: []string{"80", "[::]:80"}},
+		{listenIP: "10.0.0.10", families: []IPFamily{IPv4, IPv6}, want: []string{"10.0.0.10:80"}},
+		{listenIP: "fd00::10", families: []IPFamily{IPv4, IPv6}, want: []string{"[fd00::10]:80"}},
+	}
+	for _, tt := range tests {
+		service := &Service{ListenIP: tt.listenIP, IPFamilies: tt.families}
+		if got := ListenAddresses(service, 80); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ListenAddresses(%q, %v) = %v, want %v", tt.listenIP, tt.families, got, tt.want)
+		}
+	}
+}
+
+func TestSelectUpstreamHosts(t *testing.T) {
+	hosts := []UpstreamHost{{Host: "10.0.0.1"}, {Host: "fd00::1"}, {Host: "node1"}}
+	ipv4Hosts := []UpstreamHost{{Host: "10.0.0.1"}}
+	tests := []struct {
+		hosts    []UpstreamHost
+		families []IPFamily
+		want     []string
+	}{
+		{hosts: hosts, want: []string{"10.0.0.1", "node1"}},
+		{hosts: hosts, families: []IPFamily{IPv4}, want: []string{"10.0.0.1", "node1"}},
+		{hosts: hosts, families: []IPFamily{IPv6}, want: []string{"fd00::1", "node1"}},
+		{hosts: hosts, families: []IPFamily{IPv4, IPv6}, want: []string{"10.0.0.1", "fd00::1", "node1"}},
+		// no host matches the ip families, all the hosts are used.
+		{hosts: ipv4Hosts, families: []IPFamily{IPv6}, want: []string{"10.0.0.1"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, host := range selectUpstreamHosts(tt.hosts, &Service{IPFamilies: tt.families}) {
+			got = append(got, host.Host)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("selectUpstreamHosts(%v) = %v, want %v", tt.families, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package nginx
 
-import "path/filepath"
+import (
+	"path/filepath"
+	"strings"
+)
 
 var (
 	nginxDir = "/etc/nginx"
@@ -11,8 +14,49 @@ var (
 	httpsConfDir = filepath.Join(nginxDir, "sites-enabled")
 
 	nginxConfFile = filepath.Join(nginxDir, "nginx.conf")
+
+	// nginxLogDir and nginxPidFile are not in the nginx config directory.
+	nginxLogDir  = "/var/log/nginx"
+	nginxPidFile = "/run/nginx.pid"
 )
 
+// nginxCommand returns the nginx command line with the flags. The prefix and the
+// config file are always in the nginx config directory, not the ones compiled
+// into the nginx binary, so the generated config is used even if --nginx-dir
+// is not /etc/nginx.
+func nginxCommand(flags ...string) []string {
+	return append(append([]string{"nginx"}, flags...), "-p", nginxDir, "-c", nginxConfFile)
+}
+
+// SetNginxDir changes the nginx config directory, default to /etc/nginx.
+// It's useful to generate the nginx config files into other directory, eg: in testing.
+func SetNginxDir(dir string) {
+	locker.Lock()
+	defer locker.Unlock()
+	nginxDir = dir
+	tcpConfDir = filepath.Join(nginxDir, "sites-stream")
+	udpConfDir = filepath.Join(nginxDir, "sites-stream")
+	httpConfDir = filepath.Join(nginxDir, "sites-enabled")
+	httpsConfDir = filepath.Join(nginxDir, "sites-enabled")
+	nginxConfFile = filepath.Join(nginxDir, "nginx.conf")
+}
+
+// SetNginxLogDir changes the directory of the nginx log files, default to /var/log/nginx.
+// It's useful to test the generated nginx config without touching the host.
+func SetNginxLogDir(dir string) {
+	locker.Lock()
+	defer locker.Unlock()
+	nginxLogDir = dir
+}
+
+// SetNginxPidFile changes the nginx pid file, default to /run/nginx.pid.
+// It's useful to test the generated nginx config without touching the host.
+func SetNginxPidFile(file string) {
+	locker.Lock()
+	defer locker.Unlock()
+	nginxPidFile = file
+}
+
 type Protocol string
 
 const (
@@ -22,6 +66,14 @@ const (
 	ProtocolHTTPS Protocol = "HTTPS"
 )
 
+// IPFamily is the ip family of the k8s service, the same as corev1.IPFamily.
+type IPFamily string
+
+const (
+	IPv4 IPFamily = "IPv4"
+	IPv6 IPFamily = "IPv6"
+)
+
 type ActionType string
 
 const (
@@ -30,21 +82,112 @@ const (
 )
 
 type Service struct {
-	Action    ActionType
+	Action ActionType
+	// Cluster is the name of the cluster the k8s service in, it's prefixed to
+	// the nginx config file names and upstream names if not empty.
+	Cluster string
+	// ClusterID is the identity of the cluster, it's suffixed to the nginx config
+	// file names and upstream names and recorded in the header of the files, only
+	// the files of the same cluster id are overwritten or removed.
+	ClusterID string
 	Name      string
 	Namespace string
 
 	MeetType        bool
 	MeetAnnotations bool
+	// MeetConfig is true if the k8s service is selected by the config file.
+	MeetConfig bool
+
+	Annotations map[string]string
+	Tuning      ServiceTuning
+
+	// ListenIP is the ip address nginx listen to, from the annotation "loadbalancer/ip"
+	// or spec.loadBalancerIP. nginx listen to all addresses if it's empty.
+	ListenIP string
+	// IPFamilies is the ip families nginx listen to when ListenIP is empty, the
+	// upstream hosts are also selected by them. IPv4 is used if it's empty.
+	IPFamilies []IPFamily
 
 	Ports []ServicePort
 }
 
+// ServiceTuning is the nginx tuning of the k8s service, parsed from the
+// k8s service annotations. The zero value means using the template default.
+type ServiceTuning struct {
+	// ProxyTimeout is the stream "proxy_timeout" and the default of http
+	// "proxy_read_timeout" and "proxy_send_timeout".
+	ProxyTimeout        string
+	ProxyConnectTimeout string
+	ProxyReadTimeout    string
+	ProxySendTimeout    string
+	// BufferSize is the "proxy_buffer_size".
+	BufferSize        string
+	ClientMaxBodySize string
+	// MaxConns is the "max_conns" of every upstream server, 0 means no limit.
+	MaxConns int
+	// MaxFails and FailTimeout is the "max_fails" and "fail_timeout" of every upstream server.
+	MaxFails    *int
+	FailTimeout string
+	// ProxyResponses is the stream "proxy_responses" used by udp.
+	ProxyResponses *int
+	// ProxyNextUpstream is "on", "off" or the http conditions, eg: "error timeout http_502".
+	// The stream "proxy_next_upstream" is "off" if it's "off", otherwise is "on".
+	ProxyNextUpstream        string
+	ProxyNextUpstreamTries   int
+	ProxyNextUpstreamTimeout string
+	// SSLCertificate and SSLCertificateKey are the "ssl_certificate" and
+	// "ssl_certificate_key" of the HTTPS ports.
+	SSLCertificate    string
+	SSLCertificateKey string
+}
+
+// UpstreamParams returns the upstream parameters specified by the k8s service.
+func (t ServiceTuning) UpstreamParams() UpstreamParams {
+	return UpstreamParams{
+		MaxFails:    t.MaxFails,
+		FailTimeout: t.FailTimeout,
+		MaxConns:    t.MaxConns,
+	}
+}
+
 type ServicePort struct {
 	Name     string
 	Port     int32
 	NodePort int32
 	Protocol string
+	// ProxyProtocol is the protocol nginx proxies the port as, "TCP", "UDP",
+	// "HTTP" or "HTTPS", it selects the template. It's Protocol if empty.
+	ProxyProtocol Protocol
 
 	ListenPort int32
 }
+
+// proxyProtocol returns the protocol nginx proxies the k8s service port as.
+func (p ServicePort) proxyProtocol() Protocol {
+	if len(p.ProxyProtocol) != 0 {
+		return p.ProxyProtocol
+	}
+	return Protocol(strings.ToUpper(p.Protocol))
+}
+
+// String returns the k8s service in format namespace/name, prefixed with the cluster.
+func (s *Service) String() string {
+	if len(s.Cluster) == 0 {
+		return s.Namespace + "/" + s.Name
+	}
+	return s.Cluster + "/" + s.Namespace + "/" + s.Name
+}
+
+// HasIPFamily returns true if the k8s service has the ip family. The k8s service
+// without ip families is considered as IPv4 only.
+func (s *Service) HasIPFamily(family IPFamily) bool {
+	if len(s.IPFamilies) == 0 {
+		return family == IPv4
+	}
+	for _, f := range s.IPFamilies {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package nginx
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+)
+
+var (
+	upstreamLocker sync.RWMutex
+	// upstreamHosts is the hosts discovered from the k8s nodes of every cluster,
+	// nil means using the hosts specified by --upstream.
+	upstreamHosts = make(map[string][]UpstreamHost)
+
+	// nginxTimeRegexp matches the nginx time, eg: 30s, 1m, 1h30m.
+	nginxTimeRegexp = regexp.MustCompile(`^([0-9]+(ms|s|m|h|d|w|M|y)?)+$`)
+	// nginxSizeRegexp matches the nginx size, eg: 512, 16k, 1m, 10g.
+	nginxSizeRegexp = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+)
+
+// IsValidTime reports whether the string is a valid nginx time, eg: 30s, 1m, 1h30m.
+func IsValidTime(s string) bool { return nginxTimeRegexp.MatchString(s) }
+
+// IsValidSize reports whether the string is a valid nginx size, eg: 512, 16k, 1m, 10g.
+func IsValidSize(s string) bool { return nginxSizeRegexp.MatchString(s) }
+
+// UpstreamParams is the parameters of the server in nginx upstream block,
+// the zero value of every field means using the nginx default.
+type UpstreamParams struct {
+	Weight      int
+	MaxFails    *int
+	FailTimeout string
+	MaxConns    int
+	Backup      bool
+	// Down marks the server as permanently unavailable, it's set by the active health checking.
+	Down bool
+}
+
+// Merge returns a copy of p overridden by the non-zero fields of override.
+func (p UpstreamParams) Merge(override UpstreamParams) UpstreamParams {
+	if override.Weight != 0 {
+		p.Weight = override.Weight
+	}
+	if override.MaxFails != nil {
+		p.MaxFails = override.MaxFails
+	}
+	if len(override.FailTimeout) != 0 {
+		p.FailTimeout = override.FailTimeout
+	}
+	if override.MaxConns != 0 {
+		p.MaxConns = override.MaxConns
+	}
+	if override.Backup {
+		p.Backup = true
+	}
+	if override.Down {
+		p.Down = true
+	}
+	return p
+}
+
+// String returns the parameters in nginx upstream server format, eg: " weight=2 max_fails=3 backup".
+func (p UpstreamParams) String() string {
+	var b strings.Builder
+	if p.Weight != 0 {
+		b.WriteString(fmt.Sprintf(" weight=%d", p.Weight))
+	}
+	if p.MaxFails != nil {
+		b.WriteString(fmt.Sprintf(" max_fails=%d", *p.MaxFails))
+	}
+	if len(p.FailTimeout) != 0 {
+		b.WriteString(fmt.Sprintf(" fail_timeout=%s", p.FailTimeout))
+	}
+	if p.MaxConns != 0 {
+		b.WriteString(fmt.Sprintf(" max_conns=%d", p.MaxConns))
+	}
+	if p.Backup {
+		b.WriteString(" backup")
+	}
+	if p.Down {
+		b.WriteString(" down")
+	}
+	return b.String()
+}
+
+// UpstreamHost is a host the loadbalancer proxies traffic to.
+type UpstreamHost struct {
+	// Host is the host name or IP address.
+	Host string
+	// Params is the host specific upstream parameters.
+	Params UpstreamParams
+}
+
+// Upstream is a server in nginx upstream block.
+type Upstream struct {
+	// Host is the upstream host name or IP address.
+	Host string
+	// Port is the upstream port, it's the k8s service NodePort.
+	Port int32
+
+	// UpstreamParams is the merged upstream parameters, the precedence is:
+	// node annotations > k8s service annotations > global arguments.
+	UpstreamParams
+}
+
+// Address returns the upstream address in format host:port,
+// the IPv6 address is enclosed in brackets, eg: [fd00::10]:30080.
+func (u Upstream) Address() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(int(u.Port)))
+}
+
+// Params returns the upstream parameters in nginx upstream server format.
+func (u Upstream) Params() string {
+	return u.UpstreamParams.String()
+}
+
+// SetUpstreamHosts sets the upstream hosts of the cluster discovered from the k8s nodes.
+func SetUpstreamHosts(cluster string, hosts []UpstreamHost) {
+	upstreamLocker.Lock()
+	defer upstreamLocker.Unlock()
+	upstreamHosts[cluster] = hosts
+}
+
+// GetUpstreamHosts returns the upstream hosts of the cluster. If no hosts discovered
+// from the k8s nodes, returns the hosts specified by --upstream, the host in format
+// "cluster=host" is only used by the cluster.
+func GetUpstreamHosts(cluster string) []UpstreamHost {
+	upstreamLocker.RLock()
+	defer upstreamLocker.RUnlock()
+	if discovered := upstreamHosts[cluster]; discovered != nil {
+		hosts := make([]UpstreamHost, len(discovered))
+		copy(hosts, discovered)
+		return hosts
+	}
+	var hosts []UpstreamHost
+	for _, host := range args.GetUpstream() {
+		if items := strings.SplitN(host, "=", 2); len(items) == 2 {
+			if items[0] != cluster {
+				continue
+			}
+			host = items[1]
+		}
+		hosts = append(hosts, UpstreamHost{Host: host})
+	}
+	return hosts
+}
+
+// defaultUpstreamParams returns the global upstream parameters specified by arguments.
+func defaultUpstreamParams() UpstreamParams {
+	params := UpstreamParams{
+		FailTimeout: args.GetUpstreamFailTimeout(),
+		MaxConns:    args.GetUpstreamMaxConns(),
+	}
+	if maxFails := args.GetUpstreamMaxFails(); maxFails >= 0 {
+		params.MaxFails = &maxFails
+	}
+	return params
+}
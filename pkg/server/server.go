@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/config"
+	"github.com/forbearing/k8s-loadbalancer/pkg/metrics"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	mux = http.NewServeMux()
+	// debugMux serves the debug endpoints exposing the configuration and the
+	// generated files, it's served on --debug-address only.
+	debugMux = http.NewServeMux()
+)
+
+func init() {
+	HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.Write(w)
+	})
+	debugMux.HandleFunc("/debug/config", config.Handler)
+	debugMux.HandleFunc("/debug/dry-run", nginx.DryRunHandler)
+}
+
+// Handle registers the handler for the given pattern.
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers the handler function for the given pattern.
+func HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.HandleFunc(pattern, handler)
+}
+
+// Run serves the HTTP requests on --bind-address:--port, and the debug endpoints
+// on --debug-address if it's not empty, until stopCh closed.
+func Run(stopCh <-chan struct{}) error {
+	errCh := make(chan error, 2)
+	if addr := args.GetDebugAddress(); len(addr) != 0 {
+		go func() { errCh <- serve(stopCh, addr, debugMux, "debug HTTP server") }()
+	}
+	addr := net.JoinHostPort(args.GetBindAddress().String(), strconv.Itoa(args.GetPort()))
+	go func() { errCh <- serve(stopCh, addr, mux, "HTTP server") }()
+	return <-errCh
+}
+
+// serve serves the HTTP requests on addr until stopCh closed.
+func serve(stopCh <-chan struct{}, addr string, handler http.Handler, name string) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	logrus.Infof("Starting %s on %s", name, addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
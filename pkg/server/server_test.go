@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugEndpointsNotOnMainServer(t *testing.T) {
+	for _, path := range []string{"/debug/config", "/debug/dry-run"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s on --bind-address: status = %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+		if _, pattern := debugMux.Handler(httptest.NewRequest(http.MethodGet, path, nil)); pattern != path {
+			t.Errorf("%s is not served on --debug-address", path)
+		}
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/healthz: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
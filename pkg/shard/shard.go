@@ -0,0 +1,275 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// LabelGroup is the label of the member Leases, its value is --shard-group.
+	LabelGroup = "k8s-loadbalancer.forbearing.io/shard-group"
+	// AnnotationPool is the annotation of the member Lease, its value is --shard-pool.
+	AnnotationPool = "k8s-loadbalancer.forbearing.io/shard-pool"
+)
+
+// Member is a k8s-loadbalancer instance sharing the k8s services.
+type Member struct {
+	Name string
+	// Pool is the pool the member serves, empty means the k8s services
+	// without the pool annotation.
+	Pool string
+}
+
+var (
+	locker sync.RWMutex
+	// members is the alive members sorted by name.
+	members []Member
+
+	// observed is the Lease renew time last seen of every member and when it's
+	// seen by the local clock, it's only accessed by Start.
+	observed = make(map[string]observation)
+	// now returns the current time, it's replaced in the tests.
+	now = time.Now
+)
+
+// observation is the renew time of a member Lease and when it's first seen.
+type observation struct {
+	renewTime metav1.MicroTime
+	at        time.Time
+}
+
+// Enabled returns true if the k8s services are sharded across the members.
+func Enabled() bool {
+	return args.GetShard()
+}
+
+// Validate checks the shard arguments in a.
+func Validate(a *args.Args) error {
+	if !a.GetShard() {
+		return nil
+	}
+	if len(a.GetShardMember()) == 0 {
+		return errors.New("--shard-member is required")
+	}
+	name := a.GetShardGroup() + "-" + a.GetShardMember()
+	if msgs := validation.IsDNS1123Subdomain(name); len(msgs) != 0 {
+		return fmt.Errorf("invalid Lease name %q of --shard-group and --shard-member: %v", name, msgs)
+	}
+	if msgs := validation.IsValidLabelValue(a.GetShardGroup()); len(msgs) != 0 {
+		return fmt.Errorf("invalid --shard-group %q: %v", a.GetShardGroup(), msgs)
+	}
+	if a.GetShardLeaseDuration() < 3*time.Second {
+		return fmt.Errorf("--shard-lease-duration must be at least 3s, got %s", a.GetShardLeaseDuration())
+	}
+	return nil
+}
+
+// Self returns the name of this member.
+func Self() string {
+	return args.GetShardMember()
+}
+
+// Members returns the alive members sorted by name.
+func Members() []Member {
+	locker.RLock()
+	defer locker.RUnlock()
+	return append([]Member{}, members...)
+}
+
+// SetMembers replaces the alive members.
+func SetMembers(list []Member) {
+	locker.Lock()
+	defer locker.Unlock()
+	members = append([]Member{}, list...)
+}
+
+// Owner returns the member serving the k8s service, the k8s service is assigned
+// to one of the members of the pool by rendezvous hashing, so only the k8s
+// services of the member joined or left are reassigned. It returns empty if
+// the pool has no member.
+func Owner(key, pool string) string {
+	locker.RLock()
+	defer locker.RUnlock()
+	var owner string
+	var max uint64
+	for _, m := range members {
+		if m.Pool != pool {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(m.Name + "/" + key))
+		if sum := h.Sum64(); len(owner) == 0 || sum > max {
+			owner, max = m.Name, sum
+		}
+	}
+	return owner
+}
+
+// Owns returns true if this member serves the k8s service.
+func Owns(key, pool string) bool {
+	return Owner(key, pool) == Self()
+}
+
+// leaseName returns the name of the Lease of the member.
+func leaseName(member string) string {
+	return args.GetShardGroup() + "-" + member
+}
+
+// Start registers this member with a Lease and lists the alive members, then
+// renews the Lease and lists the members every third of the lease duration
+// until stopCh closed. onChange is called with the new members when they changed,
+// it should call SetMembers. The coordination cluster unreachable doesn't stop
+// the controller, this member serves no k8s services until its Lease renewed,
+// and the others take over them after its Lease expired.
+func Start(stopCh <-chan struct{}, client kubernetes.Interface, onChange func([]Member)) {
+	var joined bool
+	update := func() {
+		renewed := true
+		if err := renew(client); err != nil {
+			logrus.Errorf("renew shard Lease failed: %s", err.Error())
+			renewed = false
+		}
+		list, err := listMembers(client, renewed)
+		if err != nil {
+			logrus.Errorf("list shard members failed: %s", err.Error())
+			return
+		}
+		if joined && reflect.DeepEqual(list, Members()) {
+			return
+		}
+		joined = true
+		logrus.Infof("shard members changed: %v", list)
+		onChange(list)
+	}
+	update()
+
+	go func() {
+		ticker := time.NewTicker(args.GetShardLeaseDuration() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+			update()
+		}
+	}()
+}
+
+// Leave deletes the Lease of this member, so its k8s services are reassigned
+// to the other members immediately instead of after the Lease expired.
+func Leave(client kubernetes.Interface) error {
+	err := client.CoordinationV1().Leases(args.GetShardNamespace()).Delete(
+		context.TODO(), leaseName(Self()), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// renew creates or renews the Lease of this member.
+func renew(client kubernetes.Interface) error {
+	leases := client.CoordinationV1().Leases(args.GetShardNamespace())
+	name := leaseName(Self())
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(args.GetShardLeaseDuration() / time.Second)
+	lease, err := leases.Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(context.TODO(), &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Labels:      map[string]string{LabelGroup: args.GetShardGroup()},
+				Annotations: map[string]string{AnnotationPool: args.GetShardPool()},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &[]string{Self()}[0],
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	lease = lease.DeepCopy()
+	if lease.Labels == nil {
+		lease.Labels = make(map[string]string)
+	}
+	if lease.Annotations == nil {
+		lease.Annotations = make(map[string]string)
+	}
+	lease.Labels[LabelGroup] = args.GetShardGroup()
+	lease.Annotations[AnnotationPool] = args.GetShardPool()
+	lease.Spec.HolderIdentity = &[]string{Self()}[0]
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(context.TODO(), lease, metav1.UpdateOptions{})
+	return err
+}
+
+// listMembers returns the members whose Lease is not expired. This member is
+// included only if its Lease renewed, otherwise the others may have taken over
+// its k8s services. The Lease of another member expires if its renew time not
+// changed for the lease duration, it's measured by the local clock since the
+// change observed, so the clock skew between the hosts doesn't matter.
+func listMembers(client kubernetes.Interface, renewed bool) ([]Member, error) {
+	selector := labels.SelectorFromSet(labels.Set{LabelGroup: args.GetShardGroup()}).String()
+	leases, err := client.CoordinationV1().Leases(args.GetShardNamespace()).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	var list []Member
+	if renewed {
+		list = append(list, Member{Name: Self(), Pool: args.GetShardPool()})
+	} else {
+		logrus.Warnf("shard Lease of %s not renewed, serve no k8s services until renewed", Self())
+	}
+	current := now()
+	seen := make(map[string]bool)
+	for _, lease := range leases.Items {
+		spec := lease.Spec
+		if spec.HolderIdentity == nil || *spec.HolderIdentity == Self() {
+			continue
+		}
+		if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		name := *spec.HolderIdentity
+		seen[name] = true
+		last, ok := observed[name]
+		if !ok || !last.renewTime.Equal(spec.RenewTime) {
+			last = observation{renewTime: *spec.RenewTime, at: current}
+			observed[name] = last
+		}
+		if last.at.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second).Before(current) {
+			logrus.Debugf("shard member %s expired", name)
+			continue
+		}
+		list = append(list, Member{Name: name, Pool: lease.Annotations[AnnotationPool]})
+	}
+	for name := range observed {
+		if !seen[name] {
+			delete(observed, name)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
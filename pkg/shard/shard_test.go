@@ -0,0 +1,150 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestLease returns the Lease of the member renewed at renewTime.
+func newTestLease(member string, renewTime time.Time) *coordinationv1.Lease {
+	duration := int32(15)
+	renew := metav1.NewMicroTime(renewTime)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      "lb-" + member,
+			Labels:    map[string]string{LabelGroup: "lb"},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &member,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &renew,
+		},
+	}
+}
+
+// setupTestShard sets the shard args of the member "a" and the local clock.
+func setupTestShard(t *testing.T, clock *time.Time) {
+	args.NewBuilder().SetShard(true).SetShardGroup("lb").SetShardNamespace("kube-system").SetShardMember("a")
+	now = func() time.Time { return *clock }
+	observed = make(map[string]observation)
+	t.Cleanup(func() {
+		args.NewBuilder().SetShard(false).SetShardGroup("").SetShardNamespace("").SetShardMember("")
+		now = time.Now
+		observed = make(map[string]observation)
+	})
+}
+
+func names(list []Member) []string {
+	var result []string
+	for _, m := range list {
+		result = append(result, m.Name)
+	}
+	return result
+}
+
+func TestListMembersClockSkew(t *testing.T) {
+	clock := time.Now()
+	setupTestShard(t, &clock)
+	// the clock of "b" is an hour behind, the clock of "c" is an hour ahead.
+	b := newTestLease("b", clock.Add(-time.Hour))
+	c := newTestLease("c", clock.Add(time.Hour))
+	client := fake.NewSimpleClientset(b, c)
+
+	list, err := listMembers(client, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(names(list), want) {
+		t.Fatalf("members = %v, want %v", names(list), want)
+	}
+
+	// "b" keeps renewing, "c" stops renewing.
+	for i := 0; i < 4; i++ {
+		clock = clock.Add(5 * time.Second)
+		renew := metav1.NewMicroTime(b.Spec.RenewTime.Add(5 * time.Second))
+		b.Spec.RenewTime = &renew
+		if _, err := client.CoordinationV1().Leases("kube-system").Update(context.TODO(), b, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if list, err = listMembers(client, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(names(list), want) {
+		t.Fatalf("members = %v, want %v", names(list), want)
+	}
+}
+
+func TestListMembersRenewFailed(t *testing.T) {
+	clock := time.Now()
+	setupTestShard(t, &clock)
+	client := fake.NewSimpleClientset(newTestLease("a", clock), newTestLease("b", clock))
+
+	list, err := listMembers(client, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b"}; !reflect.DeepEqual(names(list), want) {
+		t.Fatalf("members = %v, want %v", names(list), want)
+	}
+	// the k8s services of this member are taken over by the others.
+	SetMembers(list)
+	t.Cleanup(func() { SetMembers(nil) })
+	if Owns("default/web", "") {
+		t.Fatal("the member not renewed still serves the k8s service")
+	}
+}
+
+func TestStartCoordinationClusterUnreachable(t *testing.T) {
+	clock := time.Now()
+	setupTestShard(t, &clock)
+	now = time.Now
+	args.NewBuilder().SetShardLeaseDuration(300 * time.Millisecond)
+	t.Cleanup(func() { args.NewBuilder().SetShardLeaseDuration(0) })
+
+	client := fake.NewSimpleClientset()
+	var unreachable int32 = 1
+	client.PrependReactor("*", "leases", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&unreachable) == 1 {
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+	changed := make(chan []Member, 10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// the controller keeps running, the members are unknown until joined.
+	Start(stopCh, client, func(list []Member) { changed <- list })
+	select {
+	case list := <-changed:
+		t.Fatalf("members changed to %v while unreachable", list)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&unreachable, 0)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case list := <-changed:
+			// the Lease may be reachable after the renew failed in the same round.
+			if reflect.DeepEqual(names(list), []string{"a"}) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("not joined after the coordination cluster reachable")
+		}
+	}
+}
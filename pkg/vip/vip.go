@@ -0,0 +1,269 @@
+package vip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// stateFile records the addresses added by the controller for every cluster, only
+// these addresses will be removed, the addresses configured by others are never touched.
+var stateFile = "/var/lib/k8s-loadbalancer/vips.json"
+
+var locker sync.Mutex
+
+// nonlocalBindSysctls allows nginx to listen to the VIPs not held by this host,
+// eg: the host is not the leader or the keepalived BACKUP.
+var nonlocalBindSysctls = []string{
+	"/proc/sys/net/ipv4/ip_nonlocal_bind",
+	"/proc/sys/net/ipv6/ip_nonlocal_bind",
+}
+
+// address is a VIP added to the interface by the controller.
+type address struct {
+	IP        string `json:"ip"`
+	Interface string `json:"interface"`
+}
+
+// state is the VIPs recorded for every cluster, the key is the cluster id.
+// The VIP shared by multiple clusters is recorded in all of them, it's removed
+// from the host only when none of them records it.
+type state map[string][]address
+
+// legacyCluster is the key of the VIPs recorded by the old version, which
+// recorded the VIPs of all the clusters together.
+const legacyCluster = ""
+
+// EnableNonlocalBind enables the nonlocal bind of IPv4 and IPv6, so nginx can
+// listen to the VIPs before they're added to this host.
+func EnableNonlocalBind() error {
+	for _, file := range nonlocalBindSysctls {
+		if err := ioutil.WriteFile(file, []byte("1"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync makes the VIPs of the clusters on the host exactly the ips, the key of
+// clusters is the cluster id. The ip not existing on the host is added to the
+// interface, the ip added before for the cluster but not in its ips anymore,
+// such as the ip left by a crash, is removed unless another cluster records it.
+//
+// The VIPs recorded for the clusters in unsynced are kept as is, the VIPs recorded
+// for other clusters, eg: the cluster removed from the configuration, are removed.
+// It returns all the VIPs added by the controller, the ips existing on the host
+// already are not included.
+func Sync(iface string, clusters map[string][]string, unsynced []string) ([]string, error) {
+	locker.Lock()
+	defer locker.Unlock()
+
+	recorded, err := load()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := hostAddresses()
+	if err != nil {
+		return nil, err
+	}
+	desired := make(state)
+	for cluster, ips := range clusters {
+		desired[cluster] = []address{}
+		for _, ip := range ips {
+			desired[cluster] = append(desired[cluster], address{IP: net.ParseIP(ip).String(), Interface: iface})
+		}
+	}
+	added, removed, managed := plan(recorded, existing, desired, unsynced)
+
+	var link netlink.Link
+	if len(added) != 0 {
+		if link, err = netlink.LinkByName(iface); err != nil {
+			return nil, fmt.Errorf("find interface %s failed: %s", iface, err.Error())
+		}
+	}
+	for _, addr := range removed {
+		logrus.Infof("remove VIP %s from %s", addr.IP, addr.Interface)
+		if err := addrDel(addr); err != nil {
+			logrus.Warnf("remove VIP %s failed: %s", addr.IP, err.Error())
+		}
+	}
+	var errs []string
+	failed := make(map[string]bool)
+	for _, addr := range added {
+		logrus.Infof("add VIP %s to %s", addr.IP, iface)
+		if err := netlink.AddrAdd(link, hostAddr(addr.IP)); err != nil {
+			errs = append(errs, fmt.Sprintf("add VIP %s to %s failed: %s", addr.IP, iface, err.Error()))
+			failed[addr.IP] = true
+		}
+	}
+	// the VIPs failed to add are not recorded, they're retried in the next sync.
+	for cluster, addrs := range managed {
+		var kept []address
+		for _, addr := range addrs {
+			if !failed[addr.IP] {
+				kept = append(kept, addr)
+			}
+		}
+		managed[cluster] = kept
+	}
+	acquired := managed.ips()
+	if err := save(managed); err != nil {
+		return acquired, err
+	}
+	if len(errs) != 0 {
+		return acquired, errors.New(strings.Join(errs, "; "))
+	}
+	return acquired, nil
+}
+
+// plan returns the VIPs should be added to and removed from the host, and the VIPs
+// recorded for every cluster after that.
+func plan(recorded state, existing map[string]struct{}, desired state, unsynced []string) (added, removed []address, managed state) {
+	managed = make(state)
+	for _, cluster := range unsynced {
+		if addrs, ok := recorded[cluster]; ok {
+			managed[cluster] = addrs
+		}
+	}
+	// owned is the VIPs recorded by any cluster before.
+	owned := make(map[string]address)
+	for _, addrs := range recorded {
+		for _, addr := range addrs {
+			owned[addr.IP] = addr
+		}
+	}
+	seen := make(map[string]bool)
+	for cluster, addrs := range desired {
+		for _, addr := range addrs {
+			if _, ok := existing[addr.IP]; ok {
+				// the ip configured by others is never managed, the ip added by the
+				// controller before is shared with the clusters recording it.
+				if prev, ok := owned[addr.IP]; ok {
+					managed[cluster] = append(managed[cluster], prev)
+				}
+				continue
+			}
+			managed[cluster] = append(managed[cluster], addr)
+			if !seen[addr.IP] {
+				seen[addr.IP] = true
+				added = append(added, addr)
+			}
+		}
+	}
+	// remove the VIPs not recorded by any cluster anymore.
+	kept := make(map[string]bool)
+	for _, addrs := range managed {
+		for _, addr := range addrs {
+			kept[addr.IP] = true
+		}
+	}
+	for _, addr := range owned {
+		if _, ok := existing[addr.IP]; ok && !kept[addr.IP] {
+			removed = append(removed, addr)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].IP < added[j].IP })
+	sort.Slice(removed, func(i, j int) bool { return removed[i].IP < removed[j].IP })
+	return added, removed, managed
+}
+
+// ips returns the deduplicated and sorted VIPs of all the clusters.
+func (s state) ips() []string {
+	seen := make(map[string]bool)
+	var ips []string
+	for _, addrs := range s {
+		for _, addr := range addrs {
+			if !seen[addr.IP] {
+				seen[addr.IP] = true
+				ips = append(ips, addr.IP)
+			}
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// addrDel removes the VIP from the interface it was added to.
+func addrDel(addr address) error {
+	link, err := netlink.LinkByName(addr.Interface)
+	if err != nil {
+		return err
+	}
+	return netlink.AddrDel(link, hostAddr(addr.IP))
+}
+
+// hostAddresses returns the ip addresses of all the host interfaces.
+func hostAddresses() (map[string]struct{}, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]struct{})
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			existing[ipnet.IP.String()] = struct{}{}
+		}
+	}
+	return existing, nil
+}
+
+// hostAddr returns the host prefix address of the ip, eg: 192.168.1.100/32, fd00::100/128.
+func hostAddr(ip string) *netlink.Addr {
+	parsed := net.ParseIP(ip)
+	bits := 128
+	if parsed.To4() != nil {
+		parsed, bits = parsed.To4(), 32
+	}
+	return &netlink.Addr{IPNet: &net.IPNet{IP: parsed, Mask: net.CIDRMask(bits, bits)}}
+}
+
+// load reads the VIPs recorded in the state file. The state file written by the old
+// version is a list of the VIPs, they're recorded as the legacy cluster, which is
+// never synced, so they're removed by the first sync unless a cluster records them.
+func load() (state, error) {
+	data, err := ioutil.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := make(state)
+	if err := json.Unmarshal(data, &s); err != nil {
+		var addrs []address
+		if err := json.Unmarshal(data, &addrs); err != nil {
+			return nil, err
+		}
+		s = state{legacyCluster: addrs}
+	}
+	return s, nil
+}
+
+// save records the VIPs into the state file.
+func save(s state) error {
+	for cluster, addrs := range s {
+		if len(addrs) == 0 {
+			delete(s, cluster)
+			continue
+		}
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i].IP < addrs[j].IP })
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stateFile, data, 0644)
+}
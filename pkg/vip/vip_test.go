@@ -0,0 +1,142 @@
+package vip
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func addrs(iface string, ips ...string) []address {
+	var result []address
+	for _, ip := range ips {
+		result = append(result, address{IP: ip, Interface: iface})
+	}
+	return result
+}
+
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		recorded state
+		existing []string
+		desired  state
+		unsynced []string
+		added    []address
+		removed  []address
+		managed  state
+	}{
+		{
+			name:    "add",
+			desired: state{"a": addrs("eth0", "10.0.0.1")},
+			added:   addrs("eth0", "10.0.0.1"),
+			managed: state{"a": addrs("eth0", "10.0.0.1")},
+		},
+		{
+			name:     "existing ip configured by others is not managed",
+			existing: []string{"10.0.0.1"},
+			desired:  state{"a": addrs("eth0", "10.0.0.1")},
+			managed:  state{},
+		},
+		{
+			name:     "one cluster doesn't remove the VIPs of another",
+			recorded: state{"a": addrs("eth0", "10.0.0.1"), "b": addrs("eth0", "10.0.0.2")},
+			existing: []string{"10.0.0.1", "10.0.0.2"},
+			desired:  state{"a": {}},
+			unsynced: []string{"b"},
+			removed:  addrs("eth0", "10.0.0.1"),
+			managed:  state{"b": addrs("eth0", "10.0.0.2")},
+		},
+		{
+			name:     "shared VIP is kept until no cluster records it",
+			recorded: state{"a": addrs("eth0", "10.0.0.1"), "b": addrs("eth0", "10.0.0.1")},
+			existing: []string{"10.0.0.1"},
+			desired:  state{"a": {}, "b": addrs("eth0", "10.0.0.1")},
+			managed:  state{"b": addrs("eth0", "10.0.0.1")},
+		},
+		{
+			name:     "VIPs of the removed cluster are removed",
+			recorded: state{"a": addrs("eth0", "10.0.0.1"), "gone": addrs("eth1", "10.0.0.9")},
+			existing: []string{"10.0.0.1", "10.0.0.9"},
+			desired:  state{"a": addrs("eth0", "10.0.0.1")},
+			removed:  addrs("eth1", "10.0.0.9"),
+			managed:  state{"a": addrs("eth0", "10.0.0.1")},
+		},
+		{
+			name:     "legacy VIPs are claimed by the cluster",
+			recorded: state{legacyCluster: addrs("eth0", "10.0.0.1", "10.0.0.2")},
+			existing: []string{"10.0.0.1", "10.0.0.2"},
+			desired:  state{"a": addrs("eth0", "10.0.0.1")},
+			removed:  addrs("eth0", "10.0.0.2"),
+			managed:  state{"a": addrs("eth0", "10.0.0.1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := make(map[string]struct{})
+			for _, ip := range tt.existing {
+				existing[ip] = struct{}{}
+			}
+			added, removed, managed := plan(tt.recorded, existing, tt.desired, tt.unsynced)
+			if !reflect.DeepEqual(added, tt.added) {
+				t.Errorf("added = %v, want %v", added, tt.added)
+			}
+			if !reflect.DeepEqual(removed, tt.removed) {
+				t.Errorf("removed = %v, want %v", removed, tt.removed)
+			}
+			for cluster, addrs := range managed {
+				if len(addrs) == 0 {
+					delete(managed, cluster)
+				}
+			}
+			if !reflect.DeepEqual(managed, tt.managed) {
+				t.Errorf("managed = %v, want %v", managed, tt.managed)
+			}
+		})
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	file := stateFile
+	stateFile = filepath.Join(t.TempDir(), "vips.json")
+	t.Cleanup(func() { stateFile = file })
+
+	// the state file written by the old version.
+	if err := ioutil.WriteFile(stateFile, []byte(`[{"ip": "10.0.0.1", "interface": "eth0"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (state{legacyCluster: addrs("eth0", "10.0.0.1")}); !reflect.DeepEqual(s, want) {
+		t.Errorf("load() = %v, want %v", s, want)
+	}
+
+	want := state{"a": addrs("eth0", "10.0.0.1", "10.0.0.2"), "b": addrs("eth1", "fd00::1")}
+	if err := save(state{"a": addrs("eth0", "10.0.0.2", "10.0.0.1"), "b": addrs("eth1", "fd00::1"), "c": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = load(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("load() = %v, want %v", s, want)
+	}
+}
+
+func TestEnableNonlocalBind(t *testing.T) {
+	sysctls := nonlocalBindSysctls
+	dir := t.TempDir()
+	nonlocalBindSysctls = []string{filepath.Join(dir, "ipv4"), filepath.Join(dir, "ipv6")}
+	t.Cleanup(func() { nonlocalBindSysctls = sysctls })
+
+	if err := EnableNonlocalBind(); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range nonlocalBindSysctls {
+		if data, err := ioutil.ReadFile(file); err != nil || string(data) != "1" {
+			t.Errorf("%s = %q, %v, want \"1\"", file, data, err)
+		}
+	}
+}
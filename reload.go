@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/config"
+	"github.com/forbearing/k8s-loadbalancer/pkg/controller"
+	"github.com/forbearing/k8s-loadbalancer/pkg/logger"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// liveFlags is the flags applied without restart when the configuration reloaded,
+// the changes of the other flags are logged and take effect after restart.
+var liveFlags = map[string]bool{
+	"upstream":              true,
+	"upstream-max-fails":    true,
+	"upstream-fail-timeout": true,
+	"upstream-max-conns":    true,
+	"log-level":             true,
+	"log-format":            true,
+	"template-dir":          true,
+	"nginx-conf-params":     true,
+	"nginx-conf-configmap":  true,
+	"health-check-timeout":  true,
+	"health-check-rise":     true,
+	"health-check-fall":     true,
+	"health-check-port":     true,
+	"health-check-path":     true,
+}
+
+var reloadLocker sync.Mutex
+
+// reloadConfig reloads the config file on SIGHUP or when the file changed. The new
+// configuration is built and validated aside first, the invalid one is rejected and
+// the current one keeps working, the valid one takes effect all together. The
+// settings requiring a restart are kept unchanged and logged, the others are
+// applied live: the upstreams, the log level and format, the templates, the
+// nginx.conf parameters and the k8s services selected by the config file. All the k8s services are re-rendered with only one nginx reload.
+func reloadConfig() {
+	reloadLocker.Lock()
+	defer reloadLocker.Unlock()
+
+	file := args.GetConfigFile()
+	var cfg *config.Config
+	if len(file) != 0 {
+		var err error
+		if cfg, err = config.Load(file); err != nil {
+			logrus.Errorf("Error reloading config file, keep the current configuration: %s", err.Error())
+			return
+		}
+	}
+
+	fs := pflag.CommandLine
+	before := config.Values(fs)
+	// the args in effect are untouched until the new ones validated, only
+	// the flags are restored.
+	rollback := func() {
+		for name, val := range before {
+			if err := config.Restore(fs, name, val); err != nil {
+				logrus.Errorf("Error restoring --%s: %s", name, err.Error())
+			}
+		}
+	}
+	if err := config.Apply(fs, cfg, file); err != nil {
+		logrus.Errorf("Error applying config, keep the current configuration: %s", err.Error())
+		rollback()
+		return
+	}
+	var changed, restart []string
+	for name, val := range config.Values(fs) {
+		if val == before[name] {
+			continue
+		}
+		if liveFlags[name] {
+			changed = append(changed, name)
+			continue
+		}
+		// the settings requiring a restart are kept unchanged.
+		restart = append(restart, "--"+name)
+		if err := config.Restore(fs, name, before[name]); err != nil {
+			logrus.Errorf("Error restoring --%s: %s", name, err.Error())
+		}
+	}
+	reloaded := buildArgs(file)
+	if err := config.Validate(reloaded); err != nil {
+		logrus.Errorf("Invalid configuration, keep the current configuration: %s", err.Error())
+		rollback()
+		return
+	}
+	args.Publish(reloaded)
+	sort.Strings(changed)
+	sort.Strings(restart)
+	if len(restart) != 0 {
+		logrus.Warnf("Settings changed but require a restart to take effect: %s", strings.Join(restart, ", "))
+	}
+	if len(changed) != 0 {
+		logrus.Infof("Settings changed: --%s", strings.Join(changed, ", --"))
+	}
+
+	for _, name := range changed {
+		if name == "log-level" || name == "log-format" {
+			logger.Init()
+			break
+		}
+	}
+	// the templates and the nginx.conf parameters are always reloaded, their
+	// files may change without the flags changed. The current ones keep working
+	// if failed.
+	if err := nginx.LoadTemplates(args.GetTemplateDir()); err != nil {
+		logrus.Errorf("Error reloading templates, keep the current templates: %s", err.Error())
+	}
+	if err := loadNginxConfParams(); err != nil {
+		logrus.Errorf("Error reloading nginx.conf parameters, keep the current parameters: %s", err.Error())
+	}
+	var services []config.ServiceConfig
+	if cfg != nil {
+		services = cfg.Services
+	}
+	controller.SetSelectedServices(services)
+	if err := controller.RerenderAll(); err != nil {
+		logrus.Errorf("Error regenerating nginx config: %s", err.Error())
+	}
+	logrus.Info("Configuration reloaded")
+}
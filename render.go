@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/args"
+	"github.com/forbearing/k8s-loadbalancer/pkg/config"
+	"github.com/forbearing/k8s-loadbalancer/pkg/controller"
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// runRender is the "render" subcommand, it renders the nginx config files of the
+// k8s services in the manifests offline, without the k8s cluster and nginx. It's
+// used to review the generated nginx config in CI before the k8s services applied.
+func runRender(arguments []string) error {
+	fs := pflag.NewFlagSet("render", pflag.ExitOnError)
+	files := fs.StringArrayP("filename", "f", nil, "the k8s Service manifests, or the output of \"kubectl get svc -o yaml\", \"-\" means stdin, can be repeated")
+	upstream := fs.StringSlice("upstream", []string{}, "the upstream hosts or IP the nginx proxies traffic to, separated by comma")
+	output := fs.StringP("output", "o", "", "the directory the nginx config tree is written to, default to stdout")
+	nginxDir := fs.String("nginx-dir", "/etc/nginx", "the nginx config directory shown in the files written to stdout")
+	confFile := fs.String(config.FileFlag, "", "the declarative configuration file, only its services are used to select the k8s services")
+	templateDir := fs.String("template-dir", "", "the directory containing the templates to override the builtin templates")
+	nginxConfParams := fs.String("nginx-conf-params", "", "the yaml file containing the parameters to render nginx.conf")
+	clusterID := fs.String("cluster-id", "", "the cluster id recorded in the files and suffixed to the file names")
+	validate := fs.Bool("validate", false, "test the rendered nginx config by \"nginx -t\" if the nginx binary is present")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s render -f services.yaml --upstream host1,host2 [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(arguments)
+	if len(*files) == 0 {
+		fs.Usage()
+		return errors.New("the k8s Service manifests are required")
+	}
+	if len(*upstream) == 0 {
+		return errors.New("--upstream is required")
+	}
+
+	// the arguments not specified are the same as the controller defaults.
+	args.NewBuilder().
+		SetUpstream(*upstream).
+		SetUpstreamMaxFails(-1).
+		SetNginxConfMode(string(nginx.NginxConfModeManaged))
+	if len(*confFile) != 0 {
+		cfg, err := config.Load(*confFile)
+		if err != nil {
+			return err
+		}
+		config.SetServices(cfg.Services)
+	}
+	if err := nginx.LoadTemplates(*templateDir); err != nil {
+		return err
+	}
+	if len(*nginxConfParams) != 0 {
+		params, err := nginx.LoadNginxConfParams(*nginxConfParams)
+		if err != nil {
+			return err
+		}
+		nginx.SetNginxConfParams(params)
+	}
+
+	var services []*corev1.Service
+	for _, file := range *files {
+		list, err := readServiceManifests(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err.Error())
+		}
+		services = append(services, list...)
+	}
+
+	selected, invalid := selectServices(os.Stderr, services, *clusterID)
+
+	// the nginx config tree is validated in a scratch directory, the logs and pid
+	// file are also in it, so nothing on the host is opened by "nginx -t".
+	if *validate {
+		scratch, err := ioutil.TempDir("", "k8s-loadbalancer-validate-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(scratch)
+		nginx.SetNginxLogDir(filepath.Join(scratch, "logs"))
+		nginx.SetNginxPidFile(filepath.Join(scratch, "nginx.pid"))
+		err = renderNginxTree(ioutil.Discard, scratch, selected)
+		nginx.SetNginxLogDir("/var/log/nginx")
+		nginx.SetNginxPidFile("/run/nginx.pid")
+		if err != nil {
+			return err
+		}
+		if err := validateNginxTree(scratch); err != nil {
+			return err
+		}
+	}
+
+	// the nginx config tree is rendered into a temporary directory if written to stdout.
+	dir := *output
+	if len(dir) == 0 {
+		tmp, err := ioutil.TempDir("", "k8s-loadbalancer-render-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := renderNginxTree(os.Stderr, dir, selected); err != nil {
+		return err
+	}
+	if len(*output) != 0 {
+		fmt.Fprintf(os.Stderr, "nginx config tree written to %s\n", *output)
+	} else if err := printNginxTree(os.Stdout, dir, *nginxDir); err != nil {
+		return err
+	}
+	if invalid != 0 {
+		return fmt.Errorf("%d k8s services have invalid annotations or nginx listen address conflicts", invalid)
+	}
+	return nil
+}
+
+// selectServices returns the nginx.Service of the k8s services meeting the condition
+// and the number of the invalid k8s services. The invalid annotations are ignored
+// and the k8s service whose nginx listen address is owned by another one is not
+// rendered, the same as the controller, they're reported to w.
+func selectServices(w io.Writer, services []*corev1.Service, clusterID string) ([]*nginx.Service, int) {
+	var candidates []*corev1.Service
+	for _, svc := range services {
+		nginxService := controller.ConstructNginxService("", clusterID, svc)
+		if !nginxService.MeetType || !(nginxService.MeetAnnotations || nginxService.MeetConfig) {
+			fmt.Fprintf(w, "SKIPPED service %s: not LoadBalancer type, or not annotated %q nor selected by the config file\n",
+				nginxService, controller.AnnotationLoadBalancer)
+			continue
+		}
+		candidates = append(candidates, svc)
+	}
+
+	var selected []*nginx.Service
+	var invalid int
+	for _, svc := range candidates {
+		nginxService := controller.ConstructNginxService("", clusterID, svc)
+		nginxService.Action = nginx.ActionTypeAdd
+		err := controller.ValidateAnnotations(svc)
+		if err != nil {
+			fmt.Fprintf(w, "INVALID service %s: %s\n", nginxService, err.Error())
+		}
+		owner, key := controller.FindPortConflict("", clusterID, svc, candidates)
+		if len(owner) != 0 {
+			fmt.Fprintf(w, "CONFLICT service %s: nginx listen address %s is already used by service %s\n", nginxService, key, owner)
+		}
+		if err != nil || len(owner) != 0 {
+			invalid++
+		}
+		if len(owner) == 0 {
+			selected = append(selected, nginxService)
+		}
+	}
+	return selected, invalid
+}
+
+// renderNginxTree renders nginx.conf and the config files of the nginx.Service
+// into dir, the rendered k8s services are reported to w.
+func renderNginxTree(w io.Writer, dir string, services []*nginx.Service) error {
+	nginx.SetNginxDir(dir)
+	for _, sub := range []string{"sites-stream", "sites-enabled"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	if err, _ := nginx.GenerateNginxConf(); err != nil {
+		return err
+	}
+	for _, nginxService := range services {
+		if err, _ := nginx.GenerateVirtualHostConf(nginxService); err != nil {
+			return fmt.Errorf("service %s: %s", nginxService, err.Error())
+		}
+		fmt.Fprintf(w, "rendered service %s\n", nginxService)
+	}
+	return nil
+}
+
+// readServiceManifests reads the k8s Services from the yaml or json file, it can
+// contain multiple documents, and the List returned by "kubectl get svc -o yaml".
+func readServiceManifests(file string) ([]*corev1.Service, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var services []*corev1.Service
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var doc struct {
+			Kind  string            `json:"kind"`
+			Items []json.RawMessage `json:"items"`
+		}
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		// the empty document, eg: "---" at the end.
+		if len(raw) == 0 || string(raw) == "null" {
+			continue
+		}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+		items := []json.RawMessage{raw}
+		switch doc.Kind {
+		case "Service":
+		case "List", "ServiceList":
+			items = doc.Items
+		default:
+			fmt.Fprintf(os.Stderr, "SKIPPED %s in %s: not a Service\n", doc.Kind, file)
+			continue
+		}
+		for _, item := range items {
+			svc := &corev1.Service{}
+			if err := json.Unmarshal(item, svc); err != nil {
+				return nil, err
+			}
+			if len(svc.Kind) != 0 && svc.Kind != "Service" {
+				fmt.Fprintf(os.Stderr, "SKIPPED %s %s in %s: not a Service\n", svc.Kind, svc.Name, file)
+				continue
+			}
+			if len(svc.Namespace) == 0 {
+				svc.Namespace = "default"
+			}
+			services = append(services, svc)
+		}
+	}
+	return services, nil
+}
+
+// validateNginxTree tests the nginx config tree rendered into the scratch directory
+// by "nginx -t", it's skipped if the nginx binary is not present. The files included
+// by nginx.conf but not rendered are created empty.
+func validateNginxTree(dir string) error {
+	if _, err := exec.LookPath("nginx"); err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING nginx binary not found, skip validating")
+		return nil
+	}
+	for _, sub := range []string{"logs", "conf.d", "modules", "modules-enabled"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "mime.types"), []byte("types {\n}\n"), 0644); err != nil {
+		return err
+	}
+	out, err := exec.Command("nginx", "-t", "-p", dir, "-c", filepath.Join(dir, "nginx.conf")).CombinedOutput()
+	os.Stderr.Write(out)
+	if err != nil {
+		return fmt.Errorf("nginx -t failed: %s", err.Error())
+	}
+	return nil
+}
+
+// printNginxTree writes all the files of the nginx config tree in dir to w, every
+// file is preceded by its path. The dir is shown as nginxDir.
+func printNginxTree(w io.Writer, dir, nginxDir string) error {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, file)
+		fmt.Fprintf(w, "### %s\n", filepath.Join(nginxDir, rel))
+		fmt.Fprintln(w, strings.ReplaceAll(string(data), dir, nginxDir))
+	}
+	return nil
+}
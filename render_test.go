@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/forbearing/k8s-loadbalancer/pkg/nginx"
+)
+
+// writeManifests writes the manifests into a temporary file.
+func writeManifests(t *testing.T, data string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "services.yaml")
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// testService returns the manifest of the annotated LoadBalancer k8s service.
+func testService(name, created string, port int) string {
+	return fmt.Sprintf(`apiVersion: v1
+kind: Service
+metadata:
+  name: %s
+  namespace: default
+  creationTimestamp: "%s"
+  annotations:
+    loadbalancer: enabled
+spec:
+  type: LoadBalancer
+  ports:
+  - name: web
+    port: %d
+    nodePort: 30080
+    protocol: TCP
+`, name, created, port)
+}
+
+// runTestRender runs the render subcommand, returns its stdout. The nginx
+// config directory is restored when the test finished.
+func runTestRender(t *testing.T, arguments ...string) (string, error) {
+	t.Helper()
+	t.Cleanup(func() { nginx.SetNginxDir("/etc/nginx") })
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		done <- data
+	}()
+	err = runRender(arguments)
+	os.Stdout = stdout
+	w.Close()
+	return string(<-done), err
+}
+
+func TestReadServiceManifests(t *testing.T) {
+	file := writeManifests(t, `---
+apiVersion: v1
+kind: Service
+metadata:
+  name: a
+spec:
+  type: LoadBalancer
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: d
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: b
+    namespace: prod
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: c
+---
+`)
+	services, err := readServiceManifests(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, svc := range services {
+		names = append(names, svc.Namespace+"/"+svc.Name)
+	}
+	if want := []string{"default/a", "prod/b"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("readServiceManifests() = %v, want %v", names, want)
+	}
+}
+
+func TestRenderStdout(t *testing.T) {
+	file := writeManifests(t, testService("web", "2024-01-01T00:00:00Z", 80))
+	out, err := runTestRender(t, "-f", file, "--upstream", "10.0.0.1", "--nginx-dir", "/etc/nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"### /etc/nginx/nginx.conf\n",
+		"### /etc/nginx/sites-stream/tcp.default.web.web\n",
+		"pid /run/nginx.pid;",
+		"include /etc/nginx/mime.types;",
+		"include /etc/nginx/sites-stream/*;",
+		"/var/log/nginx/",
+		"server 10.0.0.1:30080",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("output does not contain %q:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, os.TempDir()) {
+		t.Errorf("output contains the temporary directory:\n%s", out)
+	}
+}
+
+func TestRenderPortConflict(t *testing.T) {
+	file := writeManifests(t, testService("new", "2024-02-01T00:00:00Z", 80)+"---\n"+
+		testService("old", "2024-01-01T00:00:00Z", 80)+"---\n"+
+		testService("other", "2024-03-01T00:00:00Z", 81))
+	out, err := runTestRender(t, "-f", file, "--upstream", "10.0.0.1")
+	if err == nil {
+		t.Fatal("render succeeded with the nginx listen address conflict")
+	}
+	if !strings.Contains(out, "tcp.default.old.web") || !strings.Contains(out, "tcp.default.other.web") {
+		t.Errorf("the k8s services without conflict are not rendered:\n%s", out)
+	}
+	if strings.Contains(out, "tcp.default.new.web") {
+		t.Errorf("the conflicting k8s service is rendered:\n%s", out)
+	}
+}
+
+func TestRenderInvalidAnnotations(t *testing.T) {
+	manifest := strings.Replace(testService("web", "2024-01-01T00:00:00Z", 80),
+		"    loadbalancer: enabled\n", "    loadbalancer: enabled\n    loadbalancer/max-conns: many\n", 1)
+	out, err := runTestRender(t, "-f", writeManifests(t, manifest), "--upstream", "10.0.0.1")
+	if err == nil {
+		t.Fatal("render succeeded with the invalid annotations")
+	}
+	// the invalid annotations are ignored like the controller.
+	if !strings.Contains(out, "tcp.default.web.web") {
+		t.Errorf("the k8s service is not rendered:\n%s", out)
+	}
+}
+
+func TestRenderValidateHermetic(t *testing.T) {
+	// the fake nginx records the nginx config tree it tests.
+	bin, record := t.TempDir(), filepath.Join(t.TempDir(), "record")
+	script := "#!/bin/sh\n# args: -t -p dir -c file\nls \"$3\" > " + record + "\ncat \"$3\"/nginx.conf \"$3\"/sites-stream/* >> " + record + "\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "nginx"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	file := writeManifests(t, testService("web", "2024-01-01T00:00:00Z", 80))
+	out, err := runTestRender(t, "-f", file, "--upstream", "10.0.0.1", "--validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(record)
+	if err != nil {
+		t.Fatalf("nginx -t not run: %s", err.Error())
+	}
+	for _, s := range []string{"/etc/nginx", "/var/log/nginx", "/run/nginx.pid"} {
+		if strings.Contains(string(data), s) {
+			t.Errorf("the nginx config tree tested refers to %s on the host:\n%s", s, data)
+		}
+	}
+	if !strings.Contains(string(data), "mime.types\n") {
+		t.Errorf("mime.types included by nginx.conf is not created:\n%s", data)
+	}
+	// the output is rendered with the paths on the host.
+	for _, s := range []string{"pid /run/nginx.pid;", "/var/log/nginx/"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("output does not contain %q:\n%s", s, out)
+		}
+	}
+}